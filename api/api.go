@@ -11,10 +11,41 @@ const (
 
 	AnnotationRoutingMode = GroupNode + "/routingMode"
 
+	// AnnotationAllowedContainers is a pod annotation holding a
+	// comma-separated list of container names. When present, only the
+	// listed containers of the pod may get tokens.
+	AnnotationAllowedContainers = GroupCore + "/allowedContainers"
+
+	// AnnotationBypassRouting is a pod annotation. When "true", the
+	// connections of the pod to 169.254.169.254:80 are not redirected to
+	// the emulator in the eBPF routing mode, i.e. they reach the real
+	// metadata server. Only honored for the namespaces and ServiceAccounts
+	// in the --bypass-routing-allowlist flag.
+	AnnotationBypassRouting = GroupCore + "/bypassRouting"
+
+	// AnnotationWorkloadIdentityProvider is a ServiceAccount annotation
+	// holding the full name of the workload identity provider used for the
+	// ServiceAccount, which must be one of the providers configured in the
+	// emulator.
+	AnnotationWorkloadIdentityProvider = GroupCore + "/workloadIdentityProvider"
+
+	// AnnotationProjectID and AnnotationNumericProjectID are Namespace
+	// annotations holding the GCP project served to the pods of the
+	// namespace from the project/* metadata.
+	AnnotationProjectID        = GroupCore + "/projectID"
+	AnnotationNumericProjectID = GroupCore + "/numericProjectID"
+
+	// AnnotationQuotaProject is a ServiceAccount or Namespace annotation
+	// holding the GCP project billed for the upstream calls made for the
+	// ServiceAccount, sent as the x-goog-user-project header. The
+	// ServiceAccount annotation takes precedence.
+	AnnotationQuotaProject = GroupCore + "/quotaProject"
+
 	RoutingModeDefault  = RoutingModeBPF
 	RoutingModeBPF      = "eBPF"
 	RoutingModeLoopback = "Loopback"
 	RoutingModeNone     = "None"
+	RoutingModeNFTables = "nftables"
 
 	GKEAnnotationServiceAccount = GroupGKE + "/gcp-service-account"
 	GKELabelNodeEnabled         = GroupGKE + "/gke-metadata-server-enabled"
@@ -41,6 +41,7 @@ struct {
 	__type(value, struct AttestConfig);
 } map_attest_config SEC(".maps");
 
+// max_entries is overridden by userspace at load time.
 struct {
 	__uint(type, BPF_MAP_TYPE_LRU_HASH);
 	__uint(max_entries, 65536);
@@ -48,12 +49,36 @@ struct {
 	__type(value, struct AttestValue);
 } map_attest SEC(".maps");
 
+// Number of entries in map_attest, so userspace can export the occupancy
+// of the map without iterating it. Incremented when a new key is recorded
+// and decremented when a key is deleted. The entries evicted by the LRU
+// are not seen here, so userspace recounts them when the map fills up.
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, __u32);
+	__type(value, __s64);
+} map_attest_count SEC(".maps");
+
+static __always_inline void add_count(__s64 delta) {
+	__u32 idx = 0;
+	__s64 *c = bpf_map_lookup_elem(&map_attest_count, &idx);
+	if (c) __sync_fetch_and_add(c, delta);
+}
+
 // Debug counters: ran[0] = sockops entered (any op), ran[1] = TCP_CONNECT_CB
-// matched, ran[2] = AF_INET passed, ran[3] = map updated. Lets userspace
-// confirm whether the program is firing and how far it gets.
+// matched, ran[2] = AF_INET passed, ran[3] = map updated, ran[4] = map
+// entry deleted on close. Lets userspace confirm whether the program is
+// firing and how far it gets. Exported as Prometheus metrics.
+#define DEBUG_ENTERED  0
+#define DEBUG_CONNECT  1
+#define DEBUG_INET     2
+#define DEBUG_RECORDED 3
+#define DEBUG_DELETED  4
+
 struct {
 	__uint(type, BPF_MAP_TYPE_ARRAY);
-	__uint(max_entries, 4);
+	__uint(max_entries, 5);
 	__type(key, __u32);
 	__type(value, __u64);
 } map_attest_debug SEC(".maps");
@@ -63,9 +88,25 @@ static __always_inline void inc_debug(__u32 idx) {
 	if (c) __sync_fetch_and_add(c, 1);
 }
 
+// local_port is exposed in host byte order in the low 16 bits of a u32.
+// remote_port is the kernel's __be16 sk_dport shifted into the *high*
+// 16 bits of the u32 (see net/core/filter.c convert_bpf_sock_ops_access),
+// so we right-shift before casting to u16. Both ports end up stored in
+// network byte order so they match userspace's htons-encoded lookup key.
+static __always_inline struct AttestKey attest_key(struct bpf_sock_ops *skops) {
+	struct AttestKey key = {
+		.src_ip = skops->local_ip4,
+		.dst_ip = skops->remote_ip4,
+		.src_port = bpf_htons((__u16)skops->local_port),
+		.dst_port = (__u16)(skops->remote_port >> 16),
+	};
+	return key;
+}
+
 // Hooks active-side TCP connect to record the connecting task's cgroup ID
 // along with the 4-tuple the kernel will eventually report to the
-// server-side socket.
+// server-side socket, and the close of that same socket to delete the
+// record so the LRU map only holds live connections.
 //
 // At BPF_SOCK_OPS_TCP_CONNECT_CB the local port has been bound but the SYN
 // has not been sent yet, so the entry is in the map well before the server
@@ -74,27 +115,32 @@ static __always_inline void inc_debug(__u32 idx) {
 // pod UID from the kubelet's `pod<UID>` cgroup naming convention.
 SEC("sockops")
 int attest_connect(struct bpf_sock_ops *skops) {
-	inc_debug(0);
+	inc_debug(DEBUG_ENTERED);
+
+	// The state callback is only enabled below for sockets recorded at
+	// connect time, so every transition to TCP_CLOSE here is the end of
+	// an attested connection. args[1] is the new state.
+	if (skops->op == BPF_SOCK_OPS_STATE_CB) {
+		if (skops->family == AF_INET && skops->args[1] == BPF_TCP_CLOSE) {
+			struct AttestKey key = attest_key(skops);
+			if (bpf_map_delete_elem(&map_attest, &key) == 0) {
+				add_count(-1);
+				inc_debug(DEBUG_DELETED);
+			}
+		}
+		return 0;
+	}
+
 	if (skops->op != BPF_SOCK_OPS_TCP_CONNECT_CB) {
 		return 0;
 	}
-	inc_debug(1);
+	inc_debug(DEBUG_CONNECT);
 	if (skops->family != AF_INET) {
 		return 0;
 	}
-	inc_debug(2);
+	inc_debug(DEBUG_INET);
 
-	// local_port is exposed in host byte order in the low 16 bits of a u32.
-	// remote_port is the kernel's __be16 sk_dport shifted into the *high*
-	// 16 bits of the u32 (see net/core/filter.c convert_bpf_sock_ops_access),
-	// so we right-shift before casting to u16. Both ports end up stored in
-	// network byte order so they match userspace's htons-encoded lookup key.
-	struct AttestKey key = {
-		.src_ip = skops->local_ip4,
-		.dst_ip = skops->remote_ip4,
-		.src_port = bpf_htons((__u16)skops->local_port),
-		.dst_port = (__u16)(skops->remote_port >> 16),
-	};
+	struct AttestKey key = attest_key(skops);
 
 	// We record the connecting task's cgroup ID rather than its pid. The
 	// cgroup ID is the inode of the cgroup directory in cgroupfs and is
@@ -106,8 +152,19 @@ int attest_connect(struct bpf_sock_ops *skops) {
 		.cgroup_id = bpf_get_current_cgroup_id(),
 	};
 
-	bpf_map_update_elem(&map_attest, &key, &val, BPF_ANY);
-	inc_debug(3);
+	// The key may still be recorded if the previous connection with the
+	// same 4-tuple was not seen closing, in which case it's overwritten
+	// without counting it again.
+	if (bpf_map_update_elem(&map_attest, &key, &val, BPF_NOEXIST) == 0) {
+		add_count(1);
+	} else {
+		bpf_map_update_elem(&map_attest, &key, &val, BPF_ANY);
+	}
+	inc_debug(DEBUG_RECORDED);
+
+	// Ask for state change callbacks on this socket so the entry can be
+	// deleted when the connection closes.
+	bpf_sock_ops_cb_flags_set(skops, skops->bpf_sock_ops_cb_flags | BPF_SOCK_OPS_STATE_CB_FLAG);
 	return 0;
 }
 
@@ -12,12 +12,17 @@
 #define AF_INET 2
 
 struct Config {
-	__u64 emulator_cgroup_id;
 	__u32 emulator_ip;
-	__u16 emulator_port;
 	__u16 debug;
 };
 
+// Destination intercepted by the redirection, in host byte order.
+struct TargetKey {
+	__u32 ip;
+	__u16 port;
+	__u16 pad;
+};
+
 struct {
 	__uint(type, BPF_MAP_TYPE_ARRAY);
 	__uint(max_entries, 1);
@@ -25,8 +30,41 @@ struct {
 	__type(value, struct Config);
 } map_config SEC(".maps");
 
+// Intercepted destinations mapped to the emulator port where the proxy
+// accepts the redirected connections. Filled by userspace.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 16);
+	__type(key, struct TargetKey);
+	__type(value, __u16);
+} map_targets SEC(".maps");
+
+// Cgroup IDs of the emulator instances running on the node, shared by the
+// instances so the connections of an instance being replaced are not
+// redirected by the program of its successor. Each instance adds its own
+// cgroup ID at startup and removes it on shutdown.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 16);
+	__type(key, __u64);
+	__type(value, __u8);
+} map_emulator_cgroups SEC(".maps");
+
+// Cgroup IDs of the pods that opted out of the redirection, see the
+// bypassRouting pod annotation. Kept in sync by userspace.
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 4096);
+	__type(key, __u64);
+	__type(value, __u8);
+} map_bypass SEC(".maps");
+
+// Maximum depth of the pod cgroups in the cgroup hierarchy.
+#define MAX_CGROUP_LEVEL 16
+
 // Hooks to connect() syscalls. Redirects connections targeting
-// the GKE metadata server to the emulator.
+// the GKE metadata server (or any other intercepted destination)
+// to the emulator.
 SEC("cgroup/connect4")
 int redirect_connect4(struct bpf_sock_addr *ctx) {
 	// We only care about IPv4 TCP connections.
@@ -34,12 +72,14 @@ int redirect_connect4(struct bpf_sock_addr *ctx) {
 		return 1;
 	}
 
-	const __u32 dst = bpf_ntohl(ctx->user_ip4);
-	const __u32 dst_port = bpf_ntohs(ctx->user_port);
-
-	// 0xA9FEA9FE is 169.254.169.254, the GKE Metadata Server IP address.
-	// If the connection is not targeting that address on port 80, do nothing.
-	if (dst != 0xA9FEA9FE || dst_port != 80) {
+	// If the connection is not targeting an intercepted destination,
+	// do nothing.
+	const struct TargetKey target = {
+		.ip = bpf_ntohl(ctx->user_ip4),
+		.port = bpf_ntohs(ctx->user_port),
+	};
+	const __u16 *emulator_port = bpf_map_lookup_elem(&map_targets, &target);
+	if (!emulator_port) {
 		return 1;
 	}
 
@@ -52,24 +92,40 @@ int redirect_connect4(struct bpf_sock_addr *ctx) {
 		return 1;
 	}
 
-	// If the connection is coming from the emulator's cgroup, allow it
-	// without redirection. The cgroup ID is set by userspace at startup
-	// from the inode of the daemon's own cgroup directory; it is
+	// If the connection is coming from the cgroup of an emulator instance,
+	// allow it without redirection. The cgroup IDs are set by userspace at
+	// startup from the inode of the daemon's own cgroup directory; they are
 	// kernel-attested and stable for the lifetime of the daemon's pod.
 	const __u64 cgid = bpf_get_current_cgroup_id();
-	if (cgid == conf->emulator_cgroup_id) {
+	if (bpf_map_lookup_elem(&map_emulator_cgroups, &cgid)) {
 		if (conf->debug) {
 			bpf_printk("Not redirecting connection from emulator cgroup (id: %llu)", cgid);
 		}
 		return 1;
 	}
 
+	// If the connection is coming from a pod that opted out of the
+	// redirection, allow it without redirection. The process runs in a
+	// container cgroup, so the ancestors are checked for the pod cgroup.
+	for (int level = 1; level < MAX_CGROUP_LEVEL; level++) {
+		const __u64 ancestor = bpf_get_current_ancestor_cgroup_id(level);
+		if (ancestor == 0) {
+			break;
+		}
+		if (bpf_map_lookup_elem(&map_bypass, &ancestor)) {
+			if (conf->debug) {
+				bpf_printk("Not redirecting connection from bypassed pod cgroup (id: %llu)", ancestor);
+			}
+			return 1;
+		}
+	}
+
 	// Redirect the connection to the emulator.
 	ctx->user_ip4 = bpf_htonl(conf->emulator_ip);
-	ctx->user_port = bpf_htons(conf->emulator_port);
+	ctx->user_port = bpf_htons(*emulator_port);
 	if (conf->debug) {
 		const __u32 emu = ctx->user_ip4;
-		bpf_printk("Redirecting connection to emulator on %pI4:%d", &emu, conf->emulator_port);
+		bpf_printk("Redirecting connection to emulator on %pI4:%d", &emu, *emulator_port);
 	}
 	return 1; // Allow the connection after redirection.
 }
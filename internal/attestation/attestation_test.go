@@ -47,46 +47,88 @@ const cgroupV2SystemdUnderscores = `0::/kubepods.slice/kubepods-pod12345678_1234
 const cgroupNonPod = `0::/system.slice/kubelet.service
 `
 
-func TestPodUIDFromCgroup_Cgroupfs(t *testing.T) {
+// Hybrid layout with the cgroupfs driver: the controller-less v2 hierarchy
+// has no pod cgroups, the v1 controller hierarchies have.
+const cgroupHybrid = `12:pids:/kubepods/besteffort/pod12345678-1234-1234-1234-123456789abc/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+11:memory:/kubepods/besteffort/pod12345678-1234-1234-1234-123456789abc/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+4:cpu,cpuacct:/kubepods/besteffort/pod12345678-1234-1234-1234-123456789abc/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+1:name=systemd:/system.slice/containerd.service
+0::/system.slice/containerd.service
+`
+
+// Legacy layout: only v1 controller hierarchies.
+const cgroupLegacy = `5:cpuacct,cpu:/kubepods.slice/kubepods-pod12345678_1234_1234_1234_123456789abc.slice/cri-containerd-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.scope
+1:name=systemd:/kubepods.slice/kubepods-pod12345678_1234_1234_1234_123456789abc.slice/cri-containerd-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.scope
+`
+
+// Legacy layout without the controllers that the kubelet places pods in.
+const cgroupLegacyUnsupported = `1:name=systemd:/kubepods.slice/kubepods-pod12345678_1234_1234_1234_123456789abc.slice
+`
+
+func TestIdentityFromCgroup_Cgroupfs(t *testing.T) {
 	root := withFakeProc(t)
 	writePIDFile(t, root, 1, "cgroup", cgroupV2CgroupfsDriver)
-	uid, err := attestation.PodUIDFromCgroup(1)
+	id, err := attestation.IdentityFromCgroup(1)
 	require.NoError(t, err)
-	assert.Equal(t, "12345678-1234-1234-1234-123456789abc", uid)
+	assert.Equal(t, "12345678-1234-1234-1234-123456789abc", id.PodUID)
 }
 
-func TestPodUIDFromCgroup_Systemd(t *testing.T) {
+func TestIdentityFromCgroup_Systemd(t *testing.T) {
 	root := withFakeProc(t)
 	writePIDFile(t, root, 1, "cgroup", cgroupV2SystemdDriver)
-	uid, err := attestation.PodUIDFromCgroup(1)
+	id, err := attestation.IdentityFromCgroup(1)
 	require.NoError(t, err)
-	assert.Equal(t, "12345678-1234-1234-1234-123456789abc", uid)
+	assert.Equal(t, "12345678-1234-1234-1234-123456789abc", id.PodUID)
 }
 
-func TestPodUIDFromCgroup_SystemdUnderscores(t *testing.T) {
+func TestIdentityFromCgroup_SystemdUnderscores(t *testing.T) {
 	// systemd cgroup driver canonicalises hyphens in unit names to
 	// underscores; the parser must normalise back to the API form.
 	root := withFakeProc(t)
 	writePIDFile(t, root, 1, "cgroup", cgroupV2SystemdUnderscores)
-	uid, err := attestation.PodUIDFromCgroup(1)
+	id, err := attestation.IdentityFromCgroup(1)
 	require.NoError(t, err)
-	assert.Equal(t, "12345678-1234-1234-1234-123456789abc", uid)
+	assert.Equal(t, "12345678-1234-1234-1234-123456789abc", id.PodUID)
 }
 
-func TestPodUIDFromCgroup_NotAPod(t *testing.T) {
+func TestIdentityFromCgroup_V1(t *testing.T) {
+	want := attestation.Identity{
+		PodUID:      "12345678-1234-1234-1234-123456789abc",
+		ContainerID: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}
+	for name, contents := range map[string]string{
+		"hybrid": cgroupHybrid,
+		"legacy": cgroupLegacy,
+	} {
+		t.Run(name, func(t *testing.T) {
+			root := withFakeProc(t)
+			writePIDFile(t, root, 1, "cgroup", contents)
+			id, err := attestation.IdentityFromCgroup(1)
+			require.NoError(t, err)
+			assert.Equal(t, want, id)
+		})
+	}
+
+	root := withFakeProc(t)
+	writePIDFile(t, root, 1, "cgroup", cgroupLegacyUnsupported)
+	_, err := attestation.IdentityFromCgroup(1)
+	require.Error(t, err)
+}
+
+func TestIdentityFromCgroup_NotAPod(t *testing.T) {
 	root := withFakeProc(t)
 	writePIDFile(t, root, 1, "cgroup", cgroupNonPod)
-	_, err := attestation.PodUIDFromCgroup(1)
+	_, err := attestation.IdentityFromCgroup(1)
 	require.Error(t, err)
 }
 
-func TestPodUIDFromCgroup_Missing(t *testing.T) {
+func TestIdentityFromCgroup_Missing(t *testing.T) {
 	withFakeProc(t)
-	_, err := attestation.PodUIDFromCgroup(42)
+	_, err := attestation.IdentityFromCgroup(42)
 	require.Error(t, err)
 }
 
-func TestPodUIDFromCgroupID(t *testing.T) {
+func TestIdentityFromCgroupID(t *testing.T) {
 	root := t.TempDir()
 	old := attestation.CgroupV2Mount
 	attestation.CgroupV2Mount = root
@@ -99,17 +141,55 @@ func TestPodUIDFromCgroupID(t *testing.T) {
 	var st syscall.Stat_t
 	require.NoError(t, syscall.Stat(podDir, &st))
 
-	uid, err := attestation.PodUIDFromCgroupID(st.Ino)
+	id, err := attestation.IdentityFromCgroupID(st.Ino)
 	require.NoError(t, err)
-	assert.Equal(t, "12345678-1234-1234-1234-123456789abc", uid)
+	assert.Equal(t, attestation.Identity{PodUID: "12345678-1234-1234-1234-123456789abc"}, id)
+}
+
+func TestIdentityFromCgroup_Container(t *testing.T) {
+	const containerID = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for name, tt := range map[string]struct {
+		cgroup      string
+		containerID string
+	}{
+		"containerd systemd": {
+			cgroup:      "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod12345678_1234_1234_1234_123456789abc.slice/cri-containerd-" + containerID + ".scope",
+			containerID: containerID,
+		},
+		"crio systemd": {
+			cgroup:      "/kubepods.slice/kubepods-pod12345678_1234_1234_1234_123456789abc.slice/crio-" + containerID + ".scope",
+			containerID: containerID,
+		},
+		"cgroupfs": {
+			cgroup:      "/kubepods/besteffort/pod12345678-1234-1234-1234-123456789abc/" + containerID,
+			containerID: containerID,
+		},
+		"crio conmon": {
+			cgroup: "/kubepods.slice/kubepods-pod12345678_1234_1234_1234_123456789abc.slice/crio-conmon-" + containerID + ".scope",
+		},
+		"pod cgroup": {
+			cgroup: "/kubepods/besteffort/pod12345678-1234-1234-1234-123456789abc",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			root := withFakeProc(t)
+			writePIDFile(t, root, 1, "cgroup", "0::"+tt.cgroup+"\n")
+			id, err := attestation.IdentityFromCgroup(1)
+			require.NoError(t, err)
+			assert.Equal(t, attestation.Identity{
+				PodUID:      "12345678-1234-1234-1234-123456789abc",
+				ContainerID: tt.containerID,
+			}, id)
+		})
+	}
 }
 
-func TestPodUIDFromCgroupID_NotFound(t *testing.T) {
+func TestIdentityFromCgroupID_NotFound(t *testing.T) {
 	root := t.TempDir()
 	old := attestation.CgroupV2Mount
 	attestation.CgroupV2Mount = root
 	t.Cleanup(func() { attestation.CgroupV2Mount = old })
 
-	_, err := attestation.PodUIDFromCgroupID(0xdeadbeef)
+	_, err := attestation.IdentityFromCgroupID(0xdeadbeef)
 	require.Error(t, err)
 }
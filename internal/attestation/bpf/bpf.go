@@ -4,7 +4,8 @@
 // Package bpf wraps the eBPF sockops program and 4-tuple -> cgroup-ID map
 // that the userspace metadata server consults to derive the kubernetes pod
 // identity of a connecting process. The cgroup ID is resolved to a pod UID
-// by walking /sys/fs/cgroup for the matching inode (see attestation.PodUIDFromCgroupID).
+// through an index of the kubepods cgroups, falling back to walking
+// /sys/fs/cgroup for the matching inode (see attestation.CgroupIndex).
 package bpf
 
 import (
@@ -13,11 +14,15 @@ import (
 	"fmt"
 	"net/netip"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
+	"github.com/matheuscscp/gke-metadata-server/internal/bpfpin"
+	"github.com/matheuscscp/gke-metadata-server/internal/metrics"
 
 	"github.com/cilium/ebpf"
-	"github.com/cilium/ebpf/link"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -type AttestConfig -type AttestKey -type AttestValue attest ../../../ebpf/attest.c
@@ -25,49 +30,179 @@ import (
 // Map wraps the loaded sockops program and its companion lookup map. Lookup
 // returns ErrNotFound when the 4-tuple is unknown — typically because the
 // connect happened before the program was attached, or the LRU evicted the
-// entry. The (mode, pod-kind) dispatch in the server treats this as a hard
+// entry. Entries are deleted by the program when the connection closes, so
+// the LRU only holds live connections. The (mode, pod-kind) dispatch in the server treats this as a hard
 // attestation failure (HTTP 403); there is no fallback to source IP by
 // design.
 type Map struct {
-	objs attestObjects
-	link link.Link
+	objs       attestObjects
+	link       *bpfpin.Link
+	index      *attestation.CgroupIndex
+	maxEntries uint32
+	recountMu  sync.Mutex
+}
+
+// Options configures LoadAndAttach.
+type Options struct {
+	// PinPath is the bpffs directory where the maps and the cgroup link are
+	// pinned and adopted across daemon restarts, so connections established
+	// while the daemon is being replaced can still be attested. Empty
+	// disables pinning.
+	PinPath string
+
+	// MaxEntries is the capacity of the 4-tuple map. Default: 65536.
+	MaxEntries uint32
+
+	// CgroupIndex resolves the recorded cgroup IDs to pods. Required,
+	// owned by the caller.
+	CgroupIndex *attestation.CgroupIndex
+
+	// MetricsRegistry, if set, receives the map occupancy and the sockops
+	// debug counters.
+	MetricsRegistry *prometheus.Registry
 }
 
 // ErrNotFound is returned when no record exists for a 4-tuple.
 var ErrNotFound = errors.New("attestation: 4-tuple not in map")
 
-// LoadAndAttach loads the sockops program and attaches it to the host's
-// cgroup root so it fires for every active TCP connect on the node.
-func LoadAndAttach() (*Map, error) {
+// DefaultMaxEntries is the default capacity of the 4-tuple map.
+const DefaultMaxEntries = 65536
+
+// Indexes of the map_attest_debug counters, see ebpf/attest.c.
+var debugCounters = []string{"entered", "connect", "inet", "recorded", "deleted"}
+
+// LoadAndAttach loads the sockops program and attaches it to the root of
+// the host's cgroup v2 hierarchy (attestation.CgroupV2Mount) so it fires for every active TCP connect and close on the node.
+func LoadAndAttach(opts Options) (*Map, error) {
+	pinPath := opts.PinPath
+	if pinPath != "" {
+		pinPath = filepath.Join(pinPath, "attest")
+	}
+	if opts.MaxEntries == 0 {
+		opts.MaxEntries = DefaultMaxEntries
+	}
+	spec, err := loadAttest()
+	if err != nil {
+		return nil, fmt.Errorf("loading attest eBPF collection spec: %w", err)
+	}
+	spec.Maps["map_attest"].MaxEntries = opts.MaxEntries
 	var objs attestObjects
-	if err := loadAttestObjects(&objs, nil); err != nil {
+	if err := bpfpin.Load(spec, pinPath, &objs, nil); err != nil {
 		return nil, fmt.Errorf("loading attest eBPF objects: %w", err)
 	}
 
-	lnk, err := link.AttachCgroup(link.CgroupOptions{
-		Path:    "/sys/fs/cgroup",
-		Attach:  ebpf.AttachCGroupSockOps,
-		Program: objs.AttestConnect,
-	})
+	lnk, err := bpfpin.AttachCgroup(pinPath, "attest_connect", attestation.CgroupV2Mount,
+		ebpf.AttachCGroupSockOps, objs.AttestConnect)
 	if err != nil {
 		objs.Close()
 		return nil, fmt.Errorf("attaching attest sockops program to cgroup: %w", err)
 	}
 
-	return &Map{objs: objs, link: lnk}, nil
+	// The counter starts at zero when its map is created, but the pinned
+	// 4-tuple map may have been adopted with entries in it.
+	m := &Map{objs: objs, link: lnk, index: opts.CgroupIndex, maxEntries: opts.MaxEntries}
+	if err := m.recount(); err != nil {
+		lnk.Close()
+		objs.Close()
+		return nil, err
+	}
+
+	if opts.MetricsRegistry != nil {
+		m.registerMetrics(opts.MetricsRegistry)
+	}
+	return m, nil
+}
+
+func (m *Map) registerMetrics(registry *prometheus.Registry) {
+	registry.MustRegister(metrics.NewAttestationMapEntriesGauge(func() float64 {
+		return float64(m.entries())
+	}))
+	registry.MustRegister(metrics.NewAttestationMapCapacityGauge(float64(m.maxEntries)))
+	for i, stage := range debugCounters {
+		idx := uint32(i)
+		registry.MustRegister(metrics.NewAttestationSockopsEventsCounter(stage, func() float64 {
+			var v uint64
+			if err := m.objs.attestMaps.MapAttestDebug.Lookup(&idx, &v); err != nil {
+				return 0
+			}
+			return float64(v)
+		}))
+	}
 }
 
-// Close detaches the program and frees BPF resources.
+// entries returns the number of records currently in the 4-tuple map, as
+// counted by the program. The entries evicted by the LRU are not seen by
+// the program, so once the counter reaches the capacity of the map the
+// records are counted again by iterating the map.
+func (m *Map) entries() int64 {
+	n, err := m.count()
+	if err != nil {
+		return 0
+	}
+	if n >= int64(m.maxEntries) {
+		if err := m.recount(); err != nil {
+			return min(n, int64(m.maxEntries))
+		}
+		n, _ = m.count()
+	}
+	return max(n, 0)
+}
+
+func (m *Map) count() (int64, error) {
+	var (
+		idx uint32
+		n   int64
+	)
+	if err := m.objs.attestMaps.MapAttestCount.Lookup(&idx, &n); err != nil {
+		return 0, fmt.Errorf("looking up attestation map counter: %w", err)
+	}
+	return n, nil
+}
+
+// recount iterates the 4-tuple map and stores the number of records in the
+// counter of the program. Connections recorded or closed while iterating
+// may be missed, the next recount corrects them.
+func (m *Map) recount() error {
+	m.recountMu.Lock()
+	defer m.recountMu.Unlock()
+
+	var (
+		n   int64
+		key attestAttestKey
+		val attestAttestValue
+	)
+	iter := m.objs.attestMaps.MapAttest.Iterate()
+	for iter.Next(&key, &val) {
+		n++
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("iterating attestation map: %w", err)
+	}
+	var idx uint32
+	if err := m.objs.attestMaps.MapAttestCount.Update(&idx, &n, ebpf.UpdateAny); err != nil {
+		return fmt.Errorf("updating attestation map counter: %w", err)
+	}
+	return nil
+}
+
+// Close detaches the program and frees BPF resources. If a successor
+// daemon instance has taken over the pinned link, the program and the
+// pinned maps are left in place.
 func (m *Map) Close() error {
+	handedOff := m.link.HandedOff()
 	e1 := m.link.Close()
-	e2 := m.objs.Close()
-	return errors.Join(e1, e2)
+	var e2 error
+	if !handedOff {
+		e2 = bpfpin.UnpinMaps(m.objs.MapAttest, m.objs.MapAttestConfig, m.objs.MapAttestCount, m.objs.MapAttestDebug)
+	}
+	e3 := m.objs.Close()
+	return errors.Join(e1, e2, e3)
 }
 
-// Lookup returns the pod UID for the connection identified by the given
-// 4-tuple, derived from the cgroup ID the BPF program recorded at active-
-// connect time. Returns ErrNotFound if the 4-tuple is not in the map.
-func (m *Map) Lookup(srcIP, dstIP netip.Addr, srcPort, dstPort uint16) (string, error) {
+// Lookup returns the pod and container identity for the connection
+// identified by the given 4-tuple, derived from the cgroup ID the BPF
+// program recorded at active-connect time. Returns ErrNotFound if the 4-tuple is not in the map.
+func (m *Map) Lookup(srcIP, dstIP netip.Addr, srcPort, dstPort uint16) (attestation.Identity, error) {
 	// The BPF program writes skops->{local,remote}_ip4 (kernel __be32 fields)
 	// directly into the map key, so the in-memory bytes are network byte
 	// order. To match in Go we read the IP bytes as a native-endian uint32
@@ -84,15 +219,15 @@ func (m *Map) Lookup(srcIP, dstIP netip.Addr, srcPort, dstPort uint16) (string,
 	var val attestAttestValue
 	if err := m.objs.attestMaps.MapAttest.Lookup(&key, &val); err != nil {
 		if errors.Is(err, ebpf.ErrKeyNotExist) || errors.Is(err, os.ErrNotExist) {
-			return "", ErrNotFound
+			return attestation.Identity{}, ErrNotFound
 		}
-		return "", fmt.Errorf("looking up attestation map: %w", err)
+		return attestation.Identity{}, fmt.Errorf("looking up attestation map: %w", err)
 	}
-	uid, err := attestation.PodUIDFromCgroupID(val.CgroupId)
+	id, err := m.index.Identity(val.CgroupId)
 	if err != nil {
-		return "", fmt.Errorf("resolving pod from cgroup id %d: %w", val.CgroupId, err)
+		return attestation.Identity{}, fmt.Errorf("resolving pod from cgroup id %d: %w", val.CgroupId, err)
 	}
-	return uid, nil
+	return id, nil
 }
 
 // Verify checks that the BPF sockops program captured the given 4-tuple.
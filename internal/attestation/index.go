@@ -0,0 +1,322 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package attestation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/matheuscscp/gke-metadata-server/internal/logging"
+	"github.com/matheuscscp/gke-metadata-server/internal/metrics"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"k8s.io/utils/lru"
+)
+
+// CgroupIndex maintains a bounded cgroup ID -> Identity index so that the
+// eBPF attestation path does not walk the whole cgroup v2 hierarchy on
+// every request. The index is built at startup by walking the hierarchy
+// once and is kept current with inotify watches on the kubepods subtree
+// (down to the pod cgroups, whose children are the container cgroups).
+// Cgroup IDs missing from the index (e.g. evicted by the LRU, or created
+// under a subtree that was not being watched) fall back to a walk, which
+// also refreshes the index and the watches. Cgroup IDs that the walk does
+// not resolve to a pod (e.g. host processes, or cgroups already removed)
+// are remembered for a short while, so they are not walked for again on
+// every request.
+type CgroupIndex struct {
+	mu      sync.Mutex
+	walkMu  sync.Mutex
+	entries *lru.Cache
+	misses  *lru.Cache
+	paths   map[string]uint64
+	pods    map[string]uint64 // pod cgroup IDs by pod UID
+	podDirs map[string]string // pod UIDs by pod cgroup path
+	watcher *fsnotify.Watcher
+	metrics cgroupIndexMetrics
+	done    chan struct{}
+}
+
+// CgroupIndexOptions configures NewCgroupIndex.
+type CgroupIndexOptions struct {
+	MaxEntries      int // default: DefaultCgroupIndexMaxEntries
+	MetricsRegistry *prometheus.Registry
+}
+
+type cgroupIndexMetrics struct {
+	hits    prometheus.Counter
+	walks   prometheus.Counter
+	entries prometheus.Gauge
+}
+
+type cgroupIndexEntry struct {
+	identity Identity
+	path     string
+}
+
+type cgroupIndexMiss struct {
+	err     error
+	expires time.Time
+}
+
+// DefaultCgroupIndexMaxEntries is the default capacity of the cgroup index.
+const DefaultCgroupIndexMaxEntries = 16384
+
+const (
+	// cgroupIndexMissTTL is how long the cgroup IDs not resolved to a pod
+	// are remembered. Short, since only failures are remembered.
+	cgroupIndexMissTTL = 5 * time.Second
+
+	cgroupIndexMaxMisses = 1024
+)
+
+func cgroupIndexLogger() logrus.FieldLogger {
+	return logging.WithComponent(logging.FromContext(context.Background()), logging.ComponentAttestation)
+}
+
+// NewCgroupIndex builds the index by walking CgroupV2Mount and starts
+// watching the kubepods subtree for cgroups being created and removed.
+func NewCgroupIndex(opts CgroupIndexOptions) (*CgroupIndex, error) {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = DefaultCgroupIndexMaxEntries
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("error creating cgroup watcher: %w", err)
+	}
+
+	x := &CgroupIndex{
+		misses:  lru.New(cgroupIndexMaxMisses),
+		paths:   make(map[string]uint64),
+		pods:    make(map[string]uint64),
+		podDirs: make(map[string]string),
+		watcher: watcher,
+		metrics: cgroupIndexMetrics{
+			hits:    metrics.NewCgroupIndexHitsCounter(),
+			walks:   metrics.NewCgroupIndexWalksCounter(),
+			entries: metrics.NewCgroupIndexEntriesGauge(),
+		},
+		done: make(chan struct{}),
+	}
+	x.entries = lru.NewWithEvictionFunc(opts.MaxEntries, func(_ lru.Key, value any) {
+		// Called with x.mu held.
+		delete(x.paths, value.(cgroupIndexEntry).path)
+	})
+	if opts.MetricsRegistry != nil {
+		opts.MetricsRegistry.MustRegister(x.metrics.hits, x.metrics.walks, x.metrics.entries)
+	}
+
+	if _, err := x.walk(CgroupV2Mount, 0); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("error building cgroup index: %w", err)
+	}
+
+	go x.watch()
+
+	return x, nil
+}
+
+// Close stops watching the cgroup hierarchy.
+func (x *CgroupIndex) Close() error {
+	err := x.watcher.Close()
+	<-x.done
+	return err
+}
+
+// Identity resolves the given cgroup ID (as reported by
+// bpf_get_current_cgroup_id()) to the pod and the container that own the
+// cgroup. See IdentityFromCgroupID.
+func (x *CgroupIndex) Identity(cgid uint64) (Identity, error) {
+	if id, ok, err := x.get(cgid); ok {
+		if err == nil {
+			x.metrics.hits.Inc()
+		}
+		return id, err
+	}
+
+	// Serialize the walks and check again, a concurrent walk may have just
+	// indexed the cgroup.
+	x.walkMu.Lock()
+	defer x.walkMu.Unlock()
+	if id, ok, err := x.get(cgid); ok {
+		if err == nil {
+			x.metrics.hits.Inc()
+		}
+		return id, err
+	}
+	x.metrics.walks.Inc()
+	path, err := x.walk(CgroupV2Mount, cgid)
+	if err != nil {
+		return Identity{}, fmt.Errorf("error walking cgroup hierarchy: %w", err)
+	}
+
+	// The cgroup may not fit in the index, so it's resolved from the path
+	// found by the walk.
+	if path == "" {
+		err = fmt.Errorf("cgroup id %d not found under %s", cgid, CgroupV2Mount)
+	} else if id, ok := identityFromCgroupPath(path); ok {
+		return id, nil
+	} else {
+		err = fmt.Errorf("cgroup id %d resolved to path %q, which is not under a kubepods pod cgroup", cgid, path)
+	}
+	x.mu.Lock()
+	x.misses.Add(cgid, cgroupIndexMiss{err: err, expires: time.Now().Add(cgroupIndexMissTTL)})
+	x.mu.Unlock()
+	return Identity{}, err
+}
+
+// get looks up the given cgroup ID in the index and in the recent misses.
+func (x *CgroupIndex) get(cgid uint64) (Identity, bool, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if v, ok := x.entries.Get(cgid); ok {
+		return v.(cgroupIndexEntry).identity, true, nil
+	}
+	if v, ok := x.misses.Get(cgid); ok {
+		miss := v.(cgroupIndexMiss)
+		if time.Now().Before(miss.expires) {
+			return Identity{}, true, miss.err
+		}
+		x.misses.Remove(cgid)
+	}
+	return Identity{}, false, nil
+}
+
+// PodCgroupID returns the ID of the cgroup of the pod with the given UID,
+// or false if the pod has no cgroup (yet). Unlike the container cgroups,
+// the pod cgroups are always kept in the index.
+func (x *CgroupIndex) PodCgroupID(podUID string) (uint64, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	cgid, ok := x.pods[podUID]
+	return cgid, ok
+}
+
+func (x *CgroupIndex) add(path string, cgid uint64, id Identity, isPodDir bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries.Add(cgid, cgroupIndexEntry{identity: id, path: path})
+	x.misses.Remove(cgid)
+	x.paths[path] = cgid
+	if isPodDir {
+		x.pods[id.PodUID] = cgid
+		x.podDirs[path] = id.PodUID
+	}
+	x.metrics.entries.Set(float64(x.entries.Len()))
+}
+
+func (x *CgroupIndex) remove(path string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if uid, ok := x.podDirs[path]; ok {
+		delete(x.podDirs, path)
+		delete(x.pods, uid)
+	}
+	cgid, ok := x.paths[path]
+	if !ok {
+		return
+	}
+	x.entries.Remove(cgid)
+	x.metrics.entries.Set(float64(x.entries.Len()))
+}
+
+// walk indexes the pod cgroups under root and watches the kubepods
+// directories under root down to the pod level. If cgid is not zero, the
+// path of the cgroup with that ID is returned, or "" if not found.
+func (x *CgroupIndex) walk(root string, cgid uint64) (string, error) {
+	var found string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Skip permission errors / transient races.
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if cgid != 0 && found == "" && cgroupInode(d) == cgid {
+			found = path
+		}
+		x.visit(path, d)
+		return nil
+	})
+	return found, err
+}
+
+// cgroupInode returns the inode of the given cgroup directory, i.e. its
+// cgroup ID, or zero if it cannot be read.
+func cgroupInode(d fs.DirEntry) uint64 {
+	info, err := d.Info()
+	if err != nil {
+		return 0
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return stat.Ino
+}
+
+func (x *CgroupIndex) visit(path string, d fs.DirEntry) {
+	if !strings.Contains(path, "kubepods") {
+		return
+	}
+	id, isPodCgroup := identityFromCgroupPath(path)
+	isPodDir := podUIDPattern.MatchString(filepath.Base(path))
+	if isPodCgroup {
+		if ino := cgroupInode(d); ino != 0 {
+			x.add(path, ino, id, isPodDir)
+		}
+	}
+
+	// Watch the kubepods and QoS directories for new pods, and the pod
+	// directories for new containers. Container cgroups are leaves for
+	// our purposes.
+	if !isPodCgroup || isPodDir {
+		if err := x.watcher.Add(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			cgroupIndexLogger().WithError(err).WithField("path", path).Warn("error watching cgroup directory")
+		}
+	}
+}
+
+func (x *CgroupIndex) watch() {
+	defer close(x.done)
+	l := cgroupIndexLogger()
+	for {
+		select {
+		case ev, ok := <-x.watcher.Events:
+			if !ok {
+				return
+			}
+			switch {
+			case ev.Has(fsnotify.Create):
+				// Walk instead of visiting only the new directory, as
+				// children may have been created before the watch.
+				if _, err := x.walk(ev.Name, 0); err != nil {
+					l.WithError(err).WithField("path", ev.Name).Warn("error indexing new cgroup")
+				}
+			case ev.Has(fsnotify.Remove):
+				x.remove(ev.Name)
+			}
+		case err, ok := <-x.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Overflows lose events, the walk fallback covers them.
+			l.WithError(err).Warn("error watching cgroup hierarchy")
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package attestation_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withFakeCgroupRoot(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	old := attestation.CgroupV2Mount
+	attestation.CgroupV2Mount = root
+	t.Cleanup(func() { attestation.CgroupV2Mount = old })
+	return root
+}
+
+func mkdirIno(t *testing.T, path string) uint64 {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(path, 0o755))
+	var st syscall.Stat_t
+	require.NoError(t, syscall.Stat(path, &st))
+	return st.Ino
+}
+
+func metricValue(t *testing.T, registry *prometheus.Registry, name string) float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	for _, f := range families {
+		if f.GetName() == name {
+			m := f.GetMetric()[0]
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+	return 0
+}
+
+var (
+	containerA = strings.Repeat("a", 64)
+	containerB = strings.Repeat("b", 64)
+)
+
+const (
+	indexHits    = "gke_metadata_server_attestation_cgroup_index_hits_total"
+	indexWalks   = "gke_metadata_server_attestation_cgroup_index_walks_total"
+	indexEntries = "gke_metadata_server_attestation_cgroup_index_entries"
+)
+
+func TestCgroupIndex(t *testing.T) {
+	root := withFakeCgroupRoot(t)
+	qos := filepath.Join(root, "kubepods.slice", "kubepods-besteffort.slice")
+	podDir := filepath.Join(qos, "kubepods-besteffort-pod12345678_1234_1234_1234_123456789abc.slice")
+	existing := mkdirIno(t, filepath.Join(podDir, "cri-containerd-"+containerA+".scope"))
+	kubelet := mkdirIno(t, filepath.Join(root, "system.slice", "kubelet.service"))
+
+	registry := prometheus.NewRegistry()
+	index, err := attestation.NewCgroupIndex(attestation.CgroupIndexOptions{MetricsRegistry: registry})
+	require.NoError(t, err)
+	defer index.Close()
+
+	// Built at startup.
+	id, err := index.Identity(existing)
+	require.NoError(t, err)
+	assert.Equal(t, attestation.Identity{
+		PodUID:      "12345678-1234-1234-1234-123456789abc",
+		ContainerID: containerA,
+	}, id)
+	assert.Equal(t, float64(1), metricValue(t, registry, indexHits))
+
+	// Kept current through the watches: a new pod with a container.
+	newPodDir := filepath.Join(qos, "kubepods-besteffort-podabcdef01_2345_6789_abcd_ef0123456789.slice")
+	created := mkdirIno(t, filepath.Join(newPodDir, "cri-containerd-"+containerB+".scope"))
+	assert.Eventually(t, func() bool {
+		return metricValue(t, registry, indexEntries) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	id, err = index.Identity(created)
+	require.NoError(t, err)
+	assert.Equal(t, attestation.Identity{
+		PodUID:      "abcdef01-2345-6789-abcd-ef0123456789",
+		ContainerID: containerB,
+	}, id)
+	assert.Equal(t, float64(0), metricValue(t, registry, indexWalks))
+
+	// The pod cgroups are resolved by pod UID.
+	cgid, ok := index.PodCgroupID("abcdef01-2345-6789-abcd-ef0123456789")
+	require.True(t, ok)
+	assert.Equal(t, mkdirIno(t, newPodDir), cgid)
+	_, ok = index.PodCgroupID("00000000-0000-0000-0000-000000000000")
+	assert.False(t, ok)
+
+	// Removed cgroups leave the index.
+	require.NoError(t, os.Remove(filepath.Join(newPodDir, "cri-containerd-"+containerB+".scope")))
+	assert.Eventually(t, func() bool {
+		return metricValue(t, registry, indexEntries) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, os.Remove(newPodDir))
+	assert.Eventually(t, func() bool {
+		_, ok := index.PodCgroupID("abcdef01-2345-6789-abcd-ef0123456789")
+		return !ok && metricValue(t, registry, indexEntries) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Unknown cgroups fall back to a walk, once.
+	_, err = index.Identity(0xdeadbeef)
+	require.ErrorContains(t, err, "not found")
+	assert.Equal(t, float64(1), metricValue(t, registry, indexWalks))
+	_, err = index.Identity(0xdeadbeef)
+	require.ErrorContains(t, err, "not found")
+	assert.Equal(t, float64(1), metricValue(t, registry, indexWalks))
+
+	// And so do cgroups outside of the pods.
+	_, err = index.Identity(kubelet)
+	require.ErrorContains(t, err, "not under a kubepods pod cgroup")
+	_, err = index.Identity(kubelet)
+	require.ErrorContains(t, err, "not under a kubepods pod cgroup")
+	assert.Equal(t, float64(2), metricValue(t, registry, indexWalks))
+}
+
+func TestCgroupIndex_LRU(t *testing.T) {
+	root := withFakeCgroupRoot(t)
+	podDir := filepath.Join(root, "kubepods", "besteffort", "pod12345678-1234-1234-1234-123456789abc")
+	a := mkdirIno(t, filepath.Join(podDir, containerA))
+	b := mkdirIno(t, filepath.Join(podDir, containerB))
+
+	registry := prometheus.NewRegistry()
+	index, err := attestation.NewCgroupIndex(attestation.CgroupIndexOptions{
+		MaxEntries:      1,
+		MetricsRegistry: registry,
+	})
+	require.NoError(t, err)
+	defer index.Close()
+
+	// Only one of the three pod cgroups fits, the others are resolved
+	// through the walk fallback.
+	for cgid, containerID := range map[uint64]string{a: containerA, b: containerB} {
+		id, err := index.Identity(cgid)
+		require.NoError(t, err)
+		assert.Equal(t, "12345678-1234-1234-1234-123456789abc", id.PodUID)
+		assert.Equal(t, containerID, id.ContainerID)
+	}
+	assert.Equal(t, float64(1), metricValue(t, registry, indexEntries))
+	assert.NotZero(t, metricValue(t, registry, indexWalks))
+}
@@ -0,0 +1,204 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package attestation
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/matheuscscp/gke-metadata-server/api"
+
+	"golang.org/x/sys/unix"
+)
+
+// CgroupMode is the way the cgroup hierarchies are mounted on the node.
+type CgroupMode string
+
+const (
+	// CgroupModeUnified is a cgroup v2 hierarchy mounted at /sys/fs/cgroup.
+	CgroupModeUnified CgroupMode = "unified"
+
+	// CgroupModeHybrid is a set of cgroup v1 controller hierarchies mounted
+	// under /sys/fs/cgroup, with a controller-less cgroup v2 hierarchy
+	// mounted at /sys/fs/cgroup/unified.
+	CgroupModeHybrid CgroupMode = "hybrid"
+
+	// CgroupModeLegacy is a set of cgroup v1 controller hierarchies mounted
+	// under /sys/fs/cgroup, without a cgroup v2 hierarchy.
+	CgroupModeLegacy CgroupMode = "legacy"
+)
+
+// CgroupRoot is where the cgroup hierarchies are mounted.
+const CgroupRoot = "/sys/fs/cgroup"
+
+// CgroupLayout describes the cgroup hierarchies of the node.
+type CgroupLayout struct {
+	Mode CgroupMode
+
+	// V2Mount is the mount point of the cgroup v2 hierarchy, where the eBPF
+	// programs are attached and the cgroup IDs are resolved. Empty in
+	// CgroupModeLegacy.
+	V2Mount string
+}
+
+// DetectCgroupLayout inspects the filesystems mounted at CgroupRoot.
+func DetectCgroupLayout() (*CgroupLayout, error) {
+	var root unix.Statfs_t
+	if err := unix.Statfs(CgroupRoot, &root); err != nil {
+		return nil, fmt.Errorf("error inspecting %s: %w", CgroupRoot, err)
+	}
+	unifiedMount := filepath.Join(CgroupRoot, "unified")
+	var unified unix.Statfs_t
+	if err := unix.Statfs(unifiedMount, &unified); err != nil {
+		unified.Type = 0
+	}
+	mode, err := cgroupModeFromFSTypes(root.Type, unified.Type)
+	if err != nil {
+		return nil, err
+	}
+	layout := &CgroupLayout{Mode: mode}
+	switch mode {
+	case CgroupModeUnified:
+		layout.V2Mount = CgroupRoot
+	case CgroupModeHybrid:
+		layout.V2Mount = unifiedMount
+	}
+	return layout, nil
+}
+
+// cgroupModeFromFSTypes tells the cgroup mode from the filesystem types
+// (statfs f_type) mounted at CgroupRoot and at CgroupRoot/unified.
+func cgroupModeFromFSTypes(root, unified int64) (CgroupMode, error) {
+	switch {
+	case root == unix.CGROUP2_SUPER_MAGIC:
+		return CgroupModeUnified, nil
+	case root != unix.TMPFS_MAGIC:
+		return "", fmt.Errorf("unexpected filesystem type %#x mounted at %s", root, CgroupRoot)
+	case unified == unix.CGROUP2_SUPER_MAGIC:
+		return CgroupModeHybrid, nil
+	default:
+		return CgroupModeLegacy, nil
+	}
+}
+
+// SupportsRoutingMode returns an error explaining why the given routing
+// mode cannot work with the layout, or nil if it can.
+func (l *CgroupLayout) SupportsRoutingMode(mode string) error {
+	if l.Mode == CgroupModeHybrid && (mode == api.RoutingModeBPF || mode == api.RoutingModeNFTables) {
+		// The pods may be placed only in the cgroup v1 controller hierarchies,
+		// sharing a cgroup of the host in the controller-less cgroup v2
+		// hierarchy, in which case the cgroup v2 IDs and paths seen by the
+		// eBPF programs and the nftables rules identify neither the pods nor
+		// the emulator. The emulator runs in a pod, so its own cgroup v2 path
+		// tells whether the kubelet places the pods in the v2 hierarchy too.
+		cgroupPath, _, err := SelfCgroup()
+		if err != nil {
+			return fmt.Errorf("routing mode %s requires resolving the emulator cgroup v2 path (%s mode): %w", mode, l.Mode, err)
+		}
+		if !IsPodCgroupPath(cgroupPath) {
+			return fmt.Errorf("routing mode %s requires the pods to be placed in the cgroup v2 hierarchy to identify them, "+
+				"but the emulator cgroup v2 path %q is not a pod cgroup (%s mode), use the %s routing mode instead",
+				mode, cgroupPath, l.Mode, api.RoutingModeLoopback)
+		}
+	}
+	if l.V2Mount != "" {
+		return nil
+	}
+	switch mode {
+	case api.RoutingModeBPF:
+		return fmt.Errorf("routing mode %s requires a cgroup v2 hierarchy to attach the eBPF programs, "+
+			"but the node has only cgroup v1 hierarchies (%s mode)", mode, l.Mode)
+	case api.RoutingModeNFTables:
+		return fmt.Errorf("routing mode %s requires a cgroup v2 hierarchy to exclude the emulator from the DNAT rules, "+
+			"but the node has only cgroup v1 hierarchies (%s mode)", mode, l.Mode)
+	}
+	return nil
+}
+
+// SupportedRoutingModes lists the routing modes supported by the layout.
+func (l *CgroupLayout) SupportedRoutingModes() []string {
+	var modes []string
+	for _, mode := range []string{api.RoutingModeBPF, api.RoutingModeLoopback, api.RoutingModeNFTables, api.RoutingModeNone} {
+		if l.SupportsRoutingMode(mode) == nil {
+			modes = append(modes, mode)
+		}
+	}
+	return modes
+}
+
+// SelfCgroup resolves the path (relative to CgroupV2Mount) and the kernel
+// cgroup ID of the daemon's own cgroup in the cgroup v2 hierarchy. The
+// cgroup ID is the inode number of the cgroup directory in cgroupfs and is
+// what bpf_get_current_cgroup_id() returns from inside an eBPF program.
+//
+// A cgroup v2 hierarchy is required, either unified or mounted alongside the
+// cgroup v1 hierarchies (hybrid). The caller's cgroup is read from the line
+// of the form "0::<path>" in /proc/self/cgroup.
+func SelfCgroup() (string, uint64, error) {
+	f, err := os.Open(ProcRoot + "/self/cgroup")
+	if err != nil {
+		return "", 0, fmt.Errorf("error opening /proc/self/cgroup: %w", err)
+	}
+	defer f.Close()
+
+	var cgroupPath string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Format: <hierarchy-id>:<controllers>:<path>. The v2 line has
+		// hierarchy-id "0" and empty controllers.
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) == 3 && fields[0] == "0" && fields[1] == "" {
+			cgroupPath = fields[2]
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", 0, fmt.Errorf("error reading /proc/self/cgroup: %w", err)
+	}
+	if cgroupPath == "" {
+		return "", 0, errors.New("could not find cgroup v2 entry in /proc/self/cgroup; a cgroup v2 hierarchy is required")
+	}
+
+	dir := filepath.Join(CgroupV2Mount, cgroupPath)
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return "", 0, fmt.Errorf("error stating cgroup directory %q: %w", dir, err)
+	}
+	return cgroupPath, st.Ino, nil
+}
+
+// fileIDKernfs is the type of the file handles of cgroupfs, whose payload
+// is the cgroup ID.
+const fileIDKernfs = 0xfe
+
+// CgroupExists reports whether the cgroup with the given ID still exists in
+// the cgroup v2 hierarchy, by opening its directory from the file handle
+// made of the ID. Requires CAP_DAC_READ_SEARCH.
+func CgroupExists(cgid uint64) (bool, error) {
+	mount, err := os.Open(CgroupV2Mount)
+	if err != nil {
+		return false, fmt.Errorf("error opening cgroup v2 mount: %w", err)
+	}
+	defer mount.Close()
+
+	var id [8]byte
+	binary.NativeEndian.PutUint64(id[:], cgid)
+	handle := unix.NewFileHandle(fileIDKernfs, id[:])
+	fd, err := unix.OpenByHandleAt(int(mount.Fd()), handle, unix.O_RDONLY|unix.O_CLOEXEC)
+	switch {
+	case err == nil:
+		unix.Close(fd)
+		return true, nil
+	case errors.Is(err, unix.ESTALE), errors.Is(err, unix.ENOENT):
+		return false, nil
+	default:
+		return false, fmt.Errorf("error opening cgroup %d by handle: %w", cgid, err)
+	}
+}
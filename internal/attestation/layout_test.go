@@ -0,0 +1,97 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package attestation
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matheuscscp/gke-metadata-server/api"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestCgroupModeFromFSTypes(t *testing.T) {
+	for _, tt := range []struct {
+		root, unified int64
+		mode          CgroupMode
+	}{
+		{unix.CGROUP2_SUPER_MAGIC, 0, CgroupModeUnified},
+		{unix.TMPFS_MAGIC, unix.CGROUP2_SUPER_MAGIC, CgroupModeHybrid},
+		{unix.TMPFS_MAGIC, unix.CGROUP_SUPER_MAGIC, CgroupModeLegacy},
+		{unix.TMPFS_MAGIC, 0, CgroupModeLegacy},
+	} {
+		mode, err := cgroupModeFromFSTypes(tt.root, tt.unified)
+		require.NoError(t, err)
+		assert.Equal(t, tt.mode, mode)
+	}
+
+	_, err := cgroupModeFromFSTypes(unix.EXT4_SUPER_MAGIC, 0)
+	require.Error(t, err)
+}
+
+func TestCgroupLayout_SupportedRoutingModes(t *testing.T) {
+	unified := &CgroupLayout{Mode: CgroupModeUnified, V2Mount: "/sys/fs/cgroup"}
+	hybrid := &CgroupLayout{Mode: CgroupModeHybrid, V2Mount: "/sys/fs/cgroup/unified"}
+	legacy := &CgroupLayout{Mode: CgroupModeLegacy}
+
+	all := []string{api.RoutingModeBPF, api.RoutingModeLoopback, api.RoutingModeNFTables, api.RoutingModeNone}
+	assert.Equal(t, all, unified.SupportedRoutingModes())
+
+	// On hybrid nodes the emulator's own cgroup v2 path tells whether the
+	// pods are placed in the cgroup v2 hierarchy.
+	withSelfCgroup(t, "/kubepods.slice/kubepods-pod12345678_1234_1234_1234_123456789abc.slice/cri-containerd-abc.scope")
+	assert.Equal(t, all, hybrid.SupportedRoutingModes())
+	withSelfCgroup(t, "/system.slice/containerd.service")
+	assert.Equal(t, []string{api.RoutingModeLoopback, api.RoutingModeNone}, hybrid.SupportedRoutingModes())
+	assert.ErrorContains(t, hybrid.SupportsRoutingMode(api.RoutingModeBPF), "is not a pod cgroup (hybrid mode), use the Loopback routing mode instead")
+	assert.ErrorContains(t, hybrid.SupportsRoutingMode(api.RoutingModeNFTables), "is not a pod cgroup (hybrid mode), use the Loopback routing mode instead")
+
+	assert.Equal(t, []string{api.RoutingModeLoopback, api.RoutingModeNone}, legacy.SupportedRoutingModes())
+	assert.Error(t, legacy.SupportsRoutingMode(api.RoutingModeBPF))
+	assert.Error(t, legacy.SupportsRoutingMode(api.RoutingModeNFTables))
+}
+
+// withSelfCgroup fakes /proc/self/cgroup of a hybrid node and the cgroup v2
+// directory of the given path.
+func withSelfCgroup(t *testing.T, cgroupPath string) {
+	t.Helper()
+	proc, mount := t.TempDir(), t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(proc, "self"), 0o755))
+	content := "4:cpu,cpuacct:/kubepods/burstable/pod12345678-1234-1234-1234-123456789abc/abc\n0::" + cgroupPath + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(proc, "self", "cgroup"), []byte(content), 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(mount, cgroupPath), 0o755))
+	prevProc, prevMount := ProcRoot, CgroupV2Mount
+	ProcRoot, CgroupV2Mount = proc, mount
+	t.Cleanup(func() { ProcRoot, CgroupV2Mount = prevProc, prevMount })
+}
+
+func TestCgroupExists(t *testing.T) {
+	layout, err := DetectCgroupLayout()
+	if err != nil || layout.V2Mount == "" {
+		t.Skip("no cgroup v2 hierarchy")
+	}
+	prev := CgroupV2Mount
+	CgroupV2Mount = layout.V2Mount
+	t.Cleanup(func() { CgroupV2Mount = prev })
+	_, self, err := SelfCgroup()
+	if err != nil {
+		t.Skipf("cannot resolve own cgroup: %v", err)
+	}
+
+	exists, err := CgroupExists(self)
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("opening file handles requires CAP_DAC_READ_SEARCH")
+	}
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = CgroupExists(1 << 62)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
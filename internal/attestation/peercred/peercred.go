@@ -0,0 +1,122 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+// Package peercred implements kernel-attested pod identification for
+// connections to the metadata server's Unix domain socket.
+//
+// The kernel records the credentials of the connecting process when a Unix
+// socket connection is established, so there is no 4-tuple to look up: the
+// peer is read directly from the accepted socket. On Linux 6.5+ the kernel
+// also hands out a pidfd for the peer (SO_PEERPIDFD), which is used to make
+// sure the PID was not recycled while its /proc/<pid>/cgroup was read. On
+// older kernels only the PID (SO_PEERCRED) is available. Either way the pod
+// UID comes from the kubelet's `pod<UID>` cgroup naming convention, see
+// attestation.IdentityFromCgroup.
+package peercred
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
+
+	"golang.org/x/sys/unix"
+)
+
+// Attestor identifies the peers of Unix socket connections. It implements
+// server.PeerAttestor.
+type Attestor struct{}
+
+// Identify returns the identity of the process that connected to the
+// other end of the given Unix socket connection.
+func (Attestor) Identify(conn *net.UnixConn) (attestation.Identity, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return attestation.Identity{}, fmt.Errorf("error getting raw unix connection: %w", err)
+	}
+	pidfd, pid := -1, 0
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if pidfd, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PEERPIDFD); sockErr == nil {
+			return
+		}
+		pidfd = -1
+		var cred *unix.Ucred
+		if cred, sockErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED); sockErr == nil {
+			pid = int(cred.Pid)
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return attestation.Identity{}, fmt.Errorf("error getting unix socket peer credentials: %w", err)
+	}
+
+	if pidfd < 0 {
+		return identityFromPID(pid)
+	}
+	defer unix.Close(pidfd)
+	if pid, err = pidFromPidfd(pidfd); err != nil {
+		return attestation.Identity{}, err
+	}
+	id, err := identityFromPID(pid)
+	if err != nil {
+		return attestation.Identity{}, err
+	}
+	// If the peer is still alive, the PID was not recycled while we read
+	// its cgroup.
+	if err := unix.PidfdSendSignal(pidfd, 0, nil, 0); err != nil {
+		return attestation.Identity{}, fmt.Errorf("unix socket peer pid %d exited during attestation: %w", pid, err)
+	}
+	return id, nil
+}
+
+func identityFromPID(pid int) (attestation.Identity, error) {
+	// The PID is translated to our PID namespace, 0 means the peer is not
+	// visible from it (the daemon must run with hostPID).
+	if pid <= 0 {
+		return attestation.Identity{}, errors.New("unix socket peer pid is not visible from the daemon's pid namespace")
+	}
+	id, err := attestation.IdentityFromCgroup(pid)
+	if err != nil {
+		return attestation.Identity{}, fmt.Errorf("resolving pod uid for pid %d: %w", pid, err)
+	}
+	return id, nil
+}
+
+// pidFromPidfd reads the PID of a pidfd from the "Pid:" field of its
+// fdinfo. The PID is -1 if the process exited, and 0 if it is not visible
+// from our PID namespace.
+func pidFromPidfd(pidfd int) (int, error) {
+	path := fmt.Sprintf("/proc/self/fdinfo/%d", pidfd)
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		v, ok := strings.CutPrefix(scanner.Text(), "Pid:")
+		if !ok {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return 0, fmt.Errorf("error parsing pid in %s: %w", path, err)
+		}
+		if pid < 0 {
+			return 0, errors.New("unix socket peer exited before attestation")
+		}
+		return pid, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return 0, fmt.Errorf("no pid in %s", path)
+}
@@ -0,0 +1,50 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package peercred_test
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation/peercred"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentify(t *testing.T) {
+	// The peer is this process, pretend it runs in a pod.
+	procRoot := t.TempDir()
+	old := attestation.ProcRoot
+	attestation.ProcRoot = procRoot
+	t.Cleanup(func() { attestation.ProcRoot = old })
+	pidDir := filepath.Join(procRoot, fmt.Sprint(os.Getpid()))
+	require.NoError(t, os.MkdirAll(pidDir, 0o755))
+	const cgroup = "0::/kubepods/besteffort/pod12345678-1234-1234-1234-123456789abc/" +
+		"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef\n"
+	require.NoError(t, os.WriteFile(filepath.Join(pidDir, "cgroup"), []byte(cgroup), 0o644))
+
+	path := filepath.Join(t.TempDir(), "metadata.sock")
+	lis, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	require.NoError(t, err)
+	defer lis.Close()
+
+	client, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer client.Close()
+	conn, err := lis.AcceptUnix()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	id, err := peercred.Attestor{}.Identify(conn)
+	require.NoError(t, err)
+	assert.Equal(t, attestation.Identity{
+		PodUID:      "12345678-1234-1234-1234-123456789abc",
+		ContainerID: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}, id)
+}
@@ -8,14 +8,20 @@
 // /sys/fs/cgroup until the matching inode is found). Both inputs are
 // kernel-attested and cannot be forged from user space.
 //
-// PodUIDFromCgroup is used by the netlink SOCK_DIAG path (Loopback/None
-// routing modes for hostNetwork pods), which resolves a 4-tuple to a PID
-// via the host's socket table and a /proc/*/fd walk.
+// The container runtime places each container's processes in a child
+// cgroup of the pod cgroup named after the container ID, so the specific
+// container is recoverable from the same path.
 //
-// PodUIDFromCgroupID is used by the eBPF sockops path, which records
-// bpf_get_current_cgroup_id() at TCP connect time. Cgroup IDs are
-// namespace-independent, so this works even when the daemon runs inside a
-// nested PID namespace (e.g. inside a kind worker container).
+// IdentityFromCgroup is used by the netlink INET_DIAG path on kernels that
+// do not report the socket cgroup ID (Loopback/None routing modes for
+// hostNetwork pods), which resolves a 4-tuple to a PID via the host's
+// socket table and a /proc/*/fd walk.
+//
+// IdentityFromCgroupID is used by the eBPF sockops path, which records
+// bpf_get_current_cgroup_id() at TCP connect time, and by the INET_DIAG
+// path on newer kernels. Cgroup IDs are namespace-independent, so this
+// works even when the daemon runs inside a nested PID namespace (e.g.
+// inside a kind worker container).
 package attestation
 
 import (
@@ -26,6 +32,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
@@ -42,49 +49,121 @@ var ProcRoot = "/proc"
 // The UID itself is canonicalised to the hyphen form (kubernetes' API form).
 var podUIDPattern = regexp.MustCompile(`pod([0-9a-fA-F]{8}[-_][0-9a-fA-F]{4}[-_][0-9a-fA-F]{4}[-_][0-9a-fA-F]{4}[-_][0-9a-fA-F]{12})`)
 
-// PodUIDFromCgroup reads /proc/<pid>/cgroup and extracts the pod UID from
-// the kubepods cgroup path. Only the cgroup v2 unified hierarchy line
-// (hierarchy id "0", empty controllers field) is consulted; hybrid v1+v2
-// systems return the v2 entry, mixed-mode v1 systems are not supported.
-func PodUIDFromCgroup(pid int) (string, error) {
+// containerIDPattern matches the container cgroup directly under the pod
+// cgroup. The styles are:
+//   - cgroupfs driver: "<ID>"
+//   - systemd driver:  "cri-containerd-<ID>.scope", "crio-<ID>.scope",
+//     "docker-<ID>.scope"
+//
+// CRI-O's "crio-conmon-<ID>.scope" holds the container monitor, not the
+// container, and is deliberately not matched.
+var containerIDPattern = regexp.MustCompile(`^(?:cri-containerd-|crio-|docker-)?([0-9a-f]{64})(?:\.scope)?$`)
+
+// Identity is the kernel-attested identity of a process.
+type Identity struct {
+	PodUID string
+
+	// ContainerID is the container runtime ID of the container the process
+	// runs in, without the runtime prefix. Empty when the process is in the
+	// pod cgroup itself rather than in a container cgroup.
+	ContainerID string
+}
+
+// identityFromCgroupPath extracts the pod UID and the container ID from a
+// cgroup path. Returns false if the path is not under a pod cgroup.
+func identityFromCgroupPath(path string) (Identity, bool) {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		match := podUIDPattern.FindStringSubmatch(seg)
+		if match == nil {
+			continue
+		}
+		id := Identity{PodUID: strings.ReplaceAll(match[1], "_", "-")}
+		if i+1 < len(segments) {
+			if match := containerIDPattern.FindStringSubmatch(segments[i+1]); match != nil {
+				id.ContainerID = match[1]
+			}
+		}
+		return id, true
+	}
+	return Identity{}, false
+}
+
+// IsPodCgroupPath reports whether the given cgroup path is under a pod
+// cgroup.
+func IsPodCgroupPath(path string) bool {
+	_, ok := identityFromCgroupPath(path)
+	return ok
+}
+
+// v1Controllers are the cgroup v1 controllers whose hierarchies are
+// consulted when the cgroup v2 entry does not identify a pod, i.e. on nodes
+// with hybrid or legacy cgroup layouts where the kubelet manages pods
+// through the v1 controllers. Both are enabled by the kubelet on every pod.
+var v1Controllers = []string{"cpu", "cpuacct", "pids"}
+
+// IdentityFromCgroup reads /proc/<pid>/cgroup and extracts the pod UID and
+// the container ID from the kubepods cgroup path. The cgroup v2 unified
+// hierarchy line (hierarchy id "0", empty controllers field) is consulted
+// first. If it is missing or not under a pod cgroup, the cgroup v1 lines of
+// the "cpu,cpuacct" and "pids" controllers are consulted.
+func IdentityFromCgroup(pid int) (Identity, error) {
 	f, err := os.Open(fmt.Sprintf("%s/%d/cgroup", ProcRoot, pid))
 	if err != nil {
-		return "", fmt.Errorf("reading /proc/%d/cgroup: %w", pid, err)
+		return Identity{}, fmt.Errorf("reading /proc/%d/cgroup: %w", pid, err)
 	}
 	defer f.Close()
 
+	var v2Path string
+	var v1Paths []string
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := scanner.Text()
 		// Format: <hierarchy-id>:<controllers>:<path>.
 		fields := strings.SplitN(line, ":", 3)
-		if len(fields) != 3 || fields[0] != "0" || fields[1] != "" {
+		if len(fields) != 3 {
 			continue
 		}
-		match := podUIDPattern.FindStringSubmatch(fields[2])
-		if match == nil {
-			return "", fmt.Errorf("pid %d cgroup path %q is not under a kubepods pod cgroup", pid, fields[2])
+		switch {
+		case fields[0] == "0" && fields[1] == "":
+			v2Path = fields[2]
+		case slices.ContainsFunc(strings.Split(fields[1], ","), func(c string) bool {
+			return slices.Contains(v1Controllers, c)
+		}):
+			v1Paths = append(v1Paths, fields[2])
 		}
-		return strings.ReplaceAll(match[1], "_", "-"), nil
 	}
 	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("scanning /proc/%d/cgroup: %w", pid, err)
+		return Identity{}, fmt.Errorf("scanning /proc/%d/cgroup: %w", pid, err)
+	}
+
+	for _, path := range append([]string{v2Path}, v1Paths...) {
+		if id, ok := identityFromCgroupPath(path); ok {
+			return id, nil
+		}
+	}
+	switch {
+	case v2Path != "":
+		return Identity{}, fmt.Errorf("pid %d cgroup path %q is not under a kubepods pod cgroup", pid, v2Path)
+	case len(v1Paths) > 0:
+		return Identity{}, fmt.Errorf("pid %d cgroup v1 paths %q are not under a kubepods pod cgroup", pid, v1Paths)
+	default:
+		return Identity{}, errors.New("no cgroup v2 or supported cgroup v1 entry in /proc/" + strconv.Itoa(pid) + "/cgroup")
 	}
-	return "", errors.New("no cgroup v2 entry in /proc/" + strconv.Itoa(pid) + "/cgroup")
 }
 
-// CgroupV2Mount is the cgroup v2 unified hierarchy mount point. Overridable
-// in tests.
-var CgroupV2Mount = "/sys/fs/cgroup"
+// CgroupV2Mount is the cgroup v2 hierarchy mount point. The daemon sets it
+// from DetectCgroupLayout at startup. Overridable in tests.
+var CgroupV2Mount = CgroupRoot
 
-// PodUIDFromCgroupID walks the cgroup v2 hierarchy looking for the directory
-// whose inode equals the given cgroup id (which is what
-// bpf_get_current_cgroup_id() reports), and extracts the pod UID from the
-// matching path. The cgroup ID is namespace-independent and unique to a live
+// IdentityFromCgroupID walks the cgroup v2 hierarchy looking for the
+// directory whose inode equals the given cgroup id (which is what
+// bpf_get_current_cgroup_id() reports), and extracts the pod UID and the
+// container ID from the matching path. The cgroup ID is namespace-independent and unique to a live
 // pod cgroup, so this resolves the connecting process to its pod without any
 // PID-namespace translation.
-func PodUIDFromCgroupID(cgid uint64) (string, error) {
-	var found string
+func IdentityFromCgroupID(cgid uint64) (Identity, error) {
+	var found *Identity
 	err := filepath.WalkDir(CgroupV2Mount, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			// Skip permission errors / transient races.
@@ -107,18 +186,18 @@ func PodUIDFromCgroupID(cgid uint64) (string, error) {
 		if stat.Ino != cgid {
 			return nil
 		}
-		match := podUIDPattern.FindStringSubmatch(path)
-		if match == nil {
+		id, ok := identityFromCgroupPath(path)
+		if !ok {
 			return fmt.Errorf("cgroup id %d resolved to path %q, which is not under a kubepods pod cgroup", cgid, path)
 		}
-		found = strings.ReplaceAll(match[1], "_", "-")
+		found = &id
 		return fs.SkipAll
 	})
 	if err != nil {
-		return "", err
+		return Identity{}, err
 	}
-	if found == "" {
-		return "", fmt.Errorf("cgroup id %d not found under %s", cgid, CgroupV2Mount)
+	if found == nil {
+		return Identity{}, fmt.Errorf("cgroup id %d not found under %s", cgid, CgroupV2Mount)
 	}
-	return found, nil
+	return *found, nil
 }
@@ -0,0 +1,129 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package sockdiag
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Sizes and offsets of the INET_DIAG structures, see linux/inet_diag.h.
+const (
+	sizeofInetDiagReqV2 = 56
+	sizeofInetDiagMsg   = 72
+	inetDiagMsgInodeOff = 68
+	sizeofRtAttr        = 4
+
+	// inetDiagCgroupID is the INET_DIAG_CGROUP_ID attribute carrying the
+	// cgroup ID of the socket (Linux 5.7+).
+	inetDiagCgroupID = 21
+
+	inetDiagNoCookie = ^uint32(0)
+)
+
+// diagSocket is the part of an INET_DIAG response that we need.
+type diagSocket struct {
+	inode       uint32
+	cgroupID    uint64
+	hasCgroupID bool
+}
+
+// querySocket asks the kernel for the TCP socket with the given 4-tuple via
+// netlink INET_DIAG. Returns ErrNotFound if there is no such socket.
+func querySocket(src, dst netip.AddrPort) (*diagSocket, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_INET_DIAG)
+	if err != nil {
+		return nil, fmt.Errorf("creating netlink socket: %w", err)
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("binding netlink socket: %w", err)
+	}
+
+	if err := unix.Sendto(fd, inetDiagRequest(src, dst), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("sending inet_diag request: %w", err)
+	}
+	buf := make([]byte, 8192)
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return nil, fmt.Errorf("receiving inet_diag response: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("parsing inet_diag response: %w", err)
+	}
+
+	for _, m := range msgs {
+		switch m.Header.Type {
+		case unix.NLMSG_ERROR:
+			if len(m.Data) < 4 {
+				return nil, errors.New("short netlink error message")
+			}
+			errno := syscall.Errno(-int32(binary.NativeEndian.Uint32(m.Data[:4])))
+			if errno == 0 {
+				continue
+			}
+			if errno == syscall.ENOENT {
+				return nil, ErrNotFound
+			}
+			return nil, fmt.Errorf("inet_diag request failed: %w", errno)
+		case unix.SOCK_DIAG_BY_FAMILY:
+			return parseInetDiagMsg(m.Data)
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// inetDiagRequest builds a netlink message with an inet_diag_req_v2 that
+// looks up the exact IPv4 TCP socket identified by the 4-tuple.
+func inetDiagRequest(src, dst netip.AddrPort) []byte {
+	req := make([]byte, unix.SizeofNlMsghdr+sizeofInetDiagReqV2)
+	binary.NativeEndian.PutUint32(req[0:4], uint32(len(req)))
+	binary.NativeEndian.PutUint16(req[4:6], unix.SOCK_DIAG_BY_FAMILY)
+	binary.NativeEndian.PutUint16(req[6:8], unix.NLM_F_REQUEST)
+	binary.NativeEndian.PutUint32(req[8:12], 1) // sequence number
+
+	body := req[unix.SizeofNlMsghdr:]
+	body[0] = unix.AF_INET
+	body[1] = unix.IPPROTO_TCP
+	binary.NativeEndian.PutUint32(body[4:8], ^uint32(0)) // all states
+
+	// struct inet_diag_sockid: ports and addresses in network byte order.
+	id := body[8:]
+	binary.BigEndian.PutUint16(id[0:2], src.Port())
+	binary.BigEndian.PutUint16(id[2:4], dst.Port())
+	srcIP, dstIP := src.Addr().As4(), dst.Addr().As4()
+	copy(id[4:8], srcIP[:])
+	copy(id[20:24], dstIP[:])
+	binary.NativeEndian.PutUint32(id[40:44], inetDiagNoCookie)
+	binary.NativeEndian.PutUint32(id[44:48], inetDiagNoCookie)
+	return req
+}
+
+// parseInetDiagMsg parses an inet_diag_msg followed by its attributes.
+func parseInetDiagMsg(b []byte) (*diagSocket, error) {
+	if len(b) < sizeofInetDiagMsg {
+		return nil, fmt.Errorf("short inet_diag message: %d bytes", len(b))
+	}
+	s := &diagSocket{inode: binary.NativeEndian.Uint32(b[inetDiagMsgInodeOff:])}
+	attrs := b[sizeofInetDiagMsg:]
+	for len(attrs) >= sizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(attrs[0:2]))
+		typ := binary.NativeEndian.Uint16(attrs[2:4])
+		if l < sizeofRtAttr || l > len(attrs) {
+			return nil, fmt.Errorf("malformed inet_diag attribute of length %d", l)
+		}
+		if typ == inetDiagCgroupID && l >= sizeofRtAttr+8 {
+			s.cgroupID = binary.NativeEndian.Uint64(attrs[sizeofRtAttr:])
+			s.hasCgroupID = true
+		}
+		attrs = attrs[min((l+unix.NLA_ALIGNTO-1)&^(unix.NLA_ALIGNTO-1), len(attrs)):]
+	}
+	return s, nil
+}
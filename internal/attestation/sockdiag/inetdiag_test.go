@@ -0,0 +1,50 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package sockdiag
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuerySocket(t *testing.T) {
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	conn, err := net.Dial("tcp4", lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	local := conn.LocalAddr().(*net.TCPAddr).AddrPort()
+	remote := conn.RemoteAddr().(*net.TCPAddr).AddrPort()
+	sock, err := querySocket(netip.AddrPortFrom(local.Addr().Unmap(), local.Port()),
+		netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port()))
+	require.NoError(t, err)
+	assert.NotZero(t, sock.inode)
+
+	_, err = querySocket(netip.MustParseAddrPort("127.0.0.1:1"), netip.MustParseAddrPort("127.0.0.1:2"))
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestParseInetDiagMsg(t *testing.T) {
+	b := make([]byte, sizeofInetDiagMsg)
+	b[inetDiagMsgInodeOff] = 42
+	// An unrelated 5-byte attribute (padded to 8), then the cgroup ID.
+	b = append(b, 5, 0, 8, 0, 1, 0, 0, 0)
+	b = append(b, 12, 0, inetDiagCgroupID, 0, 7, 0, 0, 0, 0, 0, 0, 0)
+
+	sock, err := parseInetDiagMsg(b)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(42), sock.inode)
+	assert.True(t, sock.hasCgroupID)
+	assert.Equal(t, uint64(7), sock.cgroupID)
+
+	_, err = parseInetDiagMsg(b[:10])
+	assert.Error(t, err)
+}
@@ -6,24 +6,27 @@
 //
 // Both endpoints of a hostNetwork pod's TCP connection live in the host
 // network namespace, so the active-side socket is visible to a netlink
-// SOCK_DIAG query on the host. We resolve the connection's 4-tuple to the
-// owning socket's inode, walk /proc/<pid>/fd to find the process that holds
-// an fd backed by that inode, then read /proc/<pid>/cgroup and extract the
-// pod UID from the kubelet's `pod<UID>` cgroup naming convention.
+// INET_DIAG query on the host. On Linux 5.7+ the kernel reports the cgroup
+// ID of the socket in the response, which is resolved to the pod UID through
+// the cgroup index (see attestation.CgroupIndex). On older kernels we fall
+// back to resolving the socket's inode to its owner by walking
+// /proc/<pid>/fd, then read /proc/<pid>/cgroup. The same fallback is used
+// on nodes without a cgroup v2 hierarchy, where the socket cgroup ID is
+// meaningless, and when the index does not resolve the socket cgroup ID to
+// a pod, e.g. on hybrid nodes whose v2 cgroup of the process is a shared
+// host cgroup while its v1 controller cgroups are the pod's. Either way the
+// pod UID comes from the kubelet's `pod<UID>` cgroup naming convention.
 package sockdiag
 
 import (
 	"errors"
 	"fmt"
-	"net"
 	"net/netip"
 	"os"
 	"path/filepath"
 	"strconv"
 
 	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
-
-	"github.com/vishvananda/netlink"
 )
 
 // ErrNotFound mirrors the eBPF map's contract: returned when the connection
@@ -32,11 +35,24 @@ import (
 var ErrNotFound = errors.New("sockdiag: 4-tuple not in host socket table")
 
 // Lookuper resolves a connection 4-tuple to the kubernetes pod UID of the
-// owning process via netlink SOCK_DIAG plus a /proc walk.
-type Lookuper struct{}
+// owning process via netlink INET_DIAG plus the cgroup index, or a /proc
+// walk when the socket cgroup ID is not reported or not resolved to a pod.
+type Lookuper struct {
+	index *attestation.CgroupIndex // nil without a cgroup v2 hierarchy
+}
 
-// New constructs a Lookuper. Stateless; safe to share across goroutines.
-func New() *Lookuper { return &Lookuper{} }
+// Options configures New.
+type Options struct {
+	// CgroupIndex resolves the socket cgroup IDs to pods. Nil when the node
+	// has no cgroup v2 hierarchy, in which case sockets are always resolved
+	// through /proc. Owned by the caller.
+	CgroupIndex *attestation.CgroupIndex
+}
+
+// New constructs a Lookuper. Safe to share across goroutines.
+func New(opts Options) *Lookuper {
+	return &Lookuper{index: opts.CgroupIndex}
+}
 
 // Verify is a no-op for the netlink path — sockdiag is a stateless query
 // against the host's live socket table, with no asynchronous capture step
@@ -46,34 +62,57 @@ func (l *Lookuper) Verify(srcIP, dstIP netip.Addr, srcPort, dstPort uint16) erro
 }
 
 // Lookup implements server.AttestationLookuper.
-func (l *Lookuper) Lookup(srcIP, dstIP netip.Addr, srcPort, dstPort uint16) (string, error) {
-	local := &net.TCPAddr{IP: srcIP.AsSlice(), Port: int(srcPort)}
-	remote := &net.TCPAddr{IP: dstIP.AsSlice(), Port: int(dstPort)}
+func (l *Lookuper) Lookup(srcIP, dstIP netip.Addr, srcPort, dstPort uint16) (attestation.Identity, error) {
+	local := netip.AddrPortFrom(srcIP, srcPort)
+	remote := netip.AddrPortFrom(dstIP, dstPort)
 
-	sock, err := netlink.SocketGet(local, remote)
+	sock, err := querySocket(local, remote)
 	if err != nil {
-		return "", fmt.Errorf("netlink SocketGet for %s -> %s: %w", local, remote, err)
+		if errors.Is(err, ErrNotFound) {
+			return attestation.Identity{}, err
+		}
+		return attestation.Identity{}, fmt.Errorf("netlink inet_diag for %s -> %s: %w", local, remote, err)
 	}
-	if sock.INode == 0 {
-		return "", ErrNotFound
+
+	var indexErr error
+	if sock.hasCgroupID && l.index != nil {
+		id, err := l.index.Identity(sock.cgroupID)
+		if err == nil {
+			return id, nil
+		}
+		indexErr = fmt.Errorf("resolving pod from cgroup id %d: %w", sock.cgroupID, err)
+	}
+
+	// The cgroup v1 paths of the owner are only visible through /proc.
+	id, err := lookupProc(sock)
+	if err != nil && indexErr != nil {
+		return attestation.Identity{}, fmt.Errorf("%w, falling back to /proc: %w", indexErr, err)
+	}
+	return id, err
+}
+
+// lookupProc resolves the owner of the socket through its inode and /proc.
+func lookupProc(sock *diagSocket) (attestation.Identity, error) {
+	if sock.inode == 0 {
+		return attestation.Identity{}, ErrNotFound
 	}
 
-	pid, err := pidForSocketInode(uint64(sock.INode))
+	pid, err := pidForSocketInode(uint64(sock.inode))
 	if err != nil {
-		return "", err
+		return attestation.Identity{}, err
 	}
 
-	uid, err := attestation.PodUIDFromCgroup(pid)
+	id, err := attestation.IdentityFromCgroup(pid)
 	if err != nil {
-		return "", fmt.Errorf("resolving pod uid for pid %d: %w", pid, err)
+		return attestation.Identity{}, fmt.Errorf("resolving pod uid for pid %d: %w", pid, err)
 	}
-	return uid, nil
+	return id, nil
 }
 
 // pidForSocketInode walks /proc/<pid>/fd looking for a symlink to
-// "socket:[<inode>]". O(processes * fds-per-process) — acceptable for an
-// occasional metadata request handler, but worth caching if the call rate
-// ever grows.
+// "socket:[<inode>]". O(processes * fds-per-process), only used when the
+// socket cgroup ID is not reported (kernels older than 5.7) or not resolved
+// by the cgroup index.
 func pidForSocketInode(inode uint64) (int, error) {
 	target := fmt.Sprintf("socket:[%d]", inode)
 
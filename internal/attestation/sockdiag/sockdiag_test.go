@@ -0,0 +1,68 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package sockdiag
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Hybrid layout: the v2 cgroup of the process is a shared host cgroup, the
+// v1 controller cgroups are the pod's.
+const cgroupHybrid = `4:cpu,cpuacct:/kubepods/besteffort/pod12345678-1234-1234-1234-123456789abc/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+0::/system.slice/containerd.service
+`
+
+func TestLookupFallsBackToProc(t *testing.T) {
+	// An empty v2 hierarchy, so the index resolves no socket cgroup to a pod.
+	oldMount := attestation.CgroupV2Mount
+	attestation.CgroupV2Mount = t.TempDir()
+	t.Cleanup(func() { attestation.CgroupV2Mount = oldMount })
+	index, err := attestation.NewCgroupIndex(attestation.CgroupIndexOptions{})
+	require.NoError(t, err)
+	defer index.Close()
+
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	conn, err := net.Dial("tcp4", lis.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.TCPAddr).AddrPort()
+	remote := conn.RemoteAddr().(*net.TCPAddr).AddrPort()
+	localAddr, remoteAddr := local.Addr().Unmap(), remote.Addr().Unmap()
+	sock, err := querySocket(netip.AddrPortFrom(localAddr, local.Port()), netip.AddrPortFrom(remoteAddr, remote.Port()))
+	require.NoError(t, err)
+
+	// A fake /proc where a process with the hybrid cgroups owns the socket.
+	oldProc := attestation.ProcRoot
+	attestation.ProcRoot = t.TempDir()
+	t.Cleanup(func() { attestation.ProcRoot = oldProc })
+	pidDir := filepath.Join(attestation.ProcRoot, "42")
+	require.NoError(t, os.MkdirAll(filepath.Join(pidDir, "fd"), 0o755))
+	require.NoError(t, os.Symlink(fmt.Sprintf("socket:[%d]", sock.inode), filepath.Join(pidDir, "fd", "3")))
+	require.NoError(t, os.WriteFile(filepath.Join(pidDir, "cgroup"), []byte(cgroupHybrid), 0o644))
+
+	l := New(Options{CgroupIndex: index})
+	id, err := l.Lookup(localAddr, remoteAddr, local.Port(), remote.Port())
+	require.NoError(t, err)
+	assert.Equal(t, "12345678-1234-1234-1234-123456789abc", id.PodUID)
+
+	// Without an owner in /proc both errors are reported.
+	require.NoError(t, os.RemoveAll(pidDir))
+	_, err = l.Lookup(localAddr, remoteAddr, local.Port(), remote.Port())
+	assert.ErrorIs(t, err, ErrNotFound)
+	if sock.hasCgroupID {
+		assert.Contains(t, err.Error(), "falling back to /proc")
+	}
+}
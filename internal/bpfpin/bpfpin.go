@@ -0,0 +1,221 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+// Package bpfpin pins eBPF maps and cgroup links in bpffs so that the
+// daemon's programs stay attached while the daemon itself is restarted or
+// upgraded. A new daemon instance adopts the objects pinned by the previous
+// one instead of attaching from scratch, and the previous instance leaves
+// them in place on shutdown once it detects that a successor took over.
+package bpfpin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+)
+
+// DefaultPath is the default bpffs directory where the daemon pins its
+// eBPF objects.
+const DefaultPath = "/sys/fs/bpf/gke-metadata-server"
+
+const linkPinPrefix = "link_"
+
+// Link is a cgroup link that is optionally pinned in bpffs.
+type Link struct {
+	link    link.Link
+	prog    *ebpf.Program
+	pinPath string
+	adopted bool
+}
+
+// Load loads the eBPF objects described by spec into objs. When dir is
+// not empty, maps are pinned by name under dir and maps already pinned
+// there by a previous daemon instance are reused, so their state survives
+// the handoff. Pinned maps that are incompatible with spec (e.g. after an
+// upgrade changed their definition) are replaced. When dir is empty,
+// nothing is pinned. The maps in replacements, e.g. loaded with LoadMap,
+// are used instead of the maps of spec with the same name.
+func Load(spec *ebpf.CollectionSpec, dir string, objs any, replacements map[string]*ebpf.Map) error {
+	for _, m := range spec.Maps {
+		if dir == "" {
+			m.Pinning = ebpf.PinNone
+		} else if !strings.HasPrefix(m.Name, ".") { // skip global data sections
+			m.Pinning = ebpf.PinByName
+		}
+	}
+	opts := &ebpf.CollectionOptions{MapReplacements: replacements}
+	if dir == "" {
+		return spec.LoadAndAssign(objs, opts)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("error creating bpffs pin directory %q: %w", dir, err)
+	}
+	opts.Maps.PinPath = dir
+	err := spec.LoadAndAssign(objs, opts)
+	if !errors.Is(err, ebpf.ErrMapIncompatible) {
+		return err
+	}
+	if err := removeMapPins(dir); err != nil {
+		return err
+	}
+	return spec.LoadAndAssign(objs, opts)
+}
+
+// LoadMap creates the map described by spec, pinned by name under dir, or
+// reuses the map already pinned there by a previous daemon instance. A
+// pinned map that is incompatible with spec is replaced. When dir is empty,
+// the map is not pinned.
+func LoadMap(spec *ebpf.MapSpec, dir string) (*ebpf.Map, error) {
+	spec = spec.Copy()
+	if dir == "" {
+		spec.Pinning = ebpf.PinNone
+		return ebpf.NewMap(spec)
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating bpffs pin directory %q: %w", dir, err)
+	}
+	spec.Pinning = ebpf.PinByName
+	opts := ebpf.MapOptions{PinPath: dir}
+	m, err := ebpf.NewMapWithOptions(spec, opts)
+	if !errors.Is(err, ebpf.ErrMapIncompatible) {
+		return m, err
+	}
+	if err := os.Remove(filepath.Join(dir, spec.Name)); err != nil {
+		return nil, fmt.Errorf("error removing incompatible pinned map %q: %w", spec.Name, err)
+	}
+	return ebpf.NewMapWithOptions(spec, opts)
+}
+
+// RemovePins removes the pins with the given names under dir, if present.
+// Removing the pin of a link detaches it once no process holds it anymore.
+func RemovePins(dir string, names ...string) error {
+	var errs []error
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("error removing pin %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LinkPinName returns the name of the pin of the link with the given name,
+// see AttachCgroup.
+func LinkPinName(name string) string {
+	return linkPinPrefix + name
+}
+
+// removeMapPins removes the map pins under dir, leaving the link pins
+// alone so the programs stay attached.
+func removeMapPins(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading bpffs pin directory %q: %w", dir, err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), linkPinPrefix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			return fmt.Errorf("error removing incompatible pinned map %q: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+// UnpinMaps removes the bpffs pins of the given maps.
+func UnpinMaps(maps ...*ebpf.Map) error {
+	var errs []error
+	for _, m := range maps {
+		if m == nil || !m.IsPinned() {
+			continue
+		}
+		if err := m.Unpin(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AttachCgroup attaches prog to the given cgroup. When dir is not empty
+// the link is pinned under dir with the given name. If a previous daemon
+// instance already pinned a link there, the link is adopted and atomically
+// updated to run prog, so the hook is never detached during the handoff.
+func AttachCgroup(dir, name, cgroupPath string, attach ebpf.AttachType, prog *ebpf.Program) (*Link, error) {
+	l := &Link{prog: prog}
+	if dir != "" {
+		l.pinPath = filepath.Join(dir, LinkPinName(name))
+		pinned, err := link.LoadPinnedLink(l.pinPath, nil)
+		switch {
+		case err == nil:
+			if err := pinned.Update(prog); err != nil {
+				pinned.Close()
+				return nil, fmt.Errorf("error updating program of pinned link %q: %w", l.pinPath, err)
+			}
+			l.link = pinned
+			l.adopted = true
+			return l, nil
+		case !errors.Is(err, os.ErrNotExist):
+			return nil, fmt.Errorf("error loading pinned link %q: %w", l.pinPath, err)
+		}
+	}
+
+	lnk, err := link.AttachCgroup(link.CgroupOptions{
+		Path:    cgroupPath,
+		Attach:  attach,
+		Program: prog,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if l.pinPath != "" {
+		if err := lnk.Pin(l.pinPath); err != nil {
+			lnk.Close()
+			return nil, fmt.Errorf("error pinning link at %q (bpf links require Linux 5.7+): %w", l.pinPath, err)
+		}
+	}
+	l.link = lnk
+	return l, nil
+}
+
+// Adopted reports whether the link was pinned by a previous daemon
+// instance and adopted by this one.
+func (l *Link) Adopted() bool {
+	return l.adopted
+}
+
+// HandedOff reports whether a successor daemon instance took over the
+// link, i.e. the pinned link is now running a program other than ours.
+func (l *Link) HandedOff() bool {
+	if l.pinPath == "" {
+		return false
+	}
+	info, err := l.link.Info()
+	if err != nil {
+		return false
+	}
+	progInfo, err := l.prog.Info()
+	if err != nil {
+		return false
+	}
+	id, ok := progInfo.ID()
+	return ok && info.Program != id
+}
+
+// Close releases the link. If a successor took over (see HandedOff) the
+// pin is kept and the program stays attached. Otherwise the link is
+// unpinned and detached.
+func (l *Link) Close() error {
+	if l.pinPath != "" && !l.HandedOff() {
+		if err := l.link.Unpin(); err != nil {
+			return errors.Join(fmt.Errorf("error unpinning link %q: %w", l.pinPath, err), l.link.Close())
+		}
+	}
+	return l.link.Close()
+}
@@ -4,26 +4,56 @@
 package googlecredentials
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"regexp"
+	"strings"
 
+	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google/externalaccount"
+	"google.golang.org/api/googleapi"
 )
 
 type (
 	Config struct {
-		opts ConfigOptions
+		opts                 ConfigOptions
+		numericProjectID     string
+		workloadIdentityPool string
 	}
 
 	ConfigOptions struct {
 		WorkloadIdentityProvider string
+
+		// UniverseDomain is the domain of the Google Cloud universe, e.g. a
+		// sovereign cloud. The default endpoints are derived from it.
+		UniverseDomain string // default: DefaultUniverseDomain
+
+		// Google endpoints, e.g. for Private Service Connect or local fakes.
+		TokenURL              string // default: https://sts.<universe-domain>/v1/token
+		TokenInfoURL          string // default: https://sts.<universe-domain>/v1/introspect
+		ImpersonationEndpoint string // default: https://iamcredentials.<universe-domain>
+		IDTokenEndpoint       string // default: https://iamcredentials.<universe-domain>
+
+		// Transport of the calls to the Google APIs, e.g. a *Transport for
+		// retries and circuit breaking.
+		Transport http.RoundTripper // default: http.DefaultTransport
 	}
 
 	tokenSupplier string
 )
 
+const DefaultUniverseDomain = "googleapis.com"
+
+// QuotaProjectHeader is the header billing a request to a quota project
+// instead of the project of the credentials.
+const QuotaProjectHeader = "x-goog-user-project"
+
 var workloadIdentityProviderRegex = regexp.MustCompile(`^projects/(\d+)/locations/global/workloadIdentityPools/([^/]+)/providers/[^/]+$`)
 
 func AccessScopes() []string {
@@ -40,37 +70,91 @@ func NewConfig(opts ConfigOptions) (*Config, string, string, error) {
 	}
 	numericProjectID := workloadIdentityProviderRegex.FindStringSubmatch(opts.WorkloadIdentityProvider)[1]
 	workloadIdentityPool := workloadIdentityProviderRegex.FindStringSubmatch(opts.WorkloadIdentityProvider)[2]
-	return &Config{opts}, numericProjectID, workloadIdentityPool, nil
+	if opts.UniverseDomain == "" {
+		opts.UniverseDomain = DefaultUniverseDomain
+	}
+	if opts.TokenURL == "" {
+		opts.TokenURL = fmt.Sprintf("https://sts.%s/v1/token", opts.UniverseDomain)
+	}
+	if opts.TokenInfoURL == "" {
+		opts.TokenInfoURL = fmt.Sprintf("https://sts.%s/v1/introspect", opts.UniverseDomain)
+	}
+	if opts.ImpersonationEndpoint == "" {
+		opts.ImpersonationEndpoint = fmt.Sprintf("https://iamcredentials.%s", opts.UniverseDomain)
+	}
+	if opts.IDTokenEndpoint == "" {
+		opts.IDTokenEndpoint = fmt.Sprintf("https://iamcredentials.%s", opts.UniverseDomain)
+	}
+	for name, v := range map[string]string{
+		"token url":              opts.TokenURL,
+		"token info url":         opts.TokenInfoURL,
+		"impersonation endpoint": opts.ImpersonationEndpoint,
+		"id token endpoint":      opts.IDTokenEndpoint,
+	} {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, "", "", fmt.Errorf("invalid %s %q: must be an absolute http(s) url", name, v)
+		}
+	}
+	opts.ImpersonationEndpoint = strings.TrimSuffix(opts.ImpersonationEndpoint, "/")
+	opts.IDTokenEndpoint = strings.TrimSuffix(opts.IDTokenEndpoint, "/")
+	c := &Config{
+		opts:                 opts,
+		numericProjectID:     numericProjectID,
+		workloadIdentityPool: workloadIdentityPool,
+	}
+	return c, numericProjectID, workloadIdentityPool, nil
+}
+
+// WorkloadIdentityProvider returns the full name of the workload identity provider.
+func (c *Config) WorkloadIdentityProvider() string {
+	return c.opts.WorkloadIdentityProvider
+}
+
+// NumericProjectID returns the number of the project of the workload identity provider.
+func (c *Config) NumericProjectID() string {
+	return c.numericProjectID
+}
+
+// WorkloadIdentityPool returns the short name of the workload identity pool.
+func (c *Config) WorkloadIdentityPool() string {
+	return c.workloadIdentityPool
+}
+
+// UniverseDomain returns the domain of the Google Cloud universe.
+func (c *Config) UniverseDomain() string {
+	return c.opts.UniverseDomain
 }
 
 func (c *Config) WorkloadIdentityProviderAudience() string {
 	return fmt.Sprintf("//iam.googleapis.com/%s", c.opts.WorkloadIdentityProvider)
 }
 
+// NewToken exchanges the subject token for a Google access token with STS,
+// impersonating the given Google Service Account if any. The upstream calls
+// are billed to the quota project if not empty.
 func (c *Config) NewToken(ctx context.Context, subjectToken string,
-	googleServiceAccountEmail *string, scopes []string) (*oauth2.Token, error) {
+	googleServiceAccountEmail *string, scopes []string, quotaProject string) (*oauth2.Token, error) {
 
 	if len(scopes) == 0 {
 		scopes = AccessScopes()
 	}
 
 	conf := externalaccount.Config{
-		UniverseDomain:       "googleapis.com",
+		UniverseDomain:       c.opts.UniverseDomain,
 		Audience:             c.WorkloadIdentityProviderAudience(),
 		SubjectTokenType:     "urn:ietf:params:oauth:token-type:jwt",
-		TokenURL:             "https://sts.googleapis.com/v1/token",
+		TokenURL:             c.opts.TokenURL,
 		Scopes:               scopes,
 		SubjectTokenSupplier: tokenSupplier(subjectToken),
 	}
 
 	if googleServiceAccountEmail != nil {
-		conf.ServiceAccountImpersonationURL = fmt.Sprintf(
-			"https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/%s:generateAccessToken",
-			*googleServiceAccountEmail)
+		conf.ServiceAccountImpersonationURL = serviceAccountURL(c.opts.ImpersonationEndpoint, *googleServiceAccountEmail, "generateAccessToken")
 	} else {
-		conf.TokenInfoURL = "https://sts.googleapis.com/v1/introspect"
+		conf.TokenInfoURL = c.opts.TokenInfoURL
 	}
 
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c.httpClient(quotaProject))
 	src, err := externalaccount.NewTokenSource(ctx, conf)
 	if err != nil {
 		return nil, err
@@ -84,6 +168,93 @@ func (c *Config) NewToken(ctx context.Context, subjectToken string,
 	return token, nil
 }
 
+// NewIDToken generates an ID token for the given Google Service Account
+// with the IAM Credentials API, authenticated by the given access token.
+// The call is billed to the quota project if not empty. The expiration of
+// the token is read from its exp claim.
+// Non-2xx responses are returned as *googleapi.Error.
+func (c *Config) NewIDToken(ctx context.Context, accessToken, googleServiceAccountEmail,
+	audience, quotaProject string) (*oauth2.Token, error) {
+
+	reqBody, err := json.Marshal(map[string]any{
+		"audience":     audience,
+		"includeEmail": true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling id token request: %w", err)
+	}
+	reqURL := serviceAccountURL(c.opts.IDTokenEndpoint, googleServiceAccountEmail, "generateIdToken")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("error creating id token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := c.httpClient(quotaProject).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error generating id token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("error reading id token response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &googleapi.Error{
+			Code:   resp.StatusCode,
+			Body:   string(body),
+			Header: resp.Header,
+		}
+	}
+	var respBody struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &respBody); err != nil {
+		return nil, fmt.Errorf("error unmarshaling id token response: %w", err)
+	}
+	var claims jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(respBody.Token, &claims); err != nil {
+		return nil, fmt.Errorf("error parsing id token: %w", err)
+	}
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("id token has no exp claim")
+	}
+	return &oauth2.Token{
+		AccessToken: respBody.Token,
+		Expiry:      claims.ExpiresAt.Time,
+	}, nil
+}
+
+func serviceAccountURL(endpoint, googleServiceAccountEmail, method string) string {
+	return fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:%s",
+		endpoint, googleServiceAccountEmail, method)
+}
+
+// httpClient returns the client of the calls to the Google APIs, which sends
+// the quota project header if not empty. The oauth2 package uses the client
+// for the STS and impersonation calls when set in the context.
+func (c *Config) httpClient(quotaProject string) *http.Client {
+	transport := c.opts.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if quotaProject != "" {
+		transport = &quotaProjectTransport{transport, quotaProject}
+	}
+	return &http.Client{Transport: transport}
+}
+
+type quotaProjectTransport struct {
+	base         http.RoundTripper
+	quotaProject string
+}
+
+func (t *quotaProjectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(QuotaProjectHeader, t.quotaProject)
+	return t.base.RoundTrip(req)
+}
+
 func (s tokenSupplier) SubjectToken(ctx context.Context, options externalaccount.SupplierOptions) (string, error) {
 	return string(s), nil
 }
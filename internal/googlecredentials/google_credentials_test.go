@@ -0,0 +1,152 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package googlecredentials
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/googleapi"
+)
+
+const testProvider = "projects/123/locations/global/workloadIdentityPools/pool/providers/provider"
+
+func TestNewConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		opts    ConfigOptions
+		want    ConfigOptions
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			opts: ConfigOptions{WorkloadIdentityProvider: testProvider},
+			want: ConfigOptions{
+				WorkloadIdentityProvider: testProvider,
+				UniverseDomain:           "googleapis.com",
+				TokenURL:                 "https://sts.googleapis.com/v1/token",
+				TokenInfoURL:             "https://sts.googleapis.com/v1/introspect",
+				ImpersonationEndpoint:    "https://iamcredentials.googleapis.com",
+				IDTokenEndpoint:          "https://iamcredentials.googleapis.com",
+			},
+		},
+		{
+			name: "universe domain",
+			opts: ConfigOptions{
+				WorkloadIdentityProvider: testProvider,
+				UniverseDomain:           "example.cloud",
+			},
+			want: ConfigOptions{
+				WorkloadIdentityProvider: testProvider,
+				UniverseDomain:           "example.cloud",
+				TokenURL:                 "https://sts.example.cloud/v1/token",
+				TokenInfoURL:             "https://sts.example.cloud/v1/introspect",
+				ImpersonationEndpoint:    "https://iamcredentials.example.cloud",
+				IDTokenEndpoint:          "https://iamcredentials.example.cloud",
+			},
+		},
+		{
+			name: "private service connect",
+			opts: ConfigOptions{
+				WorkloadIdentityProvider: testProvider,
+				TokenURL:                 "https://sts-xyz.p.googleapis.com/v1/token",
+				ImpersonationEndpoint:    "https://iamcredentials-xyz.p.googleapis.com/",
+			},
+			want: ConfigOptions{
+				WorkloadIdentityProvider: testProvider,
+				UniverseDomain:           "googleapis.com",
+				TokenURL:                 "https://sts-xyz.p.googleapis.com/v1/token",
+				TokenInfoURL:             "https://sts.googleapis.com/v1/introspect",
+				ImpersonationEndpoint:    "https://iamcredentials-xyz.p.googleapis.com",
+				IDTokenEndpoint:          "https://iamcredentials.googleapis.com",
+			},
+		},
+		{
+			name:    "invalid provider",
+			opts:    ConfigOptions{WorkloadIdentityProvider: "pool/provider"},
+			wantErr: "workload identity provider name does not match pattern",
+		},
+		{
+			name: "relative url",
+			opts: ConfigOptions{
+				WorkloadIdentityProvider: testProvider,
+				IDTokenEndpoint:          "iamcredentials.googleapis.com",
+			},
+			wantErr: `invalid id token endpoint "iamcredentials.googleapis.com"`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, numericProjectID, pool, err := NewConfig(tt.opts)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, c.opts)
+			assert.Equal(t, "123", numericProjectID)
+			assert.Equal(t, "pool", pool)
+		})
+	}
+}
+
+func TestNewIDToken(t *testing.T) {
+	exp := time.Now().Add(30 * time.Minute).Truncate(time.Second)
+	var quotaProject string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		quotaProject = r.Header.Get(QuotaProjectHeader)
+		switch {
+		case r.Header.Get("Authorization") != "Bearer access-token":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v1/projects/-/serviceAccounts/denied@p.iam.gserviceaccount.com:generateIdToken":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":{"code":403}}`))
+		case r.URL.Path == "/v1/projects/-/serviceAccounts/noexp@p.iam.gserviceaccount.com:generateIdToken":
+			w.Write([]byte(`{"token":"` + idToken(t, jwt.MapClaims{"sub": r.URL.Path}) + `"}`))
+		default:
+			w.Write([]byte(`{"token":"` + idToken(t, jwt.MapClaims{"sub": r.URL.Path, "exp": exp.Unix()}) + `"}`))
+		}
+	}))
+	defer s.Close()
+
+	c, _, _, err := NewConfig(ConfigOptions{
+		WorkloadIdentityProvider: testProvider,
+		IDTokenEndpoint:          s.URL,
+	})
+	require.NoError(t, err)
+
+	token, err := c.NewIDToken(context.Background(), "access-token", "sa@p.iam.gserviceaccount.com", "aud", "")
+	require.NoError(t, err)
+	parsed, _, err := jwt.NewParser().ParseUnverified(token.AccessToken, jwt.MapClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "/v1/projects/-/serviceAccounts/sa@p.iam.gserviceaccount.com:generateIdToken", parsed.Claims.(jwt.MapClaims)["sub"])
+	assert.True(t, exp.Equal(token.Expiry))
+	assert.Empty(t, quotaProject)
+
+	_, err = c.NewIDToken(context.Background(), "access-token", "sa@p.iam.gserviceaccount.com", "aud", "quota-project")
+	require.NoError(t, err)
+	assert.Equal(t, "quota-project", quotaProject)
+
+	_, err = c.NewIDToken(context.Background(), "access-token", "noexp@p.iam.gserviceaccount.com", "aud", "")
+	assert.ErrorContains(t, err, "id token has no exp claim")
+
+	_, err = c.NewIDToken(context.Background(), "access-token", "denied@p.iam.gserviceaccount.com", "aud", "")
+	var apiErr *googleapi.Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusForbidden, apiErr.Code)
+	assert.Equal(t, `{"error":{"code":403}}`, apiErr.Body)
+}
+
+// idToken returns an unsigned JWT with the given claims.
+func idToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	require.NoError(t, err)
+	return token
+}
@@ -0,0 +1,114 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package googlecredentials
+
+import (
+	"errors"
+	"fmt"
+)
+
+type (
+	// Providers holds a Config for each of the workload identity providers
+	// allowed for the Kubernetes ServiceAccounts of the cluster, and selects
+	// the one of a given ServiceAccount, see Get.
+	Providers struct {
+		defaultConfig *Config
+		configs       map[string]*Config // all the providers, by name
+		selectable    map[string]*Config // the providers ServiceAccounts may select, by name
+		byNamespace   map[string]*Config
+	}
+
+	ProvidersOptions struct {
+		// ConfigOptions is the Config of the default workload identity
+		// provider. The other providers share its universe and endpoints.
+		ConfigOptions
+
+		// Additional workload identity providers that the ServiceAccounts
+		// of the namespaces not in Namespaces may select by name.
+		Additional []string
+
+		// Namespaces maps namespaces to the workload identity provider of
+		// their ServiceAccounts, which cannot select another one. The
+		// providers are allowed only for their namespaces.
+		Namespaces map[string]string
+	}
+)
+
+// ErrWorkloadIdentityProviderNotAllowed is returned by Providers.Get when a
+// ServiceAccount selects a workload identity provider that is not configured.
+var ErrWorkloadIdentityProviderNotAllowed = errors.New("workload identity provider is not allowed")
+
+func NewProviders(opts ProvidersOptions) (*Providers, error) {
+	p := &Providers{
+		configs:     make(map[string]*Config),
+		selectable:  make(map[string]*Config),
+		byNamespace: make(map[string]*Config),
+	}
+	add := func(provider string) (*Config, error) {
+		if c, ok := p.configs[provider]; ok {
+			return c, nil
+		}
+		copts := opts.ConfigOptions
+		copts.WorkloadIdentityProvider = provider
+		c, _, _, err := NewConfig(copts)
+		if err != nil {
+			return nil, fmt.Errorf("error creating config for workload identity provider %q: %w", provider, err)
+		}
+		p.configs[provider] = c
+		return c, nil
+	}
+	var err error
+	if p.defaultConfig, err = add(opts.WorkloadIdentityProvider); err != nil {
+		return nil, err
+	}
+	p.selectable[opts.WorkloadIdentityProvider] = p.defaultConfig
+	for _, provider := range opts.Additional {
+		c, err := add(provider)
+		if err != nil {
+			return nil, err
+		}
+		p.selectable[provider] = c
+	}
+	for namespace, provider := range opts.Namespaces {
+		c, err := add(provider)
+		if err != nil {
+			return nil, err
+		}
+		p.byNamespace[namespace] = c
+	}
+	return p, nil
+}
+
+// Default returns the Config of the default workload identity provider.
+func (p *Providers) Default() *Config {
+	return p.defaultConfig
+}
+
+// Multiple returns whether or not more than one workload identity provider
+// is configured, i.e. whether Get may return a Config other than Default.
+func (p *Providers) Multiple() bool {
+	return len(p.configs) > 1
+}
+
+// Get returns the Config of the workload identity provider of a ServiceAccount
+// of the given namespace, which may name a provider. The ServiceAccounts of a
+// namespace mapped to a provider always get that provider, and may only name
+// it. The other ServiceAccounts may name the default provider or one of the
+// additional providers, and get the default provider otherwise.
+func (p *Providers) Get(namespace, provider string) (*Config, error) {
+	if c, ok := p.byNamespace[namespace]; ok {
+		if provider != "" && provider != c.WorkloadIdentityProvider() {
+			return nil, fmt.Errorf("%w for namespace %s: %s", ErrWorkloadIdentityProviderNotAllowed, namespace, provider)
+		}
+		return c, nil
+	}
+	if provider == "" {
+		return p.defaultConfig, nil
+	}
+	c, ok := p.selectable[provider]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrWorkloadIdentityProviderNotAllowed, provider)
+	}
+	return c, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package googlecredentials
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProviders(t *testing.T) {
+	const (
+		tenantProvider = "projects/222/locations/global/workloadIdentityPools/tenant/providers/provider"
+		otherProvider  = "projects/333/locations/global/workloadIdentityPools/other/providers/provider"
+	)
+
+	p, err := NewProviders(ProvidersOptions{ConfigOptions: ConfigOptions{WorkloadIdentityProvider: testProvider}})
+	require.NoError(t, err)
+	assert.False(t, p.Multiple())
+
+	p, err = NewProviders(ProvidersOptions{
+		ConfigOptions: ConfigOptions{
+			WorkloadIdentityProvider: testProvider,
+			UniverseDomain:           "example.cloud",
+		},
+		Additional: []string{otherProvider},
+		Namespaces: map[string]string{"tenant": tenantProvider},
+	})
+	require.NoError(t, err)
+	assert.True(t, p.Multiple())
+
+	for _, tt := range []struct {
+		name           string
+		namespace      string
+		provider       string
+		wantProvider   string
+		wantNumericID  string
+		wantPool       string
+		wantNotAllowed bool
+	}{
+		{
+			name:          "default",
+			namespace:     "default",
+			wantProvider:  testProvider,
+			wantNumericID: "123",
+			wantPool:      "pool",
+		},
+		{
+			name:          "namespace",
+			namespace:     "tenant",
+			wantProvider:  tenantProvider,
+			wantNumericID: "222",
+			wantPool:      "tenant",
+		},
+		{
+			name:          "service account",
+			namespace:     "default",
+			provider:      otherProvider,
+			wantProvider:  otherProvider,
+			wantNumericID: "333",
+			wantPool:      "other",
+		},
+		{
+			name:          "service account selecting the default provider",
+			namespace:     "default",
+			provider:      testProvider,
+			wantProvider:  testProvider,
+			wantNumericID: "123",
+			wantPool:      "pool",
+		},
+		{
+			name:          "service account selecting the provider of its namespace",
+			namespace:     "tenant",
+			provider:      tenantProvider,
+			wantProvider:  tenantProvider,
+			wantNumericID: "222",
+			wantPool:      "tenant",
+		},
+		{
+			name:           "service account overriding its namespace",
+			namespace:      "tenant",
+			provider:       otherProvider,
+			wantNotAllowed: true,
+		},
+		{
+			name:           "service account selecting the provider of another namespace",
+			namespace:      "default",
+			provider:       tenantProvider,
+			wantNotAllowed: true,
+		},
+		{
+			name:           "not allowed",
+			namespace:      "default",
+			provider:       "projects/444/locations/global/workloadIdentityPools/x/providers/x",
+			wantNotAllowed: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := p.Get(tt.namespace, tt.provider)
+			if tt.wantNotAllowed {
+				require.ErrorIs(t, err, ErrWorkloadIdentityProviderNotAllowed)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantProvider, c.WorkloadIdentityProvider())
+			assert.Equal(t, tt.wantNumericID, c.NumericProjectID())
+			assert.Equal(t, tt.wantPool, c.WorkloadIdentityPool())
+			assert.Equal(t, "example.cloud", c.UniverseDomain())
+		})
+	}
+
+	_, err = NewProviders(ProvidersOptions{
+		ConfigOptions: ConfigOptions{WorkloadIdentityProvider: testProvider},
+		Namespaces:    map[string]string{"tenant": "pool/provider"},
+	})
+	assert.ErrorContains(t, err, `error creating config for workload identity provider "pool/provider"`)
+}
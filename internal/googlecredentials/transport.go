@@ -0,0 +1,343 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package googlecredentials
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matheuscscp/gke-metadata-server/internal/metrics"
+	"github.com/matheuscscp/gke-metadata-server/internal/retry"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type (
+	// Transport is the http.RoundTripper of the calls to the Google APIs. It
+	// retries transient failures with jittered exponential backoff, or after
+	// the delay of the Retry-After header, and fails the calls to an endpoint
+	// right away while its circuit breaker is open.
+	Transport struct {
+		opts        TransportOptions
+		failures    *prometheus.CounterVec
+		breakerOpen *prometheus.GaugeVec
+		rejections  *prometheus.CounterVec
+		breakersMu  sync.Mutex
+		breakers    map[string]*circuitBreaker
+	}
+
+	TransportOptions struct {
+		Base            http.RoundTripper // default: http.DefaultTransport
+		MetricsRegistry *prometheus.Registry
+
+		MaxAttempts       int           // default: 3
+		RetryInitialDelay time.Duration // default: 100 * time.Millisecond
+		RetryMaxDelay     time.Duration // default: 2 * time.Second
+
+		// CircuitBreakerThreshold is the number of consecutive calls to an
+		// endpoint failed by transient errors that opens its circuit breaker,
+		// counting each call once regardless of its retries. A 429 is the quota
+		// of the caller running out, e.g. of its quota project, not a failure
+		// of the endpoint, so it's not counted. While open,
+		// the calls to the endpoint are answered with a 503 without reaching
+		// it, until CircuitBreakerCooldown elapses and a single call probes
+		// the endpoint again. Negative disables the circuit breakers.
+		CircuitBreakerThreshold int           // default: 5
+		CircuitBreakerCooldown  time.Duration // default: 30 * time.Second
+	}
+
+	// circuitBreaker is the state of the circuit breaker of an endpoint.
+	circuitBreaker struct {
+		mu        sync.Mutex
+		failures  int
+		openUntil time.Time
+		probing   bool
+	}
+
+	transientStatusError struct {
+		code       int
+		retryAfter time.Duration
+	}
+)
+
+func NewTransport(opts TransportOptions) *Transport {
+	if opts.Base == nil {
+		opts.Base = http.DefaultTransport
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 3
+	}
+	if opts.RetryInitialDelay <= 0 {
+		opts.RetryInitialDelay = 100 * time.Millisecond
+	}
+	if opts.RetryMaxDelay <= 0 {
+		opts.RetryMaxDelay = 2 * time.Second
+	}
+	if opts.CircuitBreakerThreshold == 0 {
+		opts.CircuitBreakerThreshold = 5
+	}
+	if opts.CircuitBreakerCooldown <= 0 {
+		opts.CircuitBreakerCooldown = 30 * time.Second
+	}
+
+	failures := metrics.NewUpstreamFailuresCounter()
+	opts.MetricsRegistry.MustRegister(failures)
+	breakerOpen := metrics.NewUpstreamCircuitBreakerOpenGauge()
+	opts.MetricsRegistry.MustRegister(breakerOpen)
+	rejections := metrics.NewUpstreamCircuitBreakerRejectionsCounter()
+	opts.MetricsRegistry.MustRegister(rejections)
+
+	return &Transport{
+		opts:        opts,
+		failures:    failures,
+		breakerOpen: breakerOpen,
+		rejections:  rejections,
+		breakers:    make(map[string]*circuitBreaker),
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := req.URL.Host
+	breaker := t.breaker(endpoint)
+	if !breaker.allow(t.opts.CircuitBreakerThreshold) {
+		t.rejections.WithLabelValues(endpoint).Inc()
+		return circuitOpenResponse(req, endpoint), nil
+	}
+
+	maxAttempts := t.opts.MaxAttempts
+	if req.Body != nil && req.GetBody == nil {
+		maxAttempts = 1 // the body cannot be sent again
+	}
+
+	// the outcome of the last attempt is recorded in the circuit breaker once
+	// for the whole call
+	var resp *http.Response
+	var healthy, unhealthy bool
+	err := retry.Do(req.Context(), retry.Operation{
+		MaxAttempts:    maxAttempts,
+		InitialDelay:   t.opts.RetryInitialDelay,
+		MaxDelay:       t.opts.RetryMaxDelay,
+		Jitter:         true,
+		Description:    "call " + endpoint,
+		FailureCounter: t.failures.WithLabelValues(endpoint),
+		Func: func() error {
+			if resp != nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				resp = nil
+			}
+			healthy, unhealthy = false, false
+			attempt, err := rewind(req)
+			if err != nil {
+				return err
+			}
+			r, err := t.opts.Base.RoundTrip(attempt)
+			switch {
+			case err != nil && req.Context().Err() != nil:
+				return err
+			case err != nil:
+				unhealthy = true
+				return err
+			case isTransientStatus(r.StatusCode):
+				unhealthy = r.StatusCode != http.StatusTooManyRequests
+				resp = r
+				return &transientStatusError{r.StatusCode, retryAfter(r.Header)}
+			default:
+				healthy = true
+				resp = r
+				return nil
+			}
+		},
+		IsRetryable: func(err error) bool {
+			// the response is returned right away if the endpoint asks for
+			// waiting longer than the retries would
+			var tse *transientStatusError
+			if errors.As(err, &tse) && tse.retryAfter > t.opts.RetryMaxDelay {
+				return false
+			}
+			return req.Context().Err() == nil
+		},
+	})
+
+	switch {
+	case healthy:
+		if breaker.success(t.opts.CircuitBreakerThreshold) {
+			t.breakerOpen.WithLabelValues(endpoint).Set(0)
+		}
+	case unhealthy:
+		t.failure(breaker, endpoint)
+	default:
+		breaker.release()
+	}
+
+	// the response of the last attempt is returned even if it failed, so the
+	// caller sees the error of the endpoint
+	if resp != nil {
+		return resp, nil
+	}
+	return nil, err
+}
+
+func (t *Transport) breaker(endpoint string) *circuitBreaker {
+	if t.opts.CircuitBreakerThreshold < 0 {
+		return nil
+	}
+	t.breakersMu.Lock()
+	defer t.breakersMu.Unlock()
+	b, ok := t.breakers[endpoint]
+	if !ok {
+		b = &circuitBreaker{}
+		t.breakers[endpoint] = b
+		t.breakerOpen.WithLabelValues(endpoint).Set(0)
+	}
+	return b
+}
+
+func (t *Transport) failure(b *circuitBreaker, endpoint string) {
+	if b.failure(t.opts.CircuitBreakerThreshold, t.opts.CircuitBreakerCooldown) {
+		t.breakerOpen.WithLabelValues(endpoint).Set(1)
+	}
+}
+
+// allow reports whether a call may reach the endpoint. After the cooldown of
+// an open circuit breaker, only one call at a time is allowed to probe it.
+func (b *circuitBreaker) allow(threshold int) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success records a successful call and reports whether the circuit breaker
+// was closed by it.
+func (b *circuitBreaker) success(threshold int) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	wasOpen := b.failures >= threshold
+	b.failures = 0
+	b.probing = false
+	return wasOpen
+}
+
+// failure records a transient failure and reports whether the circuit
+// breaker is open after it.
+func (b *circuitBreaker) failure(threshold int, cooldown time.Duration) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures < threshold {
+		return false
+	}
+	b.openUntil = time.Now().Add(cooldown)
+	return true
+}
+
+// release records a call that says nothing about the endpoint, e.g. one that
+// was abandoned by the caller or rate limited.
+func (b *circuitBreaker) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// rewind returns the request for the next attempt, with a fresh body.
+func rewind(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.GetBody == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("error rewinding request body: %w", err)
+	}
+	attempt := req.Clone(req.Context())
+	attempt.Body = body
+	return attempt, nil
+}
+
+func isTransientStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// circuitOpenResponse is the response of the calls failed by an open circuit
+// breaker, in the error format of the Google APIs.
+func circuitOpenResponse(req *http.Request, endpoint string) *http.Response {
+	body, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"code":    http.StatusServiceUnavailable,
+			"message": fmt.Sprintf("circuit breaker of %s is open after consecutive failures", endpoint),
+			"status":  "UNAVAILABLE",
+		},
+	})
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable)),
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// retryAfter returns the delay of the Retry-After header, in seconds or an
+// HTTP date, or zero if the header is absent or invalid.
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0)
+	}
+	if date, err := http.ParseTime(v); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+func (e *transientStatusError) Error() string {
+	return fmt.Sprintf("transient status code %d", e.code)
+}
+
+// RetryAfter implements retry.RetryAfterError.
+func (e *transientStatusError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
@@ -0,0 +1,171 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package googlecredentials
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport(t *testing.T) {
+	var calls atomic.Int32
+	var statuses []int
+	var bodies []string
+	var retryAfter string
+	var callTimes []time.Time
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1)) - 1
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		callTimes = append(callTimes, time.Now())
+		status := http.StatusOK
+		if n < len(statuses) {
+			status = statuses[n]
+		}
+		if status == http.StatusTooManyRequests && retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(http.StatusText(status)))
+	}))
+	defer s.Close()
+
+	newClient := func(threshold int, cooldown time.Duration, maxDelay ...time.Duration) *http.Client {
+		retryMaxDelay := time.Millisecond
+		if len(maxDelay) > 0 {
+			retryMaxDelay = maxDelay[0]
+		}
+		return &http.Client{Transport: NewTransport(TransportOptions{
+			MetricsRegistry:         prometheus.NewRegistry(),
+			RetryInitialDelay:       time.Millisecond,
+			RetryMaxDelay:           retryMaxDelay,
+			CircuitBreakerThreshold: threshold,
+			CircuitBreakerCooldown:  cooldown,
+		})}
+	}
+	post := func(t *testing.T, c *http.Client) (int, string) {
+		t.Helper()
+		resp, err := c.Post(s.URL, "text/plain", strings.NewReader("body"))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(b)
+	}
+	reset := func(s ...int) {
+		calls.Store(0)
+		statuses = s
+		bodies = nil
+		retryAfter = ""
+		callTimes = nil
+	}
+
+	t.Run("transient failures are retried with the body", func(t *testing.T) {
+		reset(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+		status, _ := post(t, newClient(-1, 0))
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, []string{"body", "body", "body"}, bodies)
+	})
+
+	t.Run("the last failure is returned", func(t *testing.T) {
+		reset(http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+		status, body := post(t, newClient(-1, 0))
+		assert.Equal(t, http.StatusBadGateway, status)
+		assert.Equal(t, "Bad Gateway", body)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("other failures are not retried", func(t *testing.T) {
+		reset(http.StatusForbidden)
+		status, _ := post(t, newClient(-1, 0))
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("retry after", func(t *testing.T) {
+		reset(http.StatusTooManyRequests)
+		retryAfter = "1"
+		status, _ := post(t, newClient(-1, 0, 2*time.Second))
+		assert.Equal(t, http.StatusOK, status)
+		require.Len(t, callTimes, 2)
+		assert.GreaterOrEqual(t, callTimes[1].Sub(callTimes[0]), time.Second)
+	})
+
+	t.Run("retry after longer than the max delay is not retried", func(t *testing.T) {
+		reset(http.StatusTooManyRequests)
+		retryAfter = "60"
+		status, _ := post(t, newClient(-1, 0))
+		assert.Equal(t, http.StatusTooManyRequests, status)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("circuit breaker", func(t *testing.T) {
+		const cooldown = 100 * time.Millisecond
+		c := newClient(2, cooldown)
+		failures := func(n int) []int {
+			s := make([]int, n)
+			for i := range s {
+				s[i] = http.StatusInternalServerError
+			}
+			return s
+		}
+
+		// each call counts once regardless of its retries, so the second
+		// failed call opens the circuit breaker
+		reset(failures(6)...)
+		status, body := post(t, c)
+		assert.Equal(t, http.StatusInternalServerError, status)
+		assert.Equal(t, int32(3), calls.Load())
+		status, _ = post(t, c)
+		assert.Equal(t, http.StatusInternalServerError, status)
+		assert.Equal(t, int32(6), calls.Load())
+
+		// so the next call is answered without reaching the endpoint
+		status, body = post(t, c)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Contains(t, body, "circuit breaker")
+		assert.Equal(t, int32(6), calls.Load())
+
+		// after the cooldown a failed probe opens the circuit breaker again
+		time.Sleep(cooldown)
+		reset(failures(3)...)
+		status, _ = post(t, c)
+		assert.Equal(t, http.StatusInternalServerError, status)
+		assert.Equal(t, int32(3), calls.Load())
+		status, _ = post(t, c)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, int32(3), calls.Load())
+
+		// and a successful probe closes it
+		time.Sleep(cooldown)
+		reset()
+		status, _ = post(t, c)
+		assert.Equal(t, http.StatusOK, status)
+		status, _ = post(t, c)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("rate limits do not open the circuit breaker", func(t *testing.T) {
+		reset(http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests,
+			http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests)
+		c := newClient(1, time.Hour)
+		for range 2 {
+			status, _ := post(t, c)
+			assert.Equal(t, http.StatusTooManyRequests, status)
+		}
+		status, _ := post(t, c)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, int32(7), calls.Load())
+	})
+}
@@ -0,0 +1,91 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package pkghttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Listen listens on the given TCP address with SO_REUSEPORT set, so that a
+// new daemon instance can bind the same address while the previous one is
+// still draining its connections. The kernel distributes new connections
+// across both listeners until the previous instance closes its own.
+func Listen(address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// ListenUnix listens on a Unix domain socket at the given path, replacing a
+// socket left there by a previous daemon instance. The socket is accessible
+// to every user, callers are told apart by their kernel-reported
+// credentials. Closing the listener removes the socket only if it was not
+// replaced by a new daemon instance in the meantime.
+func ListenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("error creating unix socket directory: %w", err)
+	}
+	switch fi, err := os.Lstat(path); {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("error inspecting unix socket path: %w", err)
+	case fi.Mode().Type() != fs.ModeSocket:
+		return nil, fmt.Errorf("unix socket path %q exists and is not a socket", path)
+	default:
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("error removing previous unix socket: %w", err)
+		}
+	}
+
+	lis, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	lis.SetUnlinkOnClose(false)
+	if err := os.Chmod(path, 0o666); err != nil {
+		lis.Close()
+		return nil, fmt.Errorf("error setting unix socket permissions: %w", err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		lis.Close()
+		return nil, fmt.Errorf("error inspecting unix socket: %w", err)
+	}
+	return &unixListener{UnixListener: lis, path: path, file: fi}, nil
+}
+
+type unixListener struct {
+	*net.UnixListener
+	path string
+	file fs.FileInfo
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if fi, statErr := os.Lstat(l.path); statErr == nil && os.SameFile(fi, l.file) {
+		if rmErr := os.Remove(l.path); rmErr != nil && !errors.Is(rmErr, fs.ErrNotExist) {
+			err = errors.Join(err, rmErr)
+		}
+	}
+	return err
+}
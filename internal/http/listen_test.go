@@ -0,0 +1,53 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package pkghttp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenReusePort(t *testing.T) {
+	l1, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l1.Close()
+
+	l2, err := Listen(l1.Addr().String())
+	require.NoError(t, err)
+	defer l2.Close()
+}
+
+func TestListenUnixHandoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "metadata.sock")
+
+	l1, err := ListenUnix(path)
+	require.NoError(t, err)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o666), fi.Mode().Perm())
+
+	// A new instance replaces the socket, and the previous instance must
+	// not remove it when closing.
+	l2, err := ListenUnix(path)
+	require.NoError(t, err)
+	require.NoError(t, l1.Close())
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	conn.Close()
+
+	require.NoError(t, l2.Close())
+	_, err = os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestListenUnixRefusesNonSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.sock")
+	require.NoError(t, os.WriteFile(path, nil, 0o644))
+	_, err := ListenUnix(path)
+	require.Error(t, err)
+}
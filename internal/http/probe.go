@@ -0,0 +1,42 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package pkghttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Probe sends a GET request for the given path to the HTTP server listening
+// on the Unix domain socket at socketPath, and returns an error if the
+// request fails or the response status is not 2xx. It's meant for the
+// exec probes of the daemon: the socket lives in the filesystem of the
+// container, so unlike the TCP health port, which is shared through
+// SO_REUSEPORT with the instance being replaced during upgrades, it always
+// reaches the server of the same instance.
+func Probe(ctx context.Context, socketPath, path string) error {
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+path, nil)
+	if err != nil {
+		return fmt.Errorf("error creating probe request: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error sending probe request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("probe returned status %d: %s", resp.StatusCode, body)
+	}
+	return nil
+}
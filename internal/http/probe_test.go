@@ -0,0 +1,30 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package pkghttp
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "health.sock")
+	l, err := ListenUnix(path)
+	require.NoError(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+		}
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	require.NoError(t, Probe(context.Background(), path, "/healthz"))
+	require.ErrorContains(t, Probe(context.Background(), path, "/readyz"), "status 503: not ready")
+	require.Error(t, Probe(context.Background(), filepath.Join(t.TempDir(), "missing.sock"), "/healthz"))
+}
@@ -139,8 +139,8 @@ func observeRequest(r *http.Request, statusCode int, err error, errResp ...any)
 	o.observeLatencyMillis(r, statusCode, float64(latency.Milliseconds()))
 
 	l := logging.FromRequest(r).WithFields(logrus.Fields{
-		"http_response": responseLogFields(statusCode, errResp...),
-		"latency": logrus.Fields{
+		logging.HTTPResponseField: responseLogFields(statusCode, errResp...),
+		logging.LatencyField: logrus.Fields{
 			"string": latency.String(),
 			"nanos":  latency.Nanoseconds(),
 		},
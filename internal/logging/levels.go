@@ -0,0 +1,258 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package logging
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ComponentField is the log field used to tag entries with the component
+// that produced them. Entries carrying one of the Components below are
+// filtered by that component's level instead of the base level.
+const ComponentField = "component"
+
+const (
+	ComponentProxy       = "proxy"
+	ComponentCache       = "cache"
+	ComponentWatch       = "watch"
+	ComponentAttestation = "attestation"
+)
+
+// Components lists the components whose log level can be set independently.
+var Components = []string{
+	ComponentProxy,
+	ComponentCache,
+	ComponentWatch,
+	ComponentAttestation,
+}
+
+// baseTarget is the levelRegistry key holding the base log level.
+const baseTarget = ""
+
+// LevelStatus describes a log level currently in effect.
+type LevelStatus struct {
+	Level     string     `json:"level"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// LevelsStatus describes the base log level and the per-component overrides
+// currently in effect.
+type LevelsStatus struct {
+	Base       LevelStatus            `json:"base"`
+	Components map[string]LevelStatus `json:"components,omitempty"`
+}
+
+type levelRegistry struct {
+	mu        sync.RWMutex
+	settings  map[string]*levelSetting
+	listeners map[int]func()
+	nextID    int
+}
+
+type levelSetting struct {
+	level logrus.Level
+	// persistent is the level restored when a temporary setting expires.
+	// nil means the setting is removed on expiration (component overrides).
+	persistent *logrus.Level
+	expiresAt  time.Time
+	timer      *time.Timer
+}
+
+type componentLevelFilter struct {
+	logrus.Formatter
+}
+
+var levels = func() *levelRegistry {
+	info := logrus.InfoLevel
+	return &levelRegistry{
+		settings: map[string]*levelSetting{
+			baseTarget: {level: info, persistent: &info},
+		},
+		listeners: make(map[int]func()),
+	}
+}()
+
+// SetLevel changes the base log level. If ttl is positive the change is
+// temporary and the previous persistent level is restored after ttl.
+func SetLevel(level logrus.Level, ttl time.Duration) {
+	levels.set(baseTarget, level, ttl)
+}
+
+// SetComponentLevel overrides the log level of the given component. If ttl
+// is positive the override is temporary and the previous persistent
+// override (if any) is restored after ttl.
+func SetComponentLevel(component string, level logrus.Level, ttl time.Duration) error {
+	if !slices.Contains(Components, component) {
+		return fmt.Errorf("unknown log component %q. known components: %v", component, Components)
+	}
+	levels.set(component, level, ttl)
+	return nil
+}
+
+// ResetComponentLevel removes the log level override of the given component,
+// making it follow the base level again.
+func ResetComponentLevel(component string) error {
+	if !slices.Contains(Components, component) {
+		return fmt.Errorf("unknown log component %q. known components: %v", component, Components)
+	}
+	levels.reset(component)
+	return nil
+}
+
+// Levels returns the log levels currently in effect.
+func Levels() LevelsStatus {
+	return levels.status()
+}
+
+// OnLevelChange registers f to be called after every log level change. The
+// returned function unregisters it.
+func OnLevelChange(f func()) func() {
+	levels.mu.Lock()
+	defer levels.mu.Unlock()
+	id := levels.nextID
+	levels.nextID++
+	levels.listeners[id] = f
+	return func() {
+		levels.mu.Lock()
+		delete(levels.listeners, id)
+		levels.mu.Unlock()
+	}
+}
+
+func (r *levelRegistry) init(level logrus.Level) {
+	r.mu.Lock()
+	if s := r.settings[baseTarget]; s.timer != nil {
+		s.timer.Stop()
+	}
+	r.settings[baseTarget] = &levelSetting{level: level, persistent: &level}
+	r.mu.Unlock()
+}
+
+func (r *levelRegistry) set(target string, level logrus.Level, ttl time.Duration) {
+	r.mu.Lock()
+	prev := r.settings[target]
+	if prev != nil && prev.timer != nil {
+		prev.timer.Stop()
+	}
+	s := &levelSetting{level: level}
+	if ttl <= 0 {
+		s.persistent = &level
+	} else {
+		if prev != nil {
+			s.persistent = prev.persistent
+		}
+		s.expiresAt = time.Now().Add(ttl)
+		s.timer = time.AfterFunc(ttl, func() { r.expire(target, s) })
+	}
+	r.settings[target] = s
+	r.mu.Unlock()
+	r.apply()
+}
+
+func (r *levelRegistry) expire(target string, s *levelSetting) {
+	r.mu.Lock()
+	if r.settings[target] != s { // superseded by a newer setting
+		r.mu.Unlock()
+		return
+	}
+	if s.persistent == nil {
+		delete(r.settings, target)
+	} else {
+		r.settings[target] = &levelSetting{level: *s.persistent, persistent: s.persistent}
+	}
+	r.mu.Unlock()
+	r.apply()
+}
+
+func (r *levelRegistry) reset(target string) {
+	r.mu.Lock()
+	if s := r.settings[target]; s != nil && s.timer != nil {
+		s.timer.Stop()
+	}
+	delete(r.settings, target)
+	r.mu.Unlock()
+	r.apply()
+}
+
+// apply raises the root logger level to the most verbose level in effect
+// (so that no entry is discarded before componentLevelFilter sees it) and
+// notifies listeners.
+func (r *levelRegistry) apply() {
+	root().SetLevel(r.maxLevel())
+
+	r.mu.RLock()
+	listeners := make([]func(), 0, len(r.listeners))
+	for _, f := range r.listeners {
+		listeners = append(listeners, f)
+	}
+	r.mu.RUnlock()
+	for _, f := range listeners {
+		f()
+	}
+}
+
+func (r *levelRegistry) baseLevel() logrus.Level {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.settings[baseTarget].level
+}
+
+func (r *levelRegistry) levelFor(component string) logrus.Level {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if s, ok := r.settings[component]; ok {
+		return s.level
+	}
+	return r.settings[baseTarget].level
+}
+
+func (r *levelRegistry) maxLevel() logrus.Level {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var max logrus.Level
+	for _, s := range r.settings {
+		if s.level > max {
+			max = s.level
+		}
+	}
+	return max
+}
+
+func (r *levelRegistry) status() LevelsStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var st LevelsStatus
+	for target, s := range r.settings {
+		ls := LevelStatus{Level: s.level.String()}
+		if s.timer != nil {
+			expiresAt := s.expiresAt
+			ls.ExpiresAt = &expiresAt
+		}
+		if target == baseTarget {
+			st.Base = ls
+			continue
+		}
+		if st.Components == nil {
+			st.Components = make(map[string]LevelStatus)
+		}
+		st.Components[target] = ls
+	}
+	return st
+}
+
+// Format drops entries that are more verbose than the level in effect for
+// their component. The root logger runs at the most verbose level in effect,
+// so this is where the base level is enforced for untagged entries too.
+func (f *componentLevelFilter) Format(e *logrus.Entry) ([]byte, error) {
+	component, _ := e.Data[ComponentField].(string)
+	if e.Level > levels.levelFor(component) {
+		return nil, nil
+	}
+	return f.Formatter.Format(e)
+}
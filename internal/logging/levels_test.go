@@ -0,0 +1,81 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package logging
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withLevels(t *testing.T, base logrus.Level) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	l := NewLogger(base).(*logrus.Logger)
+	l.SetOutput(&buf)
+	t.Cleanup(func() {
+		for _, c := range Components {
+			levels.reset(c)
+		}
+		NewLogger(logrus.InfoLevel)
+	})
+	return &buf
+}
+
+func TestComponentLevelFilter(t *testing.T) {
+	buf := withLevels(t, logrus.InfoLevel)
+	require.NoError(t, SetComponentLevel(ComponentProxy, logrus.DebugLevel, 0))
+
+	FromContext(t.Context()).Debug("base debug")
+	WithComponent(FromContext(t.Context()), ComponentCache).Debug("cache debug")
+	WithComponent(FromContext(t.Context()), ComponentProxy).Debug("proxy debug")
+
+	out := buf.String()
+	assert.NotContains(t, out, "base debug")
+	assert.NotContains(t, out, "cache debug")
+	assert.Contains(t, out, "proxy debug")
+	assert.False(t, Debug())
+}
+
+func TestSetLevelTTL(t *testing.T) {
+	withLevels(t, logrus.InfoLevel)
+
+	changes := make(chan bool, 2)
+	unregister := OnLevelChange(func() { changes <- Debug() })
+	defer unregister()
+
+	SetLevel(logrus.DebugLevel, 50*time.Millisecond)
+	assert.True(t, <-changes)
+	assert.NotNil(t, Levels().Base.ExpiresAt)
+
+	select {
+	case debug := <-changes:
+		assert.False(t, debug)
+	case <-time.After(5 * time.Second):
+		t.Fatal("base level did not revert after ttl")
+	}
+	assert.Equal(t, logrus.InfoLevel.String(), Levels().Base.Level)
+	assert.Nil(t, Levels().Base.ExpiresAt)
+}
+
+func TestSetComponentLevelTTL(t *testing.T) {
+	withLevels(t, logrus.InfoLevel)
+
+	require.NoError(t, SetComponentLevel(ComponentWatch, logrus.WarnLevel, 0))
+	require.NoError(t, SetComponentLevel(ComponentWatch, logrus.TraceLevel, 50*time.Millisecond))
+	assert.Equal(t, logrus.TraceLevel.String(), Levels().Components[ComponentWatch].Level)
+
+	assert.Eventually(t, func() bool {
+		return Levels().Components[ComponentWatch].Level == logrus.WarnLevel.String()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, ResetComponentLevel(ComponentWatch))
+	assert.NotContains(t, Levels().Components, ComponentWatch)
+
+	assert.Error(t, SetComponentLevel("unknown", logrus.DebugLevel, 0))
+}
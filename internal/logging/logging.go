@@ -7,7 +7,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"time"
+	"sync"
 
 	"github.com/go-logr/logr"
 	"github.com/sirupsen/logrus"
@@ -18,21 +18,32 @@ type loggerContextKey struct{}
 
 type logrAdapter struct {
 	logger logrus.FieldLogger
-	level  logrus.Level
 }
 
-var logLevel logrus.Level = logrus.InfoLevel
+var (
+	rootLogger     *logrus.Logger
+	rootLoggerOnce sync.Once
+)
 
+// NewLogger sets the base log level and returns the process-wide root
+// logger. The root logger is shared so that level changes made at runtime
+// (see SetLevel and SetComponentLevel) apply to every logger derived from it.
 func NewLogger(level logrus.Level) logrus.FieldLogger {
-	logLevel = level
-	l := logrus.New()
-	l.SetFormatter(&logrus.JSONFormatter{
-		TimestampFormat: time.RFC3339Nano,
-	})
-	l.SetLevel(level)
+	l := root()
+	levels.init(level)
+	l.SetLevel(levels.maxLevel())
 	return l
 }
 
+func root() *logrus.Logger {
+	rootLoggerOnce.Do(func() {
+		rootLogger = logrus.New()
+		rootLogger.SetFormatter(&componentLevelFilter{newJSONFormatter()})
+		rootLogger.SetLevel(logrus.InfoLevel)
+	})
+	return rootLogger
+}
+
 func FromRequest(r *http.Request) logrus.FieldLogger {
 	return FromContext(r.Context())
 }
@@ -43,7 +54,7 @@ func FromContext(ctx context.Context) logrus.FieldLogger {
 			return l
 		}
 	}
-	return NewLogger(logLevel)
+	return root()
 }
 
 func IntoRequest(r *http.Request, l logrus.FieldLogger) *http.Request {
@@ -55,25 +66,32 @@ func IntoContext(ctx context.Context, l logrus.FieldLogger) context.Context {
 	return context.WithValue(ctx, loggerContextKey{}, l)
 }
 
+// WithComponent tags the logger with the given component so that
+// per-component log levels apply to it.
+func WithComponent(l logrus.FieldLogger, component string) logrus.FieldLogger {
+	return l.WithField(ComponentField, component)
+}
+
+// Debug reports whether the base log level currently includes debug logs.
 func Debug() bool {
-	return logLevel >= logrus.DebugLevel
+	return levels.baseLevel() >= logrus.DebugLevel
 }
 
-func InitKLog(l logrus.FieldLogger, level logrus.Level) {
+func InitKLog(l logrus.FieldLogger) {
 	klog.SetLogger(logr.New(&logrAdapter{
 		logger: l,
-		level:  level,
 	}))
 }
 
 func (l *logrAdapter) Enabled(level int) bool {
+	base := levels.baseLevel()
 	switch level {
 	case 0: // info
-		return l.level >= logrus.InfoLevel
+		return base >= logrus.InfoLevel
 	case 1: // debug
-		return l.level >= logrus.DebugLevel
+		return base >= logrus.DebugLevel
 	case 2: // trace
-		return l.level >= logrus.TraceLevel
+		return base >= logrus.TraceLevel
 	default:
 		return false
 	}
@@ -100,14 +118,12 @@ func (l *logrAdapter) Init(logr.RuntimeInfo) {
 func (l *logrAdapter) WithName(name string) logr.LogSink {
 	return &logrAdapter{
 		logger: l.logger.WithField("name", name),
-		level:  l.level,
 	}
 }
 
 func (l *logrAdapter) WithValues(keysAndValues ...any) logr.LogSink {
 	return &logrAdapter{
 		logger: l.logger.WithFields(keysAndValuesToFields(keysAndValues)),
-		level:  l.level,
 	}
 }
 
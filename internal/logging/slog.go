@@ -0,0 +1,320 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	BackendLogrus = "logrus"
+	BackendSlog   = "slog"
+
+	FormatJSON    = "json"
+	FormatLogfmt  = "logfmt"
+	FormatConsole = "console"
+)
+
+// Well-known field names. The slog backend translates them to the field
+// conventions of GCP Cloud Logging.
+const (
+	TraceField        = "trace"
+	HTTPRequestField  = "http_request"
+	HTTPResponseField = "http_response"
+	LatencyField      = "latency"
+)
+
+// GCP Cloud Logging special fields, see
+// https://cloud.google.com/logging/docs/structured-logging#special-payload-fields
+const (
+	gcpSeverityKey    = "severity"
+	gcpMessageKey     = "message"
+	gcpTraceKey       = "logging.googleapis.com/trace"
+	gcpHTTPRequestKey = "httpRequest"
+)
+
+// Slog levels for the logrus levels that have no slog counterpart.
+const (
+	slogLevelTrace = slog.LevelDebug - 4
+	slogLevelFatal = slog.LevelError + 4
+	slogLevelPanic = slog.LevelError + 8
+)
+
+// slogFormatter renders logrus entries through a slog.Handler, so that the
+// logrus.FieldLogger API used throughout the code base is kept while the
+// output is produced by log/slog.
+type slogFormatter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	handler slog.Handler
+}
+
+type consoleHandler struct {
+	w     io.Writer
+	attrs []slog.Attr
+	group string
+}
+
+// ConfigureOutput selects the backend and format used to render log entries.
+// The logrus backend only supports the json format. The slog backend
+// supports json, logfmt and console, and follows the GCP Cloud Logging
+// field conventions (severity, logging.googleapis.com/trace, httpRequest).
+func ConfigureOutput(backend, format string) error {
+	var formatter logrus.Formatter
+	switch backend {
+	case BackendLogrus:
+		if format != FormatJSON {
+			return fmt.Errorf("log format %q is not supported by the %s backend, only %s", format, backend, FormatJSON)
+		}
+		formatter = newJSONFormatter()
+	case BackendSlog:
+		f, err := newSlogFormatter(format)
+		if err != nil {
+			return err
+		}
+		formatter = f
+	default:
+		return fmt.Errorf("unknown log backend %q. accepted values: %s, %s", backend, BackendLogrus, BackendSlog)
+	}
+	root().SetFormatter(&componentLevelFilter{formatter})
+	return nil
+}
+
+func newJSONFormatter() logrus.Formatter {
+	return &logrus.JSONFormatter{
+		TimestampFormat: time.RFC3339Nano,
+	}
+}
+
+func newSlogFormatter(format string) (*slogFormatter, error) {
+	f := &slogFormatter{}
+	opts := &slog.HandlerOptions{
+		Level:       slogLevelTrace,
+		ReplaceAttr: replaceGCPAttr,
+	}
+	switch format {
+	case FormatJSON:
+		f.handler = slog.NewJSONHandler(&f.buf, opts)
+	case FormatLogfmt:
+		f.handler = slog.NewTextHandler(&f.buf, opts)
+	case FormatConsole:
+		f.handler = &consoleHandler{w: &f.buf}
+	default:
+		return nil, fmt.Errorf("unknown log format %q. accepted values: %s, %s, %s",
+			format, FormatJSON, FormatLogfmt, FormatConsole)
+	}
+	return f, nil
+}
+
+// Format implements logrus.Formatter.
+func (f *slogFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	r := slog.NewRecord(e.Time, slogLevel(e.Level), e.Message, 0)
+	for _, k := range slices.Sorted(maps.Keys(e.Data)) {
+		key := k
+		if k == TraceField {
+			key = gcpTraceKey
+		}
+		r.AddAttrs(slogAttr(key, e.Data[k]))
+	}
+	if req := gcpHTTPRequest(e.Data); req != nil {
+		r.AddAttrs(slog.Any(gcpHTTPRequestKey, req))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buf.Reset()
+	if err := f.handler.Handle(context.Background(), r); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(f.buf.Bytes()), nil
+}
+
+// gcpHTTPRequest builds the httpRequest special field from the request and
+// response fields attached by the HTTP server.
+func gcpHTTPRequest(data logrus.Fields) map[string]any {
+	req, ok := data[HTTPRequestField].(logrus.Fields)
+	if !ok {
+		return nil
+	}
+	m := map[string]any{}
+	if v, ok := req["method"]; ok {
+		m["requestMethod"] = v
+	}
+	if v, ok := req["path"]; ok {
+		m["requestUrl"] = v
+	}
+	if v, ok := req["remote_addr"].(string); ok {
+		if host, _, err := net.SplitHostPort(v); err == nil {
+			v = host
+		}
+		m["remoteIp"] = v
+	}
+	if v, ok := req["user_agent"]; ok {
+		m["userAgent"] = v
+	}
+	if resp, ok := data[HTTPResponseField].(logrus.Fields); ok {
+		if v, ok := resp["status_code"]; ok {
+			m["status"] = v
+		}
+	}
+	if latency, ok := data[LatencyField].(logrus.Fields); ok {
+		if nanos, ok := latency["nanos"].(int64); ok {
+			m["latency"] = fmt.Sprintf("%.9fs", time.Duration(nanos).Seconds())
+		}
+	}
+	return m
+}
+
+func slogAttr(key string, v any) slog.Attr {
+	var fields map[string]any
+	switch m := v.(type) {
+	case logrus.Fields:
+		fields = m
+	case map[string]any:
+		fields = m
+	default:
+		return slog.Any(key, v)
+	}
+	attrs := make([]any, 0, len(fields))
+	for _, k := range slices.Sorted(maps.Keys(fields)) {
+		attrs = append(attrs, slogAttr(k, fields[k]))
+	}
+	return slog.Group(key, attrs...)
+}
+
+func slogLevel(level logrus.Level) slog.Level {
+	switch level {
+	case logrus.PanicLevel:
+		return slogLevelPanic
+	case logrus.FatalLevel:
+		return slogLevelFatal
+	case logrus.ErrorLevel:
+		return slog.LevelError
+	case logrus.WarnLevel:
+		return slog.LevelWarn
+	case logrus.InfoLevel:
+		return slog.LevelInfo
+	case logrus.DebugLevel:
+		return slog.LevelDebug
+	default:
+		return slogLevelTrace
+	}
+}
+
+func gcpSeverity(level slog.Level) string {
+	switch {
+	case level >= slogLevelPanic:
+		return "ALERT"
+	case level >= slogLevelFatal:
+		return "CRITICAL"
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+func replaceGCPAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		return slog.String(gcpSeverityKey, gcpSeverity(a.Value.Any().(slog.Level)))
+	case slog.MessageKey:
+		a.Key = gcpMessageKey
+	case slog.TimeKey:
+		return slog.String(slog.TimeKey, a.Value.Time().Format(time.RFC3339Nano))
+	}
+	return a
+}
+
+// Enabled implements slog.Handler. Level filtering happens before entries
+// reach the handler, see componentLevelFilter.
+func (h *consoleHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+// Handle implements slog.Handler. Records are rendered in a human-friendly
+// single line: time, severity, message and then the attributes as key=value.
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Time.Format("15:04:05.000"))
+	fmt.Fprintf(&b, " %-8s %s", gcpSeverity(r.Level), r.Message)
+	write := func(a slog.Attr) bool {
+		writeConsoleAttr(&b, h.group, a)
+		return true
+	}
+	for _, a := range h.attrs {
+		write(a)
+	}
+	r.Attrs(write)
+	b.WriteByte('\n')
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+// WithAttrs implements slog.Handler.
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &consoleHandler{w: h.w, attrs: append(slices.Clone(h.attrs), attrs...), group: h.group}
+}
+
+// WithGroup implements slog.Handler.
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	return &consoleHandler{w: h.w, attrs: h.attrs, group: joinGroup(h.group, name)}
+}
+
+func writeConsoleAttr(b *strings.Builder, group string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			writeConsoleAttr(b, joinGroup(group, a.Key), ga)
+		}
+		return
+	}
+	fmt.Fprintf(b, " %s=%v", joinGroup(group, a.Key), a.Value.Any())
+}
+
+func joinGroup(group, key string) string {
+	if group == "" {
+		return key
+	}
+	return group + "." + key
+}
+
+// TraceFromRequest extracts the trace ID from the X-Cloud-Trace-Context or
+// the W3C traceparent request headers and formats it as expected by the
+// logging.googleapis.com/trace field. Returns an empty string if the request
+// carries no trace context.
+func TraceFromRequest(r *http.Request, projectID string) string {
+	var traceID string
+	if v := r.Header.Get("X-Cloud-Trace-Context"); v != "" { // TRACE_ID/SPAN_ID;o=OPTIONS
+		traceID, _, _ = strings.Cut(v, "/")
+	} else if v := r.Header.Get("traceparent"); v != "" { // VERSION-TRACE_ID-SPAN_ID-FLAGS
+		if parts := strings.Split(v, "-"); len(parts) == 4 {
+			traceID = parts[1]
+		}
+	}
+	if traceID == "" || projectID == "" {
+		return traceID
+	}
+	return fmt.Sprintf("projects/%s/traces/%s", projectID, traceID)
+}
@@ -0,0 +1,108 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withOutput(t *testing.T, backend, format string) *bytes.Buffer {
+	t.Helper()
+	buf := withLevels(t, logrus.InfoLevel)
+	require.NoError(t, ConfigureOutput(backend, format))
+	t.Cleanup(func() { require.NoError(t, ConfigureOutput(BackendLogrus, FormatJSON)) })
+	return buf
+}
+
+func TestSlogJSON_GCPFields(t *testing.T) {
+	buf := withOutput(t, BackendSlog, FormatJSON)
+
+	FromContext(t.Context()).WithFields(logrus.Fields{
+		TraceField: "projects/p/traces/abc",
+		HTTPRequestField: logrus.Fields{
+			"method":      "GET",
+			"path":        "/computeMetadata/v1/instance/name",
+			"remote_addr": "10.0.0.1:12345",
+		},
+		HTTPResponseField: logrus.Fields{"status_code": 200},
+		LatencyField:      logrus.Fields{"nanos": int64(1500000)},
+	}).Warn("request")
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "WARNING", entry["severity"])
+	assert.Equal(t, "request", entry["message"])
+	assert.Equal(t, "projects/p/traces/abc", entry["logging.googleapis.com/trace"])
+	assert.Equal(t, map[string]any{
+		"requestMethod": "GET",
+		"requestUrl":    "/computeMetadata/v1/instance/name",
+		"remoteIp":      "10.0.0.1",
+		"status":        float64(200),
+		"latency":       "0.001500000s",
+	}, entry["httpRequest"])
+	assert.NotContains(t, entry, "level")
+	assert.NotContains(t, entry, "msg")
+}
+
+func TestSlogLogfmt(t *testing.T) {
+	buf := withOutput(t, BackendSlog, FormatLogfmt)
+
+	WithComponent(FromContext(t.Context()), ComponentProxy).
+		WithField("pod", logrus.Fields{"name": "app"}).
+		Error("boom")
+
+	out := buf.String()
+	assert.Contains(t, out, "severity=ERROR")
+	assert.Contains(t, out, "message=boom")
+	assert.Contains(t, out, "component=proxy")
+	assert.Contains(t, out, "pod.name=app")
+}
+
+func TestSlogConsole(t *testing.T) {
+	buf := withOutput(t, BackendSlog, FormatConsole)
+
+	FromContext(t.Context()).WithField("client_ip", "10.0.0.1").Info("hello")
+	FromContext(t.Context()).Debug("filtered")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], " INFO     hello client_ip=10.0.0.1")
+}
+
+func TestConfigureOutput_Invalid(t *testing.T) {
+	assert.Error(t, ConfigureOutput(BackendLogrus, FormatLogfmt))
+	assert.Error(t, ConfigureOutput(BackendSlog, "xml"))
+	assert.Error(t, ConfigureOutput("zap", FormatJSON))
+}
+
+func TestTraceFromRequest(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header string
+		value  string
+		want   string
+	}{
+		{"cloud trace", "X-Cloud-Trace-Context", "105445aa7843bc8bf206b12000100000/1;o=1", "projects/p/traces/105445aa7843bc8bf206b12000100000"},
+		{"traceparent", "traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "projects/p/traces/4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"malformed traceparent", "traceparent", "garbage", ""},
+		{"none", "", "", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest(http.MethodGet, "/", nil)
+			require.NoError(t, err)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			assert.Equal(t, tt.want, TraceFromRequest(r, "p"))
+		})
+	}
+}
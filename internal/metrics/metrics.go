@@ -69,7 +69,25 @@ func NewProxyDialLantencyMillis() *prometheus.HistogramVec {
 		Subsystem: "proxy",
 		Name:      "dial_latency_millis",
 		Buckets:   prometheus.ExponentialBuckets(0.2, 5, 7),
-	}, []string{"client_ip"})
+	}, []string{"upstream"})
+}
+
+func NewProxyDialLatencyByClientIPMillis() *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "dial_latency_by_client_ip_millis",
+		Buckets:   prometheus.ExponentialBuckets(0.2, 5, 7),
+	}, []string{"upstream", "client_ip"})
+}
+
+func NewProxyDialFailuresCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "dial_failures_total",
+		Help:      "Total failures when dialing the upstreams of the proxy.",
+	}, []string{"upstream", "reason"})
 }
 
 func NewProxyActiveConnectionsGauge() prometheus.Gauge {
@@ -113,6 +131,22 @@ func NewServiceAccountCacheMissesCounter() prometheus.Counter {
 	})
 }
 
+func NewCachedNamespacesGauge() prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "namespaces",
+		Help:      "Amount of Namespace objects currently cached.",
+	})
+}
+
+func NewNamespaceCacheMissesCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "namespace_cache_misses_total",
+		Help:      "Total amount cache misses when looking up Namespace objects.",
+	})
+}
+
 func NewCachedServiceAccountTokensGauge() prometheus.Gauge {
 	return prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: namespace,
@@ -128,3 +162,118 @@ func NewServiceAccountTokenCacheMissesCounter() prometheus.Counter {
 		Help:      "Total amount cache misses when fetching ServiceAccount tokens.",
 	})
 }
+
+func NewServiceAccountTokenStaleHitsCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "service_account_token_stale_hits_total",
+		Help:      "Total cached tokens served past their refresh point because refreshing them failed.",
+	})
+}
+
+func NewServiceAccountTokenRefreshAheadHitsCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "service_account_token_refresh_ahead_hits_total",
+		Help:      "Total scoped access tokens and identity tokens refreshed ahead of expiry that were used before expiring.",
+	}, []string{"type"})
+}
+
+func NewServiceAccountTokenSynchronousMissesCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "service_account_token_synchronous_misses_total",
+		Help:      "Total scoped access tokens and identity tokens created while serving the requests.",
+	}, []string{"type"})
+}
+
+func NewUpstreamFailuresCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "failures_total",
+		Help:      "Total transient failures of the calls to the Google APIs, i.e. network errors, 429 and 5xx.",
+	}, []string{"endpoint"})
+}
+
+func NewUpstreamCircuitBreakerOpenGauge() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "circuit_breaker_open",
+		Help:      "Whether the circuit breaker of the Google API endpoint is open (1) or closed (0).",
+	}, []string{"endpoint"})
+}
+
+func NewUpstreamCircuitBreakerRejectionsCounter() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "upstream",
+		Name:      "circuit_breaker_rejections_total",
+		Help:      "Total calls to the Google APIs failed right away by an open circuit breaker.",
+	}, []string{"endpoint"})
+}
+
+func NewShutdownPhaseDurationMillis() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "shutdown",
+		Name:      "phase_duration_millis",
+		Help:      "Duration of each phase of the graceful shutdown sequence. Only visible to scrapes during the drain window, before the health server shuts down.",
+	}, []string{"phase"})
+}
+
+func NewAttestationMapEntriesGauge(entries func() float64) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "attestation",
+		Name:      "map_entries",
+		Help:      "Current number of connection 4-tuples recorded in the eBPF attestation map.",
+	}, entries)
+}
+
+func NewAttestationMapCapacityGauge(capacity float64) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "attestation",
+		Name:      "map_capacity",
+		Help:      "Maximum number of entries of the eBPF attestation map.",
+	}, func() float64 { return capacity })
+}
+
+func NewAttestationSockopsEventsCounter(stage string, count func() float64) prometheus.CounterFunc {
+	return prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   namespace,
+		Subsystem:   "attestation",
+		Name:        "sockops_events_total",
+		Help:        "Total events seen by the eBPF attestation sockops program, by processing stage.",
+		ConstLabels: prometheus.Labels{"stage": stage},
+	}, count)
+}
+
+func NewCgroupIndexHitsCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "attestation",
+		Name:      "cgroup_index_hits_total",
+		Help:      "Total cgroup ID to pod UID resolutions served by the cgroup index.",
+	})
+}
+
+func NewCgroupIndexWalksCounter() prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "attestation",
+		Name:      "cgroup_index_walks_total",
+		Help:      "Total walks of the cgroup hierarchy due to cgroup index misses.",
+	})
+}
+
+func NewCgroupIndexEntriesGauge() prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "attestation",
+		Name:      "cgroup_index_entries",
+		Help:      "Current number of pod cgroups in the cgroup index.",
+	})
+}
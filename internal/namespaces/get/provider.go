@@ -0,0 +1,34 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package getnamespace
+
+import (
+	"context"
+
+	"github.com/matheuscscp/gke-metadata-server/internal/namespaces"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type (
+	Provider struct {
+		opts ProviderOptions
+	}
+
+	ProviderOptions struct {
+		KubeClient kubernetes.Interface
+	}
+)
+
+func NewProvider(opts ProviderOptions) namespaces.Provider {
+	return &Provider{opts}
+}
+
+func (p *Provider) Get(ctx context.Context, name string) (*corev1.Namespace, error) {
+	return p.opts.KubeClient.CoreV1().
+		Namespaces().
+		Get(ctx, name, metav1.GetOptions{})
+}
@@ -0,0 +1,63 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package namespaces
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/matheuscscp/gke-metadata-server/api"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	ErrProjectIDAnnotationInvalid = fmt.Errorf(
+		"namespace annotation %q has invalid project id", api.AnnotationProjectID)
+
+	ErrNumericProjectIDAnnotationInvalid = fmt.Errorf(
+		"namespace annotation %q has invalid numeric project id", api.AnnotationNumericProjectID)
+
+	ErrQuotaProjectAnnotationInvalid = fmt.Errorf(
+		"namespace annotation %q has invalid project id", api.AnnotationQuotaProject)
+)
+
+var (
+	projectIDRegex        = regexp.MustCompile(`^[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+	numericProjectIDRegex = regexp.MustCompile(`^\d+$`)
+)
+
+// ValidProjectID reports whether the given string is a valid GCP project ID.
+func ValidProjectID(s string) bool {
+	return projectIDRegex.MatchString(s)
+}
+
+// ProjectID returns the GCP project ID of the namespace annotation, or nil if
+// the annotation is not present.
+func ProjectID(ns *corev1.Namespace) (*string, error) {
+	return annotation(ns, api.AnnotationProjectID, projectIDRegex, ErrProjectIDAnnotationInvalid)
+}
+
+// NumericProjectID returns the GCP numeric project ID of the namespace annotation,
+// or nil if the annotation is not present.
+func NumericProjectID(ns *corev1.Namespace) (*string, error) {
+	return annotation(ns, api.AnnotationNumericProjectID, numericProjectIDRegex, ErrNumericProjectIDAnnotationInvalid)
+}
+
+// QuotaProject returns the quota project of the namespace annotation, or nil
+// if the annotation is not present.
+func QuotaProject(ns *corev1.Namespace) (*string, error) {
+	return annotation(ns, api.AnnotationQuotaProject, projectIDRegex, ErrQuotaProjectAnnotationInvalid)
+}
+
+func annotation(ns *corev1.Namespace, key string, re *regexp.Regexp, errInvalid error) (*string, error) {
+	v, ok := ns.Annotations[key]
+	if !ok {
+		return nil, nil
+	}
+	if !re.MatchString(v) {
+		return nil, errInvalid
+	}
+	return &v, nil
+}
@@ -0,0 +1,14 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package namespaces
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+type Provider interface {
+	Get(ctx context.Context, name string) (*corev1.Namespace, error)
+}
@@ -0,0 +1,119 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package watchnamespaces
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matheuscscp/gke-metadata-server/internal/logging"
+	"github.com/matheuscscp/gke-metadata-server/internal/metrics"
+	"github.com/matheuscscp/gke-metadata-server/internal/namespaces"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	informersv1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+type (
+	Provider struct {
+		opts          ProviderOptions
+		numNamespaces prometheus.Gauge
+		cacheMisses   prometheus.Counter
+		closeChannel  chan struct{}
+		closedChannel chan struct{}
+		informer      cache.SharedIndexInformer
+	}
+
+	ProviderOptions struct {
+		FallbackSource  namespaces.Provider
+		KubeClient      kubernetes.Interface
+		MetricsRegistry *prometheus.Registry
+		ResyncPeriod    time.Duration
+	}
+)
+
+func NewProvider(opts ProviderOptions) *Provider {
+	numNamespaces := metrics.NewCachedNamespacesGauge()
+	opts.MetricsRegistry.MustRegister(numNamespaces)
+	cacheMisses := metrics.NewNamespaceCacheMissesCounter()
+	opts.MetricsRegistry.MustRegister(cacheMisses)
+
+	informer := informersv1.NewNamespaceInformer(
+		opts.KubeClient,
+		opts.ResyncPeriod,
+		cache.Indexers{},
+	)
+
+	p := &Provider{
+		opts:          opts,
+		numNamespaces: numNamespaces,
+		cacheMisses:   cacheMisses,
+		closeChannel:  make(chan struct{}),
+		closedChannel: make(chan struct{}),
+		informer:      informer,
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(any) {
+			numNamespaces.Inc()
+		},
+		DeleteFunc: func(any) {
+			numNamespaces.Dec()
+		},
+	})
+
+	return p
+}
+
+func (p *Provider) Get(ctx context.Context, name string) (*corev1.Namespace, error) {
+	ns, err := p.get(name)
+	if err == nil {
+		return ns, nil
+	}
+	if p.opts.FallbackSource == nil {
+		return nil, fmt.Errorf("error getting namespace %s from cache: %w", name, err)
+	}
+
+	logging.
+		WithComponent(logging.FromContext(ctx), logging.ComponentWatch).
+		WithError(err).
+		WithField("namespace", name).
+		Error("error getting namespace from cache, delegating request to fallback source")
+
+	ns, err = p.opts.FallbackSource.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	p.cacheMisses.Inc()
+	return ns, nil
+}
+
+func (p *Provider) get(name string) (*corev1.Namespace, error) {
+	v, ok, err := p.informer.GetStore().GetByKey(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("namespace not present in cache")
+	}
+	return v.(*corev1.Namespace), nil
+}
+
+func (p *Provider) Start(ctx context.Context) {
+	go func() {
+		logging.WithComponent(logging.FromContext(ctx), logging.ComponentWatch).Info("starting watch namespaces...")
+		p.informer.Run(p.closeChannel)
+		close(p.closedChannel)
+	}()
+}
+
+func (p *Provider) Close() error {
+	close(p.closeChannel)
+	<-p.closedChannel
+	return nil
+}
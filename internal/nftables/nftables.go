@@ -0,0 +1,234 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+// Package nftables routes the connections to 169.254.169.254:80 to the
+// emulator with DNAT rules in a dedicated nftables table, for nodes where
+// attaching eBPF programs to cgroups is not possible. Connections from pods
+// are translated in the prerouting hook, connections from the host network
+// namespace (hostNetwork pods) in the output hook, where the daemon's own
+// connections are excluded by cgroup.
+package nftables
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tableName      = "gke-metadata-server"
+	preroutingName = "prerouting"
+	outputName     = "output"
+
+	gkeMetadataServerPort = 80
+)
+
+var gkeMetadataServerIP = netip.MustParseAddr("169.254.169.254")
+
+// LoadAndAttach returns a function that installs the DNAT rules to the
+// emulator's IP and port. The table is replaced atomically, so a new daemon
+// instance takes over the rules of a previous one without a window where
+// connections are not translated. The returned close function deletes the
+// table, unless a successor has already taken it over.
+func LoadAndAttach(emulatorIP netip.Addr, emulatorPort int) func() (func() error, error) {
+	return func() (func() error, error) {
+		cgroupPath, cgroupID, err := attestation.SelfCgroup()
+		if err != nil {
+			return nil, fmt.Errorf("error resolving emulator cgroup: %w", err)
+		}
+		excludeCgroup, err := excludeCgroupExprs(cgroupPath, cgroupID)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := nftables.New()
+		if err != nil {
+			return nil, fmt.Errorf("error creating nftables connection: %w", err)
+		}
+
+		table := &nftables.Table{Name: tableName, Family: nftables.TableFamilyIPv4}
+		conn.AddTable(table)
+		prerouting := conn.AddChain(&nftables.Chain{
+			Name:     preroutingName,
+			Table:    table,
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityNATDest,
+		})
+		output := conn.AddChain(&nftables.Chain{
+			Name:     outputName,
+			Table:    table,
+			Type:     nftables.ChainTypeNAT,
+			Hooknum:  nftables.ChainHookOutput,
+			Priority: nftables.ChainPriorityNATDest,
+		})
+		conn.FlushTable(table)
+
+		conn.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: prerouting,
+			Exprs: dnatExprs(emulatorIP, emulatorPort),
+		})
+		conn.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: output,
+			Exprs: excludeCgroup,
+		})
+		conn.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: output,
+			Exprs: dnatExprs(emulatorIP, emulatorPort),
+		})
+		if err := conn.Flush(); err != nil {
+			return nil, fmt.Errorf("error installing nftables DNAT rules: %w", err)
+		}
+
+		return func() error {
+			handedOff, err := handedOff(conn, table, output, cgroupID)
+			if err != nil {
+				return err
+			}
+			if handedOff {
+				return nil
+			}
+			conn.DelTable(table)
+			if err := conn.Flush(); err != nil {
+				return fmt.Errorf("error deleting nftables table: %w", err)
+			}
+			return nil
+		}, nil
+	}
+}
+
+// dnatExprs matches "ip daddr 169.254.169.254 tcp dport 80" and translates
+// the destination to the emulator.
+func dnatExprs(emulatorIP netip.Addr, emulatorPort int) []expr.Any {
+	metadataIP := gkeMetadataServerIP.As4()
+	emulatorIPv4 := emulatorIP.As4()
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: metadataIP[:]},
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binary.BigEndian.AppendUint16(nil, gkeMetadataServerPort)},
+		&expr.Immediate{Register: 1, Data: emulatorIPv4[:]},
+		&expr.Immediate{Register: 2, Data: binary.BigEndian.AppendUint16(nil, uint16(emulatorPort))},
+		&expr.NAT{
+			Type:        expr.NATTypeDestNAT,
+			Family:      unix.NFPROTO_IPV4,
+			RegAddrMin:  1,
+			RegProtoMin: 2,
+		},
+	}
+}
+
+// excludeCgroupExprs accepts the connections of sockets in the given cgroup,
+// i.e. "socket cgroupv2 level <depth> <path> accept", so that the daemon's
+// own connections to 169.254.169.254:80 (e.g. to the real metadata server)
+// are not translated. The cgroup must be the daemon's own pod cgroup, or
+// the connections of the other processes in it would not be translated
+// either. That's not the case e.g. on nodes with the hybrid cgroup layout
+// where the container runtime leaves the pods in the root cgroup of the
+// cgroup v2 hierarchy, or in a cgroup of the host.
+func excludeCgroupExprs(cgroupPath string, cgroupID uint64) ([]expr.Any, error) {
+	if !attestation.IsPodCgroupPath(cgroupPath) {
+		return nil, fmt.Errorf("the emulator cgroup v2 path %q is not a pod cgroup, so the connections of the emulator "+
+			"cannot be told apart from the ones of the other processes in the cgroup", cgroupPath)
+	}
+	level := uint32(len(strings.FieldsFunc(cgroupPath, func(r rune) bool { return r == '/' })))
+	return []expr.Any{
+		&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: level, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binary.NativeEndian.AppendUint64(nil, cgroupID)},
+		&expr.Verdict{Kind: expr.VerdictAccept},
+	}, nil
+}
+
+// RemoveTable deletes the table left behind by a daemon instance that ran
+// in the nftables routing mode, e.g. one that crashed before the node was
+// switched to another routing mode, so it stops translating the
+// connections to a port where nothing listens anymore.
+func RemoveTable() error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("error creating nftables connection: %w", err)
+	}
+	tables, err := conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return fmt.Errorf("error listing nftables tables: %w", err)
+	}
+	for _, table := range tables {
+		if table.Name != tableName {
+			continue
+		}
+		conn.DelTable(table)
+		if err := conn.Flush(); err != nil {
+			return fmt.Errorf("error deleting nftables table: %w", err)
+		}
+	}
+	return nil
+}
+
+// handedOff reports whether a successor daemon instance took over the
+// table, i.e. the output chain no longer excludes our cgroup.
+func handedOff(conn *nftables.Conn, table *nftables.Table, output *nftables.Chain, cgroupID uint64) (bool, error) {
+	rules, err := conn.GetRules(table, output)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) {
+			return true, nil
+		}
+		return false, fmt.Errorf("error listing nftables rules: %w", err)
+	}
+	id := binary.NativeEndian.AppendUint64(nil, cgroupID)
+	for _, rule := range rules {
+		for _, e := range rule.Exprs {
+			if cmp, ok := e.(*expr.Cmp); ok && bytes.Equal(cmp.Data, id) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// OriginalDst returns the destination of the connection before it was
+// translated by the DNAT rules, as recorded by conntrack. For connections
+// that were not translated this is the local address of the connection.
+func OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// SO_ORIGINAL_DST fills a struct sockaddr_in, which has the size of
+		// struct ipv6_mreq.
+		var mreq *unix.IPv6Mreq
+		mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+		if sockErr != nil {
+			return
+		}
+		sa := mreq.Multiaddr
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+			Port: int(binary.BigEndian.Uint16(sa[2:4])),
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error getting original destination of connection: %w", err)
+	}
+	return addr, nil
+}
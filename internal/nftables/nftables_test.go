@@ -0,0 +1,86 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package nftables
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDNATExprs(t *testing.T) {
+	exprs := dnatExprs(netip.MustParseAddr("10.0.0.7"), 16321)
+	require.Len(t, exprs, 9)
+
+	// ip daddr 169.254.169.254
+	assert.Equal(t, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4}, exprs[0])
+	assert.Equal(t, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{169, 254, 169, 254}}, exprs[1])
+
+	// meta l4proto tcp
+	assert.Equal(t, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}}, exprs[3])
+
+	// tcp dport 80
+	assert.Equal(t, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2}, exprs[4])
+	assert.Equal(t, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 80}}, exprs[5])
+
+	// dnat to 10.0.0.7:16321
+	assert.Equal(t, &expr.Immediate{Register: 1, Data: []byte{10, 0, 0, 7}}, exprs[6])
+	assert.Equal(t, &expr.Immediate{Register: 2, Data: binary.BigEndian.AppendUint16(nil, 16321)}, exprs[7])
+	assert.Equal(t, &expr.NAT{
+		Type:        expr.NATTypeDestNAT,
+		Family:      unix.NFPROTO_IPV4,
+		RegAddrMin:  1,
+		RegProtoMin: 2,
+	}, exprs[8])
+}
+
+func TestExcludeCgroupExprs(t *testing.T) {
+	const cgroupID = 12345
+	for _, tt := range []struct {
+		name  string
+		path  string
+		level uint32
+		err   bool
+	}{
+		{
+			name:  "systemd driver",
+			path:  "/kubepods.slice/kubepods-besteffort.slice/kubepods-besteffort-pod12345678_1234_1234_1234_123456789abc.slice/cri-containerd-0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef.scope",
+			level: 4,
+		},
+		{
+			name:  "cgroupfs driver",
+			path:  "/kubepods/besteffort/pod12345678-1234-1234-1234-123456789abc/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			level: 4,
+		},
+		{
+			name: "root cgroup",
+			path: "/",
+			err:  true,
+		},
+		{
+			name: "host cgroup",
+			path: "/system.slice/containerd.service",
+			err:  true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			exprs, err := excludeCgroupExprs(tt.path, cgroupID)
+			if tt.err {
+				require.ErrorContains(t, err, "is not a pod cgroup")
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, []expr.Any{
+				&expr.Socket{Key: expr.SocketKeyCgroupv2, Level: tt.level, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binary.NativeEndian.AppendUint64(nil, cgroupID)},
+				&expr.Verdict{Kind: expr.VerdictAccept},
+			}, exprs)
+		})
+	}
+}
@@ -20,7 +20,7 @@ type (
 
 	ProviderOptions struct {
 		NodeName   string
-		KubeClient *kubernetes.Clientset
+		KubeClient kubernetes.Interface
 	}
 )
 
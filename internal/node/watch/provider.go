@@ -29,7 +29,7 @@ type (
 	ProviderOptions struct {
 		NodeName       string
 		FallbackSource node.Provider
-		KubeClient     *kubernetes.Clientset
+		KubeClient     kubernetes.Interface
 		ResyncPeriod   time.Duration
 	}
 )
@@ -62,7 +62,7 @@ func (p *Provider) Get(ctx context.Context) (*corev1.Node, error) {
 	}
 
 	logging.
-		FromContext(ctx).
+		WithComponent(logging.FromContext(ctx), logging.ComponentWatch).
 		WithError(err).
 		Error("error getting node from cache, delegating request to fallback source")
 
@@ -86,7 +86,7 @@ func (p *Provider) get() (*corev1.Node, error) {
 
 func (p *Provider) Start(ctx context.Context) {
 	go func() {
-		logging.FromContext(ctx).Info("starting watch node...")
+		logging.WithComponent(logging.FromContext(ctx), logging.ComponentWatch).Info("starting watch node...")
 		p.informer.Run(p.closeChannel)
 		close(p.closedChannel)
 	}()
@@ -22,7 +22,7 @@ type (
 
 	ProviderOptions struct {
 		NodeName   string
-		KubeClient *kubernetes.Clientset
+		KubeClient kubernetes.Interface
 	}
 )
 
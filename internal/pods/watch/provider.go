@@ -32,20 +32,31 @@ type (
 		closedChannel chan struct{}
 		informer      cache.SharedIndexInformer
 		listeners     []Listener
+		podListeners  []PodListener
 	}
 
 	ProviderOptions struct {
 		NodeName        string
 		FallbackSource  pods.Provider
-		KubeClient      *kubernetes.Clientset
+		KubeClient      kubernetes.Interface
 		MetricsRegistry *prometheus.Registry
 		ResyncPeriod    time.Duration
+
+		// BindServiceAccountTokens makes the listeners receive ServiceAccount
+		// references bound to the pods, see serviceaccounts.BoundReferenceFromPod.
+		BindServiceAccountTokens bool
 	}
 
 	Listener interface {
 		AddPodServiceAccount(*serviceaccounts.Reference)
 		DeletePodServiceAccount(*serviceaccounts.Reference)
 	}
+
+	// PodListener is notified of every version of the pods of the node.
+	PodListener interface {
+		UpdatePod(*corev1.Pod)
+		DeletePod(*corev1.Pod)
+	}
 )
 
 const (
@@ -101,23 +112,44 @@ func NewProvider(opts ProviderOptions) *Provider {
 	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj any) {
 			numPods.Inc()
-			saRef := serviceaccounts.ReferenceFromPod(obj.(*corev1.Pod))
+			pod := obj.(*corev1.Pod)
+			saRef := p.serviceAccountReference(pod)
 			for _, l := range p.listeners {
 				l.AddPodServiceAccount(saRef)
 			}
+			for _, l := range p.podListeners {
+				l.UpdatePod(pod)
+			}
+		},
+		UpdateFunc: func(_, obj any) {
+			pod := obj.(*corev1.Pod)
+			for _, l := range p.podListeners {
+				l.UpdatePod(pod)
+			}
 		},
 		DeleteFunc: func(obj any) {
 			numPods.Dec()
-			saRef := serviceaccounts.ReferenceFromPod(obj.(*corev1.Pod))
+			pod := obj.(*corev1.Pod)
+			saRef := p.serviceAccountReference(pod)
 			for _, l := range p.listeners {
 				l.DeletePodServiceAccount(saRef)
 			}
+			for _, l := range p.podListeners {
+				l.DeletePod(pod)
+			}
 		},
 	})
 
 	return p
 }
 
+func (p *Provider) serviceAccountReference(pod *corev1.Pod) *serviceaccounts.Reference {
+	if p.opts.BindServiceAccountTokens {
+		return serviceaccounts.BoundReferenceFromPod(pod)
+	}
+	return serviceaccounts.ReferenceFromPod(pod)
+}
+
 func (p *Provider) GetByIP(ctx context.Context, ipAddr string) (*corev1.Pod, error) {
 	pod, err := p.getByIP(ipAddr)
 	if err == nil {
@@ -128,7 +160,7 @@ func (p *Provider) GetByIP(ctx context.Context, ipAddr string) (*corev1.Pod, err
 	}
 
 	logging.
-		FromContext(ctx).
+		WithComponent(logging.FromContext(ctx), logging.ComponentWatch).
 		WithError(err).
 		WithField("cluster_ip", ipAddr).
 		Error("error getting pod by cluster ip from cache, delegating request to fallback source")
@@ -151,7 +183,7 @@ func (p *Provider) GetByUID(ctx context.Context, uid string) (*corev1.Pod, error
 	}
 
 	logging.
-		FromContext(ctx).
+		WithComponent(logging.FromContext(ctx), logging.ComponentWatch).
 		WithError(err).
 		WithField("pod_uid", uid).
 		Error("error getting pod by uid from cache, delegating request to fallback source")
@@ -217,7 +249,7 @@ func (p *Provider) getByIP(ipAddr string) (*corev1.Pod, error) {
 
 func (p *Provider) Start(ctx context.Context) {
 	go func() {
-		logging.FromContext(ctx).Info("starting watch pods...")
+		logging.WithComponent(logging.FromContext(ctx), logging.ComponentWatch).Info("starting watch pods...")
 		p.informer.Run(p.closeChannel)
 		close(p.closedChannel)
 	}()
@@ -232,3 +264,7 @@ func (p *Provider) Close() error {
 func (p *Provider) AddListener(l Listener) {
 	p.listeners = append(p.listeners, l)
 }
+
+func (p *Provider) AddPodListener(l PodListener) {
+	p.podListeners = append(p.podListeners, l)
+}
@@ -4,14 +4,19 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
 	"errors"
-	"io"
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	pkghttp "github.com/matheuscscp/gke-metadata-server/internal/http"
 	"github.com/matheuscscp/gke-metadata-server/internal/logging"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -19,70 +24,173 @@ import (
 )
 
 func logger() logrus.FieldLogger {
-	return logging.FromContext(context.Background()).WithField("component", "proxy")
+	return logging.WithComponent(logging.FromContext(context.Background()), logging.ComponentProxy)
 }
 
-type proxy struct {
+// Proxy is the listener returned by Listen.
+type Proxy struct {
 	net.Listener
 
-	queue  chan net.Conn
-	ctx    context.Context
-	cancel context.CancelFunc
+	extra     []net.Listener
+	queue     chan net.Conn
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	closeErr  error
 
-	dialLatencyMillis *prometheus.HistogramVec
-	activeConnections prometheus.Gauge
+	reverseProxy  *httputil.ReverseProxy
+	transport     *http.Transport
+	upstreamConns atomic.Int64
+	opts          Options
 }
 
-type sniffedConn struct {
+// Options configures Listen.
+type Options struct {
+	// Upstream is where the requests to 169.254.169.254:80 that are not
+	// metadata requests are proxied. NoUpstream answers them with a
+	// synthetic 404 instead. Default: DefaultUpstream.
+	Upstream string
+
+	// ExtraTargets are destinations intercepted in addition to
+	// 169.254.169.254:80. Each gets its own listener on the same host as
+	// the address of Listen and on the target's port, whose requests that
+	// are not metadata requests are proxied to the target's upstream.
+	ExtraTargets []Target
+
+	DialTimeout           time.Duration // default: DefaultDialTimeout
+	ResponseHeaderTimeout time.Duration // default: no timeout
+
+	DialLatencyMillis *prometheus.HistogramVec // labeled by upstream
+	DialFailures      *prometheus.CounterVec   // labeled by upstream and reason
+	ActiveConnections prometheus.Gauge
+
+	// DialLatencyMillisByClientIP is labeled by upstream and client_ip.
+	// When set, the connections to the upstreams are not reused, so each
+	// dial is observed for the client whose request opened it. Optional.
+	DialLatencyMillisByClientIP *prometheus.HistogramVec
+}
+
+// conn is a connection accepted by the proxy, tagged with the upstream of
+// the listener that accepted it.
+type conn struct {
+	net.Conn
+	upstream string
+}
+
+// upstreamConn is a connection to an upstream, tracked for Wait.
+type upstreamConn struct {
 	net.Conn
-	buf []byte
+	once  sync.Once
+	close func()
 }
 
+type (
+	upstreamContextKey struct{}
+	clientIPContextKey struct{}
+)
+
+// DefaultDialTimeout bounds the connection to the upstreams by default.
+const DefaultDialTimeout = time.Second
+
 // Listen creates a new proxy listener on the given network and address.
-// It sniffs incoming connections to decide whether to route them to the
-// metadata server or to 169.254.169.254:80. It's supposed to be used with
-// the eBPF routing mode, which allows for proxying connections due to how
-// eBPF can identify the calling process. Supports only the "tcp" network.
-func Listen(address string, dialLatencyMillis *prometheus.HistogramVec,
-	activeConnections prometheus.Gauge) (net.Listener, error) {
-
-	l, err := net.Listen("tcp", address)
+// The accepted connections are meant to be served by the metadata server
+// with Handler, which routes each request on a connection separately:
+// metadata requests go to the metadata handlers and any other request is
+// reverse-proxied to the upstream, so a client can reuse a keep-alive
+// connection for both. The metadata server sees the original connection of
+// the client, so the kernel attestation of the connection is kept. It's
+// supposed to be used with the eBPF routing mode, which allows for proxying
+// connections due to how eBPF can identify the calling process. Supports
+// only the "tcp" network.
+func Listen(address string, opts Options) (*Proxy, error) {
+	if opts.Upstream == "" {
+		opts.Upstream = DefaultUpstream
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultDialTimeout
+	}
+
+	l, err := pkghttp.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
+		l.Close()
 		return nil, err
 	}
+	var extra []net.Listener
+	for _, t := range opts.ExtraTargets {
+		el, err := pkghttp.Listen(net.JoinHostPort(host, strconv.Itoa(t.Port)))
+		if err != nil {
+			l.Close()
+			for _, el := range extra {
+				el.Close()
+			}
+			return nil, fmt.Errorf("error listening for intercept target %s: %w", t.Address, err)
+		}
+		extra = append(extra, el)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 
-	p := &proxy{
+	p := &Proxy{
 		Listener: l,
 
+		extra:  extra,
 		queue:  make(chan net.Conn, 100),
 		ctx:    ctx,
 		cancel: cancel,
+		opts:   opts,
+	}
+	p.transport = &http.Transport{
+		DialContext:           p.dialUpstream,
+		IdleConnTimeout:       90 * time.Second,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		DisableKeepAlives:     opts.DialLatencyMillisByClientIP != nil,
+	}
+	p.reverseProxy = &httputil.ReverseProxy{
+		// Rewrite instead of Director so no X-Forwarded-* headers are
+		// added, the requests reach the upstream as the client sent them
+		// (e.g. the AWS IMDSv2 rejects requests with X-Forwarded-For).
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = r.In.Context().Value(upstreamContextKey{}).(string)
+			r.Out.Host = r.In.Host
+		},
+		Transport:    p.transport,
+		ErrorHandler: p.handleError,
+	}
 
-		dialLatencyMillis: dialLatencyMillis,
-		activeConnections: activeConnections,
+	go p.serve(l, opts.Upstream)
+	for i, el := range extra {
+		go p.serve(el, opts.ExtraTargets[i].Upstream)
 	}
 
-	go func() {
-		for {
-			c, err := l.Accept()
-			if err != nil {
-				if !errors.Is(err, net.ErrClosed) {
-					logger().WithError(err).Error("error accepting connection")
-				}
-				p.Close()
-				return
-			}
+	return p, nil
+}
 
-			go p.handle(c)
+func (p *Proxy) serve(l net.Listener, upstream string) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger().WithError(err).Error("error accepting connection")
+			}
+			p.Close()
+			return
 		}
-	}()
 
-	return p, nil
+		select {
+		case p.queue <- &conn{Conn: c, upstream: upstream}:
+		case <-p.ctx.Done():
+			c.Close()
+			return
+		}
+	}
 }
 
 // Accept implements net.Listener.
-func (p *proxy) Accept() (net.Conn, error) {
+func (p *Proxy) Accept() (net.Conn, error) {
 	select {
 	case conn := <-p.queue:
 		return conn, nil
@@ -92,130 +200,173 @@ func (p *proxy) Accept() (net.Conn, error) {
 }
 
 // Addr implements net.Listener.
-func (p *proxy) Addr() net.Addr {
+func (p *Proxy) Addr() net.Addr {
 	return p.Listener.Addr()
 }
 
-// Close implements net.Listener.
-func (p *proxy) Close() error {
-	p.cancel()
-	return p.Listener.Close()
+// TargetAddrs returns the addresses of the listeners of the extra targets,
+// in the order of Options.ExtraTargets.
+func (p *Proxy) TargetAddrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(p.extra))
+	for _, l := range p.extra {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
 }
 
-func (p *proxy) handle(client net.Conn) {
-	l := logger().WithField("clientAddr", client.RemoteAddr().String())
+// Close implements net.Listener. It stops accepting new connections, but
+// connections already being proxied are left running, see Wait. Closing
+// more than once returns the result of the first call, as both the
+// metadata server and the accept loops close the proxy.
+func (p *Proxy) Close() error {
+	p.closeOnce.Do(func() {
+		p.cancel()
+		errs := []error{p.Listener.Close()}
+		for _, l := range p.extra {
+			errs = append(errs, l.Close())
+		}
+		p.closeErr = errors.Join(errs...)
+	})
+	return p.closeErr
+}
 
-	// Sniff the HTTP request line to decide where this connection goes. The
-	// genuine GKE metadata server serves the root path and everything under
-	// /computeMetadata, so those must reach the inner metadata server. The root
-	// probe is what ADC libraries (google-auth ping, the Go SDK testOnGCE) use
-	// to detect GCE, so it cannot be forwarded upstream. Any other request is
-	// proxied through to 169.254.169.254:80 verbatim. We read just enough of
-	// "METHOD PATH HTTP/.." to extract the path, bounded by sniffCap so a slow
-	// or garbage client cannot make us buffer unboundedly.
-	const sniffCap = 8192
-	var buf []byte
-	chunk := make([]byte, 256)
+// Wait blocks until all the connections to the upstreams finish, or until
+// ctx is done. It is meant to be called for draining the proxy after the
+// metadata server finished serving the requests (which leaves only the
+// upgraded connections, e.g. WebSockets, in use). Idle keep-alive
+// connections to the upstreams are closed.
+func (p *Proxy) Wait(ctx context.Context) error {
+	// Connections of requests that finish while waiting go idle too.
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
 	for {
-		n, err := client.Read(chunk)
-		buf = append(buf, chunk[:n]...)
-		if requestPathComplete(buf) || len(buf) >= sniffCap {
-			break
+		p.transport.CloseIdleConnections()
+		if p.upstreamConns.Load() == 0 {
+			return nil
 		}
-		if err != nil {
-			l.WithError(err).Error("error reading from client")
-			client.Close()
-			return
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for proxied connections to finish: %w", ctx.Err())
+		case <-ticker.C:
 		}
 	}
-	client = &sniffedConn{Conn: client, buf: buf}
+}
 
-	// if it targets the metadata surface, enqueue it for the inner server
-	if isMetadataRequest(buf) {
-		select {
-		case p.queue <- client:
-		case <-p.ctx.Done():
-			client.Close()
-		}
-		return
+// ConnContext stores the upstream of a connection accepted by the proxy in
+// the context of the connection, for Handler. It must be called from the
+// http.Server ConnContext hook. Other connections are left untouched.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if pc, ok := c.(*conn); ok {
+		ctx = context.WithValue(ctx, upstreamContextKey{}, pc.upstream)
 	}
+	return ctx
+}
 
-	// not a metadata request. proxy
-	const serverAddr = "169.254.169.254:80"
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+// Handler routes each request to the metadata handler if it targets the
+// metadata surface served by the emulator, or arrived on a connection not
+// accepted by the proxy. Any other request is reverse-proxied to the
+// upstream of its connection.
+func (p *Proxy) Handler(metadata http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream, ok := r.Context().Value(upstreamContextKey{}).(string)
+		if !ok || isMetadataRequest(r.Method, r.URL.Path) {
+			metadata.ServeHTTP(w, r)
+			return
+		}
+		if upstream == NoUpstream {
+			respondNoUpstream(w, r)
+			return
+		}
+		if p.opts.DialLatencyMillisByClientIP != nil {
+			clientIP := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				clientIP = host
+			}
+			r = r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, clientIP))
+		}
+		p.reverseProxy.ServeHTTP(w, r)
+	})
+}
+
+func (p *Proxy) dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	clientIP, byClientIP := ctx.Value(clientIPContextKey{}).(string)
+	ctx, cancel := context.WithTimeout(ctx, p.opts.DialTimeout)
 	defer cancel()
 	start := time.Now()
-	server, err := (&net.Dialer{}).DialContext(ctx, "tcp", serverAddr)
+	c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+	latency := float64(time.Since(start).Milliseconds())
+	p.opts.DialLatencyMillis.WithLabelValues(addr).Observe(latency)
+	if byClientIP {
+		p.opts.DialLatencyMillisByClientIP.WithLabelValues(addr, clientIP).Observe(latency)
+	}
 	if err != nil {
-		p.dialLatencyMillis.
-			WithLabelValues(client.RemoteAddr().(*net.TCPAddr).IP.String()).
-			Observe(float64(time.Since(start).Milliseconds()))
-		client.Close()
-		if !errors.Is(err, context.DeadlineExceeded) {
-			l.WithError(err).Errorf("error dialing %s", serverAddr)
+		reason := "error"
+		switch {
+		case errors.Is(err, context.Canceled):
+			reason = "canceled"
+		case errors.Is(err, context.DeadlineExceeded):
+			reason = "timeout"
+			err = fmt.Errorf("timed out after %s dialing upstream: %w", p.opts.DialTimeout, err)
 		}
-		return
-	}
-	p.dialLatencyMillis.
-		WithLabelValues(client.RemoteAddr().(*net.TCPAddr).IP.String()).
-		Observe(float64(time.Since(start).Milliseconds()))
-	p.activeConnections.Inc()
-	defer p.activeConnections.Dec()
-	defer client.Close()
-	defer server.Close()
-	done := make(chan struct{}, 2)
-	go func() {
-		io.Copy(server, client)
-		server.(*net.TCPConn).CloseWrite()
-		done <- struct{}{}
-	}()
-	go func() {
-		io.Copy(client, server)
-		client.(*sniffedConn).Conn.(*net.TCPConn).CloseWrite()
-		done <- struct{}{}
-	}()
-	<-done
-	<-done
-}
-
-// requestPathComplete reports whether buf already contains the full HTTP
-// request path, meaning the second space in "METHOD PATH HTTP/.." has been read
-// or the request line ended, so sniffing can stop.
-func requestPathComplete(buf []byte) bool {
-	if bytes.IndexByte(buf, '\n') >= 0 {
-		return true
-	}
-	sp := bytes.IndexByte(buf, ' ')
-	return sp >= 0 && bytes.IndexByte(buf[sp+1:], ' ') >= 0
-}
-
-// isMetadataRequest reports whether the sniffed request line targets the
-// metadata surface served by the emulator, meaning a GET for the root path or
-// any path under /computeMetadata. This mirrors what the genuine GKE metadata
-// server serves with 200 and the Metadata-Flavor Google header. Any other
-// request is proxied through to the real 169.254.169.254:80 endpoint.
-func isMetadataRequest(buf []byte) bool {
-	const method = "GET "
-	if !bytes.HasPrefix(buf, []byte(method)) {
-		return false
+		p.opts.DialFailures.WithLabelValues(addr, reason).Inc()
+		return nil, err
 	}
-	rest := buf[len(method):]
-	sp := bytes.IndexByte(rest, ' ')
-	if sp < 0 {
-		return false
+	p.upstreamConns.Add(1)
+	p.opts.ActiveConnections.Inc()
+	return &upstreamConn{Conn: c, close: func() {
+		p.opts.ActiveConnections.Dec()
+		p.upstreamConns.Add(-1)
+	}}, nil
+}
+
+func (p *Proxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	l := logger().WithFields(logrus.Fields{
+		"clientAddr": r.RemoteAddr,
+		"upstream":   r.URL.Host,
+	}).WithError(err)
+	status := http.StatusBadGateway
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client went away.
+		l.Debug("client canceled proxied request")
+	case errors.Is(err, context.DeadlineExceeded) || isTimeout(err):
+		status = http.StatusGatewayTimeout
+		l.Warn("timeout proxying request")
+	default:
+		l.Error("error proxying request")
 	}
-	path := string(rest[:sp])
-	if q := strings.IndexByte(path, '?'); q >= 0 {
-		path = path[:q]
+	w.WriteHeader(status)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// respondNoUpstream answers the requests that are not metadata requests
+// when no upstream is configured.
+func respondNoUpstream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, "gke-metadata-server: %s %s is not a GCP metadata request, and no upstream is configured for proxying it\n",
+		r.Method, r.URL.Path)
+}
+
+// isMetadataRequest reports whether the request targets the metadata
+// surface served by the emulator, meaning a GET for the root path or any
+// path under /computeMetadata. This mirrors what the genuine GKE metadata
+// server serves with 200 and the Metadata-Flavor Google header. The root
+// probe is what ADC libraries (google-auth ping, the Go SDK testOnGCE) use
+// to detect GCE, so it cannot be forwarded upstream. Any other request is
+// proxied through to the upstream.
+func isMetadataRequest(method, path string) bool {
+	if method != http.MethodGet {
+		return false
 	}
 	return path == "/" || path == "/computeMetadata" || strings.HasPrefix(path, "/computeMetadata/")
 }
 
-func (s *sniffedConn) Read(b []byte) (int, error) {
-	if len(s.buf) > 0 {
-		n := copy(b, s.buf)
-		s.buf = s.buf[n:]
-		return n, nil
-	}
-	return s.Conn.Read(b)
+func (u *upstreamConn) Close() error {
+	u.once.Do(u.close)
+	return u.Conn.Close()
 }
@@ -3,56 +3,271 @@
 
 package proxy
 
-import "testing"
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
 func TestIsMetadataRequest(t *testing.T) {
 	for _, tt := range []struct {
-		name string
-		line string
-		want bool
+		name   string
+		method string
+		path   string
+		want   bool
 	}{
 		// Metadata surface, must be served by the inner metadata server.
-		{"root", "GET / HTTP/1.1\r\nHost: metadata\r\n\r\n", true},
-		{"root with query", "GET /?recursive=true HTTP/1.1\r\n\r\n", true},
-		{"computeMetadata no slash", "GET /computeMetadata HTTP/1.1\r\n\r\n", true},
-		{"computeMetadata slash", "GET /computeMetadata/ HTTP/1.1\r\n\r\n", true},
-		{"v1 dir", "GET /computeMetadata/v1/ HTTP/1.1\r\n\r\n", true},
-		{"v1 leaf", "GET /computeMetadata/v1/instance/name HTTP/1.1\r\n\r\n", true},
-		{"v1 token with query", "GET /computeMetadata/v1/instance/service-accounts/default/token?scopes=x HTTP/1.1\r\n\r\n", true},
-
-		// Not metadata, must be proxied through to the real endpoint.
-		{"proxy test path", "GET /_proxy_test HTTP/1.1\r\n\r\n", false},
-		{"aws imds", "GET /latest/meta-data/ HTTP/1.1\r\n\r\n", false},
-		{"computeMetadata prefix lookalike", "GET /computeMetadatax HTTP/1.1\r\n\r\n", false},
-		{"non-GET method", "POST /computeMetadata/v1/x HTTP/1.1\r\n\r\n", false},
-		{"empty", "", false},
-		{"only method", "GET ", false},
+		{"root", http.MethodGet, "/", true},
+		{"computeMetadata no slash", http.MethodGet, "/computeMetadata", true},
+		{"computeMetadata slash", http.MethodGet, "/computeMetadata/", true},
+		{"v1 dir", http.MethodGet, "/computeMetadata/v1/", true},
+		{"v1 leaf", http.MethodGet, "/computeMetadata/v1/instance/name", true},
+		{"v1beta1 leaf", http.MethodGet, "/computeMetadata/v1beta1/instance/name", true},
+
+		// Not metadata, must be proxied through to the upstream.
+		{"proxy test path", http.MethodGet, "/_proxy_test", false},
+		{"aws imds", http.MethodGet, "/latest/meta-data/", false},
+		{"computeMetadata prefix lookalike", http.MethodGet, "/computeMetadatax", false},
+		{"non-GET method", http.MethodPost, "/computeMetadata/v1/x", false},
+		{"aws imdsv2 token", http.MethodPut, "/latest/api/token", false},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := isMetadataRequest([]byte(tt.line)); got != tt.want {
-				t.Fatalf("isMetadataRequest(%q) = %v, want %v", tt.line, got, tt.want)
-			}
+			assert.Equal(t, tt.want, isMetadataRequest(tt.method, tt.path))
 		})
 	}
 }
 
-func TestRequestPathComplete(t *testing.T) {
-	for _, tt := range []struct {
-		name string
-		buf  string
-		want bool
-	}{
-		{"full line", "GET / HTTP/1.1", true},
-		{"two spaces only", "GET /computeMetadata/v1 ", true},
-		{"newline ends line", "GET /\r\n", true},
-		{"method and path no trailing space", "GET /computeMetadata/v1", false},
-		{"only method", "GET ", false},
-		{"empty", "", false},
-	} {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := requestPathComplete([]byte(tt.buf)); got != tt.want {
-				t.Fatalf("requestPathComplete(%q) = %v, want %v", tt.buf, got, tt.want)
+// newOptions returns options proxying the requests on a single extra
+// target listening on a free port to the given upstream.
+func newOptions(upstream string) Options {
+	return Options{
+		ExtraTargets: []Target{{
+			Address:  netip.MustParseAddrPort("169.254.169.254:8080"),
+			Upstream: upstream,
+		}},
+		DialLatencyMillis: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "dial"}, []string{"upstream"}),
+		DialFailures:      prometheus.NewCounterVec(prometheus.CounterOpts{Name: "failures"}, []string{"upstream", "reason"}),
+		ActiveConnections: prometheus.NewGauge(prometheus.GaugeOpts{Name: "active"}),
+	}
+}
+
+// targetURL returns the URL of the given path on the extra target.
+func targetURL(p *Proxy, path string) string {
+	return "http://" + p.TargetAddrs()[0].String() + path
+}
+
+// startProxy serves the proxy with an inner handler answering "metadata"
+// for the metadata requests.
+func startProxy(t *testing.T, opts Options) *Proxy {
+	t.Helper()
+	p, err := Listen("127.0.0.1:0", opts)
+	require.NoError(t, err)
+	metadata := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "metadata")
+	})
+	s := &http.Server{
+		ConnContext: ConnContext,
+		Handler:     p.Handler(metadata),
+	}
+	go s.Serve(p)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return p
+}
+
+// startUpstream serves "upstream <path>" and records the X-Forwarded-For
+// header of the requests.
+func startUpstream(t *testing.T) (string, chan string) {
+	t.Helper()
+	forwardedFor := make(chan string, 10)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor <- r.Header.Get("X-Forwarded-For")
+		io.WriteString(w, "upstream "+r.URL.Path)
+	})}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String(), forwardedFor
+}
+
+// roundTrip sends a request on the given keep-alive connection and returns
+// the response body.
+func roundTrip(t *testing.T, c net.Conn, br *bufio.Reader, method, path string) string {
+	t.Helper()
+	_, err := io.WriteString(c, method+" "+path+" HTTP/1.1\r\nHost: 169.254.169.254\r\n\r\n")
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(br, nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.False(t, resp.Close)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestRoutesEachRequestOnKeepAliveConnection(t *testing.T) {
+	upstream, forwardedFor := startUpstream(t)
+	opts := newOptions(upstream)
+	p := startProxy(t, opts)
+
+	c, err := net.Dial("tcp", p.TargetAddrs()[0].String())
+	require.NoError(t, err)
+	defer c.Close()
+	br := bufio.NewReader(c)
+
+	assert.Equal(t, "metadata", roundTrip(t, c, br, http.MethodGet, "/computeMetadata/v1/instance/name"))
+	assert.Equal(t, "upstream /other", roundTrip(t, c, br, http.MethodGet, "/other"))
+	assert.Equal(t, "metadata", roundTrip(t, c, br, http.MethodGet, "/"))
+	assert.Equal(t, "upstream /latest/api/token", roundTrip(t, c, br, http.MethodPut, "/latest/api/token"))
+
+	// The requests reach the upstream without forwarding headers.
+	assert.Empty(t, <-forwardedFor)
+	assert.Empty(t, <-forwardedFor)
+}
+
+func TestUnreachableUpstream(t *testing.T) {
+	opts := newOptions("127.0.0.1:1")
+	p := startProxy(t, opts)
+
+	resp, err := http.Get(targetURL(p, "/other"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, 1.0, testutil.ToFloat64(opts.DialFailures.WithLabelValues("127.0.0.1:1", "error")))
+}
+
+func TestDialLatencyByClientIP(t *testing.T) {
+	var conns atomic.Int32
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstream := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				conns.Add(1)
 			}
-		})
+		},
+	}
+	go upstream.Serve(l)
+	defer upstream.Close()
+
+	opts := newOptions(l.Addr().String())
+	opts.DialLatencyMillisByClientIP = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "dial_by_client_ip"}, []string{"upstream", "client_ip"})
+	p := startProxy(t, opts)
+
+	for range 2 {
+		resp, err := http.Get(targetURL(p, "/other"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
 	}
+
+	// The upstream connections are not reused, so each request dials and
+	// is observed for its own client.
+	assert.Equal(t, int32(2), conns.Load())
+	assert.Equal(t, 1, testutil.CollectAndCount(opts.DialLatencyMillis))
+	assert.Equal(t, 1, testutil.CollectAndCount(opts.DialLatencyMillisByClientIP))
+	assert.True(t, opts.DialLatencyMillisByClientIP.DeleteLabelValues(l.Addr().String(), "127.0.0.1"))
+}
+
+func TestNoUpstream(t *testing.T) {
+	opts := newOptions(NoUpstream)
+	p := startProxy(t, opts)
+
+	resp, err := http.Get(targetURL(p, "/latest/meta-data/"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "GET /latest/meta-data/ is not a GCP metadata request")
+
+	// Metadata requests are still served.
+	resp, err = http.Get(targetURL(p, "/computeMetadata/v1/"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstream := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})}
+	go upstream.Serve(l)
+	defer upstream.Close()
+
+	opts := newOptions(l.Addr().String())
+	opts.ResponseHeaderTimeout = 50 * time.Millisecond
+	p := startProxy(t, opts)
+
+	resp, err := http.Get(targetURL(p, "/slow"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+}
+
+func TestWaitDrainsUpstreamConnections(t *testing.T) {
+	// An upstream that holds the response until released.
+	release := make(chan struct{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	upstream := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})}
+	go upstream.Serve(l)
+	defer upstream.Close()
+
+	opts := newOptions(l.Addr().String())
+	p := startProxy(t, opts)
+
+	respErr := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(targetURL(p, "/slow"))
+		if err == nil {
+			resp.Body.Close()
+		}
+		respErr <- err
+	}()
+
+	// The request being proxied keeps the upstream connection in use.
+	require.Eventually(t, func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		return p.Wait(ctx) != nil
+	}, time.Second, 10*time.Millisecond)
+
+	// Closing stops accepting new connections but does not cut the
+	// request being proxied.
+	require.NoError(t, p.Close())
+	_, err = net.Dial("tcp", p.Addr().String())
+	require.Error(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, p.Wait(ctx), context.DeadlineExceeded)
+
+	// Once the upstream responds the connection goes idle and is closed.
+	close(release)
+	require.NoError(t, <-respErr)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, p.Wait(ctx))
 }
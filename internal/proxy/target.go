@@ -0,0 +1,158 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// DefaultUpstream is where the requests to 169.254.169.254:80 that are not
+// metadata requests are proxied by default.
+const DefaultUpstream = "169.254.169.254:80"
+
+// NoUpstream is the upstream value for answering the requests that are not
+// metadata requests with a synthetic 404 instead of proxying them.
+const NoUpstream = "none"
+
+// metadataHostname is the name the Google libraries use for the metadata
+// server. It is mapped to 169.254.169.254 without DNS, as it often resolves
+// only inside the pods (see the hostAliases in the README).
+const metadataHostname = "metadata.google.internal"
+
+// gkeMetadataServerAddr is the destination intercepted without a target.
+var gkeMetadataServerAddr = netip.MustParseAddrPort(DefaultUpstream)
+
+// Target is a destination intercepted by the eBPF routing mode in addition
+// to 169.254.169.254:80.
+type Target struct {
+	// Address is the intercepted destination.
+	Address netip.AddrPort
+
+	// Upstream is where the requests that are not metadata requests are
+	// proxied, or NoUpstream. Defaults to Address.
+	Upstream string
+
+	// Port is the emulator port where the connections to Address are
+	// redirected and accepted by the proxy. The proxy listens on a free
+	// port when zero, see Proxy.TargetAddrs.
+	Port int
+}
+
+// ParseTarget parses a comma-separated list of key=value pairs with the
+// keys address (mandatory), port (mandatory) and upstream, e.g.
+// "address=metadata.google.internal:8080,port=16323". The host of the
+// address must be an IPv4 address or a name resolving to one.
+func ParseTarget(s string) (Target, error) {
+	var t Target
+	var address string
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return Target{}, fmt.Errorf("invalid intercept target %q: expected key=value pairs", s)
+		}
+		switch k {
+		case "address":
+			address = v
+		case "upstream":
+			t.Upstream = v
+		case "port":
+			port, err := strconv.ParseUint(v, 10, 16)
+			if err != nil || port == 0 {
+				return Target{}, fmt.Errorf("invalid port in intercept target %q", s)
+			}
+			t.Port = int(port)
+		default:
+			return Target{}, fmt.Errorf("invalid intercept target %q: unknown key %q", s, k)
+		}
+	}
+	if address == "" {
+		return Target{}, fmt.Errorf("invalid intercept target %q: missing address", s)
+	}
+	if t.Port == 0 {
+		return Target{}, fmt.Errorf("invalid intercept target %q: missing port", s)
+	}
+	var err error
+	if t.Address, err = resolveAddress(address); err != nil {
+		return Target{}, fmt.Errorf("invalid address in intercept target %q: %w", s, err)
+	}
+	if t.Upstream == "" {
+		t.Upstream = t.Address.String()
+	}
+	if err := ValidateUpstream(t.Upstream); err != nil {
+		return Target{}, fmt.Errorf("invalid upstream in intercept target %q: %w", s, err)
+	}
+	return t, nil
+}
+
+// ValidateTargets checks that the targets do not intercept
+// 169.254.169.254:80, which is always intercepted, nor the same address
+// twice, and that each target has its own port, not one of reservedPorts
+// (e.g. the ports of the metadata and health servers).
+func ValidateTargets(targets []Target, reservedPorts ...int) error {
+	addresses := make(map[netip.AddrPort]struct{}, len(targets))
+	ports := make(map[int]struct{}, len(targets)+len(reservedPorts))
+	for _, port := range reservedPorts {
+		ports[port] = struct{}{}
+	}
+	for _, t := range targets {
+		if t.Address == gkeMetadataServerAddr {
+			return fmt.Errorf("intercept target address %s is always intercepted", t.Address)
+		}
+		if _, ok := addresses[t.Address]; ok {
+			return fmt.Errorf("duplicate intercept target address %s", t.Address)
+		}
+		addresses[t.Address] = struct{}{}
+		if _, ok := ports[t.Port]; ok {
+			return fmt.Errorf("port %d of intercept target %s is already in use", t.Port, t.Address)
+		}
+		ports[t.Port] = struct{}{}
+	}
+	return nil
+}
+
+// ValidateUpstream checks that upstream is a host:port address or
+// NoUpstream.
+func ValidateUpstream(upstream string) error {
+	if upstream == NoUpstream {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		return fmt.Errorf("upstream must be a <host>:<port> address or %q: %w", NoUpstream, err)
+	}
+	return nil
+}
+
+func resolveAddress(address string) (netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %q", portStr)
+	}
+	if host == metadataHostname {
+		host = "169.254.169.254"
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !ip.Is4() {
+			return netip.AddrPort{}, fmt.Errorf("%s is not an IPv4 address", ip)
+		}
+		return netip.AddrPortFrom(ip, uint16(port)), nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return netip.AddrPortFrom(netip.AddrFrom4([4]byte(ip4)), uint16(port)), nil
+		}
+	}
+	return netip.AddrPort{}, fmt.Errorf("%s has no IPv4 address", host)
+}
@@ -0,0 +1,124 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTarget(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		s    string
+		want Target
+	}{
+		{
+			name: "metadata hostname",
+			s:    "address=metadata.google.internal:8080,port=16323",
+			want: Target{
+				Address:  netip.MustParseAddrPort("169.254.169.254:8080"),
+				Upstream: "169.254.169.254:8080",
+				Port:     16323,
+			},
+		},
+		{
+			name: "no upstream",
+			s:    "address=169.254.169.254:8080,port=16323,upstream=none",
+			want: Target{
+				Address:  netip.MustParseAddrPort("169.254.169.254:8080"),
+				Upstream: NoUpstream,
+				Port:     16323,
+			},
+		},
+		{
+			name: "upstream",
+			s:    "address=169.254.169.254:8080, port=16323, upstream=10.0.0.1:80",
+			want: Target{
+				Address:  netip.MustParseAddrPort("169.254.169.254:8080"),
+				Upstream: "10.0.0.1:80",
+				Port:     16323,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTarget(tt.s)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseTarget_Invalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"address=169.254.169.254:8080",
+		"port=16323",
+		"address=169.254.169.254,port=16323",
+		"address=169.254.169.254:8080,port=0",
+		"address=169.254.169.254:8080,port=70000",
+		"address=[fd00::1]:8080,port=16323",
+		"address=169.254.169.254:8080,port=16323,foo=bar",
+		"address=169.254.169.254:8080;port=16323",
+		"address=169.254.169.254:8080,port=16323,upstream=10.0.0.1",
+	} {
+		t.Run(s, func(t *testing.T) {
+			_, err := ParseTarget(s)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestValidateTargets(t *testing.T) {
+	target := func(address string, port int) Target {
+		return Target{Address: netip.MustParseAddrPort(address), Port: port}
+	}
+	for _, tt := range []struct {
+		name    string
+		targets []Target
+		wantErr string
+	}{
+		{
+			name:    "valid",
+			targets: []Target{target("169.254.169.254:8080", 16323), target("169.254.170.2:80", 16324)},
+		},
+		{
+			name:    "gke metadata server",
+			targets: []Target{target("169.254.169.254:80", 16323)},
+			wantErr: "is always intercepted",
+		},
+		{
+			name:    "duplicate address",
+			targets: []Target{target("169.254.169.254:8080", 16323), target("169.254.169.254:8080", 16324)},
+			wantErr: "duplicate intercept target address",
+		},
+		{
+			name:    "duplicate port",
+			targets: []Target{target("169.254.169.254:8080", 16323), target("169.254.170.2:80", 16323)},
+			wantErr: "port 16323 of intercept target 169.254.170.2:80 is already in use",
+		},
+		{
+			name:    "server port",
+			targets: []Target{target("169.254.169.254:8080", 16321)},
+			wantErr: "port 16321 of intercept target 169.254.169.254:8080 is already in use",
+		},
+		{
+			name:    "health port",
+			targets: []Target{target("169.254.169.254:8080", 16322)},
+			wantErr: "port 16322 of intercept target 169.254.169.254:8080 is already in use",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTargets(tt.targets, 16321, 16322)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -7,15 +7,15 @@
 //
 //	app pod connects 169.254.169.254:80 (non-metadata path)
 //	  → cgroup/connect4 rewrites destination to the daemon's listen addr
-//	  → proxy.handle() sniffs the request, recognises non-metadata
-//	  → daemon dials 169.254.169.254:80
+//	  → proxy.Handler() recognises a non-metadata request
+//	  → daemon reverse-proxies it to 169.254.169.254:80
 //	  → cgroup/connect4 sees the daemon's cgroup, exempts the connect
 //	  → connection routes via lo to this server
 //	  → marker is returned and proxied back to the app pod
 //
 // A successful end-to-end response from the marker server thus proves that
 // the redirect's self-exemption (the kernel-level half) and the userspace
-// sniff/forward (the userspace half) are both wired up correctly.
+// per-request routing (the userspace half) are both wired up correctly.
 package proxytest
 
 import (
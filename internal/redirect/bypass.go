@@ -0,0 +1,175 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package redirect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/matheuscscp/gke-metadata-server/api"
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
+	"github.com/matheuscscp/gke-metadata-server/internal/logging"
+
+	"github.com/cilium/ebpf"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Bypass keeps the eBPF map of the pod cgroups whose connections are not
+// redirected in sync with the pods annotated with
+// api.AnnotationBypassRouting. It is fed by the pod watch (it implements
+// watchpods.PodListener) and attached to the map when the redirect program
+// is loaded. Since the pods bypassing the redirection reach the real
+// metadata server, and hence the credentials of the node, the annotation
+// is only honored for the namespaces and ServiceAccounts allowed by the
+// operator.
+//
+// The cgroup of a pod is created by the container runtime after the pod is
+// scheduled, so it is resolved again on every pod update until found. There
+// is no other retry: a pod whose cgroup is not found is only looked up again
+// on its next update, and its connections are redirected until then.
+type Bypass struct {
+	opts    BypassOptions
+	mu      sync.Mutex
+	pods    map[string]struct{} // UIDs of the annotated pods
+	denied  map[string]struct{} // UIDs of the annotated pods not allowed
+	cgroups map[string]uint64   // cgroup IDs in the map, by pod UID
+	m       *ebpf.Map
+}
+
+// BypassOptions configures NewBypass.
+type BypassOptions struct {
+	// Allowed lists the namespaces (<namespace>) and the ServiceAccounts
+	// (<namespace>/<name>) whose pods may bypass the redirection.
+	Allowed []string
+
+	// CgroupIndex resolves the cgroups of the pods.
+	CgroupIndex *attestation.CgroupIndex
+}
+
+// NewBypass creates a Bypass.
+func NewBypass(opts BypassOptions) (*Bypass, error) {
+	for _, entry := range opts.Allowed {
+		namespace, name, isServiceAccount := strings.Cut(entry, "/")
+		if namespace == "" || (isServiceAccount && (name == "" || strings.Contains(name, "/"))) {
+			return nil, fmt.Errorf("invalid bypass routing allowlist entry '%s', must be <namespace> or <namespace>/<service-account>", entry)
+		}
+	}
+	return &Bypass{
+		opts:    opts,
+		pods:    make(map[string]struct{}),
+		denied:  make(map[string]struct{}),
+		cgroups: make(map[string]uint64),
+	}, nil
+}
+
+// UpdatePod implements watchpods.PodListener.
+func (b *Bypass) UpdatePod(pod *corev1.Pod) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	uid := string(pod.UID)
+	if pod.Annotations[api.AnnotationBypassRouting] != "true" {
+		b.remove(uid)
+		return
+	}
+	if !b.allowed(pod) {
+		b.remove(uid)
+		if _, ok := b.denied[uid]; !ok {
+			b.denied[uid] = struct{}{}
+			logging.FromContext(context.Background()).WithFields(logrus.Fields{
+				"pod":     pod.Namespace + "/" + pod.Name,
+				"pod_uid": uid,
+			}).Warn("pod annotated for bypassing routing is not allowed by the bypass routing allowlist")
+		}
+		return
+	}
+	b.pods[uid] = struct{}{}
+	b.add(uid)
+}
+
+// allowed reports whether the namespace or the ServiceAccount of the given
+// pod is in the allowlist.
+func (b *Bypass) allowed(pod *corev1.Pod) bool {
+	serviceAccount := pod.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	return slices.Contains(b.opts.Allowed, pod.Namespace) ||
+		slices.Contains(b.opts.Allowed, pod.Namespace+"/"+serviceAccount)
+}
+
+// DeletePod implements watchpods.PodListener.
+func (b *Bypass) DeletePod(pod *corev1.Pod) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	uid := string(pod.UID)
+	delete(b.denied, uid)
+	b.remove(uid)
+}
+
+// attach starts syncing the given map, which is loaded by every daemon
+// instance without a pin and hence is empty. The pods already known are
+// added right away, but the ones whose cgroup is not in the index yet are
+// only looked up again on their next update.
+func (b *Bypass) attach(m *ebpf.Map) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.m = m
+	clear(b.cgroups)
+	for uid := range b.pods {
+		b.add(uid)
+	}
+}
+
+// detach stops syncing the map.
+func (b *Bypass) detach() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.m = nil
+	clear(b.cgroups)
+}
+
+// add inserts the cgroup of the given pod in the map. Must be called with
+// b.mu held.
+func (b *Bypass) add(uid string) {
+	if _, ok := b.cgroups[uid]; ok || b.m == nil {
+		return
+	}
+	l := logging.FromContext(context.Background()).WithField("pod_uid", uid)
+	cgid, ok := b.opts.CgroupIndex.PodCgroupID(uid)
+	if !ok {
+		return
+	}
+	var value uint8 = 1
+	if err := b.m.Update(&cgid, &value, ebpf.UpdateAny); err != nil {
+		l.WithError(err).Error("error adding pod to redirect bypass map")
+		return
+	}
+	b.cgroups[uid] = cgid
+	l.WithField("cgroup_id", cgid).Info("pod bypassing routing")
+}
+
+// remove deletes the cgroup of the given pod from the map. Must be called
+// with b.mu held.
+func (b *Bypass) remove(uid string) {
+	delete(b.pods, uid)
+	cgid, ok := b.cgroups[uid]
+	if !ok {
+		return
+	}
+	delete(b.cgroups, uid)
+	l := logging.FromContext(context.Background()).WithFields(logrus.Fields{
+		"pod_uid":   uid,
+		"cgroup_id": cgid,
+	})
+	if err := b.m.Delete(&cgid); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		l.WithError(err).Error("error removing pod from redirect bypass map")
+		return
+	}
+	l.Info("pod no longer bypassing routing")
+}
@@ -0,0 +1,42 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package redirect
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBypassAllowlist(t *testing.T) {
+	for _, entry := range []string{"", "/sa", "ns/", "ns/sa/extra"} {
+		_, err := NewBypass(BypassOptions{Allowed: []string{entry}})
+		assert.ErrorContains(t, err, "invalid bypass routing allowlist entry", entry)
+	}
+
+	b, err := NewBypass(BypassOptions{Allowed: []string{"kube-system", "monitoring/agent", "apps/default"}})
+	require.NoError(t, err)
+	for _, tt := range []struct {
+		namespace      string
+		serviceAccount string
+		allowed        bool
+	}{
+		{"kube-system", "anything", true},
+		{"monitoring", "agent", true},
+		{"monitoring", "other", false},
+		{"apps", "", true},
+		{"apps", "default", true},
+		{"apps", "other", false},
+		{"default", "agent", false},
+	} {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace},
+			Spec:       corev1.PodSpec{ServiceAccountName: tt.serviceAccount},
+		}
+		assert.Equal(t, tt.allowed, b.allowed(pod), "%s/%s", tt.namespace, tt.serviceAccount)
+	}
+}
@@ -4,118 +4,243 @@
 package redirect
 
 import (
-	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net/netip"
-	"os"
 	"path/filepath"
-	"strings"
-	"syscall"
+	"sync"
 
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
+	"github.com/matheuscscp/gke-metadata-server/internal/bpfpin"
 	"github.com/matheuscscp/gke-metadata-server/internal/logging"
+	"github.com/matheuscscp/gke-metadata-server/internal/proxy"
 
 	"github.com/cilium/ebpf"
-	"github.com/cilium/ebpf/link"
 )
 
 //go:generate sh -c "bpftool btf dump file /sys/kernel/btf/vmlinux format c > ../../ebpf/vmlinux.h"
-//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -type Config redirect ../../ebpf/redirect.c
+//go:generate go run github.com/cilium/ebpf/cmd/bpf2go -type Config -type TargetKey redirect ../../ebpf/redirect.c
 
-const cgroupv2Mount = "/sys/fs/cgroup"
+// gkeMetadataServerAddr is the destination that is always redirected.
+var gkeMetadataServerAddr = netip.MustParseAddrPort("169.254.169.254:80")
 
-func LoadAndAttach(emulatorIP netip.Addr, emulatorPort int) func() (func() error, error) {
+const (
+	pinDir             = "redirect"
+	linkName           = "redirect_connect4"
+	emulatorCgroupsMap = "map_emulator_cgroups"
+)
+
+// legacyMapPins are the maps pinned by older versions, which shared the
+// configuration across the daemon instances.
+var legacyMapPins = []string{"map_config", "map_targets", "map_bypass"}
+
+// LoadAndAttach returns a function that loads the redirect eBPF program
+// and attaches it to the root of the cgroup v2 hierarchy
+// (attestation.CgroupV2Mount). Connections to 169.254.169.254:80 are
+// redirected to emulatorPort, and connections to the addresses of the extra
+// targets to their own emulator ports. When pinPath is not empty, the cgroup
+// link is pinned under pinPath so that a new daemon instance adopts it: the
+// link is atomically switched to the program of the new instance, so
+// connections to 169.254.169.254 keep being redirected during upgrades. The
+// configuration of each instance lives in its own unpinned maps, so a new
+// instance never changes the configuration of the program of the instance
+// it replaces. Only the cgroup IDs of the emulator instances, whose own
+// connections are not redirected, are shared through a pinned map. The
+// returned close function leaves the pinned objects in place when a
+// successor has already taken over. When bypass is not nil, it is attached
+// to the map of the pod cgroups whose connections are not redirected.
+func LoadAndAttach(emulatorIP netip.Addr, emulatorPort int, extraTargets []proxy.Target,
+	pinPath string, bypass *Bypass) func() (func() error, error) {
 	return func() (func() error, error) {
-		var objs redirectObjects
-		if err := loadRedirectObjects(&objs, nil); err != nil {
-			return nil, fmt.Errorf("error loading redirect eBPF redirect objects: %w", err)
+		if pinPath != "" {
+			pinPath = filepath.Join(pinPath, pinDir)
+			// The configuration maps were pinned by older versions.
+			if err := bpfpin.RemovePins(pinPath, legacyMapPins...); err != nil {
+				return nil, fmt.Errorf("error removing legacy redirect eBPF map pins: %w", err)
+			}
+		}
+		spec, err := loadRedirect()
+		if err != nil {
+			return nil, fmt.Errorf("error loading redirect eBPF collection spec: %w", err)
 		}
 
 		// Resolve the daemon's own cgroup ID so the eBPF program can identify
 		// outbound connections from the emulator itself (e.g. proxy passthrough
 		// to the real metadata server) and let them through unredirected.
-		cgroupID, err := selfCgroupID()
+		_, cgroupID, err := attestation.SelfCgroup()
 		if err != nil {
 			return nil, fmt.Errorf("error resolving emulator cgroup id: %w", err)
 		}
+		emulatorCgroups, err := bpfpin.LoadMap(spec.Maps[emulatorCgroupsMap], pinPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading redirect eBPF emulator cgroups map: %w", err)
+		}
+		removeStaleEmulatorCgroups(emulatorCgroups, cgroupID)
+		var present uint8 = 1
+		if err := emulatorCgroups.Update(&cgroupID, &present, ebpf.UpdateAny); err != nil {
+			emulatorCgroups.Close()
+			return nil, fmt.Errorf("error adding emulator cgroup to redirect eBPF map: %w", err)
+		}
+		// The map is unpinned only by the last instance, see the close
+		// function below.
+		closeEmulatorCgroups := func(unpin bool) error {
+			err := emulatorCgroups.Delete(&cgroupID)
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				err = nil
+			}
+			if unpin {
+				err = errors.Join(err, bpfpin.UnpinMaps(emulatorCgroups))
+			}
+			return errors.Join(err, emulatorCgroups.Close())
+		}
+
+		var objs redirectObjects
+		replacements := map[string]*ebpf.Map{emulatorCgroupsMap: emulatorCgroups}
+		if err := bpfpin.Load(spec, "", &objs, replacements); err != nil {
+			closeEmulatorCgroups(false)
+			return nil, fmt.Errorf("error loading redirect eBPF redirect objects: %w", err)
+		}
 
 		// Configure the eBPF program with the emulator's IP and port.
 		emulatorIPv4 := emulatorIP.As4()
 		config := redirectConfig{
-			EmulatorCgroupId: cgroupID,
-			EmulatorIp:       binary.BigEndian.Uint32(emulatorIPv4[:]),
-			EmulatorPort:     uint16(emulatorPort),
+			EmulatorIp: binary.BigEndian.Uint32(emulatorIPv4[:]),
 		}
 		if logging.Debug() {
 			config.Debug = 1
 		}
 		var key uint32 = 0
 		if err := objs.redirectMaps.MapConfig.Update(&key, &config, ebpf.UpdateAny); err != nil {
+			objs.Close()
+			closeEmulatorCgroups(false)
 			return nil, fmt.Errorf("error updating redirect eBPF config map: %w", err)
 		}
 
-		// Attach the eBPF program to the cgroup.
-		link, err := link.AttachCgroup(link.CgroupOptions{
-			Path:    cgroupv2Mount,
-			Attach:  ebpf.AttachCGroupInet4Connect,
-			Program: objs.RedirectConnect4,
+		targets := append([]proxy.Target{{Address: gkeMetadataServerAddr, Port: emulatorPort}}, extraTargets...)
+		if err := updateTargets(objs.MapTargets, targets); err != nil {
+			objs.Close()
+			closeEmulatorCgroups(false)
+			return nil, err
+		}
+
+		if bypass != nil {
+			bypass.attach(objs.MapBypass)
+		}
+
+		// Keep the debug flag in the config map in sync with the log level,
+		// which can be changed at runtime through the health server.
+		var configMu sync.Mutex
+		unregister := logging.OnLevelChange(func() {
+			configMu.Lock()
+			defer configMu.Unlock()
+			var debug uint16
+			if logging.Debug() {
+				debug = 1
+			}
+			if config.Debug == debug {
+				return
+			}
+			config.Debug = debug
+			if err := objs.redirectMaps.MapConfig.Update(&key, &config, ebpf.UpdateAny); err != nil {
+				logging.FromContext(context.Background()).WithError(err).Error("error updating debug flag in redirect eBPF config map")
+			}
 		})
+
+		// Attach the eBPF program to the cgroup, or adopt the link pinned by
+		// a previous instance.
+		link, err := bpfpin.AttachCgroup(pinPath, linkName, attestation.CgroupV2Mount,
+			ebpf.AttachCGroupInet4Connect, objs.RedirectConnect4)
 		if err != nil {
+			unregister()
+			if bypass != nil {
+				bypass.detach()
+			}
+			objs.Close()
+			closeEmulatorCgroups(false)
 			return nil, fmt.Errorf("error attaching redirect eBPF program to cgroup: %w", err)
 		}
+		if link.Adopted() {
+			logging.FromContext(context.Background()).Info("adopted redirect eBPF link pinned by a previous instance")
+		}
 
-		return func() (err error) {
-			e1 := link.Close()
-			e2 := objs.Close()
-			if e1 == nil {
-				return e2
-			}
-			if e2 == nil {
-				return e1
+		return func() error {
+			unregister()
+			if bypass != nil {
+				bypass.detach()
 			}
-			return errors.Join(e1, e2)
+			handedOff := link.HandedOff()
+			return errors.Join(
+				link.Close(),
+				closeEmulatorCgroups(!handedOff),
+				objs.Close(),
+			)
 		}, nil
 	}
 }
 
-// selfCgroupID resolves the kernel cgroup ID of the daemon's own cgroup. The
-// cgroup ID is the inode number of the cgroup directory in cgroupfs and is
-// what bpf_get_current_cgroup_id() returns from inside an eBPF program.
-//
-// Only cgroup v2 (unified hierarchy) is supported. The caller's cgroup is
-// read from /proc/self/cgroup, which on a unified system has a single line
-// of the form "0::<path>".
-func selfCgroupID() (uint64, error) {
-	f, err := os.Open("/proc/self/cgroup")
-	if err != nil {
-		return 0, fmt.Errorf("error opening /proc/self/cgroup: %w", err)
+// RemovePins detaches the redirect eBPF program pinned under pinPath by a
+// daemon instance that ran in the eBPF routing mode, e.g. one that crashed
+// before the node was switched to another routing mode, so it stops
+// redirecting the connections to a port where nothing listens anymore.
+func RemovePins(pinPath string) error {
+	if pinPath == "" {
+		return nil
 	}
-	defer f.Close()
-
-	var cgroupPath string
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := scanner.Text()
-		// Format: <hierarchy-id>:<controllers>:<path>. The unified-v2 line
-		// has hierarchy-id "0" and empty controllers.
-		fields := strings.SplitN(line, ":", 3)
-		if len(fields) == 3 && fields[0] == "0" && fields[1] == "" {
-			cgroupPath = fields[2]
-			break
+	pinPath = filepath.Join(pinPath, pinDir)
+	names := append([]string{bpfpin.LinkPinName(linkName), emulatorCgroupsMap}, legacyMapPins...)
+	return bpfpin.RemovePins(pinPath, names...)
+}
+
+// removeStaleEmulatorCgroups removes the cgroup IDs of the emulator
+// instances that no longer exist, e.g. because they crashed, from the map
+// shared by the instances. IDs whose existence cannot be checked are kept.
+func removeStaleEmulatorCgroups(m *ebpf.Map, self uint64) {
+	l := logging.FromContext(context.Background())
+	var (
+		stale   []uint64
+		cgroup  uint64
+		present uint8
+	)
+	it := m.Iterate()
+	for it.Next(&cgroup, &present) {
+		if cgroup == self {
+			continue
+		}
+		exists, err := attestation.CgroupExists(cgroup)
+		if err != nil {
+			l.WithError(err).WithField("cgroup_id", cgroup).Warn("error checking emulator cgroup, keeping it")
+			continue
+		}
+		if !exists {
+			stale = append(stale, cgroup)
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return 0, fmt.Errorf("error reading /proc/self/cgroup: %w", err)
+	if err := it.Err(); err != nil {
+		l.WithError(err).Warn("error iterating redirect eBPF emulator cgroups map")
 	}
-	if cgroupPath == "" {
-		return 0, errors.New("could not find cgroup v2 entry in /proc/self/cgroup; only the unified hierarchy is supported")
+	for _, cgroup := range stale {
+		if err := m.Delete(&cgroup); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			l.WithError(err).WithField("cgroup_id", cgroup).Warn("error removing stale emulator cgroup")
+			continue
+		}
+		l.WithField("cgroup_id", cgroup).Info("removed stale emulator cgroup from redirect eBPF map")
 	}
+}
 
-	dir := filepath.Join(cgroupv2Mount, cgroupPath)
-	var st syscall.Stat_t
-	if err := syscall.Stat(dir, &st); err != nil {
-		return 0, fmt.Errorf("error stating cgroup directory %q: %w", dir, err)
+// updateTargets sets the intercepted destinations in the targets map.
+func updateTargets(m *ebpf.Map, targets []proxy.Target) error {
+	for _, t := range targets {
+		ip := t.Address.Addr().As4()
+		key := redirectTargetKey{
+			Ip:   binary.BigEndian.Uint32(ip[:]),
+			Port: t.Address.Port(),
+		}
+		port := uint16(t.Port)
+		if err := m.Update(&key, &port, ebpf.UpdateAny); err != nil {
+			return fmt.Errorf("error adding %s to redirect eBPF targets map: %w", t.Address, err)
+		}
 	}
-	return st.Ino, nil
+	return nil
 }
@@ -7,6 +7,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand/v2"
 	"net/http"
 	"time"
 
@@ -22,6 +23,7 @@ type (
 		MaxAttempts    int           // default: 3. use negative for infinity
 		InitialDelay   time.Duration // default: time.Second
 		MaxDelay       time.Duration // default: 30 * time.Second
+		Jitter         bool          // randomize the delays, see Jitter
 		Description    string
 		FailureCounter prometheus.Counter
 		Func           func() error
@@ -34,6 +36,14 @@ type (
 		lastErr     error
 	}
 
+	// RetryAfterError is implemented by the errors that carry the delay asked
+	// by the server before the next attempt, e.g. from the Retry-After header.
+	// The next attempt waits at least this delay.
+	RetryAfterError interface {
+		error
+		RetryAfter() time.Duration
+	}
+
 	contextCanceledError struct {
 		desc    string
 		lastErr error
@@ -81,6 +91,13 @@ func Do(ctx context.Context, op Operation) error {
 		if i > 11 || expDelay > op.MaxDelay {
 			expDelay = op.MaxDelay
 		}
+		if op.Jitter {
+			expDelay = Jitter(expDelay)
+		}
+		var retryAfterErr RetryAfterError
+		if errors.As(err, &retryAfterErr) && retryAfterErr.RetryAfter() > expDelay {
+			expDelay = retryAfterErr.RetryAfter()
+		}
 		l := l.WithError(err)
 		logf := l.Warnf
 		if i == 1 { // do not warn about the first attempt failure since it's fairly common
@@ -94,6 +111,16 @@ func Do(ctx context.Context, op Operation) error {
 	return nil
 }
 
+// Jitter returns a random delay between half the given delay and the delay,
+// for spreading the retries of concurrent callers that failed together.
+func Jitter(delay time.Duration) time.Duration {
+	if delay < 2 {
+		return delay
+	}
+	half := delay / 2
+	return half + rand.N(delay-half)
+}
+
 func HTTPStatusCode(err error) int {
 	switch {
 	case errors.Is(err, &maxAttemptsError{}):
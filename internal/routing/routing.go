@@ -4,27 +4,62 @@
 package routing
 
 import (
+	"context"
 	"fmt"
 	"net/netip"
 
 	"github.com/matheuscscp/gke-metadata-server/api"
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
+	"github.com/matheuscscp/gke-metadata-server/internal/logging"
 	"github.com/matheuscscp/gke-metadata-server/internal/loopback"
+	"github.com/matheuscscp/gke-metadata-server/internal/nftables"
+	"github.com/matheuscscp/gke-metadata-server/internal/proxy"
 	"github.com/matheuscscp/gke-metadata-server/internal/redirect"
 
 	corev1 "k8s.io/api/core/v1"
 )
 
+// Options configures LoadAndAttach.
+type Options struct {
+	EmulatorIP   netip.Addr
+	EmulatorPort int
+
+	// ExtraTargets are destinations redirected to the emulator in addition
+	// to 169.254.169.254:80 in the eBPF routing mode. Ignored by the other
+	// modes.
+	ExtraTargets []proxy.Target
+
+	// BPFFSPinPath is where the eBPF routing mode pins its objects so they
+	// survive daemon restarts, see redirect.LoadAndAttach. Empty disables
+	// pinning. The other modes remove the redirect pinned there.
+	BPFFSPinPath string
+
+	// CgroupLayout is the cgroup layout of the node. Routing modes that it
+	// does not support are rejected.
+	CgroupLayout *attestation.CgroupLayout
+
+	// Bypass, if not nil, tracks the pods opted out of the eBPF routing
+	// mode. Ignored by the other modes.
+	Bypass *redirect.Bypass
+}
+
 // LoadAndAttach looks up the routing mode from the Node's annotations
 // or labels and loads and attaches the routing mechanism accordingly.
-func LoadAndAttach(node *corev1.Node, emulatorIP netip.Addr, emulatorPort int) (string, func() error, error) {
+func LoadAndAttach(node *corev1.Node, opts Options) (string, func() error, error) {
 	var loadAndAttach func() (func() error, error)
 
 	mode := getMode(node)
+	if err := opts.CgroupLayout.SupportsRoutingMode(mode); err != nil {
+		return mode, nil, err
+	}
 	switch mode {
 	case api.RoutingModeBPF:
-		loadAndAttach = redirect.LoadAndAttach(emulatorIP, emulatorPort)
+		loadAndAttach = redirect.LoadAndAttach(opts.EmulatorIP, opts.EmulatorPort, opts.ExtraTargets,
+			opts.BPFFSPinPath, opts.Bypass)
 	case api.RoutingModeLoopback:
 		loadAndAttach = loopback.LoadAndAttach
+	case api.RoutingModeNFTables:
+		loadAndAttach = nftables.LoadAndAttach(opts.EmulatorIP, opts.EmulatorPort)
 	case api.RoutingModeNone:
 		loadAndAttach = func() (func() error, error) {
 			return func() error { return nil }, nil
@@ -33,6 +68,23 @@ func LoadAndAttach(node *corev1.Node, emulatorIP netip.Addr, emulatorPort int) (
 		return "", nil, fmt.Errorf("invalid routing mode: %s", mode)
 	}
 
+	// a daemon instance that ran in the eBPF mode may have left its pinned
+	// redirect attached, e.g. if it crashed before the mode was changed
+	if mode != api.RoutingModeBPF {
+		if err := redirect.RemovePins(opts.BPFFSPinPath); err != nil {
+			return mode, nil, fmt.Errorf("error removing stale eBPF redirect pins: %w", err)
+		}
+	}
+
+	// and so may an instance that ran in the nftables mode have left its
+	// table. nftables may not be available at all in the other modes, so
+	// failing to remove the table is not fatal
+	if mode != api.RoutingModeNFTables {
+		if err := nftables.RemoveTable(); err != nil {
+			logging.FromContext(context.Background()).WithError(err).Warn("error removing stale nftables table")
+		}
+	}
+
 	close, err := loadAndAttach()
 	if err != nil {
 		return "", nil, err
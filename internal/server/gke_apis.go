@@ -8,12 +8,14 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/matheuscscp/gke-metadata-server/internal/googlecredentials"
 	pkghttp "github.com/matheuscscp/gke-metadata-server/internal/http"
 	"github.com/matheuscscp/gke-metadata-server/internal/logging"
+	"github.com/matheuscscp/gke-metadata-server/internal/namespaces"
 	"github.com/matheuscscp/gke-metadata-server/internal/preflight"
 	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts"
 
@@ -28,13 +30,69 @@ func (s *Server) gkeNodeNameAPI() pkghttp.MetadataHandlerFunc {
 
 func (s *Server) gkeProjectIDAPI() pkghttp.MetadataHandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) (any, error) {
+		if !s.opts.NamespaceProjectIDs {
+			return s.opts.ProjectID, nil
+		}
+		ns, err := s.getPodNamespace(w, r)
+		if err != nil {
+			return nil, err
+		}
+		projectID, err := namespaces.ProjectID(ns)
+		if err != nil {
+			// The namespace is misconfigured by the cluster admins, not the client.
+			const format = "error getting pod namespace project id: %w"
+			pkghttp.RespondErrorf(w, r, http.StatusInternalServerError, format, err)
+			return nil, fmt.Errorf(format, err)
+		}
+		if projectID != nil {
+			return *projectID, nil
+		}
 		return s.opts.ProjectID, nil
 	}
 }
 
 func (s *Server) gkeNumericProjectIDAPI() pkghttp.MetadataHandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) (any, error) {
-		return s.opts.NumericProjectID, nil
+		if s.opts.NamespaceProjectIDs {
+			ns, err := s.getPodNamespace(w, r)
+			if err != nil {
+				return nil, err
+			}
+			numericProjectID, err := namespaces.NumericProjectID(ns)
+			if err != nil {
+				const format = "error getting pod namespace numeric project id: %w"
+				pkghttp.RespondErrorf(w, r, http.StatusInternalServerError, format, err)
+				return nil, fmt.Errorf(format, err)
+			}
+			if numericProjectID != nil {
+				return *numericProjectID, nil
+			}
+		}
+		googleCredentials, _, err := s.getPodWorkloadIdentityProvider(w, r)
+		if err != nil {
+			return nil, err
+		}
+		return googleCredentials.NumericProjectID(), nil
+	}
+}
+
+// quotaProjectAttribute is the project attribute holding the quota project
+// of the pod, see listPodProjectAttributes.
+const quotaProjectAttribute = "quota-project"
+
+// gkeProjectAttributeAPI serves the attributes listed by listPodProjectAttributes.
+// The quota project is the only one.
+func (s *Server) gkeProjectAttributeAPI() pkghttp.MetadataHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) (any, error) {
+		quotaProject, _, err := s.getPodQuotaProject(w, r)
+		if err != nil {
+			return nil, err
+		}
+		if quotaProject == nil {
+			pkghttp.RespondNotFound(w)
+			return nil, fmt.Errorf("pod has no quota project")
+		}
+		return *quotaProject, nil
 	}
 }
 
@@ -78,6 +136,9 @@ func (s *Server) gkeServiceAccountIdentityAPI() pkghttp.MetadataHandler {
 		if err != nil {
 			return nil, err
 		}
+		if googleEmail == nil && s.opts.KubernetesIdentityTokens {
+			return s.getPodKubernetesIdentityToken(w, r, audience)
+		}
 		if googleEmail == nil {
 			saRef := r.Context().Value(podServiceAccountReferenceContextKey{}).(*serviceaccounts.Reference)
 			msg := fmt.Sprintf(`Your Kubernetes service account (%s/%s) is not annotated with a target Google service account, which is a requirement for retrieving Identity Tokens using Workload Identity.
@@ -110,6 +171,33 @@ Refer to https://cloud.google.com/kubernetes-engine/docs/how-to/workload-identit
 	return pkghttp.TokenHandler{MetadataHandler: pkghttp.MetadataHandlerFunc(mh)}
 }
 
+// getPodKubernetesIdentityToken returns a token of the pod's Kubernetes
+// ServiceAccount issued for the given audience, the identity of pods
+// without a target Google Service Account when KubernetesIdentityTokens
+// is enabled. Only the KubernetesIdentityTokenAudiences are allowed.
+// If there's an error this function sends the response to the client.
+func (s *Server) getPodKubernetesIdentityToken(w http.ResponseWriter, r *http.Request, audience string) (any, error) {
+	if !slices.Contains(s.opts.KubernetesIdentityTokenAudiences, audience) {
+		msg := fmt.Sprintf("audience %q is not allowed for Kubernetes identity tokens", audience)
+		pkghttp.RespondText(w, r, http.StatusBadRequest, msg)
+		return nil, fmt.Errorf("audience %q is not allowed for kubernetes identity tokens", audience)
+	}
+	saRef, r, err := s.getPodServiceAccountReference(w, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizePodContainer(w, r); err != nil {
+		return nil, err
+	}
+	token, _, err := s.opts.ServiceAccountTokens.GetKubernetesIdentityToken(r.Context(), saRef, audience)
+	if err != nil {
+		const format = "error getting kubernetes identity token for pod service account: %w"
+		pkghttp.RespondErrorf(w, r, http.StatusInternalServerError, format, err)
+		return nil, fmt.Errorf(format, err)
+	}
+	return token, nil
+}
+
 func (s *Server) gkeServiceAccountScopesAPI() pkghttp.MetadataHandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) (any, error) {
 		return googlecredentials.AccessScopes(), nil
@@ -149,6 +237,16 @@ func (s *Server) gkeServiceAccountTokenAPI() pkghttp.MetadataHandler {
 	return pkghttp.TokenHandler{MetadataHandler: pkghttp.MetadataHandlerFunc(mh)}
 }
 
+// gkeUniverseDomainAPI serves the domain of the Google Cloud universe of the
+// credentials, which the SDKs use for deriving the endpoints of the Google
+// APIs. The SDKs take a 404 as the default googleapis.com universe, so the
+// domain is always served, even when it is the default one.
+func (s *Server) gkeUniverseDomainAPI() pkghttp.MetadataHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) (any, error) {
+		return s.opts.UniverseDomain, nil
+	}
+}
+
 func respondGoogleAPIErrorf(w http.ResponseWriter, r *http.Request, format string, err error) {
 	const oauthSubstring = "oauth2/google: status code "
 
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	"os"
 	"regexp"
 	"testing"
@@ -195,13 +196,13 @@ func TestGKEServiceAccountTokenAPI_DefaultTokenSource(t *testing.T) {
 
 // TestProxyPassthrough proves the eBPF-mode proxy passthrough end-to-end:
 // the test pod GETs a non-metadata path on 169.254.169.254. cgroup/connect4
-// rewrites the destination to the daemon's listener; proxy.handle() sniffs
-// the prefix, sees it isn't /computeMetadata/v1, and dials 169.254.169.254:80
-// itself; cgroup/connect4 sees the daemon's cgroup and exempts the connect,
-// so the dial reaches the in-daemon test marker server (bound to lo by
+// rewrites the destination to the daemon's listener; proxy.Handler() sees
+// the request isn't a metadata request and reverse-proxies it to
+// 169.254.169.254:80 itself; cgroup/connect4 sees the daemon's cgroup and
+// exempts the connect, so the dial reaches the in-daemon test marker server (bound to lo by
 // --test-proxy-upstream). Receiving the marker proves both halves of the
 // chain work — the redirect's self-exemption (kernel) and the userspace
-// sniff/forward (Go).
+// per-request routing (Go).
 //
 // Skipped on pods that aren't pinned to eBPF nodes (where the marker server
 // isn't reachable); main_test.go sets EXPECT_PROXY_UPSTREAM=true on the
@@ -215,18 +216,51 @@ func TestProxyPassthrough(t *testing.T) {
 	url := "http://169.254.169.254" + proxytest.Path
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	require.NoError(t, err)
-	// Force a fresh TCP connection. The proxy sniff happens once at the
-	// start of each connection; reusing a kept-alive connection from an
-	// earlier metadata request would route this non-metadata request to
-	// the inner listener instead of the upstream.
-	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
-	resp, err := client.Do(req)
+	resp, err := http.DefaultClient.Do(req)
 	require.NoError(t, err)
 	defer resp.Body.Close()
 	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
 	assert.Equal(t, proxytest.Marker, resp.Header.Get(proxytest.HeaderName))
 }
 
+// TestProxyKeepAlive sends a metadata request, a non-metadata request and a
+// metadata request again on the same keep-alive connection, which the proxy
+// must route separately. Gated to eBPF nodes via EXPECT_PROXY_UPSTREAM, like
+// TestProxyPassthrough.
+func TestProxyKeepAlive(t *testing.T) {
+	if os.Getenv("EXPECT_PROXY_UPSTREAM") != "true" {
+		t.Skip("EXPECT_PROXY_UPSTREAM not set, pod is not on an eBPF node")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 1}}
+	var reused []bool
+	do := func(path string) *http.Response {
+		t.Helper()
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { reused = append(reused, info.Reused) },
+		}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace),
+			http.MethodGet, "http://169.254.169.254"+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do("/computeMetadata/v1/instance/name")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do(proxytest.Path)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, proxytest.Marker, resp.Header.Get(proxytest.HeaderName))
+	resp = do("/computeMetadata/v1/instance/name")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []bool{false, true, true}, reused)
+}
+
 // TestOnGCERootProbe exercises the bare "GET /" that ADC client libraries use
 // to detect GCE. google-auth's ping and the Go SDK's testOnGCE both require
 // HTTP 200 with the Metadata-Flavor: Google header on the root path. This is a
@@ -247,16 +281,28 @@ func TestOnGCERootProbe(t *testing.T) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/", nil)
 	require.NoError(t, err)
 	req.Header.Set("Metadata-Flavor", "Google")
-	// Force a fresh TCP connection so the proxy sniffs the request line for
-	// this request instead of reusing a keep-alive connection.
-	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
-	resp, err := client.Do(req)
+	resp, err := http.DefaultClient.Do(req)
 	require.NoError(t, err)
 	defer resp.Body.Close()
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	assert.Equal(t, "Google", resp.Header.Get("Metadata-Flavor"))
 }
 
+// TestGKEUniverseDomainAPI checks the universe domain that newer SDKs query
+// for deriving the endpoints of the Google APIs.
+func TestGKEUniverseDomainAPI(t *testing.T) {
+	// Skip this test when using None routing mode since it makes direct HTTP calls
+	// to the hardcoded IP address instead of using Google libraries that respect GCE_METADATA_HOST
+	if os.Getenv("HOST_IP") != "" && os.Getenv("GKE_METADATA_SERVER_PORT") != "" {
+		t.Skip("Skipping direct IP test when using None routing mode with GCE_METADATA_HOST")
+	}
+
+	const url = "http://169.254.169.254/computeMetadata/v1/universe/universe-domain"
+
+	universeDomain := requestURL(t, gkeHeaders, url, "application/text", gkeMetadataFlavor, http.StatusOK)
+	assert.Equal(t, "googleapis.com", universeDomain)
+}
+
 func TestGKEServiceAccountIdentityAPI(t *testing.T) {
 	// Skip this test when using None routing mode since it makes direct HTTP calls
 	// to the hardcoded IP address instead of using Google libraries that respect GCE_METADATA_HOST
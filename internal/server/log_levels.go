@@ -0,0 +1,86 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	pkghttp "github.com/matheuscscp/gke-metadata-server/internal/http"
+	"github.com/matheuscscp/gke-metadata-server/internal/logging"
+
+	"github.com/sirupsen/logrus"
+)
+
+const logLevelsAPI = "/loglevel"
+
+// logLevelsAPI serves the log levels in effect and allows changing them at
+// runtime so a live node can be debugged without a restart:
+//
+//	GET    /loglevel                                  show the levels in effect
+//	PUT    /loglevel?level=debug[&ttl=10m]            set the base level
+//	PUT    /loglevel?level=trace&component=proxy      override a component level
+//	DELETE /loglevel?component=proxy                  remove a component override
+//
+// With a ttl the change reverts automatically after the given duration.
+// The health server is reachable by anything that can reach the node, so
+// changes are refused unless ServerOptions.LogLevelWrites is enabled.
+func (s *Server) logLevelsAPI(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	component := strings.TrimSpace(q.Get("component"))
+
+	switch r.Method {
+	case http.MethodPut, http.MethodPost, http.MethodDelete:
+		if !s.opts.LogLevelWrites {
+			pkghttp.RespondErrorf(w, r, http.StatusForbidden,
+				"changing the log levels is disabled, see the --log-level-writes flag")
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		level, err := logrus.ParseLevel(q.Get("level"))
+		if err != nil {
+			pkghttp.RespondErrorf(w, r, http.StatusBadRequest, "invalid level: %w", err)
+			return
+		}
+		var ttl time.Duration
+		if v := q.Get("ttl"); v != "" {
+			if ttl, err = time.ParseDuration(v); err != nil || ttl < 0 {
+				pkghttp.RespondErrorf(w, r, http.StatusBadRequest, "invalid ttl %q", v)
+				return
+			}
+		}
+		if component == "" {
+			logging.SetLevel(level, ttl)
+		} else if err := logging.SetComponentLevel(component, level, ttl); err != nil {
+			pkghttp.RespondError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		logging.FromRequest(r).WithFields(logrus.Fields{
+			"level":         level.String(),
+			"log_component": component,
+			"ttl":           ttl.String(),
+		}).Info("log level changed")
+	case http.MethodDelete:
+		if component == "" {
+			pkghttp.RespondErrorf(w, r, http.StatusBadRequest, "component parameter required")
+			return
+		}
+		if err := logging.ResetComponentLevel(component); err != nil {
+			pkghttp.RespondError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		logging.FromRequest(r).WithField("log_component", component).Info("component log level reset")
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		pkghttp.RespondErrorf(w, r, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+
+	pkghttp.RespondJSON(w, r, http.StatusOK, logging.Levels())
+}
@@ -0,0 +1,41 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pkghttp "github.com/matheuscscp/gke-metadata-server/internal/http"
+	"github.com/matheuscscp/gke-metadata-server/internal/logging"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevelsAPI(t *testing.T) {
+	for _, tt := range []struct {
+		name           string
+		logLevelWrites bool
+		method         string
+		expectedStatus int
+	}{
+		{"get is always allowed", false, http.MethodGet, http.StatusOK},
+		{"put is refused by default", false, http.MethodPut, http.StatusForbidden},
+		{"delete is refused by default", false, http.MethodDelete, http.StatusForbidden},
+		{"put is allowed with writes", true, http.MethodPut, http.StatusOK},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() { _ = logging.ResetComponentLevel("proxy") })
+
+			s := &Server{opts: ServerOptions{LogLevelWrites: tt.logLevelWrites}}
+			r := httptest.NewRequest(tt.method, logLevelsAPI+"?level=debug&component=proxy", nil)
+			r = pkghttp.InitRequest(r, func(*http.Request, int, float64) {})
+			w := httptest.NewRecorder()
+			s.logLevelsAPI(w, r)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+		})
+	}
+}
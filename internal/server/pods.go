@@ -10,13 +10,18 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/matheuscscp/gke-metadata-server/api"
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
+	"github.com/matheuscscp/gke-metadata-server/internal/googlecredentials"
 	pkghttp "github.com/matheuscscp/gke-metadata-server/internal/http"
 	"github.com/matheuscscp/gke-metadata-server/internal/logging"
+	"github.com/matheuscscp/gke-metadata-server/internal/namespaces"
 	"github.com/matheuscscp/gke-metadata-server/internal/retry"
 	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts"
 	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounttokens"
@@ -27,14 +32,39 @@ import (
 
 type (
 	podServiceAccountReferenceContextKey   struct{}
+	podServiceAccountContextKey            struct{}
 	podGoogleServiceAccountEmailContextKey struct{}
+	podWorkloadIdentityProviderContextKey  struct{}
+	podQuotaProjectContextKey              struct{}
+	podCallerContextKey                    struct{}
+	peerIdentityContextKey                 struct{}
 )
 
-// getPodGoogleServiceAccountEmail gets the Google Service Account email associated with the given pod.
+// peerIdentity is the result of attesting the peer of a Unix socket
+// connection, see attestPeer. The peer is attested on the first request
+// of the connection, not when accepting it, since http.Server calls the
+// ConnContext hook from the accept loop.
+type peerIdentity struct {
+	attestor PeerAttestor
+	conn     *net.UnixConn
+	once     sync.Once
+	id       attestation.Identity
+	err      error
+}
+
+// podCaller is the pod associated with the request and the name of the
+// calling container. The container is only known when the pod was resolved
+// by kernel attestation and the process runs in a container cgroup.
+type podCaller struct {
+	pod       *corev1.Pod
+	container string
+}
+
+// getPodServiceAccount gets the ServiceAccount of the given pod.
 // If there's an error this function sends the response to the client.
-func (s *Server) getPodGoogleServiceAccountEmail(w http.ResponseWriter, r *http.Request) (*string, *http.Request, error) {
-	if v := r.Context().Value(podGoogleServiceAccountEmailContextKey{}); v != nil {
-		return v.(*string), r, nil
+func (s *Server) getPodServiceAccount(w http.ResponseWriter, r *http.Request) (*corev1.ServiceAccount, *http.Request, error) {
+	if v := r.Context().Value(podServiceAccountContextKey{}); v != nil {
+		return v.(*corev1.ServiceAccount), r, nil
 	}
 	saRef, r, err := s.getPodServiceAccountReference(w, r)
 	if err != nil {
@@ -46,6 +76,63 @@ func (s *Server) getPodGoogleServiceAccountEmail(w http.ResponseWriter, r *http.
 		pkghttp.RespondErrorf(w, r, http.StatusInternalServerError, format, err)
 		return nil, nil, fmt.Errorf(format, err)
 	}
+	ctx := context.WithValue(r.Context(), podServiceAccountContextKey{}, sa)
+	return sa, r.WithContext(ctx), nil
+}
+
+// getPodNamespace gets the namespace of the given pod.
+// If there's an error this function sends the response to the client.
+func (s *Server) getPodNamespace(w http.ResponseWriter, r *http.Request) (*corev1.Namespace, error) {
+	saRef, r, err := s.getPodServiceAccountReference(w, r)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := s.opts.Namespaces.Get(r.Context(), saRef.Namespace)
+	if err != nil {
+		const format = "error getting pod namespace: %w"
+		pkghttp.RespondErrorf(w, r, http.StatusInternalServerError, format, err)
+		return nil, fmt.Errorf(format, err)
+	}
+	return ns, nil
+}
+
+// getPodWorkloadIdentityProvider gets the Google credentials config of the workload identity
+// provider associated with the given pod. The pod is only looked up if multiple providers are
+// configured.
+// If there's an error this function sends the response to the client.
+func (s *Server) getPodWorkloadIdentityProvider(w http.ResponseWriter, r *http.Request) (*googlecredentials.Config, *http.Request, error) {
+	providers := s.opts.WorkloadIdentityProviders
+	if !providers.Multiple() {
+		return providers.Default(), r, nil
+	}
+	if v := r.Context().Value(podWorkloadIdentityProviderContextKey{}); v != nil {
+		return v.(*googlecredentials.Config), r, nil
+	}
+	sa, r, err := s.getPodServiceAccount(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := providers.Get(sa.Namespace, serviceaccounts.WorkloadIdentityProvider(sa))
+	if err != nil {
+		pkghttp.RespondError(w, r, http.StatusBadRequest, err)
+		return nil, nil, err
+	}
+	ctx := context.WithValue(r.Context(), podWorkloadIdentityProviderContextKey{}, c)
+	l := logging.FromRequest(r).WithField("workload_identity_provider", c.WorkloadIdentityProvider())
+	r = logging.IntoRequest(r.WithContext(ctx), l)
+	return c, r, nil
+}
+
+// getPodGoogleServiceAccountEmail gets the Google Service Account email associated with the given pod.
+// If there's an error this function sends the response to the client.
+func (s *Server) getPodGoogleServiceAccountEmail(w http.ResponseWriter, r *http.Request) (*string, *http.Request, error) {
+	if v := r.Context().Value(podGoogleServiceAccountEmailContextKey{}); v != nil {
+		return v.(*string), r, nil
+	}
+	sa, r, err := s.getPodServiceAccount(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
 	email, err := serviceaccounts.GoogleServiceAccountEmail(sa)
 	if err != nil {
 		pkghttp.RespondError(w, r, http.StatusBadRequest, err)
@@ -68,11 +155,14 @@ func (s *Server) getPodGoogleServiceAccountEmailOrWorkloadIdentityPool(w http.Re
 	if err != nil {
 		return "", nil, err
 	}
-	email := s.opts.WorkloadIdentityPool
 	if googleEmail != nil {
-		email = *googleEmail
+		return *googleEmail, r, nil
 	}
-	return email, r, nil
+	googleCredentials, r, err := s.getPodWorkloadIdentityProvider(w, r)
+	if err != nil {
+		return "", nil, err
+	}
+	return googleCredentials.WorkloadIdentityPool(), r, nil
 }
 
 // listPodGoogleServiceAccounts lists the available Google Service Accounts for the requesting Pod.
@@ -85,6 +175,60 @@ func (s *Server) listPodGoogleServiceAccounts(w http.ResponseWriter, r *http.Req
 	return []string{"default", email}, r, nil
 }
 
+// getPodQuotaProject gets the quota project of the upstream calls made for the given pod,
+// from the annotation of its ServiceAccount or, if NamespaceQuotaProjects is enabled, of
+// its namespace, or nil if there's none.
+// If there's an error this function sends the response to the client.
+func (s *Server) getPodQuotaProject(w http.ResponseWriter, r *http.Request) (*string, *http.Request, error) {
+	if v := r.Context().Value(podQuotaProjectContextKey{}); v != nil {
+		return v.(*string), r, nil
+	}
+	sa, r, err := s.getPodServiceAccount(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	var nss namespaces.Provider
+	if s.opts.NamespaceQuotaProjects {
+		nss = s.opts.Namespaces
+	}
+	quotaProject, err := serviceaccounts.QuotaProject(r.Context(), sa, nss)
+	if errors.Is(err, serviceaccounts.ErrQuotaProjectAnnotationInvalid) {
+		pkghttp.RespondError(w, r, http.StatusBadRequest, err)
+		return nil, nil, err
+	}
+	if err != nil {
+		// The namespace is misconfigured by the cluster admins or could not
+		// be retrieved, not a client error.
+		const format = "error getting pod quota project: %w"
+		pkghttp.RespondErrorf(w, r, http.StatusInternalServerError, format, err)
+		return nil, nil, fmt.Errorf(format, err)
+	}
+	ctx := context.WithValue(r.Context(), podQuotaProjectContextKey{}, quotaProject)
+	l := logging.FromRequest(r)
+	if quotaProject != nil {
+		l = l.WithField("pod_quota_project", *quotaProject)
+	}
+	r = logging.IntoRequest(r.WithContext(ctx), l)
+	return quotaProject, r, nil
+}
+
+// listPodProjectAttributes lists the project attributes of the requesting Pod, which
+// are only the quota project when QuotaProjects is enabled and the Pod has one.
+// If there's an error this function sends the response to the client.
+func (s *Server) listPodProjectAttributes(w http.ResponseWriter, r *http.Request) ([]string, *http.Request, error) {
+	if !s.opts.QuotaProjects {
+		return nil, r, nil
+	}
+	quotaProject, r, err := s.getPodQuotaProject(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if quotaProject == nil {
+		return nil, r, nil
+	}
+	return []string{quotaProjectAttribute}, r, nil
+}
+
 // getPodGoogleAccessTokens creates a pair of Google Access Tokens for the
 // given Pod's ServiceAccount, one for direct access and another one for
 // impersonation.
@@ -95,6 +239,17 @@ func (s *Server) getPodGoogleAccessTokens(w http.ResponseWriter, r *http.Request
 	if err != nil {
 		return nil, time.Time{}, nil, err
 	}
+	if err := authorizePodContainer(w, r); err != nil {
+		return nil, time.Time{}, nil, err
+	}
+	if _, r, err = s.getPodWorkloadIdentityProvider(w, r); err != nil {
+		return nil, time.Time{}, nil, err
+	}
+	if s.opts.QuotaProjects {
+		if _, r, err = s.getPodQuotaProject(w, r); err != nil {
+			return nil, time.Time{}, nil, err
+		}
+	}
 	saToken, _, err := s.opts.ServiceAccountTokens.GetServiceAccountToken(r.Context(), saRef)
 	if err != nil {
 		const format = "error getting token for pod service account: %w"
@@ -126,6 +281,17 @@ func (s *Server) getPodServiceAccountReference(w http.ResponseWriter,
 		return v.(*serviceaccounts.Reference), r, nil
 	}
 
+	// connections to the unix socket were attested from the peer
+	// credentials when they were accepted, there is no client address.
+	if v := r.Context().Value(peerIdentityContextKey{}); v != nil {
+		pod, container, err := s.podFromPeerIdentity(r, v.(*peerIdentity))
+		if err != nil {
+			pkghttp.RespondErrorf(w, r, http.StatusForbidden, "kernel attestation failed: %w", err)
+			return nil, nil, fmt.Errorf("kernel attestation failed: %w", err)
+		}
+		return s.assignPodServiceAccount(r, pod, container)
+	}
+
 	// get client ip address. **ATTENTION** this IP address **NEEDS**
 	// to be retrieved from the connection. this information **CANNOT**
 	// be retrieved from any input in the request that could've easily
@@ -157,12 +323,14 @@ func (s *Server) getPodServiceAccountReference(w http.ResponseWriter,
 	// Pick the resolution strategy by (routing mode, pod kind). Each
 	// (mode, kind) has exactly one strategy — no fallback between paths.
 	//
-	//   eBPF mode:     kernel attestation for both pod kinds (sockops map).
-	//   Loopback/None: source IP for non-hostNetwork; sockdiag for
-	//                  hostNetwork (the only way to disambiguate pods that
-	//                  share the node IP without an eBPF map).
+	//   eBPF mode:              kernel attestation for both pod kinds
+	//                           (sockops map).
+	//   Loopback/nftables/None: source IP for non-hostNetwork; sockdiag for
+	//                           hostNetwork (the only way to disambiguate
+	//                           pods that share the node IP without an eBPF
+	//                           map).
 	//
-	// hostNetwork pods on Loopback/None modes don't have a single canonical
+	// hostNetwork pods on Loopback/nftables/None modes don't have a single canonical
 	// source IP — the kernel picks one based on the route used to reach the
 	// listener (the link-local 169.254.169.254 for Loopback's lo bind, the
 	// node IP for None's wildcard bind, possibly 127.0.0.1 if the operator
@@ -171,8 +339,9 @@ func (s *Server) getPodServiceAccountReference(w http.ResponseWriter,
 	useAttestation := s.opts.RoutingMode == api.RoutingModeBPF || isHostSourceIP(clientIPAddr, s.opts.PodIP)
 
 	var pod *corev1.Pod
+	var container string
 	if useAttestation {
-		pod, err = s.attestByConnTuple(r, clientIPAddr, clientPortStr)
+		pod, container, err = s.attestByConnTuple(r, clientIPAddr, clientPortStr)
 		if err != nil {
 			pkghttp.RespondErrorf(w, r, http.StatusForbidden, "kernel attestation failed: %w", err)
 			return nil, nil, fmt.Errorf("kernel attestation failed: %w", err)
@@ -186,24 +355,89 @@ func (s *Server) getPodServiceAccountReference(w http.ResponseWriter,
 		}
 	}
 
-	return s.assignPodServiceAccount(r, pod)
+	return s.assignPodServiceAccount(r, pod, container)
 }
 
 // assignPodServiceAccount stores the resolved pod's ServiceAccount reference
 // on the request context and enriches the logger. Shared between the
 // attestation and source-IP resolution paths.
-func (s *Server) assignPodServiceAccount(r *http.Request, pod *corev1.Pod) (*serviceaccounts.Reference, *http.Request, error) {
+func (s *Server) assignPodServiceAccount(r *http.Request, pod *corev1.Pod, container string) (*serviceaccounts.Reference, *http.Request, error) {
 	saRef := serviceaccounts.ReferenceFromPod(pod)
+	if s.opts.BindServiceAccountTokens {
+		saRef = serviceaccounts.BoundReferenceFromPod(pod)
+	}
 	ctx := context.WithValue(r.Context(), podServiceAccountReferenceContextKey{}, saRef)
-	l := logging.FromRequest(r).WithField("pod", logrus.Fields{
+	ctx = context.WithValue(ctx, podCallerContextKey{}, &podCaller{pod: pod, container: container})
+	podFields := logrus.Fields{
 		"name":                 pod.Name,
 		"namespace":            pod.Namespace,
 		"service_account_name": pod.Spec.ServiceAccountName,
-	})
+	}
+	if container != "" {
+		podFields["container"] = container
+	}
+	l := logging.FromRequest(r).WithField("pod", podFields)
 	r = logging.IntoRequest(r.WithContext(ctx), l)
 	return saRef, r, nil
 }
 
+// authorizePodContainer enforces the AnnotationAllowedContainers policy of
+// the pod associated with the request. Must be called after
+// getPodServiceAccountReference.
+// If there's an error this function sends the response to the client.
+func authorizePodContainer(w http.ResponseWriter, r *http.Request) error {
+	caller := r.Context().Value(podCallerContextKey{}).(*podCaller)
+	if err := checkAllowedContainer(caller.pod, caller.container); err != nil {
+		pkghttp.RespondError(w, r, http.StatusForbidden, err)
+		return err
+	}
+	return nil
+}
+
+// checkAllowedContainer checks whether the given container of the pod may
+// get tokens according to the pod's AnnotationAllowedContainers. An empty
+// container means the calling container is unknown, which is only allowed
+// when the pod does not restrict containers.
+func checkAllowedContainer(pod *corev1.Pod, container string) error {
+	v, ok := pod.Annotations[api.AnnotationAllowedContainers]
+	if !ok {
+		return nil
+	}
+	var allowed []string
+	for name := range strings.SplitSeq(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			allowed = append(allowed, name)
+		}
+	}
+	if container == "" {
+		return fmt.Errorf("pod restricts tokens to containers %v but the calling container could not be attested", allowed)
+	}
+	if !slices.Contains(allowed, container) {
+		return fmt.Errorf("pod restricts tokens to containers %v, container %q is not allowed", allowed, container)
+	}
+	return nil
+}
+
+// containerName maps a container ID attested from the cgroup hierarchy to
+// the name of the container in the pod status. Returns an empty string if
+// the ID is empty or not (yet) in the pod status.
+func containerName(pod *corev1.Pod, containerID string) string {
+	if containerID == "" {
+		return ""
+	}
+	statuses := slices.Concat(pod.Status.InitContainerStatuses,
+		pod.Status.ContainerStatuses,
+		pod.Status.EphemeralContainerStatuses)
+	for _, st := range statuses {
+		// The status holds "<runtime>://<ID>", e.g. "containerd://<ID>".
+		_, id, ok := strings.Cut(st.ContainerID, "://")
+		if ok && id == containerID {
+			return st.Name
+		}
+	}
+	return ""
+}
+
 // isHostSourceIP reports whether clientIP looks like a connection from the
 // host's network namespace rather than from a pod-network IP. hostNetwork
 // pods share their node's network stack, so the kernel-chosen source IP for
@@ -225,18 +459,18 @@ func isHostSourceIP(clientIP netip.Addr, podIP string) bool {
 
 // attestByConnTuple resolves the connecting process to its pod via the
 // configured kernel-attestation lookuper (BPF sockops map in eBPF mode,
-// netlink SOCK_DIAG + /proc walk in Loopback/None) and a UID-based pod
-// lookup. Any failure is returned to the caller; there is no fallback by
-// design — each (routing mode, pod kind) has exactly one resolution
-// strategy.
-func (s *Server) attestByConnTuple(r *http.Request, clientIP netip.Addr, clientPortStr string) (*corev1.Pod, error) {
+// netlink INET_DIAG in Loopback/None) and a UID-based pod lookup, and
+// returns the pod and the name of the calling container (empty if unknown).
+// Any failure is returned to the caller; there is no fallback by design —
+// each (routing mode, pod kind) has exactly one resolution strategy.
+func (s *Server) attestByConnTuple(r *http.Request, clientIP netip.Addr, clientPortStr string) (*corev1.Pod, string, error) {
 	if s.opts.Attestation == nil {
-		return nil, errors.New("attestation lookuper not configured for this routing mode")
+		return nil, "", errors.New("attestation lookuper not configured for this routing mode")
 	}
 
 	clientPort, err := strconv.ParseUint(clientPortStr, 10, 16)
 	if err != nil {
-		return nil, fmt.Errorf("parsing client port %q: %w", clientPortStr, err)
+		return nil, "", fmt.Errorf("parsing client port %q: %w", clientPortStr, err)
 	}
 
 	// Use the kernel-chosen LocalAddr of this connection as the destination
@@ -244,26 +478,74 @@ func (s *Server) attestByConnTuple(r *http.Request, clientIP netip.Addr, clientP
 	// the connection, so it matches what sockops recorded (eBPF mode) and
 	// what netlink SOCK_DIAG sees in the live socket table (Loopback/None).
 	// PodIP plus a configured port wouldn't work on Loopback mode where the
-	// listener is on 169.254.169.254:80, not on PodIP.
-	local := LocalAddrFromRequest(r)
-	if local == nil {
-		return nil, errors.New("local addr not captured for this connection")
+	// listener is on 169.254.169.254:80, not on PodIP. In nftables mode this
+	// is the destination before the DNAT, see ConnContext in server.go.
+	local, err := LocalAddrFromRequest(r)
+	if err != nil {
+		return nil, "", err
 	}
 	dstIP, ok := netip.AddrFromSlice(local.IP.To4())
 	if !ok {
-		return nil, fmt.Errorf("local addr %v is not an IPv4 address", local.IP)
+		return nil, "", fmt.Errorf("local addr %v is not an IPv4 address", local.IP)
+	}
+
+	l := logging.WithComponent(logging.FromRequest(r), logging.ComponentAttestation).WithField("local_addr", local.String())
+	id, err := s.opts.Attestation.Lookup(clientIP, dstIP.Unmap(), uint16(clientPort), uint16(local.Port))
+	if err != nil {
+		l.WithError(err).Debug("attestation lookup failed")
+		return nil, "", fmt.Errorf("attestation lookup: %w", err)
+	}
+	l.WithFields(logrus.Fields{
+		"pod_uid":      id.PodUID,
+		"container_id": id.ContainerID,
+	}).Debug("attestation lookup succeeded")
+
+	pod, err := s.opts.Pods.GetByUID(r.Context(), id.PodUID)
+	if err != nil {
+		return nil, "", fmt.Errorf("getting pod with uid %s: %w", id.PodUID, err)
 	}
+	return pod, containerName(pod, id.ContainerID), nil
+}
+
+// attestPeer identifies the process on the other end of a Unix socket
+// connection from the credentials the kernel recorded when it connected.
+// Safe for concurrent use, the peer is attested only once.
+func (p *peerIdentity) attestPeer() (attestation.Identity, error) {
+	p.once.Do(func() {
+		if p.attestor == nil {
+			p.err = errors.New("peer attestor not configured")
+			return
+		}
+		id, err := p.attestor.Identify(p.conn)
+		if err != nil {
+			p.err = fmt.Errorf("attesting unix socket peer: %w", err)
+			return
+		}
+		p.id = id
+	})
+	return p.id, p.err
+}
 
-	uid, err := s.opts.Attestation.Lookup(clientIP, dstIP.Unmap(), uint16(clientPort), uint16(local.Port))
+// podFromPeerIdentity resolves the identity attested for a Unix socket
+// connection to the pod and the name of the calling container (empty if
+// unknown).
+func (s *Server) podFromPeerIdentity(r *http.Request, peer *peerIdentity) (*corev1.Pod, string, error) {
+	l := logging.WithComponent(logging.FromRequest(r), logging.ComponentAttestation)
+	id, err := peer.attestPeer()
 	if err != nil {
-		return nil, fmt.Errorf("attestation lookup: %w", err)
+		l.WithError(err).Debug("unix socket peer attestation failed")
+		return nil, "", err
 	}
+	l.WithFields(logrus.Fields{
+		"pod_uid":      id.PodUID,
+		"container_id": id.ContainerID,
+	}).Debug("unix socket peer attestation succeeded")
 
-	pod, err := s.opts.Pods.GetByUID(r.Context(), uid)
+	pod, err := s.opts.Pods.GetByUID(r.Context(), id.PodUID)
 	if err != nil {
-		return nil, fmt.Errorf("getting pod with uid %s: %w", uid, err)
+		return nil, "", fmt.Errorf("getting pod with uid %s: %w", id.PodUID, err)
 	}
-	return pod, nil
+	return pod, containerName(pod, id.ContainerID), nil
 }
 
 func (s *Server) lookupPodByIP(ctx context.Context, clientIP string) (*corev1.Pod, error) {
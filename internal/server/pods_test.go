@@ -0,0 +1,57 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package server
+
+import (
+	"testing"
+
+	"github.com/matheuscscp/gke-metadata-server/api"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestContainerName(t *testing.T) {
+	pod := &corev1.Pod{
+		Status: corev1.PodStatus{
+			InitContainerStatuses: []corev1.ContainerStatus{
+				{Name: "init", ContainerID: "containerd://1111"},
+			},
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "app", ContainerID: "containerd://2222"},
+				{Name: "sidecar", ContainerID: "cri-o://3333"},
+				{Name: "pending"},
+			},
+			EphemeralContainerStatuses: []corev1.ContainerStatus{
+				{Name: "debugger", ContainerID: "containerd://4444"},
+			},
+		},
+	}
+
+	assert.Equal(t, "init", containerName(pod, "1111"))
+	assert.Equal(t, "app", containerName(pod, "2222"))
+	assert.Equal(t, "sidecar", containerName(pod, "3333"))
+	assert.Equal(t, "debugger", containerName(pod, "4444"))
+	assert.Empty(t, containerName(pod, "5555"))
+	assert.Empty(t, containerName(pod, ""))
+}
+
+func TestCheckAllowedContainer(t *testing.T) {
+	unrestricted := &corev1.Pod{}
+	restricted := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				api.AnnotationAllowedContainers: "app, worker",
+			},
+		},
+	}
+
+	assert.NoError(t, checkAllowedContainer(unrestricted, ""))
+	assert.NoError(t, checkAllowedContainer(unrestricted, "sidecar"))
+	assert.NoError(t, checkAllowedContainer(restricted, "app"))
+	assert.NoError(t, checkAllowedContainer(restricted, "worker"))
+	assert.Error(t, checkAllowedContainer(restricted, "sidecar"))
+	assert.Error(t, checkAllowedContainer(restricted, ""))
+}
@@ -11,12 +11,18 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/matheuscscp/gke-metadata-server/api"
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
+	"github.com/matheuscscp/gke-metadata-server/internal/googlecredentials"
 	pkghttp "github.com/matheuscscp/gke-metadata-server/internal/http"
 	"github.com/matheuscscp/gke-metadata-server/internal/logging"
 	"github.com/matheuscscp/gke-metadata-server/internal/metrics"
+	"github.com/matheuscscp/gke-metadata-server/internal/namespaces"
+	"github.com/matheuscscp/gke-metadata-server/internal/nftables"
 	"github.com/matheuscscp/gke-metadata-server/internal/pods"
 	"github.com/matheuscscp/gke-metadata-server/internal/proxy"
 	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts"
@@ -30,11 +36,19 @@ import (
 // ConnContext stashes the accepted socket's LocalAddr.
 type localAddrContextKey struct{}
 
+type localAddr struct {
+	addr *net.TCPAddr
+	err  error
+}
+
 // LocalAddrFromRequest returns the server-side LocalAddr of the connection
-// the request arrived on, or nil if it was not captured.
-func LocalAddrFromRequest(r *http.Request) *net.TCPAddr {
-	v, _ := r.Context().Value(localAddrContextKey{}).(*net.TCPAddr)
-	return v
+// the request arrived on, or an error if it could not be captured.
+func LocalAddrFromRequest(r *http.Request) (*net.TCPAddr, error) {
+	v, ok := r.Context().Value(localAddrContextKey{}).(*localAddr)
+	if !ok {
+		return nil, errors.New("local addr not captured for this connection")
+	}
+	return v.addr, v.err
 }
 
 type (
@@ -42,6 +56,10 @@ type (
 		opts           ServerOptions
 		metadataServer *http.Server
 		healthServer   *http.Server
+		proxy          *proxy.Proxy
+		addr           string
+		selfCheckAddr  string
+		draining       atomic.Bool
 		metrics        serverMetrics
 	}
 
@@ -55,25 +73,95 @@ type (
 		ServiceAccountTokens serviceaccounttokens.Provider
 		MetricsRegistry      *prometheus.Registry
 		ProjectID            string
-		NumericProjectID     string
-		WorkloadIdentityPool string
+		UniverseDomain       string
 		RoutingMode          string
 		PodLookup            PodLookupOptions
 
+		// LogLevelWrites allows changing the log levels through the health
+		// server. Otherwise the log levels API is read-only.
+		LogLevelWrites bool
+
+		// WorkloadIdentityProviders selects the workload identity provider
+		// of a pod, which determines the numeric project ID and the Workload
+		// Identity Pool served to it.
+		WorkloadIdentityProviders *googlecredentials.Providers
+
+		// Namespaces is used for reading the namespace annotations when
+		// NamespaceProjectIDs or NamespaceQuotaProjects is enabled.
+		Namespaces namespaces.Provider
+
+		// NamespaceProjectIDs serves the project/* metadata from the
+		// annotations of the namespace of the requesting pod, falling back
+		// to ProjectID and the workload identity provider.
+		NamespaceProjectIDs bool
+
+		// QuotaProjects serves the quota project of a pod, annotated on its
+		// ServiceAccount or, if NamespaceQuotaProjects is enabled, on its
+		// namespace, as the project attribute quota-project for its SDK to
+		// bill the same project as the upstream calls made for it.
+		QuotaProjects          bool
+		NamespaceQuotaProjects bool
+
+		// KubernetesIdentityTokens makes the identity API return a token of
+		// the pod's Kubernetes ServiceAccount issued for the requested
+		// audience when the ServiceAccount has no target Google Service
+		// Account, instead of a 404.
+		KubernetesIdentityTokens bool
+
+		// KubernetesIdentityTokenAudiences are the audiences allowed for the
+		// Kubernetes identity tokens.
+		KubernetesIdentityTokenAudiences []string
+
+		// BindServiceAccountTokens binds the Kubernetes ServiceAccount tokens
+		// issued for a request to the requesting pod, so they are invalidated
+		// when the pod is deleted. Tokens are then cached per pod.
+		BindServiceAccountTokens bool
+
 		// Attestation resolves a connection 4-tuple to the kubernetes pod
-		// UID of the connecting process. Required in eBPF mode and for
+		// UID and container ID of the connecting process. Required in eBPF mode and for
 		// hostNetwork pods in Loopback or None modes; the (mode, pod-kind)
 		// selection in pods.go decides whether it is consulted for a given
 		// request.
 		Attestation AttestationLookuper
+
+		// UnixSocketPath, if set, is the path of a Unix domain socket where
+		// the metadata server also listens. Callers connecting through it
+		// are identified by PeerAttestation.
+		UnixSocketPath  string
+		PeerAttestation PeerAttestor
+
+		// HealthSocketPath, if set, is the path of a Unix domain socket in
+		// the filesystem of the container where the health server also
+		// listens, for the exec probes. The TCP ports are shared with the
+		// instance being replaced during upgrades, see pkghttp.Probe.
+		HealthSocketPath string
+
+		// Proxy configures the proxying of the requests that are not
+		// metadata requests in eBPF mode.
+		Proxy ProxyOptions
+	}
+
+	ProxyOptions struct {
+		// Upstream is where the requests to 169.254.169.254:80 are proxied,
+		// or proxy.NoUpstream. Default: proxy.DefaultUpstream.
+		Upstream string
+
+		// InterceptTargets are destinations redirected to the metadata
+		// server in addition to 169.254.169.254:80, each accepted on its
+		// own port and proxied to its own upstream.
+		InterceptTargets []proxy.Target
+
+		DialTimeout           time.Duration // default: proxy.DefaultDialTimeout
+		ResponseHeaderTimeout time.Duration // default: no timeout
+		DialMetricsByClientIP bool
 	}
 
 	// AttestationLookuper resolves a connection 4-tuple to the kubernetes
-	// pod UID of the connecting process. Implementations differ by routing
-	// mode (eBPF sockops map vs netlink SOCK_DIAG + /proc walk) but both
-	// converge on a kernel-attested pod identity.
+	// pod UID and container ID of the connecting process. Implementations
+	// differ by routing mode (eBPF sockops map vs netlink INET_DIAG) but
+	// both converge on a kernel-attested identity.
 	AttestationLookuper interface {
-		Lookup(srcIP, dstIP netip.Addr, srcPort, dstPort uint16) (podUID string, err error)
+		Lookup(srcIP, dstIP netip.Addr, srcPort, dstPort uint16) (attestation.Identity, error)
 		// Verify checks that the attestation pipeline correctly captured the
 		// connection identified by the given 4-tuple. Used by the readiness
 		// probe to gate /readyz on attestation being live; in eBPF mode this
@@ -82,6 +170,13 @@ type (
 		Verify(srcIP, dstIP netip.Addr, srcPort, dstPort uint16) error
 	}
 
+	// PeerAttestor resolves the process on the other end of a Unix socket
+	// connection to the kubernetes pod UID and container ID, from the
+	// credentials the kernel recorded when the connection was established.
+	PeerAttestor interface {
+		Identify(conn *net.UnixConn) (attestation.Identity, error)
+	}
+
 	PodLookupOptions struct {
 		MaxAttempts       int           // default: 3
 		RetryInitialDelay time.Duration // default: time.Second
@@ -97,12 +192,15 @@ const (
 	gkeNodeNameAPI               = "/computeMetadata/v1/instance/name"
 	gkeProjectIDAPI              = "/computeMetadata/v1/project/project-id"
 	gkeNumericProjectIDAPI       = "/computeMetadata/v1/project/numeric-project-id"
+	gkeProjectAttributesDir      = "/computeMetadata/v1/project/attributes/$attribute"
+	gkeProjectAttributeAPI       = "/computeMetadata/v1/project/attributes/$attribute"
 	gkeServiceAccountsDirectory  = "/computeMetadata/v1/instance/service-accounts/$service_account"
 	gkeServiceAccountAliasesAPI  = "/computeMetadata/v1/instance/service-accounts/$service_account/aliases"
 	gkeServiceAccountEmailAPI    = "/computeMetadata/v1/instance/service-accounts/$service_account/email"
 	gkeServiceAccountIdentityAPI = "/computeMetadata/v1/instance/service-accounts/$service_account/identity"
 	gkeServiceAccountScopesAPI   = "/computeMetadata/v1/instance/service-accounts/$service_account/scopes"
 	gkeServiceAccountTokenAPI    = "/computeMetadata/v1/instance/service-accounts/$service_account/token"
+	gkeUniverseDomainAPI         = "/computeMetadata/v1/universe/universe-domain"
 )
 
 func New(ctx context.Context, opts ServerOptions) *Server {
@@ -131,6 +229,15 @@ func New(ctx context.Context, opts ServerOptions) *Server {
 	proxyDialLatencyMillis := metrics.NewProxyDialLantencyMillis()
 	opts.MetricsRegistry.MustRegister(proxyDialLatencyMillis)
 
+	var proxyDialLatencyMillisByClientIP *prometheus.HistogramVec
+	if opts.Proxy.DialMetricsByClientIP {
+		proxyDialLatencyMillisByClientIP = metrics.NewProxyDialLatencyByClientIPMillis()
+		opts.MetricsRegistry.MustRegister(proxyDialLatencyMillisByClientIP)
+	}
+
+	proxyDialFailures := metrics.NewProxyDialFailuresCounter()
+	opts.MetricsRegistry.MustRegister(proxyDialFailures)
+
 	proxyActiveConnections := metrics.NewProxyActiveConnectionsGauge()
 	opts.MetricsRegistry.MustRegister(proxyActiveConnections)
 
@@ -138,11 +245,17 @@ func New(ctx context.Context, opts ServerOptions) *Server {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			r = pkghttp.InitRequest(r, observeLatencyMillis)
 
-			r = logging.IntoRequest(r, logging.FromRequest(r).WithField("http_request", logrus.Fields{
-				"method": r.Method,
-				"path":   r.URL.Path,
-				"query":  r.URL.Query(),
-			}))
+			l := logging.FromRequest(r).WithField(logging.HTTPRequestField, logrus.Fields{
+				"method":      r.Method,
+				"path":        r.URL.Path,
+				"query":       r.URL.Query(),
+				"remote_addr": r.RemoteAddr,
+				"user_agent":  r.UserAgent(),
+			})
+			if trace := logging.TraceFromRequest(r, opts.ProjectID); trace != "" {
+				l = l.WithField(logging.TraceField, trace)
+			}
+			r = logging.IntoRequest(r, l)
 
 			h.ServeHTTP(w, r)
 		})
@@ -166,13 +279,26 @@ func New(ctx context.Context, opts ServerOptions) *Server {
 			// equivalent to the actual local addr the kernel chose for
 			// each connection, especially on Loopback mode where the
 			// link-local 169.254.169.254 differs from PodIP.
+			// Connections accepted on the Unix socket are attested from the
+			// peer credentials of the socket instead, on their first request.
+			// In nftables mode the connections were translated by DNAT,
+			// so the destination the client connected to (the original
+			// destination recorded by conntrack) is used instead.
 			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
 				if a, ok := c.LocalAddr().(*net.TCPAddr); ok {
-					ctx = context.WithValue(ctx, localAddrContextKey{}, a)
+					local := &localAddr{addr: a}
+					if tc, ok := c.(*net.TCPConn); ok && opts.RoutingMode == api.RoutingModeNFTables {
+						local.addr, local.err = nftables.OriginalDst(tc)
+					}
+					ctx = context.WithValue(ctx, localAddrContextKey{}, local)
+				}
+				ctx = proxy.ConnContext(ctx, c)
+				if uc, ok := c.(*net.UnixConn); ok {
+					ctx = context.WithValue(ctx, peerIdentityContextKey{}, &peerIdentity{attestor: opts.PeerAttestation, conn: uc})
 				}
 				return ctx
 			},
-			Handler: observabilityMiddleware(metadataHandler),
+			Handler: observabilityMiddleware(v1beta1Alias(metadataHandler)),
 		},
 		healthServer: &http.Server{
 			Addr:        healthAddr,
@@ -185,40 +311,57 @@ func New(ctx context.Context, opts ServerOptions) *Server {
 	metadataHandler.HandleMetadata(gkeNodeNameAPI, s.gkeNodeNameAPI())
 	metadataHandler.HandleMetadata(gkeProjectIDAPI, s.gkeProjectIDAPI())
 	metadataHandler.HandleMetadata(gkeNumericProjectIDAPI, s.gkeNumericProjectIDAPI())
+	metadataHandler.HandleDirectory(gkeProjectAttributesDir, s.listPodProjectAttributes)
+	metadataHandler.HandleMetadata(gkeProjectAttributeAPI, s.gkeProjectAttributeAPI())
 	metadataHandler.HandleDirectory(gkeServiceAccountsDirectory, s.listPodGoogleServiceAccounts)
 	metadataHandler.HandleMetadata(gkeServiceAccountAliasesAPI, s.gkeServiceAccountAliasesAPI())
 	metadataHandler.HandleMetadata(gkeServiceAccountEmailAPI, s.gkeServiceAccountEmailAPI())
 	metadataHandler.HandleMetadata(gkeServiceAccountIdentityAPI, s.gkeServiceAccountIdentityAPI())
 	metadataHandler.HandleMetadata(gkeServiceAccountScopesAPI, s.gkeServiceAccountScopesAPI())
 	metadataHandler.HandleMetadata(gkeServiceAccountTokenAPI, s.gkeServiceAccountTokenAPI())
+	metadataHandler.HandleMetadata(gkeUniverseDomainAPI, s.gkeUniverseDomainAPI())
 
 	l.WithField("metadata_directory", metadataHandler).Info("metadata directory initialized")
 
 	// setup health handlers
 	healthHandler.Handle("/metrics", metrics.HandlerFor(opts.MetricsRegistry, l))
+	healthHandler.HandleFunc(logLevelsAPI, s.logLevelsAPI)
 	healthHandler.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 	// /readyz exercises the full request path against the daemon itself
-	// using a fresh TCP connection (DisableKeepAlives), then asks the
+	// using a fresh TCP connection (DisableKeepAlives) to a private loopback
+	// listener of this instance (the shared metadata port may be served by
+	// the instance being replaced during upgrades), then asks the
 	// attestation lookuper whether it captured that connection's 4-tuple.
 	// In eBPF mode this gates readiness on the sockops program actually
 	// firing for new connects; in netlink modes the verify is a no-op.
 	healthHandler.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
 		l := logging.FromRequest(r)
-		var local, remote *net.TCPAddr
+		if s.draining.Load() {
+			l.Debug("readiness: draining")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// The attestation check runs right after the dial, while the
+		// connection is still open: in eBPF mode the entry is deleted from
+		// the map when the connection closes.
+		var attestationErr error
 		client := &http.Client{Transport: &http.Transport{
 			DisableKeepAlives: true,
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
-				if err == nil {
-					local = conn.LocalAddr().(*net.TCPAddr)
-					remote = conn.RemoteAddr().(*net.TCPAddr)
+				if err == nil && opts.Attestation != nil {
+					local := conn.LocalAddr().(*net.TCPAddr)
+					remote := conn.RemoteAddr().(*net.TCPAddr)
+					src, _ := netip.AddrFromSlice(local.IP.To4())
+					dst, _ := netip.AddrFromSlice(remote.IP.To4())
+					attestationErr = opts.Attestation.Verify(src.Unmap(), dst.Unmap(), uint16(local.Port), uint16(remote.Port))
 				}
 				return conn, err
 			},
 		}}
-		url := fmt.Sprintf("http://%s%s", opts.Addr, gkeNodeNameAPI)
+		url := fmt.Sprintf("http://%s%s", s.selfCheckAddr, gkeNodeNameAPI)
 		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
 		if err != nil {
 			l.WithError(err).Error("readiness: building self request")
@@ -250,65 +393,171 @@ func New(ctx context.Context, opts ServerOptions) *Server {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		if opts.Attestation != nil && local != nil && remote != nil {
-			src, _ := netip.AddrFromSlice(local.IP.To4())
-			dst, _ := netip.AddrFromSlice(remote.IP.To4())
-			if err := opts.Attestation.Verify(src.Unmap(), dst.Unmap(), uint16(local.Port), uint16(remote.Port)); err != nil {
-				l.WithError(err).Error("readiness: attestation pipeline did not capture self-connection")
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+		if attestationErr != nil {
+			l.WithError(attestationErr).Error("readiness: attestation pipeline did not capture self-connection")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
 		w.WriteHeader(http.StatusOK)
 	})
 
-	done := make(chan struct{}, 2)
+	done := make(chan struct{}, 5)
 
-	// start metadata server
+	// start metadata server. in eBPF mode the proxy accepts the connections
+	// and routes the requests that are not metadata requests upstream
 	l.Info("starting metadata server...")
-	go func() {
-		var lis net.Listener
-		var err error
-		if opts.RoutingMode != api.RoutingModeBPF {
-			lis, err = net.Listen("tcp", s.metadataServer.Addr)
-		} else {
-			lis, err = proxy.Listen(s.metadataServer.Addr, proxyDialLatencyMillis, proxyActiveConnections)
-		}
-		if err != nil {
-			l.WithError(err).Fatal("error listening on metadata server address")
+	var lis net.Listener
+	var err error
+	if opts.RoutingMode != api.RoutingModeBPF {
+		lis, err = pkghttp.Listen(s.metadataServer.Addr)
+	} else {
+		s.proxy, err = proxy.Listen(s.metadataServer.Addr, proxy.Options{
+			Upstream:              opts.Proxy.Upstream,
+			ExtraTargets:          opts.Proxy.InterceptTargets,
+			DialTimeout:           opts.Proxy.DialTimeout,
+			ResponseHeaderTimeout: opts.Proxy.ResponseHeaderTimeout,
+			DialLatencyMillis:     proxyDialLatencyMillis,
+			DialFailures:          proxyDialFailures,
+			ActiveConnections:     proxyActiveConnections,
+
+			DialLatencyMillisByClientIP: proxyDialLatencyMillisByClientIP,
+		})
+		lis = s.proxy
+		if err == nil {
+			s.metadataServer.Handler = s.proxy.Handler(s.metadataServer.Handler)
 		}
-
+	}
+	if err != nil {
+		l.WithError(err).Fatal("error listening on metadata server address")
+	}
+	s.addr = lis.Addr().String()
+	go func() {
 		done <- struct{}{}
 		if err := s.metadataServer.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			l.WithError(err).Fatal("error serving metadata server")
 		}
 	}()
 
+	// start metadata server on the private listener of the readiness
+	// self-check. no SO_REUSEPORT, the port must belong to this instance
+	selfCheckLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		l.WithError(err).Fatal("error listening on readiness self-check address")
+	}
+	s.selfCheckAddr = selfCheckLis.Addr().String()
+	go func() {
+		done <- struct{}{}
+		if err := s.metadataServer.Serve(selfCheckLis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.WithError(err).Fatal("error serving metadata server on readiness self-check address")
+		}
+	}()
+
+	// start metadata server on the unix socket
+	if opts.UnixSocketPath != "" {
+		l.WithField("unix_socket_path", opts.UnixSocketPath).Info("starting metadata server on unix socket...")
+		go func() {
+			lis, err := pkghttp.ListenUnix(opts.UnixSocketPath)
+			if err != nil {
+				l.WithError(err).Fatal("error listening on metadata server unix socket")
+			}
+
+			done <- struct{}{}
+			if err := s.metadataServer.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				l.WithError(err).Fatal("error serving metadata server on unix socket")
+			}
+		}()
+	} else {
+		done <- struct{}{}
+	}
+
 	// start health server
 	l.Info("starting health server...")
 	go func() {
+		lis, err := pkghttp.Listen(s.healthServer.Addr)
+		if err != nil {
+			l.WithError(err).Fatal("error listening on health server address")
+		}
+
 		done <- struct{}{}
-		if err := s.healthServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			l.WithError(err).Fatal("error listening and serving health server")
+		if err := s.healthServer.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			l.WithError(err).Fatal("error serving health server")
 		}
 	}()
 
+	// start health server on the unix socket
+	if opts.HealthSocketPath != "" {
+		l.WithField("health_socket_path", opts.HealthSocketPath).Info("starting health server on unix socket...")
+		go func() {
+			lis, err := pkghttp.ListenUnix(opts.HealthSocketPath)
+			if err != nil {
+				l.WithError(err).Fatal("error listening on health server unix socket")
+			}
+
+			done <- struct{}{}
+			if err := s.healthServer.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				l.WithError(err).Fatal("error serving health server on unix socket")
+			}
+		}()
+	} else {
+		done <- struct{}{}
+	}
+
 	// wait for servers to start
-	<-done
-	<-done
+	for range cap(done) {
+		<-done
+	}
 	l.Info("servers started successfully")
 
 	return s
 }
 
-func (s *Server) Shutdown(ctx context.Context) error {
-	e1 := s.metadataServer.Shutdown(ctx)
-	e2 := s.healthServer.Shutdown(ctx)
-	if e1 == nil {
-		return e2
-	}
-	if e2 == nil {
-		return e1
+// v1beta1Alias serves the legacy /computeMetadata/v1beta1 paths, still
+// used by some old SDKs, with the v1 handlers. The Metadata-Flavor header
+// is required like for v1.
+func v1beta1Alias(h http.Handler) http.Handler {
+	const v1beta1, v1 = "/computeMetadata/v1beta1", "/computeMetadata/v1"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rest, ok := strings.CutPrefix(r.URL.Path, v1beta1); ok && (rest == "" || rest[0] == '/') {
+			r = r.Clone(r.Context())
+			r.URL.Path = v1 + rest
+			r.URL.RawPath = ""
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Addr returns the address the metadata server listens on, with the port
+// resolved when ServerOptions.Addr has port zero.
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// StartDraining makes /readyz fail so the daemon is taken out of rotation
+// before it stops serving. It is the first step of the shutdown sequence.
+func (s *Server) StartDraining() {
+	s.draining.Store(true)
+}
+
+// ShutdownMetadataServer stops accepting new metadata connections (which
+// also closes the eBPF-mode proxy listener) and waits for in-flight
+// metadata requests to finish.
+func (s *Server) ShutdownMetadataServer(ctx context.Context) error {
+	return s.metadataServer.Shutdown(ctx)
+}
+
+// WaitProxiedConnections waits for the connections being proxied through
+// to 169.254.169.254:80 (or the upstreams of the intercept targets) to
+// finish. No-op outside eBPF mode. Must be called after
+// ShutdownMetadataServer.
+func (s *Server) WaitProxiedConnections(ctx context.Context) error {
+	if s.proxy == nil {
+		return nil
 	}
-	return errors.Join(e1, e2)
+	return s.proxy.Wait(ctx)
+}
+
+// ShutdownHealthServer shuts down the health server. It is the last step of
+// the shutdown sequence, so metrics remain available while draining.
+func (s *Server) ShutdownHealthServer(ctx context.Context) error {
+	return s.healthServer.Shutdown(ctx)
 }
@@ -0,0 +1,35 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestV1beta1Alias(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/computeMetadata/v1beta1/instance/name", "/computeMetadata/v1/instance/name"},
+		{"/computeMetadata/v1beta1/", "/computeMetadata/v1/"},
+		{"/computeMetadata/v1beta1", "/computeMetadata/v1"},
+		{"/computeMetadata/v1/instance/name", "/computeMetadata/v1/instance/name"},
+		{"/computeMetadata/v1beta1x", "/computeMetadata/v1beta1x"},
+		{"/", "/"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			var got string
+			h := v1beta1Alias(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.URL.Path
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package servertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matheuscscp/gke-metadata-server/internal/googlecredentials"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// Google is a local stand-in for the STS and IAM Credentials APIs. The STS
+// exchanges the kube ServiceAccount tokens issued for the audience of one of
+// the workload identity providers for DirectAccessToken, and the IAM Credentials API
+// generates ImpersonatedAccessToken and IdentityToken for any Google Service
+// Account not denied with Deny. The requests are counted, see Calls and
+// IdentityTokenCalls, and their quota projects are recorded, see QuotaProjects.
+type Google struct {
+	*httptest.Server
+
+	audiences          []string
+	mu                 sync.Mutex
+	denied             map[string]bool
+	calls              map[string]int
+	identityTokenCalls map[string]int
+	quotaProjects      map[string][]string
+	outage             int
+}
+
+const iamCredentialsPrefix = "/v1/projects/-/serviceAccounts/"
+
+// DirectAccessToken is the access token the fake STS issues for the given
+// kube ServiceAccount.
+func DirectAccessToken(namespace, name string) string {
+	return fmt.Sprintf("sts/%s/%s", namespace, name)
+}
+
+// ImpersonatedAccessToken is the access token the fake IAM Credentials API
+// generates for the given Google Service Account.
+func ImpersonatedAccessToken(googleEmail string) string {
+	return "iam/" + googleEmail
+}
+
+// IdentityTokenExpiry is the exp claim of the ID tokens the fake IAM
+// Credentials API generates. It is fixed so that the tokens can be compared
+// with IdentityToken, the cache bounds them with its MaxTokenDuration.
+var IdentityTokenExpiry = time.Date(2100, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// IdentityToken is the ID token the fake IAM Credentials API generates for
+// the given Google Service Account and audience, an unsigned JWT.
+func IdentityToken(googleEmail, audience string) string {
+	claims := jwt.MapClaims{
+		"sub":   googleEmail,
+		"email": googleEmail,
+		"aud":   audience,
+		"exp":   jwt.NewNumericDate(IdentityTokenExpiry),
+	}
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	return token
+}
+
+func newGoogle(audiences []string) *Google {
+	g := &Google{
+		audiences:          audiences,
+		denied:             make(map[string]bool),
+		calls:              make(map[string]int),
+		identityTokenCalls: make(map[string]int),
+		quotaProjects:      make(map[string][]string),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/token", g.token)
+	mux.HandleFunc("POST /v1/introspect", g.introspect)
+	mux.HandleFunc("POST "+iamCredentialsPrefix, g.iamCredentials)
+	g.Server = httptest.NewServer(g.withOutage(mux))
+	return g
+}
+
+// ConfigOptions returns the googlecredentials options pointing to the fake.
+func (g *Google) ConfigOptions(workloadIdentityProvider string) googlecredentials.ConfigOptions {
+	return googlecredentials.ConfigOptions{
+		WorkloadIdentityProvider: workloadIdentityProvider,
+		TokenURL:                 g.URL + "/v1/token",
+		TokenInfoURL:             g.URL + "/v1/introspect",
+		ImpersonationEndpoint:    g.URL,
+		IDTokenEndpoint:          g.URL,
+	}
+}
+
+// Deny makes the IAM Credentials API answer 403 for the given Google
+// Service Account, as when the kube ServiceAccount is missing the
+// roles/iam.workloadIdentityUser binding.
+func (g *Google) Deny(googleEmail string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.denied[googleEmail] = true
+}
+
+// SetOutage makes every API answer the given status code, e.g. 503, as in
+// an outage of Google. Zero ends the outage.
+func (g *Google) SetOutage(statusCode int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.outage = statusCode
+}
+
+func (g *Google) withOutage(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.mu.Lock()
+		outage := g.outage
+		g.mu.Unlock()
+		if outage != 0 {
+			respondGoogleError(w, outage, "UNAVAILABLE", "the service is currently unavailable")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Calls returns the number of requests to the given method, "token" for the
+// STS or the method of the IAM Credentials API, e.g. "generateIdToken",
+// that reached it during no outage.
+func (g *Google) Calls(method string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.calls[method]
+}
+
+// IdentityTokenCalls returns the number of requests to generateIdToken for
+// the given audience.
+func (g *Google) IdentityTokenCalls(audience string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.identityTokenCalls[audience]
+}
+
+// QuotaProjects returns the x-goog-user-project headers of the requests to
+// the given method, "token" for the STS or the method of the IAM Credentials
+// API, e.g. "generateAccessToken", in order. Requests without the header are
+// recorded as an empty string.
+func (g *Google) QuotaProjects(method string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return slices.Clone(g.quotaProjects[method])
+}
+
+func (g *Google) record(method string, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.calls[method]++
+	g.quotaProjects[method] = append(g.quotaProjects[method], r.Header.Get(googlecredentials.QuotaProjectHeader))
+}
+
+func (g *Google) token(w http.ResponseWriter, r *http.Request) {
+	g.record("token", r)
+	if err := r.ParseForm(); err != nil {
+		respondOAuthError(w, "invalid_request", err.Error())
+		return
+	}
+	aud := r.PostForm.Get("audience")
+	if !slices.Contains(g.audiences, aud) {
+		respondOAuthError(w, "invalid_target", fmt.Sprintf("unexpected audience %q", aud))
+		return
+	}
+	var claims jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(r.PostForm.Get("subject_token"), &claims); err != nil {
+		respondOAuthError(w, "invalid_grant", err.Error())
+		return
+	}
+	if !slices.Contains(claims.Audience, aud) {
+		respondOAuthError(w, "invalid_grant", "subject token not issued for the workload identity provider")
+		return
+	}
+	s := strings.Split(claims.Subject, ":") // system:serviceaccount:{namespace}:{name}
+	if len(s) != 4 {
+		respondOAuthError(w, "invalid_grant", fmt.Sprintf("unexpected subject %q", claims.Subject))
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]any{
+		"access_token":      DirectAccessToken(s[2], s[3]),
+		"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+		"token_type":        "Bearer",
+		"expires_in":        3600,
+	})
+}
+
+func (g *Google) introspect(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]any{"active": true})
+}
+
+func (g *Google) iamCredentials(w http.ResponseWriter, r *http.Request) {
+	email, method, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, iamCredentialsPrefix), ":")
+	if !ok {
+		respondGoogleError(w, http.StatusNotFound, "NOT_FOUND", "unknown method")
+		return
+	}
+	g.record(method, r)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer sts/") {
+		respondGoogleError(w, http.StatusUnauthorized, "UNAUTHENTICATED", "request not authenticated with an STS token")
+		return
+	}
+	g.mu.Lock()
+	denied := g.denied[email]
+	g.mu.Unlock()
+	if denied {
+		respondGoogleError(w, http.StatusForbidden, "PERMISSION_DENIED",
+			fmt.Sprintf("Permission 'iam.serviceAccounts.%s' denied on resource (or it may not exist).", method))
+		return
+	}
+	var req struct {
+		Audience string `json:"audience"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondGoogleError(w, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error())
+		return
+	}
+	switch method {
+	case "generateAccessToken":
+		respondJSON(w, http.StatusOK, map[string]any{
+			"accessToken": ImpersonatedAccessToken(email),
+			"expireTime":  time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+		})
+	case "generateIdToken":
+		g.mu.Lock()
+		g.identityTokenCalls[req.Audience]++
+		g.mu.Unlock()
+		respondJSON(w, http.StatusOK, map[string]any{
+			"token": IdentityToken(email, req.Audience),
+		})
+	default:
+		respondGoogleError(w, http.StatusNotFound, "NOT_FOUND", "unknown method "+method)
+	}
+}
+
+func respondJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func respondOAuthError(w http.ResponseWriter, code, description string) {
+	respondJSON(w, http.StatusBadRequest, map[string]any{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+func respondGoogleError(w http.ResponseWriter, status int, code, message string) {
+	respondJSON(w, status, map[string]any{
+		"error": map[string]any{
+			"code":    status,
+			"message": message,
+			"status":  code,
+		},
+	})
+}
@@ -0,0 +1,182 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package servertest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matheuscscp/gke-metadata-server/api"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	authnv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// NodeName is the node where the pods served by the harness run.
+const NodeName = "test-node"
+
+// Pod returns a running pod on NodeName with the given ServiceAccount. The
+// UID of the pod is "<namespace>/<name>".
+func Pod(namespace, name, serviceAccount string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			UID:       types.UID(namespace + "/" + name),
+		},
+		Spec: corev1.PodSpec{
+			NodeName:           NodeName,
+			ServiceAccountName: serviceAccount,
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+		},
+	}
+}
+
+// Workload is a pod running as its own ServiceAccount, see NewWorkload.
+type Workload struct {
+	Pod            *corev1.Pod
+	ServiceAccount *corev1.ServiceAccount
+}
+
+// NewWorkload returns a pod and a ServiceAccount with the same name, the
+// ServiceAccount annotated like ServiceAccount.
+func NewWorkload(namespace, name, googleEmail string) Workload {
+	return Workload{
+		Pod:            Pod(namespace, name, name),
+		ServiceAccount: ServiceAccount(namespace, name, googleEmail),
+	}
+}
+
+// Annotate adds the given annotation to the ServiceAccount of the workload.
+func (w Workload) Annotate(key, value string) Workload {
+	if w.ServiceAccount.Annotations == nil {
+		w.ServiceAccount.Annotations = make(map[string]string)
+	}
+	w.ServiceAccount.Annotations[key] = value
+	return w
+}
+
+// Namespace returns a Namespace with the given annotations.
+func Namespace(name string, annotations map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: annotations,
+		},
+	}
+}
+
+// ServiceAccount returns a ServiceAccount annotated with the given Google
+// Service Account email, or not annotated if the email is empty.
+func ServiceAccount(namespace, name, googleEmail string) *corev1.ServiceAccount {
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+	}
+	if googleEmail != "" {
+		sa.Annotations = map[string]string{
+			api.GKEAnnotationServiceAccount: googleEmail,
+		}
+	}
+	return sa
+}
+
+// newKubeClient returns a fake kube client seeded with the given objects.
+// Unlike the bare fake, it applies the field selectors of pod lists and
+// issues ServiceAccount tokens, see serviceAccountToken.
+func newKubeClient(objects ...runtime.Object) *fake.Clientset {
+	c := fake.NewClientset(objects...)
+
+	c.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		la := action.(k8stesting.ListActionImpl)
+		obj, err := c.Tracker().List(la.GetResource(), la.GetKind(), la.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		list := obj.(*corev1.PodList)
+		sel := la.GetListRestrictions().Fields
+		var items []corev1.Pod
+		for _, pod := range list.Items {
+			if sel == nil || sel.Matches(podFields(&pod)) {
+				items = append(items, pod)
+			}
+		}
+		list.Items = items
+		return true, list, nil
+	})
+
+	c.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		ca, ok := action.(k8stesting.CreateActionImpl)
+		if !ok || ca.GetSubresource() != "token" {
+			return false, nil, nil
+		}
+		gvr := schema.GroupVersionResource{Version: "v1", Resource: "serviceaccounts"}
+		if _, err := c.Tracker().Get(gvr, ca.GetNamespace(), ca.Name); err != nil {
+			return true, nil, err
+		}
+		tr := ca.GetObject().(*authnv1.TokenRequest).DeepCopy()
+		exp := time.Now().Add(time.Hour)
+		if s := tr.Spec.ExpirationSeconds; s != nil {
+			exp = time.Now().Add(time.Duration(*s) * time.Second)
+		}
+		token, err := serviceAccountToken(ca.GetNamespace(), ca.Name, tr.Spec.Audiences, exp, tr.Spec.BoundObjectRef)
+		if err != nil {
+			return true, nil, err
+		}
+		tr.Status = authnv1.TokenRequestStatus{
+			Token:               token,
+			ExpirationTimestamp: metav1.NewTime(exp),
+		}
+		return true, tr, nil
+	})
+
+	return c
+}
+
+// podFields returns the pod fields supported by the kube API field
+// selectors that the pod providers use.
+func podFields(pod *corev1.Pod) fields.Set {
+	return fields.Set{
+		"metadata.namespace": pod.Namespace,
+		"metadata.name":      pod.Name,
+		"spec.nodeName":      pod.Spec.NodeName,
+		"spec.hostNetwork":   fmt.Sprint(pod.Spec.HostNetwork),
+		"status.podIP":       pod.Status.PodIP,
+	}
+}
+
+// serviceAccountToken returns an unsigned JWT with the claims of a kube
+// ServiceAccount token, which the fake STS exchanges. Tokens bound to a pod
+// carry the pod in the private claims, like the kube API server does.
+func serviceAccountToken(namespace, name string, audiences []string, exp time.Time,
+	boundObject *authnv1.BoundObjectReference) (string, error) {
+
+	claims := jwt.MapClaims{
+		"sub": fmt.Sprintf("system:serviceaccount:%s:%s", namespace, name),
+		"aud": audiences,
+		"exp": jwt.NewNumericDate(exp),
+	}
+	if boundObject != nil && boundObject.Kind == "Pod" {
+		claims["kubernetes.io"] = map[string]any{
+			"namespace": namespace,
+			"pod": map[string]any{
+				"name": boundObject.Name,
+				"uid":  boundObject.UID,
+			},
+		}
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+}
@@ -0,0 +1,330 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+// Package servertest runs the metadata server in-process for tests, without
+// a cluster or GCP. The server is started with server.New against:
+//
+//   - a fake kube API seeded with the test objects, see NewWorkload, Pod
+//     and ServiceAccount, which applies the field selectors of the pod
+//     providers and issues ServiceAccount tokens;
+//   - a fake attestation lookuper, which attests the connections opened
+//     by Harness.Client as the given pod and container;
+//   - the fake STS and IAM Credentials APIs of Google.
+//
+// The server is configured with the None routing mode and listens on
+// loopback, so every request is resolved to its pod by attestation (like
+// hostNetwork pods in production) and goes through the real handlers,
+// providers and Google credentials code.
+package servertest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matheuscscp/gke-metadata-server/api"
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
+	"github.com/matheuscscp/gke-metadata-server/internal/googlecredentials"
+	pkghttp "github.com/matheuscscp/gke-metadata-server/internal/http"
+	"github.com/matheuscscp/gke-metadata-server/internal/metrics"
+	"github.com/matheuscscp/gke-metadata-server/internal/namespaces"
+	getnamespace "github.com/matheuscscp/gke-metadata-server/internal/namespaces/get"
+	watchnamespaces "github.com/matheuscscp/gke-metadata-server/internal/namespaces/watch"
+	listpods "github.com/matheuscscp/gke-metadata-server/internal/pods/list"
+	"github.com/matheuscscp/gke-metadata-server/internal/server"
+	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts"
+	getserviceaccount "github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts/get"
+	cacheserviceaccounttokens "github.com/matheuscscp/gke-metadata-server/internal/serviceaccounttokens/cache"
+	createserviceaccounttoken "github.com/matheuscscp/gke-metadata-server/internal/serviceaccounttokens/create"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// DefaultWorkloadIdentityProvider is the workload identity provider used
+// when Options.WorkloadIdentityProvider is not set.
+const DefaultWorkloadIdentityProvider = "projects/123456789/locations/global/workloadIdentityPools/test-pool/providers/test-provider"
+
+type (
+	// Harness is a metadata server running in-process, see New.
+	Harness struct {
+		Kube    *fake.Clientset
+		Google  *Google
+		Server  *server.Server
+		Metrics *prometheus.Registry
+
+		NumericProjectID     string
+		WorkloadIdentityPool string
+
+		attestation *fakeAttestation
+	}
+
+	Options struct {
+		ProjectID      string           // default: "test-project"
+		UniverseDomain string           // default: googlecredentials.DefaultUniverseDomain
+		Workloads      []Workload       // pods and ServiceAccounts seeded into the fake kube API
+		Objects        []runtime.Object // other objects seeded into the fake kube API
+
+		Providers ProvidersOptions
+		Tokens    TokensOptions
+		Cache     *CacheOptions // serve the tokens through the token cache when not nil
+
+		NamespaceProjectIDs    bool // watching the namespaces
+		QuotaProjects          bool
+		NamespaceQuotaProjects bool // watching the namespaces
+	}
+
+	ProvidersOptions struct {
+		Default    string            // default: DefaultWorkloadIdentityProvider
+		Additional []string          // allowed in the ServiceAccount annotation
+		Namespaces map[string]string // namespace to provider
+	}
+
+	TokensOptions struct {
+		KubernetesIdentityTokens         bool
+		KubernetesIdentityTokenAudiences []string
+		BindServiceAccountTokens         bool
+		ServiceAccountTokenExpiration    time.Duration
+	}
+
+	CacheOptions struct {
+		MaxTokenDuration   time.Duration
+		ServeStale         bool
+		RefreshAheadBudget int
+
+		// default: the number of KubernetesIdentityTokenAudiences
+		MaxKubernetesIDTokensPerServiceAccount int
+	}
+
+	// fakeAttestation attests the connections opened by Harness.Client,
+	// identified by the client address.
+	fakeAttestation struct {
+		mu    sync.Mutex
+		conns map[netip.AddrPort]attestation.Identity
+	}
+)
+
+// New starts a metadata server with fakes for its dependencies. The server
+// and the fakes are shut down when the test finishes.
+func New(t testing.TB, opts Options) *Harness {
+	t.Helper()
+	if opts.ProjectID == "" {
+		opts.ProjectID = "test-project"
+	}
+	if opts.Providers.Default == "" {
+		opts.Providers.Default = DefaultWorkloadIdentityProvider
+	}
+	objects := slices.Clone(opts.Objects)
+	for _, w := range opts.Workloads {
+		objects = append(objects, w.Pod, w.ServiceAccount)
+	}
+
+	h := &Harness{
+		Kube:    newKubeClient(objects...),
+		Metrics: metrics.NewRegistry(),
+		attestation: &fakeAttestation{
+			conns: make(map[netip.AddrPort]attestation.Identity),
+		},
+	}
+	var audiences []string
+	for _, provider := range append([]string{opts.Providers.Default}, opts.Providers.Additional...) {
+		audiences = append(audiences, "//iam.googleapis.com/"+provider)
+	}
+	for _, provider := range opts.Providers.Namespaces {
+		audiences = append(audiences, "//iam.googleapis.com/"+provider)
+	}
+	h.Google = newGoogle(audiences)
+	t.Cleanup(h.Google.Close)
+
+	googleCredentialsOpts := h.Google.ConfigOptions(opts.Providers.Default)
+	googleCredentialsOpts.UniverseDomain = opts.UniverseDomain
+	googleCredentialsOpts.Transport = googlecredentials.NewTransport(googlecredentials.TransportOptions{
+		MetricsRegistry:   h.Metrics,
+		RetryInitialDelay: time.Millisecond,
+		RetryMaxDelay:     time.Millisecond,
+	})
+	googleCredentials, err := googlecredentials.NewProviders(googlecredentials.ProvidersOptions{
+		ConfigOptions: googleCredentialsOpts,
+		Additional:    opts.Providers.Additional,
+		Namespaces:    opts.Providers.Namespaces,
+	})
+	if err != nil {
+		t.Fatalf("error creating google credentials config: %v", err)
+	}
+	h.NumericProjectID = googleCredentials.Default().NumericProjectID()
+	h.WorkloadIdentityPool = googleCredentials.Default().WorkloadIdentityPool()
+
+	serviceAccounts := getserviceaccount.NewProvider(getserviceaccount.ProviderOptions{
+		KubeClient: h.Kube,
+	})
+
+	var namespaceProvider namespaces.Provider
+	if opts.NamespaceProjectIDs || opts.NamespaceQuotaProjects {
+		wns := watchnamespaces.NewProvider(watchnamespaces.ProviderOptions{
+			FallbackSource: getnamespace.NewProvider(getnamespace.ProviderOptions{
+				KubeClient: h.Kube,
+			}),
+			KubeClient:      h.Kube,
+			MetricsRegistry: h.Metrics,
+		})
+		wns.Start(context.Background())
+		t.Cleanup(func() { wns.Close() })
+		namespaceProvider = wns
+	}
+
+	serviceAccountTokensOpts := createserviceaccounttoken.ProviderOptions{
+		GoogleCredentials: googleCredentials,
+		ServiceAccounts:   serviceAccounts,
+		KubeClient:        h.Kube,
+		Expiration:        opts.Tokens.ServiceAccountTokenExpiration,
+		QuotaProjects:     opts.QuotaProjects,
+	}
+	if opts.NamespaceQuotaProjects {
+		serviceAccountTokensOpts.Namespaces = namespaceProvider
+	}
+	serviceAccountTokens := createserviceaccounttoken.NewProvider(serviceAccountTokensOpts)
+	if opts.Cache != nil {
+		maxKubernetesIDTokens := opts.Cache.MaxKubernetesIDTokensPerServiceAccount
+		if maxKubernetesIDTokens == 0 {
+			maxKubernetesIDTokens = len(opts.Tokens.KubernetesIdentityTokenAudiences)
+		}
+		p := cacheserviceaccounttokens.NewProvider(context.Background(), cacheserviceaccounttokens.ProviderOptions{
+			Source:             serviceAccountTokens,
+			ServiceAccounts:    serviceAccounts,
+			MetricsRegistry:    h.Metrics,
+			Concurrency:        10,
+			MaxTokenDuration:   opts.Cache.MaxTokenDuration,
+			ServeStale:         opts.Cache.ServeStale,
+			RefreshAheadBudget: opts.Cache.RefreshAheadBudget,
+
+			MaxKubernetesIDTokensPerServiceAccount: maxKubernetesIDTokens,
+		})
+		t.Cleanup(func() { p.Close() })
+		// Register the seeded pods like the pod watcher does, see watchpods.Listener.
+		for _, obj := range objects {
+			pod, ok := obj.(*corev1.Pod)
+			if !ok {
+				continue
+			}
+			saRef := serviceaccounts.ReferenceFromPod(pod)
+			if opts.Tokens.BindServiceAccountTokens {
+				saRef = serviceaccounts.BoundReferenceFromPod(pod)
+			}
+			p.AddPodServiceAccount(saRef)
+		}
+		serviceAccountTokens = p
+	}
+
+	h.Server = server.New(context.Background(), server.ServerOptions{
+		NodeName: NodeName,
+		PodIP:    "127.0.0.1",
+		Addr:     "127.0.0.1:0",
+		Pods: listpods.NewProvider(listpods.ProviderOptions{
+			NodeName:   NodeName,
+			KubeClient: h.Kube,
+		}),
+		ServiceAccounts:           serviceAccounts,
+		ServiceAccountTokens:      serviceAccountTokens,
+		MetricsRegistry:           h.Metrics,
+		ProjectID:                 opts.ProjectID,
+		WorkloadIdentityProviders: googleCredentials,
+		Namespaces:                namespaceProvider,
+		UniverseDomain:            googleCredentials.Default().UniverseDomain(),
+		RoutingMode:               api.RoutingModeNone,
+		PodLookup:                 server.PodLookupOptions{MaxAttempts: 1},
+		Attestation:               h.attestation,
+
+		KubernetesIdentityTokens: opts.Tokens.KubernetesIdentityTokens,
+		BindServiceAccountTokens: opts.Tokens.BindServiceAccountTokens,
+		NamespaceProjectIDs:      opts.NamespaceProjectIDs,
+		QuotaProjects:            opts.QuotaProjects,
+		NamespaceQuotaProjects:   opts.NamespaceQuotaProjects,
+
+		KubernetesIdentityTokenAudiences: opts.Tokens.KubernetesIdentityTokenAudiences,
+	})
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		h.Server.ShutdownMetadataServer(ctx)
+		h.Server.ShutdownHealthServer(ctx)
+	})
+
+	return h
+}
+
+// URL returns the URL of the given path on the metadata server.
+func (h *Harness) URL(path string) string {
+	return "http://" + h.Server.Addr() + path
+}
+
+// Client returns an HTTP client whose connections to the metadata server
+// are attested as the given container of the pod. The container ID is
+// matched against the container statuses of the pod, and may be empty.
+func (h *Harness) Client(pod *corev1.Pod, containerID string) *http.Client {
+	id := attestation.Identity{
+		PodUID:      string(pod.UID),
+		ContainerID: containerID,
+	}
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			h.attestation.add(c.LocalAddr().(*net.TCPAddr).AddrPort(), id)
+			return c, nil
+		},
+	}}
+}
+
+// Get requests the given path as the pod with the Metadata-Flavor header,
+// and returns the status code and the body of the response.
+func (h *Harness) Get(t testing.TB, pod *corev1.Pod, path string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, h.URL(path), nil)
+	if err != nil {
+		t.Fatalf("error creating request: %v", err)
+	}
+	req.Header.Set(pkghttp.MetadataFlavorHeader, pkghttp.MetadataFlavorGoogle)
+	resp, err := h.Client(pod, "").Do(req)
+	if err != nil {
+		t.Fatalf("error requesting %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading response of %s: %v", path, err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func (f *fakeAttestation) add(client netip.AddrPort, id attestation.Identity) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conns[netip.AddrPortFrom(client.Addr().Unmap(), client.Port())] = id
+}
+
+// Lookup implements server.AttestationLookuper.
+func (f *fakeAttestation) Lookup(srcIP, dstIP netip.Addr, srcPort, dstPort uint16) (attestation.Identity, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id, ok := f.conns[netip.AddrPortFrom(srcIP, srcPort)]
+	if !ok {
+		return attestation.Identity{}, fmt.Errorf("connection from %s:%d not opened by a harness client", srcIP, srcPort)
+	}
+	return id, nil
+}
+
+// Verify implements server.AttestationLookuper.
+func (f *fakeAttestation) Verify(srcIP, dstIP netip.Addr, srcPort, dstPort uint16) error {
+	return nil
+}
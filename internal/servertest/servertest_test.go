@@ -0,0 +1,759 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package servertest_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matheuscscp/gke-metadata-server/api"
+	"github.com/matheuscscp/gke-metadata-server/internal/servertest"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	authnv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	testGoogleEmail   = "test@test-project.iam.gserviceaccount.com"
+	deniedGoogleEmail = "denied@test-project.iam.gserviceaccount.com"
+
+	saPath               = "/computeMetadata/v1/instance/service-accounts"
+	tokenPath            = saPath + "/default/token"
+	identityPath         = saPath + "/default/identity?audience="
+	emailPath            = saPath + "/default/email"
+	projectIDPath        = "/computeMetadata/v1/project/project-id"
+	numericProjectIDPath = "/computeMetadata/v1/project/numeric-project-id"
+	quotaProjectPath     = "/computeMetadata/v1/project/attributes/quota-project"
+)
+
+// kubernetesIdentityTokenAudiences are the audiences allowed for the
+// Kubernetes identity tokens in the tests.
+var kubernetesIdentityTokenAudiences = []string{"https://receiver.example.com", "https://other.example.com"}
+
+// cacheModes are the ways of serving the tokens the token tests run with,
+// see forEachCacheMode.
+var cacheModes = []struct {
+	name  string
+	cache *servertest.CacheOptions
+}{
+	{"uncached", nil},
+	{"cached", &servertest.CacheOptions{}},
+}
+
+// forEachCacheMode runs the test with the tokens served with and without
+// the token cache.
+func forEachCacheMode(t *testing.T, test func(t *testing.T, cache *servertest.CacheOptions)) {
+	for _, mode := range cacheModes {
+		t.Run(mode.name, func(t *testing.T) {
+			test(t, mode.cache)
+		})
+	}
+}
+
+// getOK requests the path as the pod and requires a 200 response, whose
+// body is returned.
+func getOK(t *testing.T, h *servertest.Harness, pod *corev1.Pod, path string) string {
+	t.Helper()
+	status, body := h.Get(t, pod, path)
+	require.Equal(t, http.StatusOK, status, body)
+	return body
+}
+
+func TestMetadataPaths(t *testing.T) {
+	impersonated := servertest.NewWorkload("default", "impersonated", testGoogleEmail)
+	direct := servertest.NewWorkload("default", "direct", "")
+	denied := servertest.NewWorkload("other", "denied", deniedGoogleEmail)
+	h := servertest.New(t, servertest.Options{
+		Workloads: []servertest.Workload{impersonated, direct, denied},
+	})
+	h.Google.Deny(deniedGoogleEmail)
+
+	for _, tt := range []struct {
+		name         string
+		workload     servertest.Workload
+		path         string
+		wantStatus   int
+		wantBody     string
+		wantContains string
+	}{
+		{
+			name:       "node name",
+			workload:   direct,
+			path:       "/computeMetadata/v1/instance/name",
+			wantStatus: http.StatusOK,
+			wantBody:   servertest.NodeName,
+		},
+		{
+			name:       "project id",
+			workload:   direct,
+			path:       projectIDPath,
+			wantStatus: http.StatusOK,
+			wantBody:   "test-project",
+		},
+		{
+			name:       "numeric project id",
+			workload:   direct,
+			path:       numericProjectIDPath,
+			wantStatus: http.StatusOK,
+			wantBody:   "123456789",
+		},
+		{
+			name:       "v1beta1 alias",
+			workload:   direct,
+			path:       "/computeMetadata/v1beta1/project/project-id",
+			wantStatus: http.StatusOK,
+			wantBody:   "test-project",
+		},
+		{
+			name:       "universe domain",
+			workload:   direct,
+			path:       "/computeMetadata/v1/universe/universe-domain",
+			wantStatus: http.StatusOK,
+			wantBody:   "googleapis.com",
+		},
+		{
+			name:       "universe directory",
+			workload:   direct,
+			path:       "/computeMetadata/v1/universe/",
+			wantStatus: http.StatusOK,
+			wantBody:   "universe-domain\n",
+		},
+		{
+			name:       "universe recursive",
+			workload:   direct,
+			path:       "/computeMetadata/v1/universe/?recursive=true",
+			wantStatus: http.StatusOK,
+			wantBody:   `{"universeDomain":"googleapis.com"}`,
+		},
+		{
+			name:       "service accounts of impersonated pod",
+			workload:   impersonated,
+			path:       saPath + "/",
+			wantStatus: http.StatusOK,
+			wantBody:   "default/\n" + testGoogleEmail + "/\n",
+		},
+		{
+			name:       "service accounts of direct access pod",
+			workload:   direct,
+			path:       saPath + "/",
+			wantStatus: http.StatusOK,
+			wantBody:   "default/\ntest-pool/\n",
+		},
+		{
+			name:       "email of impersonated pod",
+			workload:   impersonated,
+			path:       emailPath,
+			wantStatus: http.StatusOK,
+			wantBody:   testGoogleEmail,
+		},
+		{
+			name:       "email by google service account",
+			workload:   impersonated,
+			path:       saPath + "/" + testGoogleEmail + "/email",
+			wantStatus: http.StatusOK,
+			wantBody:   testGoogleEmail,
+		},
+		{
+			name:       "email of direct access pod",
+			workload:   direct,
+			path:       emailPath,
+			wantStatus: http.StatusOK,
+			wantBody:   "test-pool",
+		},
+		{
+			name:       "unknown service account",
+			workload:   direct,
+			path:       saPath + "/" + testGoogleEmail + "/email",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "service account directory",
+			workload:   impersonated,
+			path:       saPath + "/default/",
+			wantStatus: http.StatusOK,
+			wantBody:   "aliases\nemail\nidentity\nscopes\ntoken\n",
+		},
+		{
+			name:       "service account recursive",
+			workload:   impersonated,
+			path:       saPath + "/default/?recursive=true",
+			wantStatus: http.StatusOK,
+			wantBody: `{"aliases":["default"],"email":"` + testGoogleEmail + `",` +
+				`"scopes":["https://www.googleapis.com/auth/cloud-platform","https://www.googleapis.com/auth/userinfo.email"]}`,
+		},
+		{
+			name:       "aliases",
+			workload:   direct,
+			path:       saPath + "/default/aliases",
+			wantStatus: http.StatusOK,
+			wantBody:   "default\n",
+		},
+		{
+			name:       "scopes",
+			workload:   direct,
+			path:       saPath + "/default/scopes",
+			wantStatus: http.StatusOK,
+			wantBody:   "https://www.googleapis.com/auth/cloud-platform\nhttps://www.googleapis.com/auth/userinfo.email\n",
+		},
+		{
+			name:         "token of impersonated pod",
+			workload:     impersonated,
+			path:         tokenPath,
+			wantStatus:   http.StatusOK,
+			wantContains: `"access_token":"` + servertest.ImpersonatedAccessToken(testGoogleEmail) + `"`,
+		},
+		{
+			name:         "token with scopes of impersonated pod",
+			workload:     impersonated,
+			path:         saPath + "/default/token?scopes=https://www.googleapis.com/auth/devstorage.read_only",
+			wantStatus:   http.StatusOK,
+			wantContains: `"access_token":"` + servertest.ImpersonatedAccessToken(testGoogleEmail) + `"`,
+		},
+		{
+			name:         "token of direct access pod",
+			workload:     direct,
+			path:         tokenPath,
+			wantStatus:   http.StatusOK,
+			wantContains: `"access_token":"` + servertest.DirectAccessToken("default", "direct") + `"`,
+		},
+		{
+			name:         "token denied by iam",
+			workload:     denied,
+			path:         tokenPath,
+			wantStatus:   http.StatusForbidden,
+			wantContains: "PERMISSION_DENIED",
+		},
+		{
+			name:       "identity of impersonated pod",
+			workload:   impersonated,
+			path:       identityPath + "test-audience",
+			wantStatus: http.StatusOK,
+			wantBody:   servertest.IdentityToken(testGoogleEmail, "test-audience"),
+		},
+		{
+			name:         "identity of direct access pod",
+			workload:     direct,
+			path:         identityPath + "test-audience",
+			wantStatus:   http.StatusNotFound,
+			wantContains: "is not annotated with a target Google service account",
+		},
+		{
+			name:         "identity without audience",
+			workload:     impersonated,
+			path:         saPath + "/default/identity",
+			wantStatus:   http.StatusBadRequest,
+			wantContains: "non-empty audience parameter required",
+		},
+		{
+			name:         "identity denied by iam",
+			workload:     denied,
+			path:         identityPath + "test-audience",
+			wantStatus:   http.StatusForbidden,
+			wantContains: "PERMISSION_DENIED",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := h.Get(t, tt.workload.Pod, tt.path)
+			assert.Equal(t, tt.wantStatus, status, body)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, body)
+			}
+			assert.Contains(t, body, tt.wantContains)
+		})
+	}
+}
+
+func TestMetadataFlavorRequired(t *testing.T) {
+	h := servertest.New(t, servertest.Options{})
+
+	resp, err := h.Client(servertest.Pod("default", "test", "test"), "").
+		Get(h.URL("/computeMetadata/v1/instance/name"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestUniverseDomain(t *testing.T) {
+	h := servertest.New(t, servertest.Options{UniverseDomain: "example.cloud"})
+
+	status, body := h.Get(t, servertest.Pod("default", "test", "test"), "/computeMetadata/v1/universe/universe-domain")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "example.cloud", body)
+}
+
+func TestKubernetesIdentityTokens(t *testing.T) {
+	forEachCacheMode(t, func(t *testing.T, cache *servertest.CacheOptions) {
+		direct := servertest.NewWorkload("default", "direct", "")
+		restricted := servertest.Pod("default", "restricted", "direct")
+		restricted.Annotations = map[string]string{api.AnnotationAllowedContainers: "app"}
+		h := servertest.New(t, servertest.Options{
+			Workloads: []servertest.Workload{direct},
+			Objects:   []runtime.Object{restricted},
+			Tokens: servertest.TokensOptions{
+				KubernetesIdentityTokens:         true,
+				KubernetesIdentityTokenAudiences: kubernetesIdentityTokenAudiences,
+			},
+			Cache: cache,
+		})
+
+		token := getOK(t, h, direct.Pod, identityPath+"https://receiver.example.com")
+		var claims jwt.RegisteredClaims
+		_, _, err := jwt.NewParser().ParseUnverified(token, &claims)
+		require.NoError(t, err)
+		assert.Equal(t, "system:serviceaccount:default:direct", claims.Subject)
+		assert.Equal(t, jwt.ClaimStrings{"https://receiver.example.com"}, claims.Audience)
+
+		again := getOK(t, h, direct.Pod, identityPath+"https://receiver.example.com")
+		other := getOK(t, h, direct.Pod, identityPath+"https://other.example.com")
+		assert.NotEqual(t, token, other)
+		if cache != nil {
+			assert.Equal(t, token, again)
+			assert.Equal(t, 2, countIdentityTokenRequests(h))
+		} else {
+			assert.Equal(t, 3, countIdentityTokenRequests(h))
+		}
+
+		// The container restriction of the pod applies.
+		status, body := h.Get(t, restricted, identityPath+"https://receiver.example.com")
+		assert.Equal(t, http.StatusForbidden, status)
+		assert.Contains(t, body, "could not be attested")
+
+		// Only the allowed audiences are issued.
+		status, body = h.Get(t, direct.Pod, identityPath+"https://kubernetes.default.svc")
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.Contains(t, body, `audience "https://kubernetes.default.svc" is not allowed`)
+	})
+}
+
+func TestKubernetesIdentityTokensEviction(t *testing.T) {
+	direct := servertest.NewWorkload("default", "direct", "")
+	h := servertest.New(t, servertest.Options{
+		Workloads: []servertest.Workload{direct},
+		Tokens: servertest.TokensOptions{
+			KubernetesIdentityTokens:         true,
+			KubernetesIdentityTokenAudiences: kubernetesIdentityTokenAudiences,
+		},
+		Cache: &servertest.CacheOptions{MaxKubernetesIDTokensPerServiceAccount: 1},
+	})
+
+	// Caching the token of the second audience evicts the first one.
+	for _, audience := range []string{"https://receiver.example.com", "https://other.example.com", "https://receiver.example.com"} {
+		getOK(t, h, direct.Pod, identityPath+audience)
+	}
+	assert.Equal(t, 3, countIdentityTokenRequests(h))
+}
+
+func TestBoundServiceAccountTokens(t *testing.T) {
+	forEachCacheMode(t, func(t *testing.T, cache *servertest.CacheOptions) {
+		first := servertest.Pod("default", "first", "impersonated")
+		second := servertest.Pod("default", "second", "impersonated")
+		h := servertest.New(t, servertest.Options{
+			Objects: []runtime.Object{
+				first,
+				second,
+				servertest.ServiceAccount("default", "impersonated", testGoogleEmail),
+			},
+			Tokens: servertest.TokensOptions{
+				BindServiceAccountTokens:      true,
+				ServiceAccountTokenExpiration: 20 * time.Minute,
+			},
+			Cache: cache,
+		})
+
+		for _, pod := range []*corev1.Pod{first, second, first} {
+			assert.Contains(t, getOK(t, h, pod, tokenPath), servertest.ImpersonatedAccessToken(testGoogleEmail))
+		}
+
+		// The tokens are bound to each pod, so they are cached per pod.
+		var boundPods []string
+		for _, tr := range tokenRequests(h) {
+			require.NotNil(t, tr.Spec.BoundObjectRef)
+			assert.Equal(t, "Pod", tr.Spec.BoundObjectRef.Kind)
+			assert.Equal(t, "v1", tr.Spec.BoundObjectRef.APIVersion)
+			assert.Equal(t, types.UID("default/"+tr.Spec.BoundObjectRef.Name), tr.Spec.BoundObjectRef.UID)
+			require.NotNil(t, tr.Spec.ExpirationSeconds)
+			assert.Equal(t, int64(1200), *tr.Spec.ExpirationSeconds)
+			boundPods = append(boundPods, tr.Spec.BoundObjectRef.Name)
+		}
+		if cache != nil {
+			assert.ElementsMatch(t, []string{"first", "second"}, boundPods)
+		} else {
+			assert.ElementsMatch(t, []string{"first", "second", "first"}, boundPods)
+		}
+	})
+}
+
+func TestWorkloadIdentityProviders(t *testing.T) {
+	const (
+		tenantProvider = "projects/222/locations/global/workloadIdentityPools/tenant-pool/providers/tenant"
+		otherProvider  = "projects/333/locations/global/workloadIdentityPools/other-pool/providers/other"
+	)
+	defaultWorkload := servertest.NewWorkload("default", "direct", "")
+	tenant := servertest.NewWorkload("tenant", "direct", "")
+	annotated := servertest.NewWorkload("default", "annotated", "").
+		Annotate(api.AnnotationWorkloadIdentityProvider, otherProvider)
+	tenantAnnotated := servertest.NewWorkload("tenant", "annotated", "").
+		Annotate(api.AnnotationWorkloadIdentityProvider, tenantProvider)
+	notAllowed := servertest.NewWorkload("default", "not-allowed", "").
+		Annotate(api.AnnotationWorkloadIdentityProvider, "projects/444/locations/global/workloadIdentityPools/x/providers/x")
+	otherNamespace := servertest.NewWorkload("default", "other-namespace", "").
+		Annotate(api.AnnotationWorkloadIdentityProvider, tenantProvider)
+	tenantOverride := servertest.NewWorkload("tenant", "override", "").
+		Annotate(api.AnnotationWorkloadIdentityProvider, otherProvider)
+	h := servertest.New(t, servertest.Options{
+		Workloads: []servertest.Workload{defaultWorkload, tenant, annotated, tenantAnnotated, notAllowed, otherNamespace, tenantOverride},
+		Providers: servertest.ProvidersOptions{
+			Additional: []string{otherProvider},
+			Namespaces: map[string]string{"tenant": tenantProvider},
+		},
+	})
+
+	for _, tt := range []struct {
+		workload         servertest.Workload
+		provider         string
+		numericProjectID string
+		pool             string
+	}{
+		{defaultWorkload, servertest.DefaultWorkloadIdentityProvider, "123456789", "test-pool"},
+		{tenant, tenantProvider, "222", "tenant-pool"},
+		{annotated, otherProvider, "333", "other-pool"},
+		{tenantAnnotated, tenantProvider, "222", "tenant-pool"},
+	} {
+		pod := tt.workload.Pod
+		t.Run(pod.Namespace+"/"+pod.Name, func(t *testing.T) {
+			assert.Equal(t, tt.numericProjectID, getOK(t, h, pod, numericProjectIDPath))
+			assert.Equal(t, tt.pool, getOK(t, h, pod, emailPath))
+
+			// The fake STS only exchanges tokens issued for the provider audience.
+			assert.Contains(t, getOK(t, h, pod, tokenPath), servertest.DirectAccessToken(pod.Namespace, pod.Spec.ServiceAccountName))
+			trs := tokenRequests(h)
+			assert.Equal(t, []string{"//iam.googleapis.com/" + tt.provider}, trs[len(trs)-1].Spec.Audiences)
+		})
+	}
+
+	// Namespace providers are only available to their namespaces, and cannot
+	// be overridden by annotations.
+	for _, w := range []servertest.Workload{notAllowed, otherNamespace, tenantOverride} {
+		pod := w.Pod
+		t.Run("not allowed "+pod.Namespace+"/"+pod.Name, func(t *testing.T) {
+			for _, path := range []string{numericProjectIDPath, tokenPath} {
+				status, body := h.Get(t, pod, path)
+				assert.Equal(t, http.StatusBadRequest, status, path)
+				assert.Contains(t, body, "workload identity provider is not allowed", path)
+			}
+		})
+	}
+}
+
+func TestNamespaceProjectIDs(t *testing.T) {
+	defaultWorkload := servertest.NewWorkload("default", "direct", "")
+	tenant := servertest.NewWorkload("tenant", "direct", "")
+	invalid := servertest.NewWorkload("invalid", "direct", "")
+	defaultPod, tenantPod, invalidPod := defaultWorkload.Pod, tenant.Pod, invalid.Pod
+	h := servertest.New(t, servertest.Options{
+		Workloads: []servertest.Workload{defaultWorkload, tenant, invalid},
+		Objects: []runtime.Object{
+			servertest.Namespace("default", nil),
+			servertest.Namespace("tenant", map[string]string{
+				api.AnnotationProjectID:        "tenant-project",
+				api.AnnotationNumericProjectID: "222",
+				api.AnnotationQuotaProject:     "tenant-quota-project",
+			}),
+			servertest.Namespace("invalid", map[string]string{
+				api.AnnotationProjectID: "Invalid_Project",
+			}),
+		},
+		NamespaceProjectIDs: true,
+		QuotaProjects:       true, // without NamespaceQuotaProjects
+	})
+
+	for _, tt := range []struct {
+		pod        *corev1.Pod
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{defaultPod, projectIDPath, http.StatusOK, "test-project"},
+		{defaultPod, numericProjectIDPath, http.StatusOK, h.NumericProjectID},
+		{tenantPod, projectIDPath, http.StatusOK, "tenant-project"},
+		{tenantPod, numericProjectIDPath, http.StatusOK, "222"},
+		{tenantPod, quotaProjectPath, http.StatusNotFound, ""},
+		{invalidPod, projectIDPath, http.StatusInternalServerError, "has invalid project id"},
+		{invalidPod, numericProjectIDPath, http.StatusOK, h.NumericProjectID},
+	} {
+		t.Run(tt.pod.Namespace+tt.path, func(t *testing.T) {
+			status, body := h.Get(t, tt.pod, tt.path)
+			assert.Equal(t, tt.wantStatus, status)
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, tt.wantBody, body)
+			} else {
+				assert.Contains(t, body, tt.wantBody)
+			}
+		})
+	}
+
+	// Changes to the annotations are served once observed by the watch.
+	ns := servertest.Namespace("tenant", map[string]string{api.AnnotationProjectID: "other-project"})
+	_, err := h.Kube.CoreV1().Namespaces().Update(context.Background(), ns, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, projectID := h.Get(t, tenantPod, projectIDPath)
+		_, numericProjectID := h.Get(t, tenantPod, numericProjectIDPath)
+		return projectID == "other-project" && numericProjectID == h.NumericProjectID
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// countIdentityTokenRequests counts the ServiceAccount tokens requested for
+// audiences other than the workload identity provider.
+func countIdentityTokenRequests(h *servertest.Harness) int {
+	var n int
+	for _, tr := range tokenRequests(h) {
+		if tr.Spec.Audiences[0] != "//iam.googleapis.com/"+servertest.DefaultWorkloadIdentityProvider {
+			n++
+		}
+	}
+	return n
+}
+
+func countServiceAccountGets(h *servertest.Harness) int {
+	var n int
+	for _, a := range h.Kube.Actions() {
+		if a.Matches("get", "serviceaccounts") {
+			n++
+		}
+	}
+	return n
+}
+
+func tokenRequests(h *servertest.Harness) []*authnv1.TokenRequest {
+	var trs []*authnv1.TokenRequest
+	for _, a := range h.Kube.Actions() {
+		if a.Matches("create", "serviceaccounts") && a.GetSubresource() == "token" {
+			trs = append(trs, a.(k8stesting.CreateAction).GetObject().(*authnv1.TokenRequest))
+		}
+	}
+	return trs
+}
+
+func TestQuotaProjects(t *testing.T) {
+	const googleEmail = "billed@test-project.iam.gserviceaccount.com"
+	defaultWorkload := servertest.NewWorkload("default", "direct", "")
+	billed := servertest.NewWorkload("default", "billed", googleEmail).
+		Annotate(api.AnnotationQuotaProject, "sa-quota-project")
+	invalid := servertest.NewWorkload("default", "invalid", "").
+		Annotate(api.AnnotationQuotaProject, "Invalid_Project")
+	tenant := servertest.NewWorkload("tenant", "direct", "")
+	invalidTenant := servertest.NewWorkload("invalid", "direct", "")
+	defaultPod, billedPod, invalidPod, tenantPod := defaultWorkload.Pod, billed.Pod, invalid.Pod, tenant.Pod
+	h := servertest.New(t, servertest.Options{
+		Workloads: []servertest.Workload{defaultWorkload, billed, invalid, tenant, invalidTenant},
+		Objects: []runtime.Object{
+			servertest.Namespace("default", nil),
+			servertest.Namespace("tenant", map[string]string{
+				api.AnnotationQuotaProject: "tenant-quota-project",
+			}),
+			servertest.Namespace("invalid", map[string]string{
+				api.AnnotationQuotaProject: "Invalid_Project",
+			}),
+		},
+		Providers: servertest.ProvidersOptions{
+			Additional: []string{"projects/333/locations/global/workloadIdentityPools/other-pool/providers/other"},
+		},
+		QuotaProjects:          true,
+		NamespaceQuotaProjects: true,
+	})
+
+	last := func(method string) string {
+		quotaProjects := h.Google.QuotaProjects(method)
+		require.NotEmpty(t, quotaProjects, method)
+		return quotaProjects[len(quotaProjects)-1]
+	}
+
+	t.Run("service account annotation", func(t *testing.T) {
+		getOK(t, h, billedPod, tokenPath)
+		assert.Equal(t, "sa-quota-project", last("token"))
+		assert.Equal(t, "sa-quota-project", last("generateAccessToken"))
+
+		getOK(t, h, billedPod, identityPath+"aud")
+		assert.Equal(t, "sa-quota-project", last("generateIdToken"))
+
+		assert.Equal(t, "sa-quota-project", getOK(t, h, billedPod, quotaProjectPath))
+		assert.Equal(t, "quota-project\n", getOK(t, h, billedPod, "/computeMetadata/v1/project/attributes/"))
+		assert.Contains(t, getOK(t, h, billedPod, "/computeMetadata/v1/project/?recursive=true"),
+			`"attributes":{"quota-project":"sa-quota-project"}`)
+	})
+
+	t.Run("service account lookups", func(t *testing.T) {
+		// The ServiceAccount is looked up once by the server for the request,
+		// and once per upstream step for both the provider and the quota project:
+		// the Kubernetes token for the provider audience and the Google tokens.
+		before := countServiceAccountGets(h)
+		getOK(t, h, billedPod, tokenPath)
+		assert.Equal(t, 3, countServiceAccountGets(h)-before)
+	})
+
+	t.Run("namespace annotation", func(t *testing.T) {
+		getOK(t, h, tenantPod, tokenPath)
+		assert.Equal(t, "tenant-quota-project", last("token"))
+		assert.Equal(t, "tenant-quota-project", getOK(t, h, tenantPod, quotaProjectPath))
+	})
+
+	t.Run("no annotation", func(t *testing.T) {
+		getOK(t, h, defaultPod, tokenPath)
+		assert.Empty(t, last("token"))
+
+		status, _ := h.Get(t, defaultPod, quotaProjectPath)
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("invalid annotation", func(t *testing.T) {
+		for _, path := range []string{tokenPath, quotaProjectPath} {
+			status, body := h.Get(t, invalidPod, path)
+			assert.Equal(t, http.StatusBadRequest, status, path)
+			assert.Contains(t, body, "has invalid project id", path)
+		}
+	})
+
+	t.Run("invalid namespace annotation", func(t *testing.T) {
+		for _, path := range []string{tokenPath, quotaProjectPath} {
+			status, body := h.Get(t, invalidTenant.Pod, path)
+			assert.Equal(t, http.StatusInternalServerError, status, path)
+			assert.Contains(t, body, "has invalid project id", path)
+		}
+	})
+}
+
+func TestServeStaleTokens(t *testing.T) {
+	const (
+		googleEmail      = "stale@test-project.iam.gserviceaccount.com"
+		maxTokenDuration = 200 * time.Millisecond
+		scopedTokenPath  = tokenPath + "?scopes=scope"
+	)
+	stale := servertest.NewWorkload("default", "stale", googleEmail)
+	pod := stale.Pod
+	h := servertest.New(t, servertest.Options{
+		Workloads: []servertest.Workload{stale},
+		Cache: &servertest.CacheOptions{
+			MaxTokenDuration: maxTokenDuration,
+			ServeStale:       true,
+		},
+	})
+
+	type token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	getToken := func(t *testing.T, path string) token {
+		t.Helper()
+		var tok token
+		require.NoError(t, json.Unmarshal([]byte(getOK(t, h, pod, path)), &tok))
+		return tok
+	}
+
+	accessToken := getToken(t, tokenPath)
+	scopedAccessToken := getToken(t, scopedTokenPath)
+	identityToken := getOK(t, h, pod, identityPath+"aud")
+
+	// The tokens are past their refresh point but still valid during the outage.
+	h.Google.SetOutage(http.StatusServiceUnavailable)
+	time.Sleep(2 * maxTokenDuration)
+
+	tok := getToken(t, tokenPath)
+	assert.Equal(t, accessToken.AccessToken, tok.AccessToken)
+	assert.Greater(t, tok.ExpiresIn, int(maxTokenDuration.Seconds()))
+	assert.Equal(t, scopedAccessToken.AccessToken, getToken(t, scopedTokenPath).AccessToken)
+	assert.Equal(t, identityToken, getOK(t, h, pod, identityPath+"aud"))
+}
+
+func TestUpstreamOutage(t *testing.T) {
+	direct := servertest.NewWorkload("default", "direct", "")
+	pod := direct.Pod
+	h := servertest.New(t, servertest.Options{
+		Workloads: []servertest.Workload{direct},
+	})
+	h.Google.SetOutage(http.StatusServiceUnavailable)
+
+	// The outage is retried and then reported to the client, and after enough
+	// failed calls, counted once regardless of their retries, the circuit
+	// breaker fails the calls without reaching Google.
+	for range 5 {
+		status, body := h.Get(t, pod, tokenPath)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Contains(t, body, "UNAVAILABLE")
+	}
+	status, body := h.Get(t, pod, tokenPath)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Contains(t, body, "circuit breaker")
+}
+
+func TestRefreshAhead(t *testing.T) {
+	const (
+		googleEmail      = "refresh@test-project.iam.gserviceaccount.com"
+		maxTokenDuration = time.Second
+	)
+	refresh := servertest.NewWorkload("default", "refresh", googleEmail)
+	pod := refresh.Pod
+	h := servertest.New(t, servertest.Options{
+		Workloads: []servertest.Workload{refresh},
+		Cache: &servertest.CacheOptions{
+			MaxTokenDuration:   maxTokenDuration,
+			RefreshAheadBudget: 1,
+		},
+	})
+
+	counter := func(t *testing.T, name string) float64 {
+		t.Helper()
+		families, err := h.Metrics.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() != "gke_metadata_server_"+name {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "type" && label.GetValue() == "google_id_token" {
+						return m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+		return 0
+	}
+	getIdentity := func(t *testing.T, audience string) {
+		t.Helper()
+		require.Equal(t, servertest.IdentityToken(googleEmail, audience), getOK(t, h, pod, identityPath+audience))
+	}
+
+	// the budget holds the most recently used audience, so the second one
+	// evicts the first one
+	getIdentity(t, "first")
+	getIdentity(t, "second")
+	assert.Equal(t, float64(2), counter(t, "service_account_token_synchronous_misses_total"))
+	require.Equal(t, 2, h.Google.Calls("generateIdToken"))
+
+	// the second audience is refreshed in the background before it expires
+	require.Eventually(t, func() bool {
+		return h.Google.IdentityTokenCalls("second") >= 2
+	}, 5*time.Second, 10*time.Millisecond)
+	getIdentity(t, "second")
+	assert.Equal(t, float64(1), counter(t, "service_account_token_refresh_ahead_hits_total"))
+	assert.Equal(t, float64(2), counter(t, "service_account_token_synchronous_misses_total"))
+
+	// the first audience expires and is issued again while serving the request
+	assert.Eventually(t, func() bool {
+		getIdentity(t, "first")
+		return counter(t, "service_account_token_synchronous_misses_total") == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, h.Google.IdentityTokenCalls("first"))
+}
@@ -19,7 +19,7 @@ type (
 	}
 
 	ProviderOptions struct {
-		KubeClient *kubernetes.Clientset
+		KubeClient kubernetes.Interface
 	}
 )
 
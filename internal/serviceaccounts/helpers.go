@@ -4,11 +4,14 @@
 package serviceaccounts
 
 import (
+	"context"
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/matheuscscp/gke-metadata-server/api"
+	"github.com/matheuscscp/gke-metadata-server/internal/namespaces"
 
 	"github.com/golang-jwt/jwt/v5"
 	corev1 "k8s.io/api/core/v1"
@@ -17,12 +20,25 @@ import (
 type Reference struct {
 	Name      string `json:"name"`
 	Namespace string `json:"namespace"`
+
+	// Pod is set when the tokens of the ServiceAccount are bound to a Pod.
+	Pod PodReference `json:"pod,omitzero"`
+}
+
+// PodReference identifies the Pod a ServiceAccount token is bound to.
+type PodReference struct {
+	Name string `json:"name"`
+	UID  string `json:"uid"`
 }
 
 var ErrGKEAnnotationInvalid = fmt.Errorf(
 	"gke annotation %q has invalid google service account email",
 	api.GKEAnnotationServiceAccount)
 
+var ErrQuotaProjectAnnotationInvalid = fmt.Errorf(
+	"service account annotation %q has invalid project id",
+	api.AnnotationQuotaProject)
+
 var googleEmailRegex = regexp.MustCompile(`^[a-zA-Z0-9-]+@[a-zA-Z0-9-]+\.iam\.gserviceaccount\.com$`)
 
 // ReferenceFromObject returns a ServiceAccount reference from a ServiceAccount object.
@@ -41,12 +57,82 @@ func ReferenceFromPod(pod *corev1.Pod) *Reference {
 	}
 }
 
+// BoundReferenceFromPod returns a ServiceAccount reference from a Pod object
+// whose tokens are bound to the Pod.
+func BoundReferenceFromPod(pod *corev1.Pod) *Reference {
+	ref := ReferenceFromPod(pod)
+	ref.Pod = PodReference{
+		Name: pod.Name,
+		UID:  string(pod.UID),
+	}
+	return ref
+}
+
+// defaultAPIServerAudiences are the audiences of the Kubernetes API server
+// in clusters configured with the default issuer.
+var defaultAPIServerAudiences = []string{
+	"https://kubernetes.default.svc",
+	"https://kubernetes.default.svc.cluster.local",
+	"kubernetes.default.svc",
+	"kubernetes.default.svc.cluster.local",
+}
+
+// APIServerAudiences returns the audiences accepted by the Kubernetes API
+// server, read from a token it issued without an explicit audience (e.g.
+// the ServiceAccount token of the in-cluster config), in addition to the
+// audiences of the default issuer. Tokens issued for these audiences
+// authenticate to the API server.
+func APIServerAudiences(token string) []string {
+	var claims jwt.RegisteredClaims
+	jwt.NewParser().ParseUnverified(token, &claims)
+	return append(slices.Clone(defaultAPIServerAudiences), claims.Audience...)
+}
+
 // ReferenceFromToken returns a ServiceAccount reference from a ServiceAccount Token.
+// The Pod is set from the private claims of tokens bound to a Pod.
 func ReferenceFromToken(token string) *Reference {
-	tok, _, _ := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
-	sub, _ := tok.Claims.GetSubject()
-	s := strings.Split(sub, ":") // system:serviceaccount:{namespace}:{name}
-	return &Reference{Namespace: s[2], Name: s[3]}
+	var claims tokenClaims
+	jwt.NewParser().ParseUnverified(token, &claims)
+	s := strings.Split(claims.Subject, ":") // system:serviceaccount:{namespace}:{name}
+	ref := &Reference{Namespace: s[2], Name: s[3]}
+	if pod := claims.Kubernetes.Pod; pod != nil {
+		ref.Pod = *pod
+	}
+	return ref
+}
+
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Kubernetes struct {
+		Pod *PodReference `json:"pod"`
+	} `json:"kubernetes.io"`
+}
+
+// WorkloadIdentityProvider returns the workload identity provider selected by the
+// ServiceAccount annotation, or an empty string if the annotation is not present.
+func WorkloadIdentityProvider(sa *corev1.ServiceAccount) string {
+	return sa.Annotations[api.AnnotationWorkloadIdentityProvider]
+}
+
+// QuotaProject returns the quota project of the upstream calls made for the
+// ServiceAccount, from its annotation or, if nss is not nil, from the annotation
+// of its namespace, or nil if neither is annotated. An invalid ServiceAccount
+// annotation is reported with ErrQuotaProjectAnnotationInvalid.
+func QuotaProject(ctx context.Context, sa *corev1.ServiceAccount, nss namespaces.Provider) (*string, error) {
+	if v, ok := sa.Annotations[api.AnnotationQuotaProject]; ok {
+		if !namespaces.ValidProjectID(v) {
+			return nil, ErrQuotaProjectAnnotationInvalid
+		}
+		return &v, nil
+	}
+	if nss == nil {
+		return nil, nil
+	}
+	ns, err := nss.Get(ctx, sa.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error getting kubernetes namespace: %w", err)
+	}
+	return namespaces.QuotaProject(ns)
 }
 
 // GoogleServiceAccountEmail returns the Google service account email from the same annotation
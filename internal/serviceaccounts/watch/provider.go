@@ -32,7 +32,7 @@ type (
 
 	ProviderOptions struct {
 		FallbackSource  serviceaccounts.Provider
-		KubeClient      *kubernetes.Clientset
+		KubeClient      kubernetes.Interface
 		MetricsRegistry *prometheus.Registry
 		ResyncPeriod    time.Duration
 	}
@@ -103,7 +103,7 @@ func (p *Provider) Get(ctx context.Context, ref *serviceaccounts.Reference) (*co
 	}
 
 	logging.
-		FromContext(ctx).
+		WithComponent(logging.FromContext(ctx), logging.ComponentWatch).
 		WithError(err).
 		WithField("service_account", fmt.Sprintf("%s/%s", namespace, name)).
 		Error("error getting service account from cache, delegating request to fallback source")
@@ -129,7 +129,7 @@ func (p *Provider) get(namespace, name string) (*corev1.ServiceAccount, error) {
 
 func (p *Provider) Start(ctx context.Context) {
 	go func() {
-		logging.FromContext(ctx).Info("starting watch service accounts...")
+		logging.WithComponent(logging.FromContext(ctx), logging.ComponentWatch).Info("starting watch service accounts...")
 		p.informer.Run(p.closeChannel)
 		close(p.closedChannel)
 	}()
@@ -11,26 +11,37 @@ import (
 	"sync"
 	"time"
 
+	"github.com/matheuscscp/gke-metadata-server/internal/googlecredentials"
 	"github.com/matheuscscp/gke-metadata-server/internal/logging"
 	"github.com/matheuscscp/gke-metadata-server/internal/metrics"
+	"github.com/matheuscscp/gke-metadata-server/internal/retry"
 	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts"
 	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounttokens"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/utils/lru"
 )
 
 type Provider struct {
 	opts                          ProviderOptions
 	numTokens                     prometheus.Gauge
 	cacheMisses                   prometheus.Counter
+	staleHits                     prometheus.Counter
+	refreshAheadHits              *prometheus.CounterVec
+	synchronousMisses             *prometheus.CounterVec
 	serviceAccounts               map[serviceaccounts.Reference]*serviceAccount
 	googleIDTokens                map[googleIDTokenReference]*tokenAndExpiration[string]
+	kubernetesIDTokens            map[kubernetesIDTokenReference]*tokenAndExpiration[string]
+	kubernetesIDTokenCounts       map[serviceaccounts.Reference]int
 	googleScopedAccessTokens      map[googleScopedAccessTokenReference]*tokenAndExpiration[string]
 	ctx                           context.Context
 	cancelCtx                     context.CancelFunc
 	serviceAccountsMutex          sync.Mutex
 	googleIDTokensMutex           sync.RWMutex
+	kubernetesIDTokensMutex       sync.RWMutex
 	googleScopedAccessTokensMutex sync.RWMutex
+	refreshAheads                 map[serviceaccounts.Reference]*lru.Cache
+	refreshAheadMutex             sync.Mutex
 	wg                            sync.WaitGroup
 	semaphore                     chan struct{}
 }
@@ -41,6 +52,25 @@ type ProviderOptions struct {
 	MetricsRegistry  *prometheus.Registry
 	Concurrency      int
 	MaxTokenDuration time.Duration
+
+	// ServeStale serves the cached tokens that are past their refresh point
+	// but still valid when refreshing them fails, instead of failing. The
+	// tokens that are not past their refresh point yet are kept and served
+	// when refreshing them ahead of it fails regardless of this option.
+	ServeStale bool
+
+	// MaxKubernetesIDTokensPerServiceAccount is the maximum number of
+	// Kubernetes identity tokens cached for each ServiceAccount, one per
+	// audience. The token closest to expiring is evicted to cache a new
+	// one. Zero means no limit.
+	MaxKubernetesIDTokensPerServiceAccount int
+
+	// RefreshAheadBudget is the maximum number of scoped access tokens and
+	// identity tokens refreshed ahead of expiry for each ServiceAccount.
+	// Tokens are refreshed for as long as they are used before expiring,
+	// and the least recently used token stops being refreshed to make room
+	// for a new one. Zero disables the refresh ahead.
+	RefreshAheadBudget int
 }
 
 var errServiceAccountDeleted = errors.New("service account was deleted")
@@ -50,18 +80,31 @@ func NewProvider(ctx context.Context, opts ProviderOptions) *Provider {
 	opts.MetricsRegistry.MustRegister(numTokens)
 	cacheMisses := metrics.NewServiceAccountTokenCacheMissesCounter()
 	opts.MetricsRegistry.MustRegister(cacheMisses)
+	staleHits := metrics.NewServiceAccountTokenStaleHitsCounter()
+	opts.MetricsRegistry.MustRegister(staleHits)
+	refreshAheadHits := metrics.NewServiceAccountTokenRefreshAheadHitsCounter()
+	opts.MetricsRegistry.MustRegister(refreshAheadHits)
+	synchronousMisses := metrics.NewServiceAccountTokenSynchronousMissesCounter()
+	opts.MetricsRegistry.MustRegister(synchronousMisses)
 
 	// create a new background context for the goroutines with logging from the parent context
-	backgroundCtx := logging.IntoContext(context.Background(), logging.FromContext(ctx))
+	l := logging.WithComponent(logging.FromContext(ctx), logging.ComponentCache)
+	backgroundCtx := logging.IntoContext(context.Background(), l)
 	backgroundCtx, cancel := context.WithCancel(backgroundCtx)
 
 	p := &Provider{
 		opts:                     opts,
 		numTokens:                numTokens,
 		cacheMisses:              cacheMisses,
+		staleHits:                staleHits,
+		refreshAheadHits:         refreshAheadHits,
+		synchronousMisses:        synchronousMisses,
 		serviceAccounts:          make(map[serviceaccounts.Reference]*serviceAccount),
 		googleIDTokens:           make(map[googleIDTokenReference]*tokenAndExpiration[string]),
+		kubernetesIDTokens:       make(map[kubernetesIDTokenReference]*tokenAndExpiration[string]),
+		kubernetesIDTokenCounts:  make(map[serviceaccounts.Reference]int),
 		googleScopedAccessTokens: make(map[googleScopedAccessTokenReference]*tokenAndExpiration[string]),
+		refreshAheads:            make(map[serviceaccounts.Reference]*lru.Cache),
 		ctx:                      backgroundCtx,
 		cancelCtx:                cancel,
 		semaphore:                make(chan struct{}, opts.Concurrency),
@@ -80,15 +123,23 @@ func NewProvider(ctx context.Context, opts ProviderOptions) *Provider {
 			case <-sleep.C:
 				p.googleIDTokensMutex.Lock()
 				for ref, token := range p.googleIDTokens {
-					if token.isExpired() {
+					if token.isInvalid() {
 						delete(p.googleIDTokens, ref)
 					}
 				}
 				p.googleIDTokensMutex.Unlock()
 
+				p.kubernetesIDTokensMutex.Lock()
+				for ref, token := range p.kubernetesIDTokens {
+					if token.isInvalid() {
+						p.deleteKubernetesIDToken(ref)
+					}
+				}
+				p.kubernetesIDTokensMutex.Unlock()
+
 				p.googleScopedAccessTokensMutex.Lock()
 				for ref, token := range p.googleScopedAccessTokens {
-					if token.isExpired() {
+					if token.isInvalid() {
 						delete(p.googleScopedAccessTokens, ref)
 					}
 				}
@@ -112,7 +163,7 @@ func (p *Provider) GetServiceAccountToken(ctx context.Context, ref *serviceaccou
 		return "", time.Time{}, err
 	}
 	token := tokens.serviceAccountToken
-	return token.token, token.expiration(), nil
+	return token.token, token.expiresAt(), nil
 }
 
 func (p *Provider) GetGoogleAccessTokens(ctx context.Context, saToken string,
@@ -127,7 +178,7 @@ func (p *Provider) GetGoogleAccessTokens(ctx context.Context, saToken string,
 			return nil, time.Time{}, err
 		}
 		token := tokens.googleAccessTokens
-		return token.token, token.expiration(), nil
+		return token.token, token.expiresAt(), nil
 	}
 
 	// handle case with custom scopes
@@ -143,8 +194,10 @@ func (p *Provider) GetGoogleAccessTokens(ctx context.Context, saToken string,
 	token, ok := p.googleScopedAccessTokens[ref]
 	p.googleScopedAccessTokensMutex.RUnlock()
 	if ok && !token.isExpired() {
+		p.useToken(*saRef, ref, token, tokenTypeGoogleScopedAccessToken)
 		return &serviceaccounttokens.AccessTokens{DirectAccess: token.token}, token.expiration(), nil
 	}
+	p.synchronousMisses.WithLabelValues(tokenTypeGoogleScopedAccessToken).Inc()
 
 	// cache miss or token expired. need to cache a new token, so acquire semaphore to limit concurrency
 	select {
@@ -162,6 +215,9 @@ func (p *Provider) GetGoogleAccessTokens(ctx context.Context, saToken string,
 
 	// check error
 	if err != nil {
+		if ok && p.serveStale(ctx, token, err) {
+			return &serviceaccounttokens.AccessTokens{DirectAccess: token.token}, token.expiresAt(), nil
+		}
 		return nil, time.Time{}, err
 	}
 
@@ -171,9 +227,11 @@ func (p *Provider) GetGoogleAccessTokens(ctx context.Context, saToken string,
 		tokenString = tokens.Impersonated
 	}
 	token = newToken(tokenString, expiration, p.opts.MaxTokenDuration)
+	token.used.Store(true)
 	p.googleScopedAccessTokensMutex.Lock()
 	p.googleScopedAccessTokens[ref] = token
 	p.googleScopedAccessTokensMutex.Unlock()
+	p.refreshAhead(*saRef, ref, tokenTypeGoogleScopedAccessToken, token, p.refreshGoogleScopedAccessToken(ref))
 	return &serviceaccounttokens.AccessTokens{DirectAccess: token.token}, token.expiration(), nil
 }
 
@@ -187,8 +245,10 @@ func (p *Provider) GetGoogleIdentityToken(ctx context.Context, saRef *serviceacc
 	token, ok := p.googleIDTokens[ref]
 	p.googleIDTokensMutex.RUnlock()
 	if ok && !token.isExpired() {
+		p.useToken(*saRef, ref, token, tokenTypeGoogleIDToken)
 		return token.token, token.expiration(), nil
 	}
+	p.synchronousMisses.WithLabelValues(tokenTypeGoogleIDToken).Inc()
 
 	// cache miss or token expired. need to cache a new token, so acquire semaphore to limit concurrency
 	select {
@@ -206,17 +266,131 @@ func (p *Provider) GetGoogleIdentityToken(ctx context.Context, saRef *serviceacc
 
 	// check error
 	if err != nil {
+		if ok && p.serveStale(ctx, token, err) {
+			return token.token, token.expiresAt(), nil
+		}
 		return "", time.Time{}, err
 	}
 
 	// token issued successfully. cache it and return
 	token = newToken(tokenString, expiration, p.opts.MaxTokenDuration)
+	token.used.Store(true)
 	p.googleIDTokensMutex.Lock()
 	p.googleIDTokens[ref] = token
 	p.googleIDTokensMutex.Unlock()
+	p.refreshAhead(*saRef, ref, tokenTypeGoogleIDToken, token, p.refreshGoogleIDToken(ref))
+	return token.token, token.expiration(), nil
+}
+
+func (p *Provider) GetKubernetesIdentityToken(ctx context.Context, saRef *serviceaccounts.Reference,
+	audience string) (string, time.Time, error) {
+
+	ref := kubernetesIDTokenReference{*saRef, audience}
+
+	// check cache first
+	p.kubernetesIDTokensMutex.RLock()
+	token, ok := p.kubernetesIDTokens[ref]
+	p.kubernetesIDTokensMutex.RUnlock()
+	if ok && !token.isExpired() {
+		p.useToken(*saRef, ref, token, tokenTypeKubernetesIDToken)
+		return token.token, token.expiration(), nil
+	}
+	p.synchronousMisses.WithLabelValues(tokenTypeKubernetesIDToken).Inc()
+
+	// cache miss or token expired. need to cache a new token, so acquire semaphore to limit concurrency
+	select {
+	case p.semaphore <- struct{}{}:
+	case <-ctx.Done():
+		return "", time.Time{}, fmt.Errorf("request context done while acquiring semaphore: %w", ctx.Err())
+	case <-p.ctx.Done():
+		return "", time.Time{}, fmt.Errorf("process terminated while acquiring semaphore: %w", p.ctx.Err())
+	}
+
+	tokenString, expiration, err := p.opts.Source.GetKubernetesIdentityToken(ctx, saRef, audience)
+
+	// release concurrency semaphore
+	<-p.semaphore
+
+	// check error
+	if err != nil {
+		if ok && p.serveStale(ctx, token, err) {
+			return token.token, token.expiresAt(), nil
+		}
+		return "", time.Time{}, err
+	}
+
+	// token issued successfully. cache it and return
+	token = newToken(tokenString, expiration, p.opts.MaxTokenDuration)
+	token.used.Store(true)
+	p.kubernetesIDTokensMutex.Lock()
+	if _, ok := p.kubernetesIDTokens[ref]; !ok {
+		p.evictKubernetesIDToken(*saRef)
+		p.kubernetesIDTokenCounts[*saRef]++
+	}
+	p.kubernetesIDTokens[ref] = token
+	p.kubernetesIDTokensMutex.Unlock()
+	p.refreshAhead(*saRef, ref, tokenTypeKubernetesIDToken, token, p.refreshKubernetesIDToken(ref))
 	return token.token, token.expiration(), nil
 }
 
+// evictKubernetesIDToken makes room for a new Kubernetes identity token of
+// the given ServiceAccount by removing the one closest to expiring when the
+// ServiceAccount has MaxKubernetesIDTokensPerServiceAccount tokens cached.
+// The caller must hold kubernetesIDTokensMutex.
+func (p *Provider) evictKubernetesIDToken(saRef serviceaccounts.Reference) {
+	limit := p.opts.MaxKubernetesIDTokensPerServiceAccount
+	if limit <= 0 || p.kubernetesIDTokenCounts[saRef] < limit {
+		return
+	}
+	var evict *kubernetesIDTokenReference
+	var evictToken *tokenAndExpiration[string]
+	for ref, token := range p.kubernetesIDTokens {
+		if ref.serviceAccountRefernce != saRef {
+			continue
+		}
+		if evict == nil || token.expiration().Before(evictToken.expiration()) {
+			evict, evictToken = &ref, token
+		}
+	}
+	if evict != nil {
+		p.deleteKubernetesIDToken(*evict)
+	}
+}
+
+// deleteKubernetesIDToken removes a cached Kubernetes identity token. The
+// caller must hold kubernetesIDTokensMutex.
+func (p *Provider) deleteKubernetesIDToken(ref kubernetesIDTokenReference) {
+	saRef := ref.serviceAccountRefernce
+	delete(p.kubernetesIDTokens, ref)
+	p.kubernetesIDTokenCounts[saRef]--
+	if p.kubernetesIDTokenCounts[saRef] <= 0 {
+		delete(p.kubernetesIDTokenCounts, saRef)
+	}
+}
+
+// useToken marks the given cached token as used, counting the first use of
+// the tokens refreshed ahead of expiry, and as the most recently used token
+// in the refresh ahead budget of the ServiceAccount.
+func (p *Provider) useToken(saRef serviceaccounts.Reference, ref any,
+	token *tokenAndExpiration[string], tokenType string) {
+
+	if token.use() {
+		p.refreshAheadHits.WithLabelValues(tokenType).Inc()
+	}
+	p.touchRefreshAhead(saRef, ref)
+}
+
+// serveStale returns whether the given cached token should be served after
+// refreshing it failed with the given error, see ProviderOptions.ServeStale.
+func (p *Provider) serveStale(ctx context.Context, token *tokenAndExpiration[string], err error) bool {
+	if !p.opts.ServeStale || !token.isStale() {
+		return false
+	}
+	p.staleHits.Inc()
+	logging.FromContext(ctx).WithError(err).Warn("error refreshing token, serving stale token")
+	return true
+}
+
 func (p *Provider) cacheTokens(sa *serviceAccount) (retErr error) {
 	l := logging.FromContext(p.ctx).WithField("service_account", sa.Reference)
 
@@ -234,7 +408,10 @@ func (p *Provider) cacheTokens(sa *serviceAccount) (retErr error) {
 		}
 		externalRequests = nil
 	}
-	defer sendResponse(&tokensAndError{err: retErr})
+	// the closure reads retErr on return. deferring sendResponse directly
+	// would evaluate its argument here, when retErr is still nil, and the
+	// pending requests would be answered with neither tokens nor an error
+	defer func() { sendResponse(&tokensAndError{err: retErr}) }()
 
 	var retries int
 	for {
@@ -269,14 +446,20 @@ func (p *Provider) cacheTokens(sa *serviceAccount) (retErr error) {
 		// check error
 		var sleepDuration time.Duration
 		if err != nil {
-			// do not retry invalid GKE annotation errors
-			if errors.Is(err, serviceaccounts.ErrGKEAnnotationInvalid) {
+			// do not retry invalid annotation errors
+			if errors.Is(err, serviceaccounts.ErrGKEAnnotationInvalid) ||
+				errors.Is(err, serviceaccounts.ErrQuotaProjectAnnotationInvalid) ||
+				errors.Is(err, googlecredentials.ErrWorkloadIdentityProviderNotAllowed) {
 				sleepDuration = 10 * 365 * 24 * time.Hour // infinite
 				retries = 0
+				sa.tokens.Store(nil)
 				sendResponse(&tokensAndError{err: err})
-				l.WithError(err).Error("service account has invalid GKE annotation, will not retry")
-			} else { // retry any other error
-				sleepDuration = (1 << retries) * time.Second
+				l.WithError(err).Error("service account has invalid annotation, will not retry")
+			} else {
+				// retry any other error, keeping the previous tokens. they are still
+				// served until their refresh point, which is up to a minute after
+				// this failure, and past it only with ServeStale, see getTokens
+				sleepDuration = retry.Jitter((1 << retries) * time.Second)
 				if retries < 5 {
 					retries++
 				}
@@ -290,13 +473,11 @@ func (p *Provider) cacheTokens(sa *serviceAccount) (retErr error) {
 				sleepDuration -= safeDistance
 			}
 			retries = 0
+			sa.tokens.Store(tokens)
 			sendResponse(&tokensAndError{tokens: tokens})
 			l.Info("cached tokens for service account")
 		}
 
-		// store tokens
-		sa.tokens = tokens
-
 		// sleep
 		t := time.NewTimer(sleepDuration)
 		select {
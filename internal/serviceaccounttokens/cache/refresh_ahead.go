@@ -0,0 +1,290 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package cacheserviceaccounttokens
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matheuscscp/gke-metadata-server/internal/logging"
+	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts"
+
+	"k8s.io/utils/lru"
+)
+
+const (
+	tokenTypeGoogleScopedAccessToken = "google_scoped_access_token"
+	tokenTypeGoogleIDToken           = "google_id_token"
+	tokenTypeKubernetesIDToken       = "kubernetes_id_token"
+)
+
+// refreshFunc replaces the given input-dependant token with a new one and
+// returns it. A nil token and error means that the given token was already
+// replaced or removed from the cache.
+type refreshFunc func(ctx context.Context, old *tokenAndExpiration[string]) (*tokenAndExpiration[string], error)
+
+// refreshAheadEntry is the value of a token in the refresh ahead budget of
+// its ServiceAccount. Evicting it stops the goroutine refreshing the token.
+type refreshAheadEntry struct {
+	cancel context.CancelFunc
+}
+
+// refreshAheadSafeDistance is how long before the expiration of a token it's
+// refreshed, or half the time until its expiration if shorter.
+const refreshAheadSafeDistance = time.Minute
+
+// refreshAhead refreshes the given input-dependant token ahead of its
+// expiration for as long as it keeps being used, within the budget of the
+// ServiceAccount, see ProviderOptions.RefreshAheadBudget. The budget is an
+// LRU of the tokens of the ServiceAccount, so the least recently used token
+// stops being refreshed when a new one does not fit.
+func (p *Provider) refreshAhead(saRef serviceaccounts.Reference, ref any, tokenType string,
+	token *tokenAndExpiration[string], refresh refreshFunc) {
+
+	if p.opts.RefreshAheadBudget <= 0 || p.ctx.Err() != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	entry := &refreshAheadEntry{cancel}
+	p.refreshAheadMutex.Lock()
+	budget, ok := p.refreshAheads[saRef]
+	if !ok {
+		budget = lru.NewWithEvictionFunc(p.opts.RefreshAheadBudget, func(_ lru.Key, value any) {
+			value.(*refreshAheadEntry).cancel()
+		})
+		p.refreshAheads[saRef] = budget
+	}
+	if old, ok := budget.Get(ref); ok {
+		// the token was issued again, e.g. after expiring
+		old.(*refreshAheadEntry).cancel()
+	}
+	budget.Add(ref, entry)
+	p.refreshAheadMutex.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer p.removeRefreshAhead(saRef, ref, entry)
+
+		l := logging.FromContext(ctx).
+			WithField("service_account", saRef).
+			WithField("token_type", tokenType)
+
+		for {
+			t := time.NewTimer(refreshAheadDelay(token.timeUntilExpiration()))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+
+			// stop refreshing tokens that were not used since the last refresh
+			// or whose service account is no longer cached
+			if !token.used.Load() || !p.hasServiceAccount(saRef) {
+				return
+			}
+
+			newToken, err := refresh(ctx, token)
+			if err != nil {
+				if ctx.Err() == nil {
+					l.WithError(err).Error("error refreshing token ahead of expiry")
+				}
+				return
+			}
+			if newToken == nil {
+				return
+			}
+			token = newToken
+		}
+	}()
+}
+
+// refreshAheadDelay returns how long to wait for refreshing a token that
+// expires in the given duration.
+func refreshAheadDelay(untilExpiration time.Duration) time.Duration {
+	if untilExpiration <= 0 {
+		return 0
+	}
+	return untilExpiration - min(refreshAheadSafeDistance, untilExpiration/2)
+}
+
+// touchRefreshAhead marks the given token as the most recently used one in
+// the refresh ahead budget of its ServiceAccount, if it's being refreshed.
+func (p *Provider) touchRefreshAhead(saRef serviceaccounts.Reference, ref any) {
+	if p.opts.RefreshAheadBudget <= 0 {
+		return
+	}
+	p.refreshAheadMutex.Lock()
+	defer p.refreshAheadMutex.Unlock()
+	if budget, ok := p.refreshAheads[saRef]; ok {
+		budget.Get(ref)
+	}
+}
+
+// removeRefreshAhead removes the given entry from the refresh ahead budget
+// of its ServiceAccount when its goroutine stops, unless it was replaced.
+func (p *Provider) removeRefreshAhead(saRef serviceaccounts.Reference, ref any, entry *refreshAheadEntry) {
+	entry.cancel()
+	p.refreshAheadMutex.Lock()
+	defer p.refreshAheadMutex.Unlock()
+	budget, ok := p.refreshAheads[saRef]
+	if !ok {
+		return
+	}
+	if current, ok := budget.Get(ref); ok && current == entry {
+		budget.Remove(ref)
+	}
+	if budget.Len() == 0 {
+		delete(p.refreshAheads, saRef)
+	}
+}
+
+func (p *Provider) hasServiceAccount(ref serviceaccounts.Reference) bool {
+	p.serviceAccountsMutex.Lock()
+	defer p.serviceAccountsMutex.Unlock()
+
+	sa, ok := p.serviceAccounts[ref]
+	return ok && !sa.deleted
+}
+
+func (p *Provider) refreshGoogleScopedAccessToken(ref googleScopedAccessTokenReference) refreshFunc {
+	return func(ctx context.Context, old *tokenAndExpiration[string]) (*tokenAndExpiration[string], error) {
+		if cachedToken(&p.googleScopedAccessTokensMutex, p.googleScopedAccessTokens, ref) != old {
+			return nil, nil
+		}
+
+		saTokens, err := p.getTokens(ctx, &ref.serviceAccountRefernce)
+		if err != nil {
+			return nil, err
+		}
+		var email *string
+		if ref.email != "" {
+			email = &ref.email
+		}
+		scopes := strings.Split(ref.scopes, ",")
+
+		var token *tokenAndExpiration[string]
+		err = p.withSemaphore(func() error {
+			tokens, expiration, err := p.opts.Source.GetGoogleAccessTokens(ctx,
+				saTokens.serviceAccountToken.token, email, scopes)
+			if err != nil {
+				return err
+			}
+			tokenString := tokens.DirectAccess
+			if tokenString == "" {
+				tokenString = tokens.Impersonated
+			}
+			token = newToken(tokenString, expiration, p.opts.MaxTokenDuration)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		token.refreshedAhead = true
+		if !replaceToken(&p.googleScopedAccessTokensMutex, p.googleScopedAccessTokens, ref, old, token) {
+			return nil, nil
+		}
+		return token, nil
+	}
+}
+
+func (p *Provider) refreshGoogleIDToken(ref googleIDTokenReference) refreshFunc {
+	return func(ctx context.Context, old *tokenAndExpiration[string]) (*tokenAndExpiration[string], error) {
+		if cachedToken(&p.googleIDTokensMutex, p.googleIDTokens, ref) != old {
+			return nil, nil
+		}
+
+		saTokens, err := p.getTokens(ctx, &ref.serviceAccountRefernce)
+		if err != nil {
+			return nil, err
+		}
+		accessToken := saTokens.googleAccessTokens.token.DirectAccess
+
+		var token *tokenAndExpiration[string]
+		err = p.withSemaphore(func() error {
+			tokenString, expiration, err := p.opts.Source.GetGoogleIdentityToken(ctx,
+				&ref.serviceAccountRefernce, accessToken, ref.email, ref.audience)
+			if err != nil {
+				return err
+			}
+			token = newToken(tokenString, expiration, p.opts.MaxTokenDuration)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		token.refreshedAhead = true
+		if !replaceToken(&p.googleIDTokensMutex, p.googleIDTokens, ref, old, token) {
+			return nil, nil
+		}
+		return token, nil
+	}
+}
+
+func (p *Provider) refreshKubernetesIDToken(ref kubernetesIDTokenReference) refreshFunc {
+	return func(ctx context.Context, old *tokenAndExpiration[string]) (*tokenAndExpiration[string], error) {
+		if cachedToken(&p.kubernetesIDTokensMutex, p.kubernetesIDTokens, ref) != old {
+			return nil, nil
+		}
+
+		var token *tokenAndExpiration[string]
+		err := p.withSemaphore(func() error {
+			tokenString, expiration, err := p.opts.Source.GetKubernetesIdentityToken(ctx,
+				&ref.serviceAccountRefernce, ref.audience)
+			if err != nil {
+				return err
+			}
+			token = newToken(tokenString, expiration, p.opts.MaxTokenDuration)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		token.refreshedAhead = true
+		if !replaceToken(&p.kubernetesIDTokensMutex, p.kubernetesIDTokens, ref, old, token) {
+			return nil, nil
+		}
+		return token, nil
+	}
+}
+
+// withSemaphore calls f holding the semaphore that limits concurrency.
+func (p *Provider) withSemaphore(f func() error) error {
+	select {
+	case p.semaphore <- struct{}{}:
+	case <-p.ctx.Done():
+		return fmt.Errorf("process terminated while acquiring semaphore: %w", p.ctx.Err())
+	}
+	defer func() { <-p.semaphore }()
+	return f()
+}
+
+func cachedToken[K comparable](mu *sync.RWMutex, tokens map[K]*tokenAndExpiration[string],
+	ref K) *tokenAndExpiration[string] {
+
+	mu.RLock()
+	defer mu.RUnlock()
+	return tokens[ref]
+}
+
+// replaceToken stores the new token if the old one is still cached.
+func replaceToken[K comparable](mu *sync.RWMutex, tokens map[K]*tokenAndExpiration[string],
+	ref K, old, token *tokenAndExpiration[string]) bool {
+
+	mu.Lock()
+	defer mu.Unlock()
+	if tokens[ref] != old {
+		return false
+	}
+	tokens[ref] = token
+	return true
+}
@@ -6,15 +6,20 @@ package cacheserviceaccounttokens
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 
 	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts"
 )
 
 type serviceAccount struct {
 	serviceaccounts.Reference
-	podCount         int
-	deleted          bool
-	tokens           *tokens
+	podCount int
+	deleted  bool
+
+	// tokens is stored by the goroutine of cacheTokens and loaded by the
+	// requests without holding serviceAccountsMutex.
+	tokens atomic.Pointer[tokens]
+
 	externalRequests chan chan<- *tokensAndError
 }
 
@@ -30,8 +35,13 @@ func (p *Provider) getTokens(ctx context.Context, ref *serviceaccounts.Reference
 	}
 	p.serviceAccountsMutex.Unlock()
 
-	tokens := sa.tokens
-	if tokens == nil || tokens.serviceAccountToken.isExpired() || tokens.googleAccessTokens.isExpired() {
+	tokens := sa.tokens.Load()
+	if tokens != nil && tokens.isExpired() && !tokens.isInvalid() && p.opts.ServeStale {
+		// the refresh of the tokens is failing, see cacheTokens
+		p.staleHits.Inc()
+		return tokens, nil
+	}
+	if tokens == nil || tokens.isExpired() {
 		p.cacheMisses.Inc()
 		tokens, err := sa.requestTokens(ctx, p.ctx)
 		if err != nil {
@@ -117,15 +127,13 @@ func (p *Provider) UpdateServiceAccount(ref *serviceaccounts.Reference) {
 	p.serviceAccountsMutex.Lock()
 	defer p.serviceAccountsMutex.Unlock()
 
-	sa, ok := p.serviceAccounts[*ref]
-	if !ok {
-		return
-	}
-	sa.deleted = false
+	for _, sa := range p.serviceAccountEntries(ref) {
+		sa.deleted = false
 
-	select {
-	case sa.externalRequests <- nil:
-	default:
+		select {
+		case sa.externalRequests <- nil:
+		default:
+		}
 	}
 }
 
@@ -133,16 +141,30 @@ func (p *Provider) DeleteServiceAccount(ref *serviceaccounts.Reference) {
 	p.serviceAccountsMutex.Lock()
 	defer p.serviceAccountsMutex.Unlock()
 
-	sa, ok := p.serviceAccounts[*ref]
-	if !ok {
-		return
+	for _, sa := range p.serviceAccountEntries(ref) {
+		sa.deleted = true
+
+		select {
+		case sa.externalRequests <- nil:
+		default:
+		}
 	}
-	sa.deleted = true
+}
 
-	select {
-	case sa.externalRequests <- nil:
-	default:
+// serviceAccountEntries returns the cache entries of the given ServiceAccount,
+// one per Pod when the tokens are bound to Pods. Must be called with the
+// serviceAccountsMutex held.
+func (p *Provider) serviceAccountEntries(ref *serviceaccounts.Reference) []*serviceAccount {
+	if sa, ok := p.serviceAccounts[*ref]; ok {
+		return []*serviceAccount{sa}
+	}
+	var entries []*serviceAccount
+	for key, sa := range p.serviceAccounts {
+		if key.Name == ref.Name && key.Namespace == ref.Namespace {
+			entries = append(entries, sa)
+		}
 	}
+	return entries
 }
 
 func (p *Provider) checkIfMustDeleteAndDelete(sa *serviceAccount) bool {
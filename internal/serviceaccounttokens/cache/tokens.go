@@ -6,6 +6,7 @@ package cacheserviceaccounttokens
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts"
@@ -16,6 +17,16 @@ type tokenAndExpiration[T any] struct {
 	token               T
 	monotonicExpiration time.Time
 	wallClockExpiration time.Time
+
+	// The token is stale between the expiration and the end of the validity,
+	// see ProviderOptions.ServeStale.
+	monotonicValidity time.Time
+	wallClockValidity time.Time
+
+	// The input-dependant tokens are refreshed ahead of expiry only if they
+	// were used, see ProviderOptions.RefreshAheadBudget.
+	used           atomic.Bool
+	refreshedAhead bool
 }
 
 type tokens struct {
@@ -23,6 +34,9 @@ type tokens struct {
 	googleAccessTokens  *tokenAndExpiration[*serviceaccounttokens.AccessTokens]
 }
 
+// staleSafetyMargin is how long before expiring stale tokens stop being served.
+const staleSafetyMargin = time.Minute
+
 type tokensAndError struct {
 	tokens *tokens
 	err    error
@@ -34,6 +48,11 @@ type googleIDTokenReference struct {
 	audience               string
 }
 
+type kubernetesIDTokenReference struct {
+	serviceAccountRefernce serviceaccounts.Reference
+	audience               string
+}
+
 type googleScopedAccessTokenReference struct {
 	serviceAccountRefernce serviceaccounts.Reference
 	email                  string
@@ -85,10 +104,18 @@ func newToken[T any](token T, monotonicExpiration time.Time, maxTokenDuration ti
 
 	effectiveExpiration := now.Add(effectiveDuration)
 
+	// Stale tokens are served with a safety margin before they actually expire
+	validity := now.Add(duration - staleSafetyMargin)
+	if validity.Before(effectiveExpiration) {
+		validity = effectiveExpiration
+	}
+
 	return &tokenAndExpiration[T]{
 		token:               token,
 		monotonicExpiration: effectiveExpiration,
 		wallClockExpiration: time.Unix(effectiveExpiration.Unix(), 0),
+		monotonicValidity:   validity,
+		wallClockValidity:   time.Unix(validity.Unix(), 0),
 	}
 }
 
@@ -99,6 +126,30 @@ func (t *tokenAndExpiration[T]) expiration() time.Time {
 	return t.wallClockExpiration
 }
 
+// validity returns the end of the validity of the token, which is not before
+// the expiration.
+func (t *tokenAndExpiration[T]) validity() time.Time {
+	if time.Until(t.monotonicValidity) < time.Until(t.wallClockValidity) {
+		return t.monotonicValidity
+	}
+	return t.wallClockValidity
+}
+
+// expiresAt returns the expiration of the token, or the end of its validity
+// if it is stale.
+func (t *tokenAndExpiration[T]) expiresAt() time.Time {
+	if t.isExpired() {
+		return t.validity()
+	}
+	return t.expiration()
+}
+
+// use marks the token as used and returns whether this is the first use of
+// a token that was refreshed ahead of expiry.
+func (t *tokenAndExpiration[T]) use() bool {
+	return !t.used.Swap(true) && t.refreshedAhead
+}
+
 func (t *tokenAndExpiration[T]) timeUntilExpiration() time.Duration {
 	return time.Until(t.expiration())
 }
@@ -107,6 +158,24 @@ func (t *tokenAndExpiration[T]) isExpired() bool {
 	return t.timeUntilExpiration() <= 0
 }
 
+// isStale returns whether the token is expired but still valid.
+func (t *tokenAndExpiration[T]) isStale() bool {
+	return t.isExpired() && !t.isInvalid()
+}
+
+// isInvalid returns whether the token is past its validity.
+func (t *tokenAndExpiration[T]) isInvalid() bool {
+	return time.Until(t.validity()) <= 0
+}
+
+func (t *tokens) isExpired() bool {
+	return t.serviceAccountToken.isExpired() || t.googleAccessTokens.isExpired()
+}
+
+func (t *tokens) isInvalid() bool {
+	return t.serviceAccountToken.isInvalid() || t.googleAccessTokens.isInvalid()
+}
+
 func (t *tokens) timeUntilExpiration() time.Duration {
 	d := t.serviceAccountToken.timeUntilExpiration()
 	if google := t.googleAccessTokens.timeUntilExpiration(); google < d {
@@ -5,17 +5,18 @@ package createserviceaccounttoken
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/matheuscscp/gke-metadata-server/internal/googlecredentials"
+	"github.com/matheuscscp/gke-metadata-server/internal/namespaces"
 	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts"
 	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounttokens"
-	"golang.org/x/oauth2"
 
-	"google.golang.org/api/impersonate"
-	"google.golang.org/api/option"
 	authnv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -25,8 +26,24 @@ type (
 	}
 
 	ProviderOptions struct {
-		GoogleCredentialsConfig *googlecredentials.Config
-		KubeClient              *kubernetes.Clientset
+		GoogleCredentials *googlecredentials.Providers
+		ServiceAccounts   serviceaccounts.Provider // for selecting the workload identity provider and the quota project
+		KubeClient        kubernetes.Interface
+
+		// QuotaProjects bills the upstream calls made for a ServiceAccount to
+		// the quota project of its annotation, or of the annotation of its
+		// namespace if Namespaces is set, see serviceaccounts.QuotaProject.
+		QuotaProjects bool
+		Namespaces    namespaces.Provider
+
+		// Audience of the ServiceAccount tokens exchanged for Google access
+		// tokens. Defaults to the workload identity provider audience, and must
+		// be accepted by the allowed audiences of the provider.
+		Audience string
+
+		// Expiration of the ServiceAccount tokens. Defaults to the expiration
+		// chosen by the kube API server.
+		Expiration time.Duration
 	}
 )
 
@@ -35,15 +52,50 @@ func NewProvider(opts ProviderOptions) serviceaccounttokens.Provider {
 }
 
 func (p *Provider) GetServiceAccountToken(ctx context.Context, ref *serviceaccounts.Reference) (string, time.Time, error) {
+	audience := p.opts.Audience
+	if audience == "" {
+		var sa *corev1.ServiceAccount
+		if p.opts.GoogleCredentials.Multiple() {
+			var err error
+			if sa, err = p.serviceAccount(ctx, ref); err != nil {
+				return "", time.Time{}, err
+			}
+		}
+		googleCredentials, err := p.googleCredentials(ref, sa)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		audience = googleCredentials.WorkloadIdentityProviderAudience()
+	}
+	return p.createToken(ctx, ref, audience)
+}
+
+func (p *Provider) GetKubernetesIdentityToken(ctx context.Context, ref *serviceaccounts.Reference,
+	audience string) (string, time.Time, error) {
+	return p.createToken(ctx, ref, audience)
+}
+
+func (p *Provider) createToken(ctx context.Context, ref *serviceaccounts.Reference, audience string) (string, time.Time, error) {
+	spec := authnv1.TokenRequestSpec{
+		Audiences: []string{audience},
+	}
+	if p.opts.Expiration > 0 {
+		expirationSeconds := int64(p.opts.Expiration.Seconds())
+		spec.ExpirationSeconds = &expirationSeconds
+	}
+	if ref.Pod.Name != "" {
+		spec.BoundObjectRef = &authnv1.BoundObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Name:       ref.Pod.Name,
+			UID:        types.UID(ref.Pod.UID),
+		}
+	}
 	tokenRequest, err := p.opts.
 		KubeClient.
 		CoreV1().
 		ServiceAccounts(ref.Namespace).
-		CreateToken(ctx, ref.Name, &authnv1.TokenRequest{
-			Spec: authnv1.TokenRequestSpec{
-				Audiences: []string{p.opts.GoogleCredentialsConfig.WorkloadIdentityProviderAudience()},
-			},
-		}, metav1.CreateOptions{})
+		CreateToken(ctx, ref.Name, &authnv1.TokenRequest{Spec: spec}, metav1.CreateOptions{})
 	if err != nil {
 		return "", time.Time{}, err
 	}
@@ -54,6 +106,23 @@ func (p *Provider) GetServiceAccountToken(ctx context.Context, ref *serviceaccou
 func (p *Provider) GetGoogleAccessTokens(ctx context.Context, saToken string,
 	googleEmail *string, scopes []string) (*serviceaccounttokens.AccessTokens, time.Time, error) {
 
+	ref := serviceaccounts.ReferenceFromToken(saToken)
+	var sa *corev1.ServiceAccount
+	if p.opts.GoogleCredentials.Multiple() || p.opts.QuotaProjects {
+		var err error
+		if sa, err = p.serviceAccount(ctx, ref); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	googleCredentials, err := p.googleCredentials(ref, sa)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	quotaProject, err := p.quotaProject(ctx, sa)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
 	expiration := time.Now().Add(365 * 24 * time.Hour)
 
 	// Optimization: No need for a direct access token if the token was requested with custom
@@ -62,7 +131,7 @@ func (p *Provider) GetGoogleAccessTokens(ctx context.Context, saToken string,
 	// cache the token that was requested by a client pod.
 	var directAccess string
 	if !(googleEmail != nil && len(scopes) > 0) {
-		token, err := p.opts.GoogleCredentialsConfig.NewToken(ctx, saToken, nil, scopes)
+		token, err := googleCredentials.NewToken(ctx, saToken, nil, scopes, quotaProject)
 		if err != nil {
 			return nil, time.Time{}, err
 		}
@@ -72,7 +141,7 @@ func (p *Provider) GetGoogleAccessTokens(ctx context.Context, saToken string,
 
 	var impersonated string
 	if googleEmail != nil {
-		token, err := p.opts.GoogleCredentialsConfig.NewToken(ctx, saToken, googleEmail, scopes)
+		token, err := googleCredentials.NewToken(ctx, saToken, googleEmail, scopes, quotaProject)
 		if err != nil {
 			return nil, time.Time{}, err
 		}
@@ -88,26 +157,68 @@ func (p *Provider) GetGoogleAccessTokens(ctx context.Context, saToken string,
 	}, expiration, nil
 }
 
-func (p *Provider) GetGoogleIdentityToken(ctx context.Context, _ *serviceaccounts.Reference,
+func (p *Provider) GetGoogleIdentityToken(ctx context.Context, ref *serviceaccounts.Reference,
 	accessToken, googleEmail, audience string) (string, time.Time, error) {
 
-	conf := impersonate.IDTokenConfig{
-		Audience:        audience,
-		TargetPrincipal: googleEmail,
-		IncludeEmail:    true,
+	var sa *corev1.ServiceAccount
+	if p.opts.QuotaProjects {
+		var err error
+		if sa, err = p.serviceAccount(ctx, ref); err != nil {
+			return "", time.Time{}, err
+		}
 	}
-	accessTokenSource := oauth2.StaticTokenSource(&oauth2.Token{
-		AccessToken: accessToken,
-	})
-	idTokenSource, err := impersonate.IDTokenSource(ctx, conf, option.WithTokenSource(accessTokenSource))
+	quotaProject, err := p.quotaProject(ctx, sa)
 	if err != nil {
 		return "", time.Time{}, err
 	}
 
-	idToken, err := idTokenSource.Token()
+	// The IAM Credentials API is authenticated by the access token, so any
+	// workload identity provider can generate the ID token.
+	idToken, err := p.opts.GoogleCredentials.Default().NewIDToken(ctx, accessToken, googleEmail, audience, quotaProject)
 	if err != nil {
 		return "", time.Time{}, err
 	}
 
 	return idToken.AccessToken, idToken.Expiry, nil
 }
+
+// serviceAccount gets the ServiceAccount for selecting the workload identity
+// provider and the quota project. It's looked up once per call and passed
+// down, as without a watch every lookup is a request to the kube API server.
+func (p *Provider) serviceAccount(ctx context.Context, ref *serviceaccounts.Reference) (*corev1.ServiceAccount, error) {
+	sa, err := p.opts.ServiceAccounts.Get(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("error getting kubernetes service account: %w", err)
+	}
+	return sa, nil
+}
+
+// googleCredentials returns the Config of the workload identity provider of
+// the ServiceAccount. The ServiceAccount is only required if multiple
+// providers are configured.
+func (p *Provider) googleCredentials(ref *serviceaccounts.Reference,
+	sa *corev1.ServiceAccount) (*googlecredentials.Config, error) {
+
+	if !p.opts.GoogleCredentials.Multiple() {
+		return p.opts.GoogleCredentials.Default(), nil
+	}
+	return p.opts.GoogleCredentials.Get(ref.Namespace, serviceaccounts.WorkloadIdentityProvider(sa))
+}
+
+// quotaProject returns the quota project of the upstream calls made for the
+// ServiceAccount, or an empty string if QuotaProjects is disabled or the
+// quota project is not annotated. The ServiceAccount is only required if
+// QuotaProjects is enabled.
+func (p *Provider) quotaProject(ctx context.Context, sa *corev1.ServiceAccount) (string, error) {
+	if !p.opts.QuotaProjects {
+		return "", nil
+	}
+	quotaProject, err := serviceaccounts.QuotaProject(ctx, sa, p.opts.Namespaces)
+	if err != nil {
+		return "", err
+	}
+	if quotaProject == nil {
+		return "", nil
+	}
+	return *quotaProject, nil
+}
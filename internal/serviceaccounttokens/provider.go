@@ -21,4 +21,9 @@ type Provider interface {
 		scopes []string) (*AccessTokens, time.Time, error)
 	GetGoogleIdentityToken(ctx context.Context, saRef *serviceaccounts.Reference,
 		accessToken, googleEmail, audience string) (string, time.Time, error)
+	// GetKubernetesIdentityToken returns a token of the Kubernetes
+	// ServiceAccount issued for the given audience, for receivers that
+	// accept Kubernetes tokens in place of Google ID tokens.
+	GetKubernetesIdentityToken(ctx context.Context, saRef *serviceaccounts.Reference,
+		audience string) (string, time.Time, error)
 }
@@ -9,24 +9,34 @@ import (
 	"fmt"
 	"net/netip"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/matheuscscp/gke-metadata-server/api"
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation"
 	attestbpf "github.com/matheuscscp/gke-metadata-server/internal/attestation/bpf"
+	"github.com/matheuscscp/gke-metadata-server/internal/attestation/peercred"
 	"github.com/matheuscscp/gke-metadata-server/internal/attestation/sockdiag"
+	"github.com/matheuscscp/gke-metadata-server/internal/bpfpin"
 	"github.com/matheuscscp/gke-metadata-server/internal/googlecredentials"
 	"github.com/matheuscscp/gke-metadata-server/internal/logging"
 	"github.com/matheuscscp/gke-metadata-server/internal/loopback"
 	"github.com/matheuscscp/gke-metadata-server/internal/metrics"
+	"github.com/matheuscscp/gke-metadata-server/internal/namespaces"
+	getnamespace "github.com/matheuscscp/gke-metadata-server/internal/namespaces/get"
+	watchnamespaces "github.com/matheuscscp/gke-metadata-server/internal/namespaces/watch"
 	getnode "github.com/matheuscscp/gke-metadata-server/internal/node/get"
 	"github.com/matheuscscp/gke-metadata-server/internal/node/taints"
 	watchnode "github.com/matheuscscp/gke-metadata-server/internal/node/watch"
 	listpods "github.com/matheuscscp/gke-metadata-server/internal/pods/list"
 	watchpods "github.com/matheuscscp/gke-metadata-server/internal/pods/watch"
+	"github.com/matheuscscp/gke-metadata-server/internal/proxy"
 	"github.com/matheuscscp/gke-metadata-server/internal/proxytest"
+	"github.com/matheuscscp/gke-metadata-server/internal/redirect"
 	"github.com/matheuscscp/gke-metadata-server/internal/routing"
 	"github.com/matheuscscp/gke-metadata-server/internal/server"
+	"github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts"
 	getserviceaccount "github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts/get"
 	watchserviceaccounts "github.com/matheuscscp/gke-metadata-server/internal/serviceaccounts/watch"
 	cacheserviceaccounttokens "github.com/matheuscscp/gke-metadata-server/internal/serviceaccounttokens/cache"
@@ -39,8 +49,6 @@ import (
 	ctrl "sigs.k8s.io/controller-runtime"
 )
 
-const shutdownGracePeriod = 20 * time.Second
-
 var acceptedLogLevels = func() string {
 	logLevels := make([]string, len(logrus.AllLevels))
 	for i, level := range logrus.AllLevels {
@@ -50,12 +58,25 @@ var acceptedLogLevels = func() string {
 }()
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == probeCommand {
+		os.Exit(probe(os.Args[2:]))
+	}
+
 	var (
 		stringLogLevel                      string
+		logBackend                          string
+		logFormat                           string
 		serverPort                          int
 		healthPort                          int
 		projectID                           string
 		workloadIdentityProvider            string
+		workloadIdentityProviders           []string
+		namespaceWorkloadIdentityProviders  map[string]string
+		googleUniverseDomain                string
+		googleTokenURL                      string
+		googleTokenInfoURL                  string
+		googleImpersonationEndpoint         string
+		googleIDTokenEndpoint               string
 		watchPods                           bool
 		watchPodsResyncPeriod               time.Duration
 		watchPodsDisableFallback            bool
@@ -65,19 +86,57 @@ func main() {
 		watchServiceAccounts                bool
 		watchServiceAccountsResyncPeriod    time.Duration
 		watchServiceAccountsDisableFallback bool
+		namespaceProjectIDs                 bool
+		watchNamespaces                     bool
+		watchNamespacesResyncPeriod         time.Duration
+		watchNamespacesDisableFallback      bool
 		cacheTokens                         bool
 		cacheTokensConcurrency              int
 		cacheMaxTokenDuration               time.Duration
+		cacheServeStaleTokens               bool
+		cacheRefreshAheadBudget             int
+		kubernetesIdentityTokens            bool
+		kubernetesIdentityTokenAudiences    []string
+		serviceAccountTokenAudience         string
+		serviceAccountTokenExpiration       time.Duration
+		bindServiceAccountTokens            bool
+		quotaProjects                       bool
+		namespaceQuotaProjects              bool
 		podLookupMaxAttempts                int
 		podLookupRetryInitialDelay          time.Duration
 		podLookupRetryMaxDelay              time.Duration
+		upstreamMaxAttempts                 int
+		upstreamRetryInitialDelay           time.Duration
+		upstreamRetryMaxDelay               time.Duration
+		upstreamCircuitBreakerThreshold     int
+		upstreamCircuitBreakerCooldown      time.Duration
 		testProxyUpstream                   bool
+		shutdownPreStopDelay                time.Duration
+		shutdownGracePeriod                 time.Duration
+		bpffsPinPath                        string
+		attestationMapMaxEntries            uint32
+		cgroupIndexMaxEntries               int
+		unixSocketPath                      string
+		healthSocketPath                    string
+		bypassRoutingAllowlist              []string
+		interceptTargetFlags                []string
+		proxyUpstream                       string
+		proxyDialTimeout                    time.Duration
+		proxyResponseHeaderTimeout          time.Duration
+		proxyDialMetricsByClientIP          bool
+		logLevelWrites                      bool
 	)
 
 	flags := pflag.NewFlagSet(os.Args[0], pflag.ContinueOnError)
 
 	flags.StringVar(&stringLogLevel, "log-level", logrus.InfoLevel.String(),
 		"Log level. Accepted values: "+acceptedLogLevels)
+	flags.StringVar(&logBackend, "log-backend", logging.BackendLogrus,
+		"Logging backend. Accepted values: "+logging.BackendLogrus+", "+logging.BackendSlog+". The slog backend follows the GCP Cloud Logging field conventions")
+	flags.StringVar(&logFormat, "log-format", logging.FormatJSON,
+		"Log output format. Accepted values: "+logging.FormatJSON+", "+logging.FormatLogfmt+" and "+logging.FormatConsole+" (the last two only with the slog backend)")
+	flags.BoolVar(&logLevelWrites, "log-level-writes", false,
+		"Whether or not to allow changing the log levels at runtime through the /loglevel endpoint of the health server, which is reachable by anything that can reach the node. The endpoint is read-only otherwise (default false)")
 	flags.IntVar(&serverPort, "server-port", 16321,
 		"Network address where the metadata server must listen on. Ignored on nodes annotated/labeled with loopback routing")
 	flags.IntVar(&healthPort, "health-port", 16322,
@@ -86,6 +145,20 @@ func main() {
 		"Project ID of the GCP project where the GCP Workload Identity Provider is configured")
 	flags.StringVar(&workloadIdentityProvider, "workload-identity-provider", "",
 		"Mandatory fully-qualified resource name of the GCP Workload Identity Provider (projects/<project_number>/locations/global/workloadIdentityPools/<pool_name>/providers/<provider_name>)")
+	flags.StringSliceVar(&workloadIdentityProviders, "workload-identity-providers", nil,
+		"Additional fully-qualified resource names of GCP Workload Identity Providers that Kubernetes ServiceAccounts may select with the annotation "+api.AnnotationWorkloadIdentityProvider)
+	flags.StringToStringVar(&namespaceWorkloadIdentityProviders, "namespace-workload-identity-providers", nil,
+		"Mapping from namespace to the fully-qualified resource name of the GCP Workload Identity Provider of its Kubernetes ServiceAccounts, e.g. tenant-a=projects/<project_number>/locations/global/workloadIdentityPools/<pool_name>/providers/<provider_name>")
+	flags.StringVar(&googleUniverseDomain, "google-universe-domain", googlecredentials.DefaultUniverseDomain,
+		"Domain of the Google Cloud universe, e.g. of a sovereign cloud. The default Google endpoints are derived from it")
+	flags.StringVar(&googleTokenURL, "google-token-url", "",
+		"URL of the STS token exchange endpoint, e.g. of a Private Service Connect endpoint (default https://sts.<universe-domain>/v1/token)")
+	flags.StringVar(&googleTokenInfoURL, "google-token-info-url", "",
+		"URL of the STS token introspection endpoint (default https://sts.<universe-domain>/v1/introspect)")
+	flags.StringVar(&googleImpersonationEndpoint, "google-impersonation-endpoint", "",
+		"Base URL of the IAM Credentials API used for generating access tokens of Google Service Accounts (default https://iamcredentials.<universe-domain>)")
+	flags.StringVar(&googleIDTokenEndpoint, "google-id-token-endpoint", "",
+		"Base URL of the IAM Credentials API used for generating ID tokens of Google Service Accounts (default https://iamcredentials.<universe-domain>)")
 	flags.BoolVar(&watchPods, "watch-pods", false,
 		"Whether or not to watch the pods running on the same node (default false)")
 	flags.DurationVar(&watchPodsResyncPeriod, "watch-pods-resync-period", 10*time.Minute,
@@ -104,18 +177,80 @@ func main() {
 		"When watching service accounts, how often to fully resync")
 	flags.BoolVar(&watchServiceAccountsDisableFallback, "watch-service-accounts-disable-fallback", false,
 		"When watching service accounts, whether or not to disable the use of a simple fallback method for retrieving service accounts upon cache misses (default false)")
+	flags.BoolVar(&namespaceProjectIDs, "namespace-project-ids", false,
+		"Whether or not to serve the project/* metadata from the annotations "+api.AnnotationProjectID+" and "+api.AnnotationNumericProjectID+" of the namespace of the requesting pod, falling back to --project-id and the numeric project ID of the workload identity provider (default false)")
+	flags.BoolVar(&watchNamespaces, "watch-namespaces", false,
+		"When reading namespace annotations (--namespace-project-ids or --namespace-quota-projects), whether or not to watch all the namespaces of the cluster (default false)")
+	flags.DurationVar(&watchNamespacesResyncPeriod, "watch-namespaces-resync-period", time.Hour,
+		"When watching namespaces, how often to fully resync")
+	flags.BoolVar(&watchNamespacesDisableFallback, "watch-namespaces-disable-fallback", false,
+		"When watching namespaces, whether or not to disable the use of a simple fallback method for retrieving namespaces upon cache misses (default false)")
+	flags.BoolVar(&quotaProjects, "quota-projects", false,
+		"Whether or not to bill the STS and IAM Credentials calls made for a service account to the quota project of the annotation "+api.AnnotationQuotaProject+" of the service account, or of its namespace when --namespace-quota-projects is enabled, by sending the x-goog-user-project header, and to serve this quota project to the pods from the project/attributes/quota-project metadata (default false)")
+	flags.BoolVar(&namespaceQuotaProjects, "namespace-quota-projects", false,
+		"When --quota-projects is enabled, whether or not to fall back to the quota project of the annotation "+api.AnnotationQuotaProject+" of the namespace of the service account (default false)")
 	flags.BoolVar(&cacheTokens, "cache-tokens", false,
 		"Whether or not to proactively cache tokens for the service accounts used by the pods running on the same node (default false)")
 	flags.IntVar(&cacheTokensConcurrency, "cache-tokens-concurrency", 10,
 		"When proactively caching service account tokens, what is the maximum amount of caching operations that can happen in parallel")
 	flags.DurationVar(&cacheMaxTokenDuration, "cache-max-token-duration", time.Hour,
 		"Maximum duration for cached service account tokens")
+	flags.BoolVar(&cacheServeStaleTokens, "cache-serve-stale-tokens", false,
+		"When proactively caching service account tokens, whether or not to serve the cached tokens that are past their refresh point but still valid when refreshing them fails, instead of failing the requests (default false)")
+	flags.IntVar(&cacheRefreshAheadBudget, "cache-refresh-ahead-budget", 0,
+		"When proactively caching service account tokens, the maximum number of scoped access tokens and identity tokens refreshed ahead of expiry for each service account while they keep being used, evicting the least recently used token. Zero disables the refresh ahead (default 0)")
+	flags.BoolVar(&kubernetesIdentityTokens, "kubernetes-identity-tokens", false,
+		"Whether or not to return a token of the Kubernetes ServiceAccount issued for the requested audience from the identity API when the ServiceAccount has no target Google Service Account, instead of a 404 (default false)")
+	flags.StringSliceVar(&kubernetesIdentityTokenAudiences, "kubernetes-identity-token-audiences", nil,
+		"Audiences allowed for the tokens of the Kubernetes ServiceAccounts returned from the identity API. Required with --kubernetes-identity-tokens. The audiences of the Kubernetes API server are refused")
+	flags.StringVar(&serviceAccountTokenAudience, "service-account-token-audience", "",
+		"Audience of the Kubernetes ServiceAccount tokens exchanged for Google access tokens. Must be one of the allowed audiences of the workload identity provider. Cannot be used with multiple workload identity providers (default the workload identity provider audience)")
+	flags.DurationVar(&serviceAccountTokenExpiration, "service-account-token-expiration", 0,
+		"Expiration of the Kubernetes ServiceAccount tokens, at least 10m (default chosen by the Kubernetes API server)")
+	flags.BoolVar(&bindServiceAccountTokens, "bind-service-account-tokens", false,
+		"Whether or not to bind the Kubernetes ServiceAccount tokens to the requesting pods, so they are invalidated when the pods are deleted. Tokens are then cached per pod instead of per ServiceAccount (default false)")
 	flags.IntVar(&podLookupMaxAttempts, "pod-lookup-max-attempts", 3,
 		"Maximum number of attempts to try looking up a pod by the client connection IP address")
 	flags.DurationVar(&podLookupRetryInitialDelay, "pod-lookup-retry-initial-delay", time.Second,
 		"Initial delay for retrying pod lookups upon failures")
 	flags.DurationVar(&podLookupRetryMaxDelay, "pod-lookup-retry-max-delay", 30*time.Second,
 		"Maximum delay for retrying pod lookups upon failures")
+	flags.IntVar(&upstreamMaxAttempts, "upstream-max-attempts", 3,
+		"Maximum number of attempts of the calls to the Google APIs upon transient failures, i.e. network errors, 429 and 5xx")
+	flags.DurationVar(&upstreamRetryInitialDelay, "upstream-retry-initial-delay", 100*time.Millisecond,
+		"Initial delay for retrying the calls to the Google APIs, randomized with jitter")
+	flags.DurationVar(&upstreamRetryMaxDelay, "upstream-retry-max-delay", 2*time.Second,
+		"Maximum delay for retrying the calls to the Google APIs, randomized with jitter. Responses whose Retry-After header asks for a longer delay are not retried")
+	flags.IntVar(&upstreamCircuitBreakerThreshold, "upstream-circuit-breaker-threshold", 5,
+		"Number of consecutive calls to a Google API endpoint failed by transient errors, regardless of their retries and except for 429, that opens its circuit breaker, failing the calls to the endpoint right away with a 503 until the cooldown elapses. Negative disables the circuit breakers")
+	flags.DurationVar(&upstreamCircuitBreakerCooldown, "upstream-circuit-breaker-cooldown", 30*time.Second,
+		"How long the circuit breaker of a Google API endpoint stays open before a call probes the endpoint again")
+	flags.DurationVar(&shutdownPreStopDelay, "shutdown-pre-stop-delay", 5*time.Second,
+		"Upon termination, how long to keep serving with a failing readiness probe before closing the metadata server")
+	flags.DurationVar(&shutdownGracePeriod, "shutdown-grace-period", 20*time.Second,
+		"Upon termination, maximum time to wait for in-flight requests and proxied connections to finish after the pre-stop delay")
+	flags.StringVar(&bpffsPinPath, "bpffs-pin-path", bpfpin.DefaultPath,
+		"bpffs directory where the eBPF routing mode pins its programs, maps and links so a new daemon instance can adopt them during upgrades without detaching the routes. Empty disables pinning")
+	flags.Uint32Var(&attestationMapMaxEntries, "attestation-map-max-entries", attestbpf.DefaultMaxEntries,
+		"Capacity of the eBPF attestation map of live connections in eBPF routing mode. Raise it on nodes with many concurrent TCP connections")
+	flags.IntVar(&cgroupIndexMaxEntries, "cgroup-index-max-entries", attestation.DefaultCgroupIndexMaxEntries,
+		"Capacity of the cgroup ID to pod UID index used by the kernel attestation. Cgroups that do not fit are resolved by walking /sys/fs/cgroup")
+	flags.StringVar(&unixSocketPath, "unix-socket-path", "",
+		"Path of a Unix domain socket where the metadata server also listens, for pods that mount it from the host. Callers are identified by the kernel-reported peer credentials. Empty disables the socket")
+	flags.StringSliceVar(&bypassRoutingAllowlist, "bypass-routing-allowlist", nil,
+		"Namespaces (<namespace>) and ServiceAccounts (<namespace>/<name>) whose Pods may opt out of the eBPF routing mode with the annotation "+api.AnnotationBypassRouting+", reaching the real metadata server and hence the credentials of the Node. Requires --watch-pods. Empty disables the annotation")
+	flags.StringVar(&healthSocketPath, "health-socket-path", defaultHealthSocketPath,
+		"Path of a Unix domain socket where the health server also listens, for the exec probes (see the "+probeCommand+" subcommand). Must be private to the container: the health port is shared with the previous instance during upgrades. Empty disables the socket")
+	flags.StringArrayVar(&interceptTargetFlags, "intercept-target", nil,
+		"Destination redirected to the metadata server in addition to 169.254.169.254:80 in eBPF routing mode, in the format address=<host>:<port>,port=<emulator-port>[,upstream=<host>:<port>]. The emulator accepts the redirected connections on the given port and proxies the requests that are not metadata requests to the upstream (default: the address, \"none\" answers them with a 404). Can be repeated")
+	flags.StringVar(&proxyUpstream, "proxy-upstream", proxy.DefaultUpstream,
+		"In eBPF routing mode, where the requests to 169.254.169.254:80 that are not metadata requests are proxied, e.g. the metadata service of another cloud or a local stub. \""+proxy.NoUpstream+"\" answers them with a 404 instead")
+	flags.DurationVar(&proxyDialTimeout, "proxy-dial-timeout", proxy.DefaultDialTimeout,
+		"In eBPF routing mode, maximum time to wait for connecting to the upstream of the requests that are not metadata requests")
+	flags.DurationVar(&proxyResponseHeaderTimeout, "proxy-response-header-timeout", 0,
+		"In eBPF routing mode, maximum time to wait for the response headers of the upstream of the requests that are not metadata requests. Zero means no timeout")
+	flags.BoolVar(&proxyDialMetricsByClientIP, "proxy-dial-metrics-by-client-ip", false,
+		"Whether or not to export the proxy dial latency metric labeled with the client IP address besides the upstream. Disables the reuse of the connections to the upstreams, and has one series per client")
 	flags.BoolVar(&testProxyUpstream, "test-proxy-upstream", false,
 		"Test-only: in eBPF mode, bind 169.254.169.254 to lo and serve a marker on port 80 to e2e-test the proxy passthrough chain. Has no effect outside eBPF mode. Do not enable in production.")
 
@@ -135,9 +270,13 @@ func main() {
 		fmt.Fprintf(os.Stderr, "invalid value for --log-level flag. the accepted values are: %s\n", acceptedLogLevels)
 		os.Exit(1)
 	}
+	if err := logging.ConfigureOutput(logBackend, logFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
 	l := logging.NewLogger(logLevel)
 	ctx = logging.IntoContext(ctx, l)
-	logging.InitKLog(l, logLevel)
+	logging.InitKLog(l)
 
 	// validate inputs
 	nodeName := os.Getenv("NODE_NAME")
@@ -155,15 +294,75 @@ func main() {
 	if !emulatorIP.Is4() {
 		l.Fatal("POD_IP environment variable must be an IPv4 address")
 	}
-	googleCredentialsConfig, numericProjectID, workloadIdentityPool, err := googlecredentials.NewConfig(googlecredentials.ConfigOptions{
-		WorkloadIdentityProvider: workloadIdentityProvider,
+	if upstreamMaxAttempts <= 0 {
+		l.Fatal("--upstream-max-attempts must be positive")
+	}
+	if upstreamCircuitBreakerThreshold == 0 {
+		l.Fatal("--upstream-circuit-breaker-threshold must not be zero, use a negative value for disabling the circuit breakers")
+	}
+	if cacheRefreshAheadBudget < 0 {
+		l.Fatal("--cache-refresh-ahead-budget must not be negative")
+	}
+	if kubernetesIdentityTokens && len(kubernetesIdentityTokenAudiences) == 0 {
+		l.Fatal("--kubernetes-identity-tokens requires --kubernetes-identity-token-audiences")
+	}
+	if namespaceQuotaProjects && !quotaProjects {
+		l.Fatal("--namespace-quota-projects requires --quota-projects")
+	}
+	if len(bypassRoutingAllowlist) > 0 && !watchPods {
+		l.Fatal("--bypass-routing-allowlist requires --watch-pods")
+	}
+	if healthSocketPath != "" && healthSocketPath == unixSocketPath {
+		l.Fatal("--health-socket-path must be different from --unix-socket-path")
+	}
+	metricsRegistry := metrics.NewRegistry()
+	googleTransport := googlecredentials.NewTransport(googlecredentials.TransportOptions{
+		MetricsRegistry:         metricsRegistry,
+		MaxAttempts:             upstreamMaxAttempts,
+		RetryInitialDelay:       upstreamRetryInitialDelay,
+		RetryMaxDelay:           upstreamRetryMaxDelay,
+		CircuitBreakerThreshold: upstreamCircuitBreakerThreshold,
+		CircuitBreakerCooldown:  upstreamCircuitBreakerCooldown,
+	})
+	googleCredentials, err := googlecredentials.NewProviders(googlecredentials.ProvidersOptions{
+		ConfigOptions: googlecredentials.ConfigOptions{
+			WorkloadIdentityProvider: workloadIdentityProvider,
+			UniverseDomain:           googleUniverseDomain,
+			TokenURL:                 googleTokenURL,
+			TokenInfoURL:             googleTokenInfoURL,
+			ImpersonationEndpoint:    googleImpersonationEndpoint,
+			IDTokenEndpoint:          googleIDTokenEndpoint,
+			Transport:                googleTransport,
+		},
+		Additional: workloadIdentityProviders,
+		Namespaces: namespaceWorkloadIdentityProviders,
 	})
 	if err != nil {
 		l.WithError(err).Fatal("error creating google credentials config")
 	}
+	if serviceAccountTokenAudience != "" && googleCredentials.Multiple() {
+		l.Fatal("--service-account-token-audience cannot be used with --workload-identity-providers or --namespace-workload-identity-providers, the audience would be used for every provider")
+	}
+	if serviceAccountTokenExpiration != 0 && serviceAccountTokenExpiration < 10*time.Minute {
+		l.Fatal("--service-account-token-expiration must be at least 10m")
+	}
 	if podLookupMaxAttempts < 0 {
 		podLookupMaxAttempts = 0
 	}
+	if err := proxy.ValidateUpstream(proxyUpstream); err != nil {
+		l.WithError(err).Fatal("invalid value for --proxy-upstream flag")
+	}
+	var interceptTargets []proxy.Target
+	for _, f := range interceptTargetFlags {
+		t, err := proxy.ParseTarget(f)
+		if err != nil {
+			l.WithError(err).Fatal("error parsing --intercept-target flag")
+		}
+		interceptTargets = append(interceptTargets, t)
+	}
+	if err := proxy.ValidateTargets(interceptTargets, serverPort, healthPort); err != nil {
+		l.WithError(err).Fatal("invalid value for --intercept-target flag")
+	}
 
 	// create kube client
 	kubeConfig, err := rest.InClusterConfig()
@@ -174,8 +373,15 @@ func main() {
 	if err != nil {
 		l.WithError(err).Fatal("error creating kubernetes client")
 	}
-
-	metricsRegistry := metrics.NewRegistry()
+	if kubernetesIdentityTokens {
+		apiServerAudiences := serviceaccounts.APIServerAudiences(kubeConfig.BearerToken)
+		for _, audience := range kubernetesIdentityTokenAudiences {
+			if slices.Contains(apiServerAudiences, audience) {
+				l.WithField("audience", audience).
+					Fatal("--kubernetes-identity-token-audiences must not contain the audiences of the Kubernetes API server")
+			}
+		}
+	}
 
 	// create pod provider
 	pods := listpods.NewProvider(listpods.ProviderOptions{
@@ -190,6 +396,8 @@ func main() {
 			KubeClient:      kubeClient,
 			MetricsRegistry: metricsRegistry,
 			ResyncPeriod:    watchPodsResyncPeriod,
+
+			BindServiceAccountTokens: bindServiceAccountTokens,
 		}
 		if watchPodsDisableFallback {
 			opts.FallbackSource = nil
@@ -241,18 +449,53 @@ func main() {
 		serviceAccounts = wsa
 	}
 
+	// create namespace provider
+	var namespaceProvider namespaces.Provider
+	var wns *watchnamespaces.Provider
+	if namespaceProjectIDs || namespaceQuotaProjects {
+		namespaceProvider = getnamespace.NewProvider(getnamespace.ProviderOptions{
+			KubeClient: kubeClient,
+		})
+		if watchNamespaces {
+			opts := watchnamespaces.ProviderOptions{
+				FallbackSource:  namespaceProvider,
+				KubeClient:      kubeClient,
+				MetricsRegistry: metricsRegistry,
+				ResyncPeriod:    watchNamespacesResyncPeriod,
+			}
+			if watchNamespacesDisableFallback {
+				opts.FallbackSource = nil
+			}
+			wns = watchnamespaces.NewProvider(opts)
+			defer wns.Close()
+			namespaceProvider = wns
+		}
+	}
+
 	// create service account token provider
-	serviceAccountTokens := createserviceaccounttoken.NewProvider(createserviceaccounttoken.ProviderOptions{
-		GoogleCredentialsConfig: googleCredentialsConfig,
-		KubeClient:              kubeClient,
-	})
+	serviceAccountTokensOpts := createserviceaccounttoken.ProviderOptions{
+		GoogleCredentials: googleCredentials,
+		ServiceAccounts:   serviceAccounts,
+		KubeClient:        kubeClient,
+		Audience:          serviceAccountTokenAudience,
+		Expiration:        serviceAccountTokenExpiration,
+		QuotaProjects:     quotaProjects,
+	}
+	if namespaceQuotaProjects {
+		serviceAccountTokensOpts.Namespaces = namespaceProvider
+	}
+	serviceAccountTokens := createserviceaccounttoken.NewProvider(serviceAccountTokensOpts)
 	if cacheTokens {
 		p := cacheserviceaccounttokens.NewProvider(ctx, cacheserviceaccounttokens.ProviderOptions{
-			Source:           serviceAccountTokens,
-			ServiceAccounts:  serviceAccounts,
-			MetricsRegistry:  metricsRegistry,
-			Concurrency:      cacheTokensConcurrency,
-			MaxTokenDuration: cacheMaxTokenDuration,
+			Source:             serviceAccountTokens,
+			ServiceAccounts:    serviceAccounts,
+			MetricsRegistry:    metricsRegistry,
+			Concurrency:        cacheTokensConcurrency,
+			MaxTokenDuration:   cacheMaxTokenDuration,
+			ServeStale:         cacheServeStaleTokens,
+			RefreshAheadBudget: cacheRefreshAheadBudget,
+
+			MaxKubernetesIDTokensPerServiceAccount: len(kubernetesIdentityTokenAudiences),
 		})
 		defer p.Close()
 		if wp != nil {
@@ -264,6 +507,48 @@ func main() {
 		serviceAccountTokens = p
 	}
 
+	// inspect the cgroup layout of the node, which decides where the eBPF
+	// programs are attached and which routing modes can work
+	cgroupLayout, err := attestation.DetectCgroupLayout()
+	if err != nil {
+		l.WithError(err).Fatal("error detecting cgroup layout")
+	}
+	if cgroupLayout.V2Mount != "" {
+		attestation.CgroupV2Mount = cgroupLayout.V2Mount
+	}
+	l.WithFields(logrus.Fields{
+		"mode":                  cgroupLayout.Mode,
+		"v2Mount":               cgroupLayout.V2Mount,
+		"supportedRoutingModes": cgroupLayout.SupportedRoutingModes(),
+	}).Info("cgroup layout detected")
+
+	// index the pod cgroups of the node, for the kernel attestation and for
+	// the pods opted out of the eBPF routing mode
+	var cgroupIndex *attestation.CgroupIndex
+	if cgroupLayout.V2Mount != "" {
+		cgroupIndex, err = attestation.NewCgroupIndex(attestation.CgroupIndexOptions{
+			MaxEntries:      cgroupIndexMaxEntries,
+			MetricsRegistry: metricsRegistry,
+		})
+		if err != nil {
+			l.WithError(err).Fatal("error building cgroup index")
+		}
+	}
+
+	// track the pods opted out of the eBPF routing mode, which requires
+	// watching the pods of the node
+	var bypass *redirect.Bypass
+	if len(bypassRoutingAllowlist) > 0 {
+		bypass, err = redirect.NewBypass(redirect.BypassOptions{
+			Allowed:     bypassRoutingAllowlist,
+			CgroupIndex: cgroupIndex,
+		})
+		if err != nil {
+			l.WithError(err).Fatal("error creating bypass routing tracker")
+		}
+		wp.AddPodListener(bypass)
+	}
+
 	// start watches
 	if wp != nil {
 		wp.Start(ctx)
@@ -274,21 +559,26 @@ func main() {
 	if wsa != nil {
 		wsa.Start(ctx)
 	}
+	if wns != nil {
+		wns.Start(ctx)
+	}
 
 	// load and attach network route based on node annotation
 	curNode, err := nodeGetter.Get(ctx)
 	if err != nil {
 		l.WithError(err).Fatal("error getting current node")
 	}
-	routingMode, closeRoute, err := routing.LoadAndAttach(curNode, emulatorIP, serverPort)
+	routingMode, closeRoute, err := routing.LoadAndAttach(curNode, routing.Options{
+		EmulatorIP:   emulatorIP,
+		EmulatorPort: serverPort,
+		BPFFSPinPath: bpffsPinPath,
+		CgroupLayout: cgroupLayout,
+		ExtraTargets: interceptTargets,
+		Bypass:       bypass,
+	})
 	if err != nil {
 		l.WithField("routing", routingMode).WithError(err).Fatal("error loading and attaching network route")
 	}
-	defer func() {
-		if err := closeRoute(); err != nil {
-			l.WithField("routing", routingMode).WithError(err).Error("error closing network route")
-		}
-	}()
 	serverAddr := fmt.Sprintf(":%d", serverPort)
 	if routingMode == api.RoutingModeLoopback {
 		serverAddr = loopback.GKEMetadataServerAddr
@@ -296,27 +586,35 @@ func main() {
 
 	// Pick the per-mode attestation strategy. eBPF mode loads a sockops
 	// program that records every active TCP connect's 4-tuple -> cgroup ID,
-	// which userspace resolves to a pod UID by walking /sys/fs/cgroup.
-	// Loopback and None modes use a userspace netlink SOCK_DIAG fallback
-	// that resolves a 4-tuple to the owning socket's inode, walks
-	// /proc/<pid>/fd to find the PID, then reads /proc/<pid>/cgroup. The
+	// which userspace resolves to a pod UID through an index of the
+	// kubepods cgroups, falling back to walking /sys/fs/cgroup.
+	// Loopback, nftables and None modes use a userspace netlink INET_DIAG
+	// query that resolves a 4-tuple to the owning socket's cgroup ID, or on
+	// older kernels to its inode and then walks /proc/<pid>/fd to find the
+	// PID and reads /proc/<pid>/cgroup. The
 	// server consults this lookuper for hostNetwork pods (and, in eBPF
 	// mode, for every pod).
 	var attestationLookuper server.AttestationLookuper
+	closeAttestation := func() error { return nil }
 	switch routingMode {
 	case api.RoutingModeBPF:
-		attestMap, err := attestbpf.LoadAndAttach()
+		attestMap, err := attestbpf.LoadAndAttach(attestbpf.Options{
+			PinPath:         bpffsPinPath,
+			MaxEntries:      attestationMapMaxEntries,
+			CgroupIndex:     cgroupIndex,
+			MetricsRegistry: metricsRegistry,
+		})
 		if err != nil {
 			l.WithError(err).Fatal("error loading attestation eBPF program")
 		}
-		defer func() {
-			if err := attestMap.Close(); err != nil {
-				l.WithError(err).Error("error closing attestation eBPF program")
-			}
-		}()
+		closeAttestation = attestMap.Close
 		attestationLookuper = attestMap
-	case api.RoutingModeLoopback, api.RoutingModeNone:
-		attestationLookuper = sockdiag.New()
+	case api.RoutingModeLoopback, api.RoutingModeNFTables, api.RoutingModeNone:
+		attestationLookuper = sockdiag.New(sockdiag.Options{CgroupIndex: cgroupIndex})
+	}
+	if cgroupIndex != nil {
+		closeLookuper := closeAttestation
+		closeAttestation = func() error { return errors.Join(closeLookuper(), cgroupIndex.Close()) }
 	}
 
 	l.WithFields(logrus.Fields{
@@ -338,19 +636,39 @@ func main() {
 
 	// start server
 	s := server.New(ctx, server.ServerOptions{
-		NodeName:             nodeName,
-		PodIP:                podIP,
-		Addr:                 serverAddr,
-		HealthPort:           healthPort,
-		Pods:                 pods,
-		ServiceAccounts:      serviceAccounts,
-		ServiceAccountTokens: serviceAccountTokens,
-		MetricsRegistry:      metricsRegistry,
-		ProjectID:            projectID,
-		NumericProjectID:     numericProjectID,
-		WorkloadIdentityPool: workloadIdentityPool,
-		RoutingMode:          routingMode,
-		Attestation:          attestationLookuper,
+		NodeName:                  nodeName,
+		PodIP:                     podIP,
+		Addr:                      serverAddr,
+		HealthPort:                healthPort,
+		Pods:                      pods,
+		ServiceAccounts:           serviceAccounts,
+		ServiceAccountTokens:      serviceAccountTokens,
+		MetricsRegistry:           metricsRegistry,
+		ProjectID:                 projectID,
+		WorkloadIdentityProviders: googleCredentials,
+		Namespaces:                namespaceProvider,
+		UniverseDomain:            googleCredentials.Default().UniverseDomain(),
+		KubernetesIdentityTokens:  kubernetesIdentityTokens,
+		BindServiceAccountTokens:  bindServiceAccountTokens,
+		NamespaceProjectIDs:       namespaceProjectIDs,
+		QuotaProjects:             quotaProjects,
+		NamespaceQuotaProjects:    namespaceQuotaProjects,
+		RoutingMode:               routingMode,
+		Attestation:               attestationLookuper,
+		UnixSocketPath:            unixSocketPath,
+		HealthSocketPath:          healthSocketPath,
+		PeerAttestation:           peercred.Attestor{},
+
+		KubernetesIdentityTokenAudiences: kubernetesIdentityTokenAudiences,
+
+		Proxy: server.ProxyOptions{
+			Upstream:              proxyUpstream,
+			InterceptTargets:      interceptTargets,
+			DialTimeout:           proxyDialTimeout,
+			ResponseHeaderTimeout: proxyResponseHeaderTimeout,
+			DialMetricsByClientIP: proxyDialMetricsByClientIP,
+		},
+		LogLevelWrites: logLevelWrites,
 		PodLookup: server.PodLookupOptions{
 			MaxAttempts:       podLookupMaxAttempts,
 			RetryInitialDelay: podLookupRetryInitialDelay,
@@ -363,11 +681,51 @@ func main() {
 	metricsRegistry.MustRegister(removeTaintsFailures)
 	taints.Remove(ctx, kubeClient, nodeName, removeTaintsFailures.WithLabelValues(nodeName))
 
+	shutdownPhaseDuration := metrics.NewShutdownPhaseDurationMillis()
+	metricsRegistry.MustRegister(shutdownPhaseDuration)
+
 	<-ctx.Done()
-	l.Info("signal received, shutting down server")
-	ctx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+
+	// Drain sequence. Readiness fails first, then the network route is
+	// detached so new connections are no longer sent to the emulator, then
+	// the metadata server stops accepting new connections while in-flight
+	// requests and proxied streams finish, so pods never see their
+	// connections cut or refused mid-rollout. In Loopback mode the route is
+	// the address the connections are bound to, so it is removed last.
+	runPhase := func(phase string, f func() error) {
+		start := time.Now()
+		err := f()
+		duration := time.Since(start)
+		shutdownPhaseDuration.WithLabelValues(phase).Set(float64(duration.Milliseconds()))
+		l := l.WithFields(logrus.Fields{
+			"shutdown_phase": phase,
+			"duration": logrus.Fields{
+				"string": duration.String(),
+				"nanos":  duration.Nanoseconds(),
+			},
+		})
+		if err != nil {
+			l.WithError(err).Error("error in shutdown phase")
+			return
+		}
+		l.Info("shutdown phase completed")
+	}
+	l.Info("signal received, draining server")
+	s.StartDraining()
+	runPhase("pre_stop_delay", func() error {
+		time.Sleep(shutdownPreStopDelay)
+		return nil
+	})
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
 	defer cancel()
-	if err := s.Shutdown(ctx); err != nil {
-		l.WithError(err).Error("error shutting down server")
+	if routingMode != api.RoutingModeLoopback {
+		runPhase("network_route", closeRoute)
+	}
+	runPhase("metadata_server", func() error { return s.ShutdownMetadataServer(shutdownCtx) })
+	runPhase("proxied_connections", func() error { return s.WaitProxiedConnections(shutdownCtx) })
+	if routingMode == api.RoutingModeLoopback {
+		runPhase("network_route", closeRoute)
 	}
+	runPhase("attestation", closeAttestation)
+	runPhase("health_server", func() error { return s.ShutdownHealthServer(shutdownCtx) })
 }
@@ -0,0 +1,56 @@
+// Copyright 2026 Matheus Pimenta.
+// SPDX-License-Identifier: AGPL-3.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	pkghttp "github.com/matheuscscp/gke-metadata-server/internal/http"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	probeCommand = "probe"
+
+	defaultHealthSocketPath = "/tmp/gke-metadata-server-health.sock"
+)
+
+// probe implements the probe subcommand, used by the exec probes of the
+// DaemonSet to reach the health server of the same instance through its
+// Unix domain socket. It returns the exit code of the process.
+func probe(args []string) int {
+	var (
+		healthSocketPath string
+		path             string
+		timeout          time.Duration
+	)
+
+	flags := pflag.NewFlagSet(probeCommand, pflag.ContinueOnError)
+	flags.StringVar(&healthSocketPath, "health-socket-path", defaultHealthSocketPath,
+		"Path of the Unix domain socket of the health server")
+	flags.StringVar(&path, "path", "/healthz",
+		"Path of the health server endpoint to probe, e.g. /healthz or /readyz")
+	flags.DurationVar(&timeout, "timeout", 5*time.Second,
+		"Maximum time to wait for the probe response")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "error parsing flags: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := pkghttp.Probe(ctx, healthSocketPath, path); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -4,6 +4,8 @@
 package templates
 
 import (
+	cuepath "path"
+
 	appsv1 "k8s.io/api/apps/v1"
 )
 
@@ -14,6 +16,16 @@ import (
 	metadata:   #config.#namespacedMetadata
 	spec: {
 		selector: matchLabels: #config.selector.labels
+		// The surge rollout starts the new daemon on each node before the old one is stopped,
+		// so the new instance can adopt the pinned eBPF objects and the listeners are handed off
+		// without downtime.
+		updateStrategy: {
+			type: "RollingUpdate"
+			rollingUpdate: {
+				maxSurge:       1
+				maxUnavailable: 0
+			}
+		}
 		template: {
 			metadata: {
 				labels: #config.selector.labels & {
@@ -25,12 +37,15 @@ import (
 			}
 			spec: {
 				hostNetwork: true
-				// hostPID is required by the netlink SOCK_DIAG fallback used in
-				// Loopback and None routing modes for hostNetwork pods: the
+				// hostPID is required by the netlink INET_DIAG fallback used in
+				// Loopback and None routing modes for hostNetwork pods on kernels
+				// older than 5.7, which do not report the socket cgroup ID: the
 				// server walks /proc/<pid>/fd to map a socket inode back to its
 				// owning PID, then reads /proc/<pid>/cgroup to derive the pod
 				// UID. eBPF mode does not need it (cgroup ID alone identifies
-				// the pod).
+				// the pod). The Unix domain socket also needs it, as the kernel
+				// reports the PIDs of the socket peers in the server's PID
+				// namespace.
 				hostPID:            true
 				serviceAccountName: #config.#namespacedMetadata.name
 				priorityClassName:  "system-node-critical"
@@ -72,9 +87,39 @@ import (
 					args: [
 						"--project-id=\(#config.settings.projectID)",
 						"--workload-identity-provider=\(#config.settings.workloadIdentityProvider)",
+						for provider in #config.settings.workloadIdentityProviders {
+							"--workload-identity-providers=\(provider)"
+						}
+						for namespace, provider in #config.settings.namespaceWorkloadIdentityProviders {
+							"--namespace-workload-identity-providers=\(namespace)=\(provider)"
+						}
+						if #config.settings.google.universeDomain != _|_ {
+							"--google-universe-domain=\(#config.settings.google.universeDomain)"
+						}
+						if #config.settings.google.tokenURL != _|_ {
+							"--google-token-url=\(#config.settings.google.tokenURL)"
+						}
+						if #config.settings.google.tokenInfoURL != _|_ {
+							"--google-token-info-url=\(#config.settings.google.tokenInfoURL)"
+						}
+						if #config.settings.google.impersonationEndpoint != _|_ {
+							"--google-impersonation-endpoint=\(#config.settings.google.impersonationEndpoint)"
+						}
+						if #config.settings.google.idTokenEndpoint != _|_ {
+							"--google-id-token-endpoint=\(#config.settings.google.idTokenEndpoint)"
+						}
 						if #config.settings.logLevel != _|_ {
 							"--log-level=\(#config.settings.logLevel)"
 						}
+						if #config.settings.logBackend != _|_ {
+							"--log-backend=\(#config.settings.logBackend)"
+						}
+						if #config.settings.logFormat != _|_ {
+							"--log-format=\(#config.settings.logFormat)"
+						}
+						if #config.settings.logLevelWrites {
+							"--log-level-writes"
+						}
 						if #config.settings.serverPort != _|_ {
 							"--server-port=\(#config.settings.serverPort)"
 						}
@@ -108,6 +153,24 @@ import (
 						if #config.settings.watchServiceAccounts.enable && #config.settings.watchServiceAccounts.resyncPeriod != _|_ {
 							"--watch-service-accounts-resync-period=\(#config.settings.watchServiceAccounts.resyncPeriod)"
 						}
+						if #config.settings.namespaceProjectIDs {
+							"--namespace-project-ids"
+						}
+						if (#config.settings.namespaceProjectIDs || (#config.settings.quotaProjects && #config.settings.namespaceQuotaProjects)) && #config.settings.watchNamespaces.enable {
+							"--watch-namespaces"
+						}
+						if (#config.settings.namespaceProjectIDs || (#config.settings.quotaProjects && #config.settings.namespaceQuotaProjects)) && #config.settings.watchNamespaces.enable && #config.settings.watchNamespaces.disableFallback {
+							"--watch-namespaces-disable-fallback"
+						}
+						if (#config.settings.namespaceProjectIDs || (#config.settings.quotaProjects && #config.settings.namespaceQuotaProjects)) && #config.settings.watchNamespaces.enable && #config.settings.watchNamespaces.resyncPeriod != _|_ {
+							"--watch-namespaces-resync-period=\(#config.settings.watchNamespaces.resyncPeriod)"
+						}
+						if #config.settings.quotaProjects {
+							"--quota-projects"
+						}
+						if #config.settings.quotaProjects && #config.settings.namespaceQuotaProjects {
+							"--namespace-quota-projects"
+						}
 						if #config.settings.cacheTokens.enable {
 							"--cache-tokens"
 						}
@@ -117,6 +180,27 @@ import (
 						if #config.settings.cacheTokens.enable && #config.settings.cacheTokens.maxTokenDuration != _|_ {
 							"--cache-max-token-duration=\(#config.settings.cacheTokens.maxTokenDuration)"
 						}
+						if #config.settings.cacheTokens.enable && #config.settings.cacheTokens.serveStale {
+							"--cache-serve-stale-tokens"
+						}
+						if #config.settings.cacheTokens.enable && #config.settings.cacheTokens.refreshAheadBudget != _|_ {
+							"--cache-refresh-ahead-budget=\(#config.settings.cacheTokens.refreshAheadBudget)"
+						}
+						if #config.settings.kubernetesIdentityTokens {
+							"--kubernetes-identity-tokens"
+						}
+						for a in #config.settings.kubernetesIdentityTokenAudiences {
+							"--kubernetes-identity-token-audiences=\(a)"
+						}
+						if #config.settings.serviceAccountTokens.audience != _|_ {
+							"--service-account-token-audience=\(#config.settings.serviceAccountTokens.audience)"
+						}
+						if #config.settings.serviceAccountTokens.expiration != _|_ {
+							"--service-account-token-expiration=\(#config.settings.serviceAccountTokens.expiration)"
+						}
+						if #config.settings.serviceAccountTokens.bindToPods {
+							"--bind-service-account-tokens"
+						}
 						if #config.settings.podLookup.maxAttempts != _|_ {
 							"--pod-lookup-max-attempts=\(#config.settings.podLookup.maxAttempts)"
 						}
@@ -126,6 +210,56 @@ import (
 						if #config.settings.podLookup.retryMaxDelay != _|_ {
 							"--pod-lookup-retry-max-delay=\(#config.settings.podLookup.retryMaxDelay)"
 						}
+						if #config.settings.upstream.maxAttempts != _|_ {
+							"--upstream-max-attempts=\(#config.settings.upstream.maxAttempts)"
+						}
+						if #config.settings.upstream.retryInitialDelay != _|_ {
+							"--upstream-retry-initial-delay=\(#config.settings.upstream.retryInitialDelay)"
+						}
+						if #config.settings.upstream.retryMaxDelay != _|_ {
+							"--upstream-retry-max-delay=\(#config.settings.upstream.retryMaxDelay)"
+						}
+						if #config.settings.upstream.circuitBreaker.threshold != _|_ {
+							"--upstream-circuit-breaker-threshold=\(#config.settings.upstream.circuitBreaker.threshold)"
+						}
+						if #config.settings.upstream.circuitBreaker.cooldown != _|_ {
+							"--upstream-circuit-breaker-cooldown=\(#config.settings.upstream.circuitBreaker.cooldown)"
+						}
+						if #config.settings.shutdown.preStopDelay != _|_ {
+							"--shutdown-pre-stop-delay=\(#config.settings.shutdown.preStopDelay)"
+						}
+						if #config.settings.shutdown.gracePeriod != _|_ {
+							"--shutdown-grace-period=\(#config.settings.shutdown.gracePeriod)"
+						}
+						if #config.settings.proxy.upstream != _|_ {
+							"--proxy-upstream=\(#config.settings.proxy.upstream)"
+						}
+						if #config.settings.proxy.dialTimeout != _|_ {
+							"--proxy-dial-timeout=\(#config.settings.proxy.dialTimeout)"
+						}
+						if #config.settings.proxy.responseHeaderTimeout != _|_ {
+							"--proxy-response-header-timeout=\(#config.settings.proxy.responseHeaderTimeout)"
+						}
+						"--proxy-dial-metrics-by-client-ip=\(#config.settings.proxy.dialMetricsByClientIP)",
+						"--bpffs-pin-path=\(#config.settings.bpffsPinPath)",
+						if #config.settings.attestationMapMaxEntries != _|_ {
+							"--attestation-map-max-entries=\(#config.settings.attestationMapMaxEntries)"
+						}
+						if #config.settings.cgroupIndexMaxEntries != _|_ {
+							"--cgroup-index-max-entries=\(#config.settings.cgroupIndexMaxEntries)"
+						}
+						if #config.settings.unixSocketPath != _|_ {
+							"--unix-socket-path=\(#config.settings.unixSocketPath)"
+						}
+						for t in #config.settings.interceptTargets if t.upstream == _|_ {
+							"--intercept-target=address=\(t.address),port=\(t.port)"
+						}
+						for t in #config.settings.interceptTargets if t.upstream != _|_ {
+							"--intercept-target=address=\(t.address),port=\(t.port),upstream=\(t.upstream)"
+						}
+						for e in #config.settings.bypassRoutingAllowlist {
+							"--bypass-routing-allowlist=\(e)"
+						}
 						if #config.settings.testProxyUpstream {
 							"--test-proxy-upstream"
 						}
@@ -140,29 +274,57 @@ import (
 							valueFrom: fieldRef: fieldPath: "status.podIP"
 						},
 					]
-					ports: [{
-						name:          "health"
-						containerPort: #config.settings.healthPort
-						protocol:      "TCP"
-					}]
+					// The health port is intentionally not declared as a container port: with
+					// hostNetwork it would become a host port and prevent the surge pod from being
+					// scheduled during rollouts. Both instances bind the port with SO_REUSEPORT instead,
+					// so the probes go through the Unix domain socket of the health server in the
+					// container filesystem, which always reaches this instance.
 					livenessProbe: {
 						initialDelaySeconds: 3
-						httpGet: {
-							path: "/healthz"
-							port: "health"
-						}
+						exec: command: ["/gke-metadata-server", "probe", "--path=/healthz"]
 					}
 					readinessProbe: {
 						initialDelaySeconds: 3
-						httpGet: {
-							path: "/readyz"
-							port: "health"
-						}
+						exec: command: ["/gke-metadata-server", "probe", "--path=/readyz"]
 					}
 					if #config.pod.resources != _|_ {
 						resources: #config.pod.resources
 					}
+					volumeMounts: [
+						if #config.settings.bpffsPinPath != "" {
+							{
+								name:      "bpffs"
+								mountPath: "/sys/fs/bpf"
+							}
+						},
+						if #config.settings.unixSocketPath != _|_ {
+							{
+								name:      "unix-socket"
+								mountPath: cuepath.Dir(#config.settings.unixSocketPath, cuepath.Unix)
+							}
+						},
+					]
 				}]
+				volumes: [
+					if #config.settings.bpffsPinPath != "" {
+						{
+							name: "bpffs"
+							hostPath: {
+								path: "/sys/fs/bpf"
+								type: "Directory"
+							}
+						}
+					},
+					if #config.settings.unixSocketPath != _|_ {
+						{
+							name: "unix-socket"
+							hostPath: {
+								path: cuepath.Dir(#config.settings.unixSocketPath, cuepath.Unix)
+								type: "DirectoryOrCreate"
+							}
+						}
+					},
+				]
 			}
 		}
 	}
@@ -22,7 +22,7 @@ import (
 	metadata:   #config.#clusterScopedMetadata
 	rules: [{
 		apiGroups: [""]
-		resources: ["pods", "nodes", "serviceaccounts"]
+		resources: ["pods", "nodes", "serviceaccounts", "namespaces"]
 		verbs:     ["get", "list", "watch"]
 	},{
 		apiGroups: [""]
@@ -14,11 +14,53 @@ import (
 
 	// workloadIdentityProvider is the mandatory fully-qualified name of the GCP Workload Identity Provider.
 	// This full name can be retrieved on the Google Cloud Console webpage for the provider.
-	workloadIdentityProvider: string & =~"^projects/\\d+/locations/global/workloadIdentityPools/[^/]+/providers/[^/]+$"
+	workloadIdentityProvider: #workloadIdentityProvider
+
+	// workloadIdentityProviders is a list of additional GCP Workload Identity Providers, e.g. of tenants
+	// in other GCP projects. Kubernetes ServiceAccounts select one of them with the annotation
+	// gke-metadata-server.matheuscscp.io/workloadIdentityProvider.
+	workloadIdentityProviders: [...#workloadIdentityProvider] | *[]
+
+	// namespaceWorkloadIdentityProviders maps namespaces to the GCP Workload Identity Provider of their
+	// Kubernetes ServiceAccounts, used when the ServiceAccount does not select a provider. The providers
+	// of this mapping may also be selected by ServiceAccounts.
+	namespaceWorkloadIdentityProviders: [string]: #workloadIdentityProvider
+
+	// google is the settings for the Google Cloud universe and endpoints, e.g. for sovereign
+	// clouds or Private Service Connect.
+	google: {
+		// universeDomain is the domain of the Google Cloud universe. The default endpoints are
+		// derived from it.
+		universeDomain?: string
+
+		// tokenURL is the STS token exchange endpoint. Default: https://sts.<universeDomain>/v1/token
+		tokenURL?: string
+
+		// tokenInfoURL is the STS token introspection endpoint. Default: https://sts.<universeDomain>/v1/introspect
+		tokenInfoURL?: string
+
+		// impersonationEndpoint is the IAM Credentials API for access tokens of Google Service Accounts.
+		// Default: https://iamcredentials.<universeDomain>
+		impersonationEndpoint?: string
+
+		// idTokenEndpoint is the IAM Credentials API for ID tokens of Google Service Accounts.
+		// Default: https://iamcredentials.<universeDomain>
+		idTokenEndpoint?: string
+	}
 
 	// logLevel is the log level for gke-metadata-server.
 	logLevel?: string & ("panic" | "fatal" | "error" | "warning" | "info" | "debug" | "trace")
 
+	// logBackend is the logging backend. The slog backend follows the GCP Cloud Logging field conventions.
+	logBackend?: string & ("logrus" | "slog")
+
+	// logFormat is the log output format. logfmt and console are only supported by the slog backend.
+	logFormat?: string & ("json" | "logfmt" | "console")
+
+	// logLevelWrites is whether or not to allow changing the log levels at runtime through the
+	// health server, which is reachable by anything that can reach the node.
+	logLevelWrites: bool | *false
+
  	// serverPort is the TCP port for gke-metadata-server to listen HTTP on.
 	serverPort: int & >0 & <65536 | *16321
 
@@ -34,6 +76,26 @@ import (
 	// watchServiceAccounts is the watch settings for gke-metadata-server to watch all the ServiceAccounts in the cluster.
 	watchServiceAccounts: #watchSettings
 
+	// namespaceProjectIDs is whether or not to serve the project/* metadata from the annotations
+	// gke-metadata-server.matheuscscp.io/projectID and gke-metadata-server.matheuscscp.io/numericProjectID
+	// of the namespace of the requesting Pod.
+	namespaceProjectIDs: bool | *false
+
+	// watchNamespaces is the watch settings for gke-metadata-server to watch all the Namespaces in the
+	// cluster when namespaceProjectIDs or namespaceQuotaProjects is enabled.
+	watchNamespaces: #watchSettings
+
+	// quotaProjects is whether or not to bill the upstream calls made for a ServiceAccount to the
+	// quota project of the annotation gke-metadata-server.matheuscscp.io/quotaProject of the
+	// ServiceAccount, or of its Namespace when namespaceQuotaProjects is enabled, and to serve this
+	// quota project to the Pods.
+	quotaProjects: bool | *false
+
+	// namespaceQuotaProjects is whether or not to fall back to the annotation
+	// gke-metadata-server.matheuscscp.io/quotaProject of the Namespace of the ServiceAccount when
+	// quotaProjects is enabled.
+	namespaceQuotaProjects: bool | *false
+
 	// cacheTokens is the settings for caching the GCP tokens.
 	cacheTokens: {
 		// enable is a flag to enable the cache tokens feature.
@@ -44,6 +106,41 @@ import (
 
 		// maxTokenDuration is the maximum duration for cached service account tokens.
 		maxTokenDuration?: time.Duration
+
+		// serveStale is whether or not to serve the cached tokens that are past their refresh point
+		// but still valid when refreshing them fails, instead of failing the requests.
+		serveStale: bool | *false
+
+		// refreshAheadBudget is the maximum number of scoped access tokens and identity tokens
+		// refreshed ahead of expiry for each service account while they keep being used, evicting
+		// the least recently used token.
+		refreshAheadBudget?: int & >=0
+	}
+
+	// kubernetesIdentityTokens is whether or not the identity API returns a token of the Kubernetes
+	// ServiceAccount issued for the requested audience when the ServiceAccount has no target Google
+	// Service Account, instead of a 404.
+	kubernetesIdentityTokens: bool | *false
+
+	// kubernetesIdentityTokenAudiences are the audiences allowed for the Kubernetes ServiceAccount
+	// tokens returned from the identity API. Required with kubernetesIdentityTokens. The audiences of
+	// the Kubernetes API server are refused.
+	kubernetesIdentityTokenAudiences: [...string] | *[]
+
+	// serviceAccountTokens is the settings for the Kubernetes ServiceAccount tokens exchanged for
+	// Google access tokens.
+	serviceAccountTokens: {
+		// audience must be one of the allowed audiences of the workload identity provider.
+		// Cannot be used with multiple workload identity providers. Defaults to the workload identity
+		// provider audience.
+		audience?: string & !=""
+
+		// expiration of the tokens, at least 10m. Defaults to the Kubernetes API server choice.
+		expiration?: time.Duration
+
+		// bindToPods is whether or not the tokens are bound to the requesting Pods, so they are
+		// invalidated when the Pods are deleted. Tokens are then cached per Pod.
+		bindToPods: bool | *false
 	}
 
 	// podLookup is the settings for looking up Pods by client connection IP address.
@@ -58,6 +155,93 @@ import (
 		retryMaxDelay?: time.Duration
 	}
 
+	// upstream is the settings for retrying and circuit breaking the calls to the Google APIs
+	// (STS and IAM Credentials).
+	upstream: {
+		// maxAttempts is the maximum number of attempts upon transient failures, i.e. network
+		// errors, 429 and 5xx.
+		maxAttempts?: int & >0
+
+		// retryInitialDelay is the initial delay for retrying, randomized with jitter.
+		retryInitialDelay?: time.Duration
+
+		// retryMaxDelay is the maximum delay for retrying, randomized with jitter. Responses whose
+		// Retry-After header asks for a longer delay are not retried.
+		retryMaxDelay?: time.Duration
+
+		circuitBreaker: {
+			// threshold is the number of consecutive calls to an endpoint failed by transient errors,
+			// counted once regardless of their retries and except for 429, that opens its circuit
+			// breaker, failing the calls right away with a 503. Negative disables.
+			threshold?: int & !=0
+
+			// cooldown is how long a circuit breaker stays open before a call probes the endpoint again.
+			cooldown?: time.Duration
+		}
+	}
+
+	// shutdown is the settings for draining the server upon termination.
+	// The delays must add up to less than the Pod terminationGracePeriodSeconds (30s by default).
+	shutdown: {
+		// preStopDelay is how long to keep serving with a failing readiness probe before closing the metadata server.
+		preStopDelay?: time.Duration
+
+		// gracePeriod is the maximum time to wait for in-flight requests and proxied connections to finish.
+		gracePeriod?: time.Duration
+	}
+
+	// proxy is the settings for proxying the requests that are not metadata requests in the eBPF routing mode.
+	proxy: {
+		// upstream is where the requests to 169.254.169.254:80 are proxied, e.g. the metadata service
+		// of another cloud or a local stub. "none" answers them with a 404.
+		upstream?: string
+
+		// dialTimeout is the maximum time to wait for connecting to the upstream.
+		dialTimeout?: time.Duration
+
+		// responseHeaderTimeout is the maximum time to wait for the response headers of the upstream.
+		responseHeaderTimeout?: time.Duration
+
+		// dialMetricsByClientIP is whether or not to export a dial latency metric labeled with the client
+		// IP address besides the upstream. Disables the reuse of the connections to the upstreams.
+		dialMetricsByClientIP: bool | *false
+	}
+
+	// bpffsPinPath is the bpffs directory where the eBPF routing mode pins its programs, maps and links
+	// so that a new daemon instance adopts them during upgrades without detaching the routes.
+	// Empty disables pinning.
+	bpffsPinPath: string | *"/sys/fs/bpf/gke-metadata-server"
+
+	// attestationMapMaxEntries is the capacity of the eBPF attestation map of live connections
+	// in eBPF routing mode. Raise it on nodes with many concurrent TCP connections.
+	attestationMapMaxEntries?: int & >0
+
+	// cgroupIndexMaxEntries is the capacity of the cgroup ID to pod UID index used by the kernel
+	// attestation. Cgroups that do not fit are resolved by walking /sys/fs/cgroup.
+	cgroupIndexMaxEntries?: int & >0
+
+	// unixSocketPath is the path of a Unix domain socket on the host where the metadata server
+	// also listens. Pods that mount the socket's directory from the host can reach the metadata
+	// server through it, and are identified by the kernel-reported peer credentials.
+	// Example: /var/run/gke-metadata-server/metadata.sock
+	unixSocketPath?: string & =~"^/.+/[^/]+$"
+
+	// interceptTargets are destinations redirected to the metadata server in addition to
+	// 169.254.169.254:80 in the eBPF routing mode. The emulator accepts the connections
+	// redirected from each address on the given port, and proxies the requests that are not
+	// metadata requests to the upstream (default: the address).
+	interceptTargets: [...{
+		address:   string
+		port:      int & >0 & <=65535
+		upstream?: string
+	}] | *[]
+
+	// bypassRoutingAllowlist lists the namespaces (<namespace>) and ServiceAccounts
+	// (<namespace>/<name>) whose Pods may opt out of the eBPF routing mode with the annotation
+	// gke-metadata-server.matheuscscp.io/bypassRouting, reaching the real metadata server and
+	// hence the credentials of the Node. Requires watchPods.enable. Empty disables the annotation.
+	bypassRoutingAllowlist: [...string & =~"^[^/]+(/[^/]+)?$"] | *[]
+
 	// testProxyUpstream is a TEST-ONLY flag. When true, in eBPF routing mode the
 	// daemon binds 169.254.169.254 to lo and serves a marker on port 80 to allow
 	// the project's e2e suite to assert the proxy-passthrough chain is wired up.
@@ -65,6 +249,8 @@ import (
 	testProxyUpstream: bool | *false
 
 	// Helper definitions.
+	#workloadIdentityProvider: string & =~"^projects/\\d+/locations/global/workloadIdentityPools/[^/]+/providers/[^/]+$"
+
 	#watchSettings: {
 		// enable is a flag to enable the watch feature.
 		enable: bool | *true